@@ -1,12 +1,21 @@
 package cache
 
 import (
-	"encoding/json"
+	"bufio"
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,20 +23,44 @@ type Cache struct {
 	users map[string]*UserCache
 	mu    sync.RWMutex
 	cfg   Config
+
+	// bytes is the total value size across all users.
+	bytes atomic.Int64
+
+	// global eviction state
+	evictMu  sync.Mutex
+	rrCursor string // last user evicted from by the round-robin policy
+
+	// events delivers Config.OnEvict callbacks (nil when unset)
+	events *evictNotifier
+	// wal is the write-ahead log (nil unless Config.WALEnabled)
+	wal *walLog
 }
 
 func NewCache(cfg Config) *Cache {
 	if cfg.JanitorInterval == 0 {
 		cfg = DefaultConfig()
 	}
+	if cfg.MetricsSink == nil {
+		cfg.MetricsSink = NopSink{}
+	}
+	if cfg.SpillThresholdBytes > 0 {
+		// spill files only back live entries; leftovers from a previous run are orphans
+		if err := os.RemoveAll(spillDir(cfg)); err != nil {
+			log.Printf("[cache] clear spill dir: %v", err)
+		}
+	}
 
 	return &Cache{
-		users: make(map[string]*UserCache),
-		cfg:   cfg,
+		users:  make(map[string]*UserCache),
+		cfg:    cfg,
+		events: newEvictNotifier(cfg.OnEvict, cfg.MetricsSink),
+		wal:    newWALLog(cfg),
 	}
 }
 
 func (c *Cache) CreateUser(userID string) error {
+	userID = c.NormalizeUserID(userID)
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -35,54 +68,459 @@ func (c *Cache) CreateUser(userID string) error {
 	if ok {
 		return ErrUserExists
 	}
-	c.users[userID] = newUserCache(c.cfg)
+	c.users[userID] = c.newUser(userID)
+	c.cfg.MetricsSink.SetGauge(MetricUsers, float64(len(c.users)))
 	return nil
 }
 
+// NormalizeUserID applies Config.NormalizeUserID (identity when unset). Every Cache
+// method taking a user ID normalizes it, so callers only need this for IDs used
+// outside the cache, such as ring hashing.
+func (c *Cache) NormalizeUserID(userID string) string {
+	if c.cfg.NormalizeUserID == nil {
+		return userID
+	}
+	return c.cfg.NormalizeUserID(userID)
+}
+
+// GetOrCreateUser returns the user's cache, creating it if missing. Lookup and insert
+// happen under one write lock, so concurrent callers always get the same *UserCache.
+// Write paths use it instead of CreateUser-then-ignore-ErrUserExists. A user deleted
+// after this returns is stopped, and operations on the stale reference fail with
+// ErrUserNotFound.
+func (c *Cache) GetOrCreateUser(userID string) *UserCache {
+	userID = c.NormalizeUserID(userID)
+	if uc := c.getUser(userID); uc != nil {
+		return uc
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	uc, ok := c.users[userID]
+	if !ok {
+		uc = c.newUser(userID)
+		c.users[userID] = uc
+		c.cfg.MetricsSink.SetGauge(MetricUsers, float64(len(c.users)))
+	}
+	return uc
+}
+
 func (c *Cache) DeleteUser(userID string) error {
+	userID = c.NormalizeUserID(userID)
+	if c.cfg.SnapshotOnDelete {
+		// keep a copy in trash/ first so an accidental delete can be undone
+		if err := c.trashUser(userID); err != nil {
+			return err
+		}
+	}
+
+	if c.getUser(userID) == nil {
+		return ErrUserNotFound
+	}
+	// the snapshot file stays on disk; the tombstone keeps it from being loaded again
+	if err := c.tombstoneUser(userID); err != nil {
+		return err
+	}
+	if !c.dropUser(userID) {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// dropUser removes and stops the user, reporting whether it existed.
+func (c *Cache) dropUser(userID string) bool {
 	c.mu.Lock()
 	user, ok := c.users[userID]
 
 	if !ok {
 		c.mu.Unlock()
-		return ErrUserNotFound
+		return false
 	}
 
 	delete(c.users, userID)
+	c.cfg.MetricsSink.SetGauge(MetricUsers, float64(len(c.users)))
 	c.mu.Unlock()
 
 	user.stop()
-	return nil
+	c.bytes.Add(-user.usage())
+	c.wal.append(walRecord{op: walDropUser, userID: userID})
+	return true
+}
+
+// FlushAll deletes every user and returns how many were removed. Snapshot files are kept
+// but tombstoned, as in DeleteUser.
+func (c *Cache) FlushAll() int {
+	c.mu.Lock()
+	users := c.users
+	c.users = make(map[string]*UserCache)
+	c.mu.Unlock()
+	c.cfg.MetricsSink.SetGauge(MetricUsers, 0)
+
+	for userID, user := range users {
+		if err := c.tombstoneUser(userID); err != nil {
+			log.Printf("[cache] tombstone %s: %v", userID, err)
+		}
+		user.stop()
+		c.bytes.Add(-user.usage())
+		c.wal.append(walRecord{op: walDropUser, userID: userID})
+	}
+	return len(users)
 }
 
-// New: called by internal replication endpoint to set with timestamp semantics.
-// It creates user if missing. It only writes if incoming timestamp >= existing timestamp.
-func (c *Cache) Set(userID, key string, value []byte, ttl time.Duration, timestamp int64) error {
+// Flush removes all of the user's keys without deleting the user, so its janitor keeps
+// running and its hit/miss counters are preserved.
+func (c *Cache) Flush(userID string) error {
 	uc := c.getUser(userID)
 	if uc == nil {
-		// try to create the user
-		if err := c.CreateUser(userID); err != nil && err != ErrUserExists {
-			return err
+		return ErrUserNotFound
+	}
+	return uc.flush()
+}
+
+// newUser creates a UserCache wired to this cache's global accounting.
+func (c *Cache) newUser(userID string) *UserCache {
+	return newUserCache(userID, c.cfg, &c.bytes, c.events, c.wal)
+}
+
+// Bytes returns the total value size stored across all users.
+func (c *Cache) Bytes() int64 {
+	return c.bytes.Load()
+}
+
+// LoadUser brings a user that isn't in memory in from its snapshot file, e.g. on the
+// node a ring change moved it to. It never creates an empty user: it reports false,
+// with no error, when there is no snapshot file or the user was deleted after it was
+// saved. An unreadable or corrupt file is returned as an error. Snapshot entries are
+// merged, so a write racing with the load is kept.
+func (c *Cache) LoadUser(userID string) (bool, error) {
+	userID = c.NormalizeUserID(userID)
+	if c.getUser(userID) != nil {
+		return false, nil
+	}
+	if c.isTombstoned(userID) {
+		return false, nil
+	}
+
+	snap, err := c.LoadUserFromFile(userID)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := c.RestoreUserMerge(snap); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ListUsers returns the sorted IDs of all users.
+func (c *Cache) ListUsers() []string {
+	c.mu.RLock()
+	out := make([]string, 0, len(c.users))
+	for id := range c.users {
+		out = append(out, id)
+	}
+	c.mu.RUnlock()
+
+	sort.Strings(out)
+	return out
+}
+
+// ListUsersMatch returns the sorted IDs of users matching a glob pattern (path.Match syntax).
+func (c *Cache) ListUsersMatch(pattern string) ([]string, error) {
+	// validate pattern up front so an empty cache still reports a bad pattern
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	out := make([]string, 0)
+	for id := range c.users {
+		if ok, _ := path.Match(pattern, id); ok {
+			out = append(out, id)
 		}
-		uc = c.getUser(userID)
-		if uc == nil {
-			return ErrUserNotFound
+	}
+	c.mu.RUnlock()
+
+	sort.Strings(out)
+	return out, nil
+}
+
+// RemoveUserSnapshot deletes the user's snapshot file. A missing file is not an error.
+func (c *Cache) RemoveUserSnapshot(userID string) error {
+	userID = c.NormalizeUserID(userID)
+	for _, ext := range snapshotExts {
+		if err := os.Remove(snapshotPath(c.dataDir(), userID, ext)); err != nil && !os.IsNotExist(err) {
+			return err
 		}
 	}
-	// only write if timestamp is newer or equal
-	uc.set(key, value, ttl, timestamp)
+	if err := os.Remove(tombstonePath(c.dataDir(), userID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
 
+// tombstoneUser marks a deleted user's snapshot file as stale. The file is kept (see
+// RemoveUserSnapshot), but loads skip it until the user is saved again. Users without
+// a snapshot file need no tombstone.
+func (c *Cache) tombstoneUser(userID string) error {
+	if _, err := os.Stat(c.findSnapshotFile(c.dataDir(), userID)); err != nil {
+		return nil
+	}
+	return os.WriteFile(tombstonePath(c.dataDir(), userID), nil, 0o644)
+}
+
+// isTombstoned reports whether the user was deleted after its snapshot was saved.
+func (c *Cache) isTombstoned(userID string) bool {
+	_, err := os.Stat(tombstonePath(c.dataDir(), userID))
+	return err == nil
+}
+
+// Set writes with last-write-wins semantics (client writes and replication alike).
+// It creates user if missing. It only writes if incoming timestamp >= existing timestamp,
+// so delayed replication retries can't resurrect stale data.
+// created reports whether the key did not exist before this write.
+func (c *Cache) Set(userID, key string, value []byte, ttl time.Duration, timestamp int64) (bool, error) {
+	uc := c.GetOrCreateUser(userID)
+	// only write if timestamp is newer or equal
+	created, err := uc.set(key, value, ttl, timestamp)
+	if err != nil {
+		return false, err
+	}
+	c.enforceGlobalBudget()
+	return created, nil
+}
+
+// SetUntil is Set with an absolute expiry (zero = no expiry), used for replicated
+// writes so replicas expire at the same instant as the primary. An expiry already in
+// the past deletes the key instead of storing it.
+func (c *Cache) SetUntil(userID, key string, value []byte, expiresAt time.Time, timestamp int64) (bool, error) {
+	uc := c.GetOrCreateUser(userID)
+	created, err := uc.setUntil(key, value, expiresAt, timestamp)
+	if err != nil {
+		return false, err
+	}
+	c.enforceGlobalBudget()
+	return created, nil
+}
+
+// SetMany writes all values for one user with a shared TTL and timestamp, taking the
+// user's lock once and evicting once at the end. It returns how many keys were created.
+func (c *Cache) SetMany(userID string, values map[string][]byte, ttl time.Duration, timestamp int64) (int, error) {
+	var expires time.Time
+	if ttl != 0 {
+		expires = time.Now().Add(ttl)
+	}
+
+	uc := c.GetOrCreateUser(userID)
+	created, err := uc.setMany(values, expires, timestamp)
+	if err != nil {
+		return 0, err
+	}
+	c.enforceGlobalBudget()
+	return created, nil
+}
+
+// KV is one key/value pair of a batch write.
+type KV struct {
+	Key   string
+	Value []byte
+}
+
+// MSet writes all pairs with a shared TTL and timestamp under a single lock
+// acquisition (see SetMany). If a key appears more than once, the last pair wins.
+func (c *Cache) MSet(userID string, pairs []KV, ttl time.Duration, ts int64) error {
+	values := make(map[string][]byte, len(pairs))
+	for _, p := range pairs {
+		values[p.Key] = p.Value
+	}
+	_, err := c.SetMany(userID, values, ttl, ts)
+	return err
+}
+
+// MGet returns the values of all live keys under a single lock acquisition. Missing
+// and expired keys are absent from the result.
+func (c *Cache) MGet(userID string, keys []string) (map[string][]byte, error) {
+	uc := c.getUser(userID)
+	if uc == nil {
+		return nil, ErrUserNotFound
+	}
+	return uc.getMany(keys)
+}
+
+// SetIfStale writes value only if the key is missing or its remaining TTL is below
+// staleWithin, and reports whether it wrote. Keys without a TTL are never stale.
+// Meant for refresh-ahead caching: concurrent refreshers don't all rewrite the key.
+func (c *Cache) SetIfStale(userID, key string, value []byte, ttl time.Duration, staleWithin time.Duration) (bool, error) {
+	return c.SetIfStaleAt(userID, key, value, ttl, staleWithin, 0)
+}
+
+// SetIfStaleAt is SetIfStale with an explicit write timestamp (0 = now), so the
+// server can replicate the write with the same timestamp.
+func (c *Cache) SetIfStaleAt(userID, key string, value []byte, ttl, staleWithin time.Duration, ts int64) (bool, error) {
+	uc := c.GetOrCreateUser(userID)
+	wrote, err := uc.setIfStale(key, value, ttl, staleWithin, ts)
+	if err != nil {
+		return false, err
+	}
+	if wrote {
+		c.enforceGlobalBudget()
+	}
+	return wrote, nil
+}
+
+// SetNX stores value only if the key does not exist; it reports whether it did.
+// The user is created if missing.
+func (c *Cache) SetNX(userID, key string, value []byte, ttl time.Duration, ts int64) (bool, error) {
+	_, created, err := c.GetOrSet(userID, key, value, ttl, ts)
+	return created, err
+}
+
+// GetOrSet returns the existing value for key, or stores value if the key is absent
+// and returns it. set reports whether this call stored the value. Built on the same
+// atomic check-and-write as SetNX, so concurrent callers all see the winning value.
+func (c *Cache) GetOrSet(userID, key string, value []byte, ttl time.Duration, ts int64) (val []byte, set bool, err error) {
+	uc := c.GetOrCreateUser(userID)
+
+	item, created, err := uc.setNX(key, value, ttl, ts)
+	if err != nil {
+		return nil, false, err
+	}
+	if created {
+		c.enforceGlobalBudget()
+	}
+
+	out := make([]byte, len(item.Value))
+	copy(out, item.Value)
+	return out, created, nil
+}
+
 func (c *Cache) Get(userID, key string) ([]byte, error) {
 	uc := c.getUser(userID)
 	if uc == nil {
 		return nil, ErrUserNotFound
 	}
 
-	item, ok := uc.get(key)
-	if !ok {
-		return nil, ErrKeyNotFound
+	item, err := uc.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return item.Value, nil
+}
+
+// Incr atomically adds delta to the integer stored under key and returns the new
+// value. A missing key starts at 0; the result is stored as a decimal string, so GET
+// sees it. A non-numeric value yields ErrNotInteger. The user is created if missing.
+func (c *Cache) Incr(userID, key string, delta int64) (int64, error) {
+	uc := c.GetOrCreateUser(userID)
+	n, err := uc.incr(key, delta, 0)
+	if err != nil {
+		return 0, err
+	}
+	c.enforceGlobalBudget()
+	return n, nil
+}
+
+// Decr is Incr with the delta negated.
+func (c *Cache) Decr(userID, key string, delta int64) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, ErrIntegerOverflow
+	}
+	return c.Incr(userID, key, -delta)
+}
+
+// GetSet stores value and returns the previous one. When there was none it returns
+// ErrKeyNotFound, with the write still applied. The user is created if missing.
+func (c *Cache) GetSet(userID, key string, value []byte, ttl time.Duration) ([]byte, error) {
+	uc := c.GetOrCreateUser(userID)
+	old, err := uc.getSet(key, value, ttl, 0)
+	if err != nil && err != ErrKeyNotFound {
+		return nil, err
+	}
+	c.enforceGlobalBudget()
+	if err != nil {
+		return nil, err
+	}
+	return old.Value, nil
+}
+
+// NoExpiry is returned by TTL for keys that never expire.
+const NoExpiry time.Duration = -1
+
+// TTL returns how long key has left before it expires, NoExpiry if it has no TTL, or
+// ErrKeyNotFound if it is absent or already expired.
+func (c *Cache) TTL(userID, key string) (time.Duration, error) {
+	uc := c.getUser(userID)
+	if uc == nil {
+		return 0, ErrUserNotFound
+	}
+	return uc.ttl(key)
+}
+
+// Expire sets a new TTL on an existing key, keeping its value. A ttl <= 0 removes the
+// key. It returns ErrKeyNotFound if the key is absent or already expired.
+func (c *Cache) Expire(userID, key string, ttl time.Duration) error {
+	uc := c.getUser(userID)
+	if uc == nil {
+		return ErrUserNotFound
+	}
+	now := time.Now()
+	return uc.setExpiry(key, now.Add(ttl), now.UnixNano())
+}
+
+// Persist clears the expiry of an existing key so it no longer expires.
+func (c *Cache) Persist(userID, key string) error {
+	uc := c.getUser(userID)
+	if uc == nil {
+		return ErrUserNotFound
+	}
+	return uc.setExpiry(key, time.Time{}, 0)
+}
+
+// Peek returns a copy of the stored item (value, expiry, write timestamp) without
+// counting a hit or refreshing its LRU position.
+func (c *Cache) Peek(userID, key string) (Item, error) {
+	uc := c.getUser(userID)
+	if uc == nil {
+		return Item{}, ErrUserNotFound
+	}
+	return uc.peek(key)
+}
+
+// Revert undoes the write made at timestamp ts, unless a newer write has replaced it.
+// prev (as returned by Peek before the write) is restored with timestamp revertTS, so
+// the revert also wins when replicated; a nil prev deletes the key. It reports whether
+// the write was reverted.
+func (c *Cache) Revert(userID, key string, ts int64, prev *Item, revertTS int64) (bool, error) {
+	uc := c.getUser(userID)
+	if uc == nil {
+		return false, ErrUserNotFound
+	}
+	reverted, err := uc.revert(key, ts, prev, revertTS)
+	if err != nil {
+		return false, err
+	}
+	if reverted {
+		c.enforceGlobalBudget()
+	}
+	return reverted, nil
+}
+
+// GetRef is like Get but returns the stored value without copying it.
+// The caller must treat the returned slice as read-only; it is meant for
+// trusted read paths (e.g. server handlers that immediately serialize the value).
+func (c *Cache) GetRef(userID, key string) ([]byte, error) {
+	uc := c.getUser(userID)
+	if uc == nil {
+		return nil, ErrUserNotFound
+	}
+
+	item, err := uc.getRef(key)
+	if err != nil {
+		return nil, err
 	}
 
 	return item.Value, nil
@@ -93,7 +531,7 @@ func (c *Cache) Delete(userID, key string) error {
 	if uc == nil {
 		return ErrUserNotFound
 	}
-	uc.delete(key)
+	uc.deleteAt(key, time.Now().UnixNano())
 	return nil
 }
 
@@ -105,7 +543,102 @@ func (c *Cache) ListKeys(userID string) ([]string, error) {
 	return uc.keys(), nil
 }
 
+// ListKeysMatch is ListKeys filtered by a glob pattern: '*' matches any run of
+// characters and '?' a single one. An empty pattern returns every key.
+func (c *Cache) ListKeysMatch(userID, pattern string) ([]string, error) {
+	uc := c.getUser(userID)
+	if uc == nil {
+		return nil, ErrUserNotFound
+	}
+	return uc.keysMatch(pattern), nil
+}
+
+// Scan returns the next chunk of about count live keys starting at cursor (0 to
+// begin) and the cursor for the following call, which is 0 when the scan is complete.
+// Cursors are opaque; see scan.go for how they stay valid across writes.
+func (c *Cache) Scan(userID string, cursor uint64, count int) ([]string, uint64, error) {
+	uc := c.getUser(userID)
+	if uc == nil {
+		return nil, 0, ErrUserNotFound
+	}
+	if count <= 0 {
+		count = 10
+	}
+	keys, next := uc.scan(cursor, count)
+	return keys, next, nil
+}
+
+// Digest returns key -> last write timestamp for the user's live keys, used to
+// compare replicas without transferring values.
+func (c *Cache) Digest(userID string) (map[string]int64, error) {
+	uc := c.getUser(userID)
+	if uc == nil {
+		return nil, ErrUserNotFound
+	}
+	return uc.digest(), nil
+}
+
+// NearExpiry returns up to limit keys whose TTL ends within the given window, soonest first,
+// so clients can refresh them before they expire. Keys with no expiry are excluded.
+func (c *Cache) NearExpiry(userID string, within time.Duration, limit int) ([]string, error) {
+	uc := c.getUser(userID)
+	if uc == nil {
+		return nil, ErrUserNotFound
+	}
+	return uc.nearExpiry(within, limit), nil
+}
+
+// UserKeyDump summarizes one user's keys for admin dumps.
+type UserKeyDump struct {
+	Count     int      `json:"count"`
+	Keys      []string `json:"keys,omitempty"`
+	Truncated bool     `json:"truncated,omitempty"`
+}
+
+// DumpKeys reports the live key count for every user. When includeKeys is true the
+// (sorted) keys are included too, capped at maxKeys per user (0 = no cap).
+func (c *Cache) DumpKeys(includeKeys bool, maxKeys int) map[string]UserKeyDump {
+	users := c.usersSnapshot()
+	out := make(map[string]UserKeyDump, len(users))
+	for userID, uc := range users {
+		keys := uc.keys()
+		dump := UserKeyDump{Count: len(keys)}
+		if includeKeys {
+			sort.Strings(keys)
+			if maxKeys > 0 && len(keys) > maxKeys {
+				keys = keys[:maxKeys]
+				dump.Truncated = true
+			}
+			dump.Keys = keys
+		}
+		out[userID] = dump
+	}
+	return out
+}
+
+// RecomputeStats reconciles accounting for every user and returns the result per user.
+func (c *Cache) RecomputeStats() map[string]RecomputeResult {
+	users := c.usersSnapshot()
+	out := make(map[string]RecomputeResult, len(users))
+	for userID, uc := range users {
+		out[userID] = uc.recompute()
+	}
+	return out
+}
+
+// usersSnapshot returns a copy of the user map so callers can iterate without holding c.mu.
+func (c *Cache) usersSnapshot() map[string]*UserCache {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make(map[string]*UserCache, len(c.users))
+	for id, uc := range c.users {
+		out[id] = uc
+	}
+	return out
+}
+
 func (c *Cache) getUser(userID string) *UserCache {
+	userID = c.NormalizeUserID(userID)
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	uc, ok := c.users[userID]
@@ -127,11 +660,15 @@ type PersistedItem struct {
 type UserSnapshot struct {
 	UserID string          `json:"user_id"`
 	Items  []PersistedItem `json:"items"`
+	// Checksum is the hex CRC-32C of UserID and Items, set when the snapshot is
+	// written to a file and checked when it is read back (ErrSnapshotCorrupt).
+	Checksum string `json:"checksum,omitempty"`
 }
 
 // SnapshotUser returns a snapshot for the given userID.
 // Caller can then SaveUserToFile(snapshot).
 func (c *Cache) SnapshotUser(userID string) (*UserSnapshot, error) {
+	userID = c.NormalizeUserID(userID)
 	uc := c.getUser(userID)
 	if uc == nil {
 		return nil, ErrUserNotFound
@@ -158,26 +695,118 @@ func (c *Cache) SnapshotUser(userID string) (*UserSnapshot, error) {
 // SaveUserToFile writes snapshot to a JSON file under c.cfg.DataDir using atomic rename.
 // Path: <DataDir>/user_<userID>.json
 func (c *Cache) SaveUserToFile(snap *UserSnapshot) (string, error) {
+	if id := c.NormalizeUserID(snap.UserID); id != snap.UserID {
+		normalized := *snap
+		normalized.UserID = id
+		snap = &normalized
+	}
 	dir := c.cfg.DataDir
 	if dir == "" {
 		dir = "data"
 	}
+	return c.writeSnapshotFile(dir, snap)
+}
 
+// SnapshotReport summarizes a SnapshotAllReport or SnapshotDirty run.
+type SnapshotReport struct {
+	Saved     int
+	Unchanged int              // users skipped by SnapshotDirty
+	Failed    map[string]error // user ID -> why its snapshot wasn't written
+	Duration  time.Duration
+}
+
+// SnapshotAll writes a snapshot file for every user (see SnapshotAllReport). A failing
+// user doesn't stop the others; all failures are returned joined.
+func (c *Cache) SnapshotAll() error {
+	report := c.SnapshotAllReport()
+	errs := make([]error, 0, len(report.Failed))
+	for userID, err := range report.Failed {
+		errs = append(errs, fmt.Errorf("%s: %w", userID, err))
+	}
+	return errors.Join(errs...)
+}
+
+// SnapshotAllReport snapshots and saves every user, one at a time, with per-user
+// errors. The user list is copied first, so c.mu isn't held during file I/O; each
+// file is written atomically. A user deleted meanwhile is skipped.
+func (c *Cache) SnapshotAllReport() *SnapshotReport {
+	return c.snapshotUsers(false)
+}
+
+// SnapshotDirty is SnapshotAllReport restricted to users changed since their last
+// SnapshotAll/SnapshotDirty save. Used by periodic background snapshots.
+func (c *Cache) SnapshotDirty() *SnapshotReport {
+	return c.snapshotUsers(true)
+}
+
+func (c *Cache) snapshotUsers(onlyDirty bool) *SnapshotReport {
+	start := time.Now()
+	report := &SnapshotReport{Failed: make(map[string]error)}
+	// everything logged before the new segment is in memory now, so in the files below
+	seq := c.wal.rotate()
+	for _, userID := range c.ListUsers() {
+		uc := c.getUser(userID)
+		if uc == nil {
+			continue
+		}
+		// clear before copying: a write racing with the save marks the user again
+		if wasDirty := uc.dirty.Swap(false); onlyDirty && !wasDirty {
+			report.Unchanged++
+			continue
+		}
+		snap, err := c.SnapshotUser(userID)
+		if err == ErrUserNotFound {
+			continue
+		}
+		if err == nil {
+			_, err = c.SaveUserToFile(snap)
+		}
+		if err != nil {
+			uc.dirty.Store(true)
+			report.Failed[userID] = err
+			continue
+		}
+		report.Saved++
+	}
+	if len(report.Failed) == 0 {
+		c.wal.truncateBefore(seq)
+	}
+	report.Duration = time.Since(start)
+	return report
+}
+
+// writeSnapshotFile atomically writes snap to dir/user_<userID> with the extension
+// for the configured SnapshotFormat and CompressSnapshots. Copies in other formats are
+// removed so loads find only this one.
+func (c *Cache) writeSnapshotFile(dir string, snap *UserSnapshot) (string, error) {
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return "", err
 	}
 
-	filename := getUserFilePath(dir, snap.UserID)
+	ext := c.snapshotExt()
+	filename := snapshotPath(dir, snap.UserID, ext)
+
+	withSum := *snap
+	withSum.Checksum = formatChecksum(checksumOf(snap))
+	snap = &withSum
 
 	tmpFile, err := os.CreateTemp(dir, snap.UserID)
 	if err != nil {
 		return "", err
 	}
 
-	enc := json.NewEncoder(tmpFile)
-	enc.SetIndent("", "  ")
+	var w io.Writer = tmpFile
+	var gz *gzip.Writer
+	if c.cfg.CompressSnapshots {
+		gz = gzip.NewWriter(tmpFile)
+		w = gz
+	}
 
-	if err := enc.Encode(snap); err != nil {
+	err = codecFor(c.cfg.SnapshotFormat).encode(w, snap)
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err != nil {
 		_ = tmpFile.Close()
 		_ = os.Remove(tmpFile.Name())
 		return "", err
@@ -192,48 +821,128 @@ func (c *Cache) SaveUserToFile(snap *UserSnapshot) (string, error) {
 		_ = os.Remove(tmpFile.Name())
 		return "", err
 	}
+	// the user exists again, so its file is current
+	if err := os.Remove(tombstonePath(dir, snap.UserID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("[cache] remove tombstone for %s: %v", snap.UserID, err)
+	}
+	for _, other := range snapshotExts {
+		if other == ext {
+			continue
+		}
+		stale := snapshotPath(dir, snap.UserID, other)
+		if err := os.Remove(stale); err != nil && !os.IsNotExist(err) {
+			log.Printf("[cache] remove stale snapshot %s: %v", stale, err)
+		}
+	}
 	return filename, nil
 }
 
 // LoadUserFromFile loads snapshot for userID from file and returns snapshot.
 func (c *Cache) LoadUserFromFile(userID string) (*UserSnapshot, error) {
+	userID = c.NormalizeUserID(userID)
 	dir := c.cfg.DataDir
 	if dir == "" {
 		dir = "data"
 	}
 
-	filename := getUserFilePath(dir, userID)
+	return readSnapshotFile(c.findSnapshotFile(dir, userID))
+}
+
+// findSnapshotFile returns the snapshot path for userID under dir, in whichever
+// format exists, preferring the configured one. If none exists it returns the
+// configured path.
+func (c *Cache) findSnapshotFile(dir, userID string) string {
+	preferred := snapshotPath(dir, userID, c.snapshotExt())
+	if _, err := os.Stat(preferred); err == nil {
+		return preferred
+	}
+	for _, ext := range snapshotExts {
+		if filename := snapshotPath(dir, userID, ext); filename != preferred {
+			if _, err := os.Stat(filename); err == nil {
+				return filename
+			}
+		}
+	}
+	return preferred
+}
 
+// readSnapshotFile decodes a snapshot file, rejecting empty or malformed ones.
+func readSnapshotFile(filename string) (*UserSnapshot, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	var snap UserSnapshot
-	dec := json.NewDecoder(f)
-	if err := dec.Decode(&snap); err != nil {
+	info, err := f.Stat()
+	if err != nil {
 		return nil, err
 	}
+	if info.Size() == 0 {
+		return nil, ErrSnapshotEmpty
+	}
 
-	return &snap, nil
+	// gzip is detected by its magic bytes, whatever the file is called
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrSnapshotInvalid, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	// likewise binary snapshots by their header; anything else is JSON
+	codec := codecFor(SnapshotJSON)
+	sniff := bufio.NewReader(r)
+	if magic, _ := sniff.Peek(len(binaryMagic)); isBinarySnapshot(magic) {
+		codec = codecFor(SnapshotBinary)
+	}
+
+	snap, err := codec.decode(sniff)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotInvalid, err)
+	}
+	if err := verifyChecksum(snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
 }
 
 // RestoreUserFromSnapshot overwrites the user's existing cache with the provided snapshot.
 // If the user does not exist, it will create it.
 func (c *Cache) RestoreUserFromSnapshot(snap *UserSnapshot) error {
+	userID := c.NormalizeUserID(snap.UserID)
 
 	// ensure user exists
-	c.mu.Lock()
+	uc := c.GetOrCreateUser(userID)
 
-	uc, ok := c.users[snap.UserID]
-	if !ok {
-		uc = newUserCache(c.cfg)
-		c.users[snap.UserID] = uc
+	// replace user cache contents with snapshot
+	if err := uc.RestoreFromSnapshot(snapshotItems(snap)); err != nil {
+		return err
 	}
-	c.mu.Unlock()
+	// restored bytes count against the global budget like any other write
+	c.enforceGlobalBudget()
+	return nil
+}
+
+// RestoreUserMerge restores a snapshot without discarding newer data: a snapshot
+// entry is stored only when the key is missing, expired, or holds an older write
+// (lower timestamp). Keys not in the snapshot are kept, so writes made after the
+// backup survive. If the user does not exist, it will create it.
+func (c *Cache) RestoreUserMerge(snap *UserSnapshot) error {
+	uc := c.GetOrCreateUser(c.NormalizeUserID(snap.UserID))
+	if err := uc.merge(snapshotItems(snap)); err != nil {
+		return err
+	}
+	c.enforceGlobalBudget()
+	return nil
+}
 
-	// build map of key->item
+// snapshotItems converts snapshot entries to items, skipping ones already expired.
+func snapshotItems(snap *UserSnapshot) map[string]Item {
 	items := make(map[string]Item, len(snap.Items))
 	now := time.Now()
 
@@ -253,65 +962,155 @@ func (c *Cache) RestoreUserFromSnapshot(snap *UserSnapshot) error {
 			Timestamp: item.Timestamp,
 		}
 	}
-
-	// replace user cache contents with snapshot
-	return uc.RestoreFromSnapshot(items)
-
+	return items
 }
 
 // LoadAllUsersFromDir loads all snapshot files in DataDir and restores them into cache.
 // It will skip invalid files and continue. Returns number of loaded snapshots and error if fatal.
 func (c *Cache) LoadAllUsersFromDir() (int, error) {
+	report, err := c.LoadAllUsersFromDirReport()
+	if err != nil {
+		return 0, err
+	}
+	return report.Loaded, nil
+}
+
+// LoadReport summarizes a LoadAllUsersFromDirReport run.
+type LoadReport struct {
+	Loaded int
+	Failed map[string]error // snapshot filename -> why it was skipped
+	// Corrupt lists the files in Failed whose checksum didn't match, sorted.
+	Corrupt  []string
+	Duration time.Duration
+}
+
+// LoadAllUsersFromDirReport is LoadAllUsersFromDir with per-file errors. Snapshots are
+// read and restored by Config.LoadConcurrency workers (default: NumCPU); progress is
+// logged roughly every 10%.
+func (c *Cache) LoadAllUsersFromDirReport() (*LoadReport, error) {
+	start := time.Now()
 	dir := c.cfg.DataDir
 	if dir == "" {
 		dir = "data"
 	}
 
 	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	entries, err := os.ReadDir(dir)
 
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	loaded := 0
-
+	// one file per user: if a crash or format change left several, load the configured one
+	byUser := make(map[string]string)
+	deleted := make(map[string]bool)
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), "user_") && strings.HasSuffix(e.Name(), tombstoneExt) {
+			deleted[strings.TrimSuffix(strings.TrimPrefix(e.Name(), "user_"), tombstoneExt)] = true
+		}
+	}
 	for _, e := range entries {
 		if e.IsDir() {
 			continue
 		}
-
-		filename := e.Name()
-		if !isUserSnapshotFile(filename) {
+		userID := getUserIDFromFilename(e.Name())
+		if userID == "" || deleted[userID] {
 			continue
 		}
-
-		userID := getUserIDFromFilename(filename)
-		if userID == "" {
+		if prev, ok := byUser[userID]; ok && snapshotFileExt(prev) == c.snapshotExt() {
 			continue
 		}
+		byUser[userID] = e.Name()
+	}
+	files := make([]string, 0, len(byUser))
+	for _, name := range byUser {
+		files = append(files, name)
+	}
+	sort.Strings(files)
 
-		snap, err := c.LoadUserFromFile(userID)
-		if err != nil {
-			// skip invalid file
-			continue
-		}
+	workers := c.cfg.LoadConcurrency
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(files) {
+		workers = len(files)
+	}
+
+	report := &LoadReport{Failed: make(map[string]error)}
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		done int
+		jobs = make(chan string)
+	)
+	step := len(files) / 10
+	if step == 0 {
+		step = 1
+	}
 
-		// restore snapshot
-		c.RestoreUserFromSnapshot(snap)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filename := range jobs {
+				err := c.loadSnapshotFile(dir, filename)
 
-		loaded++
+				mu.Lock()
+				done++
+				if err != nil {
+					report.Failed[filename] = err
+					if errors.Is(err, ErrSnapshotCorrupt) {
+						report.Corrupt = append(report.Corrupt, filename)
+					}
+				} else {
+					report.Loaded++
+				}
+				if done%step == 0 || done == len(files) {
+					log.Printf("[cache] loaded %d/%d snapshots", done, len(files))
+				}
+				mu.Unlock()
+			}
+		}()
 	}
+	for _, f := range files {
+		jobs <- f
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Strings(report.Corrupt)
+	report.Duration = time.Since(start)
+	return report, nil
+}
 
-	return loaded, nil
+// loadSnapshotFile restores one snapshot file from dir, quarantining it if corrupt
+// and QuarantineCorruptSnapshots is set.
+func (c *Cache) loadSnapshotFile(dir, filename string) error {
+	// read by file name (not user ID) so files saved before normalization still load
+	snap, err := readSnapshotFile(filepath.Join(dir, filename))
+	if err != nil {
+		if errors.Is(err, ErrSnapshotEmpty) || errors.Is(err, ErrSnapshotInvalid) || errors.Is(err, ErrSnapshotCorrupt) {
+			log.Printf("[cache] corrupt snapshot %s: %v", filename, err)
+			if c.cfg.QuarantineCorruptSnapshots {
+				if err := quarantineFile(dir, filename); err != nil {
+					log.Printf("[cache] quarantine %s failed: %v", filename, err)
+				}
+			}
+		}
+		// skip invalid file
+		return err
+	}
 
+	// restore snapshot
+	return c.RestoreUserFromSnapshot(snap)
 }
 
 func isUserSnapshotFile(filename string) bool {
-	return strings.HasPrefix(filename, "user_") && strings.HasSuffix(filename, ".json") && len(filename) > len("user_.json")
+	ext := snapshotFileExt(filename)
+	return strings.HasPrefix(filename, "user_") && ext != "" && len(filename) > len("user_"+ext)
 }
 
 func getUserIDFromFilename(filename string) string {
@@ -319,7 +1118,24 @@ func getUserIDFromFilename(filename string) string {
 		return ""
 	}
 
-	return strings.TrimSuffix(strings.TrimPrefix(filename, "user_"), ".json")
+	return strings.TrimSuffix(strings.TrimPrefix(filename, "user_"), snapshotFileExt(filename))
+}
+
+// dataDir returns the configured snapshot directory, defaulting to "data".
+func (c *Cache) dataDir() string {
+	if c.cfg.DataDir == "" {
+		return "data"
+	}
+	return c.cfg.DataDir
+}
+
+// quarantineFile moves dir/filename into dir/corrupt/ so it is not loaded again.
+func quarantineFile(dir, filename string) error {
+	corruptDir := filepath.Join(dir, "corrupt")
+	if err := os.MkdirAll(corruptDir, 0o755); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(dir, filename), filepath.Join(corruptDir, filename))
 }
 
 // helpers for filenames
@@ -0,0 +1,1072 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCache returns a cache with snapshots in a temp dir and no entry limit.
+func newTestCache(t *testing.T, mutate ...func(*Config)) *Cache {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.MaxEntries = 0
+	cfg.DataDir = t.TempDir()
+	for _, m := range mutate {
+		m(&cfg)
+	}
+	return NewCache(cfg)
+}
+
+// saveUser writes a snapshot file for userID holding pairs (key, value, ...) at ts.
+func saveUser(t *testing.T, c *Cache, userID string, ts int64, pairs ...string) {
+	t.Helper()
+	snap := &UserSnapshot{UserID: userID}
+	for i := 0; i < len(pairs); i += 2 {
+		snap.Items = append(snap.Items, PersistedItem{Key: pairs[i], Value: []byte(pairs[i+1]), Timestamp: ts})
+	}
+	if _, err := c.SaveUserToFile(snap); err != nil {
+		t.Fatalf("save snapshot: %v", err)
+	}
+}
+
+// mustGet returns the value of userID/key, failing the test if it is missing.
+func mustGet(t *testing.T, c *Cache, userID, key string) string {
+	t.Helper()
+	v, err := c.Get(userID, key)
+	if err != nil {
+		t.Fatalf("get %s/%s: %v", userID, key, err)
+	}
+	return string(v)
+}
+
+func TestSetOutOfOrder(t *testing.T) {
+	type write struct {
+		value string
+		ts    int64
+	}
+	tests := []struct {
+		name   string
+		writes []write
+		want   write // final value and stored timestamp
+	}{
+		{name: "in order", writes: []write{{"a", 1}, {"b", 2}, {"c", 3}}, want: write{"c", 3}},
+		{name: "older after newer", writes: []write{{"new", 5}, {"old", 3}}, want: write{"new", 5}},
+		{name: "delayed retry", writes: []write{{"a", 1}, {"b", 3}, {"a", 1}}, want: write{"b", 3}},
+		{name: "equal timestamp overwrites", writes: []write{{"a", 4}, {"b", 4}}, want: write{"b", 4}},
+		{name: "shuffled", writes: []write{{"c", 30}, {"a", 10}, {"d", 40}, {"b", 20}}, want: write{"d", 40}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			for _, w := range tt.writes {
+				if _, err := c.Set("alice", "k", []byte(w.value), 0, w.ts); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+			}
+			item, err := c.Peek("alice", "k")
+			if err != nil {
+				t.Fatalf("peek: %v", err)
+			}
+			if got := (write{string(item.Value), item.Timestamp}); got != tt.want {
+				t.Fatalf("stored %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListUsersMatch(t *testing.T) {
+	c := newTestCache(t)
+	for _, id := range []string{"test_a", "test_b", "prod_a", "testx"} {
+		if err := c.CreateUser(id); err != nil {
+			t.Fatalf("create %s: %v", id, err)
+		}
+	}
+	tests := []struct {
+		pattern string
+		want    []string
+		wantErr bool
+	}{
+		{pattern: "test_*", want: []string{"test_a", "test_b"}},
+		{pattern: "*_a", want: []string{"prod_a", "test_a"}},
+		{pattern: "test?", want: []string{"testx"}},
+		{pattern: "*", want: []string{"prod_a", "test_a", "test_b", "testx"}},
+		{pattern: "nobody*", want: []string{}},
+		{pattern: "[", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			got, err := c.ListUsersMatch(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !slices.Equal(got, tt.want) {
+				t.Fatalf("users = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetRef(t *testing.T) {
+	tests := []struct {
+		name string
+		get  func(c *Cache, userID, key string) ([]byte, error)
+		copy bool // mutating the result leaves the stored value alone
+	}{
+		{name: "Get", get: (*Cache).Get, copy: true},
+		{name: "GetRef", get: (*Cache).GetRef},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			if _, err := tt.get(c, "nobody", "k"); err != ErrUserNotFound {
+				t.Fatalf("missing user: err = %v, want ErrUserNotFound", err)
+			}
+			if _, err := c.Set("alice", "k", []byte("value"), 0, 0); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+			if _, err := tt.get(c, "alice", "nope"); err != ErrKeyNotFound {
+				t.Fatalf("missing key: err = %v, want ErrKeyNotFound", err)
+			}
+
+			got, err := tt.get(c, "alice", "k")
+			if err != nil || string(got) != "value" {
+				t.Fatalf("get = %q, %v", got, err)
+			}
+			// an overwrite replaces the stored slice, so a reference already handed out
+			// keeps the old bytes
+			if _, err := c.Set("alice", "k", []byte("other"), 0, 0); err != nil {
+				t.Fatalf("overwrite: %v", err)
+			}
+			if string(got) != "value" {
+				t.Fatalf("earlier result changed to %q after overwrite", got)
+			}
+
+			got, _ = tt.get(c, "alice", "k")
+			got[0] = 'X'
+			if stored := mustGet(t, c, "alice", "k"); (stored == "other") != tt.copy {
+				t.Fatalf("stored value after mutating the result = %q", stored)
+			}
+		})
+	}
+}
+
+func TestSetCreated(t *testing.T) {
+	tests := []struct {
+		name    string
+		prior   func(c *Cache) // state before the write
+		ts      int64
+		created bool
+	}{
+		{name: "new key", prior: func(*Cache) {}, created: true},
+		{name: "new key of an existing user", prior: func(c *Cache) { c.Set("alice", "other", []byte("v"), 0, 0) }, created: true},
+		{name: "overwrite", prior: func(c *Cache) { c.Set("alice", "k", []byte("old"), 0, 0) }},
+		{name: "older write ignored", prior: func(c *Cache) { c.Set("alice", "k", []byte("old"), 0, 20) }, ts: 10},
+		{name: "expired key", prior: func(c *Cache) {
+			c.Set("alice", "k", []byte("old"), time.Millisecond, 0)
+			time.Sleep(5 * time.Millisecond)
+		}, created: true},
+		{name: "deleted key", prior: func(c *Cache) {
+			c.Set("alice", "k", []byte("old"), 0, 0)
+			c.Delete("alice", "k")
+		}, created: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			tt.prior(c)
+			created, err := c.Set("alice", "k", []byte("new"), 0, tt.ts)
+			if err != nil || created != tt.created {
+				t.Fatalf("Set = %v, %v; want created %v", created, err, tt.created)
+			}
+		})
+	}
+}
+
+func BenchmarkGetRef(b *testing.B) {
+	cfg := DefaultConfig()
+	cfg.MaxEntries = 0
+	cfg.DataDir = b.TempDir()
+	c := NewCache(cfg)
+	if _, err := c.Set("alice", "k", make([]byte, 4096), 0, 0); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bb := range []struct {
+		name string
+		get  func(c *Cache, userID, key string) ([]byte, error)
+	}{
+		{name: "Get", get: (*Cache).Get},
+		{name: "GetRef", get: (*Cache).GetRef},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := bb.get(c, "alice", "k"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestNearExpiry(t *testing.T) {
+	c := newTestCache(t)
+	for key, ttl := range map[string]time.Duration{"m3": 3 * time.Minute, "m1": time.Minute, "m10": 10 * time.Minute, "m2": 2 * time.Minute, "forever": 0} {
+		if _, err := c.Set("alice", key, []byte("v"), ttl, 0); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+	tests := []struct {
+		name   string
+		within time.Duration
+		limit  int
+		want   []string
+	}{
+		{name: "soonest first", within: 5 * time.Minute, want: []string{"m1", "m2", "m3"}},
+		{name: "limited", within: 5 * time.Minute, limit: 2, want: []string{"m1", "m2"}},
+		{name: "wide window skips keys without ttl", within: time.Hour, want: []string{"m1", "m2", "m3", "m10"}},
+		{name: "nothing that soon", within: 30 * time.Second, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.NearExpiry("alice", tt.within, tt.limit)
+			if err != nil {
+				t.Fatalf("NearExpiry: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("NearExpiry = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, err := c.NearExpiry("nobody", time.Hour, 0); err != ErrUserNotFound {
+		t.Fatalf("unknown user: err = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestSetIfStale(t *testing.T) {
+	tests := []struct {
+		name      string
+		existing  string        // "" = key missing
+		ttl       time.Duration // ttl of the existing key
+		wantWrote bool
+	}{
+		{name: "fresh", existing: "old", ttl: 10 * time.Minute, wantWrote: false},
+		{name: "stale", existing: "old", ttl: 30 * time.Second, wantWrote: true},
+		{name: "missing", wantWrote: true},
+		{name: "no ttl is never stale", existing: "old", wantWrote: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			if tt.existing != "" {
+				if _, err := c.Set("alice", "k", []byte(tt.existing), tt.ttl, 0); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+			}
+			wrote, err := c.SetIfStale("alice", "k", []byte("new"), 5*time.Minute, time.Minute)
+			if err != nil {
+				t.Fatalf("SetIfStale: %v", err)
+			}
+			if wrote != tt.wantWrote {
+				t.Fatalf("wrote = %v, want %v", wrote, tt.wantWrote)
+			}
+			want, wantTTL := tt.existing, tt.ttl
+			if tt.wantWrote {
+				want, wantTTL = "new", 5*time.Minute
+			}
+			if got := mustGet(t, c, "alice", "k"); got != want {
+				t.Fatalf("value = %q, want %q", got, want)
+			}
+			left, err := c.TTL("alice", "k")
+			if err != nil {
+				t.Fatalf("TTL: %v", err)
+			}
+			if wantTTL == 0 && left > 0 || wantTTL > 0 && (left <= 0 || left > wantTTL) {
+				t.Fatalf("ttl = %v, want about %v", left, wantTTL)
+			}
+		})
+	}
+
+	// concurrent refreshers of a stale key: only one of them writes
+	c := newTestCache(t)
+	if _, err := c.Set("alice", "k", []byte("old"), time.Second, 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	writes := 0
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wrote, err := c.SetIfStale("alice", "k", []byte("new"), time.Hour, time.Minute)
+			if err != nil {
+				t.Errorf("SetIfStale: %v", err)
+			}
+			if wrote {
+				mu.Lock()
+				writes++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if writes != 1 {
+		t.Fatalf("%d concurrent refreshers wrote, want 1", writes)
+	}
+}
+
+func TestCorruptSnapshotFiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string // written as bob's snapshot
+		quarantine bool
+		wantErr    error
+	}{
+		{name: "empty", content: "", wantErr: ErrSnapshotEmpty},
+		{name: "not json", content: "{not json", wantErr: ErrSnapshotInvalid},
+		{name: "empty quarantined", content: "", quarantine: true, wantErr: ErrSnapshotEmpty},
+		{name: "not json quarantined", content: "garbage", quarantine: true, wantErr: ErrSnapshotInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, func(cfg *Config) { cfg.QuarantineCorruptSnapshots = tt.quarantine })
+			saveUser(t, c, "alice", 1, "k", "v")
+			bad := getUserFilePath(c.cfg.DataDir, "bob")
+			if err := os.WriteFile(bad, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := c.LoadUserFromFile("bob"); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("LoadUserFromFile = %v, want %v", err, tt.wantErr)
+			}
+			report, err := c.LoadAllUsersFromDirReport()
+			if err != nil {
+				t.Fatalf("load all: %v", err)
+			}
+			if report.Loaded != 1 || len(report.Failed) != 1 || report.Failed[filepath.Base(bad)] == nil {
+				t.Fatalf("report = loaded %d, failed %v; want alice loaded and bob failed", report.Loaded, report.Failed)
+			}
+			if got := mustGet(t, c, "alice", "k"); got != "v" {
+				t.Fatalf("alice/k = %q", got)
+			}
+
+			_, statErr := os.Stat(bad)
+			_, movedErr := os.Stat(filepath.Join(c.cfg.DataDir, "corrupt", filepath.Base(bad)))
+			if tt.quarantine != (statErr != nil) || tt.quarantine != (movedErr == nil) {
+				t.Fatalf("quarantine %v: file in place err=%v, in corrupt/ err=%v", tt.quarantine, statErr, movedErr)
+			}
+		})
+	}
+}
+
+func TestDeletedUserTombstone(t *testing.T) {
+	dir := t.TempDir()
+	inDir := func(cfg *Config) { cfg.DataDir = dir }
+	c := newTestCache(t, inDir)
+	saveUser(t, c, "alice", 1, "a", "old")
+	saveUser(t, c, "bob", 1, "b", "1")
+	if n, err := c.LoadAllUsersFromDir(); err != nil || n != 2 {
+		t.Fatalf("load = %d, %v", n, err)
+	}
+
+	if err := c.DeleteUser("alice"); err != nil {
+		t.Fatalf("delete user: %v", err)
+	}
+	if _, err := os.Stat(snapshotPath(dir, "alice", ".json")); err != nil {
+		t.Fatalf("snapshot file should be kept: %v", err)
+	}
+
+	fresh := newTestCache(t, inDir)
+	if n, err := fresh.LoadAllUsersFromDir(); err != nil || n != 1 {
+		t.Fatalf("load after delete = %d, %v; want only bob", n, err)
+	}
+	if fresh.getUser("alice") != nil {
+		t.Fatal("tombstoned user loaded")
+	}
+	if loaded, err := fresh.LoadUser("alice"); err != nil || loaded {
+		t.Fatalf("LoadUser(tombstoned) = %v, %v; want false", loaded, err)
+	}
+
+	// saving the user again clears the tombstone
+	if _, err := fresh.Set("alice", "a", []byte("new"), 0, 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := fresh.SnapshotAll(); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if fresh.isTombstoned("alice") {
+		t.Fatal("tombstone survived a new snapshot")
+	}
+	again := newTestCache(t, inDir)
+	if n, err := again.LoadAllUsersFromDir(); err != nil || n != 2 {
+		t.Fatalf("load after re-save = %d, %v", n, err)
+	}
+	if got := mustGet(t, again, "alice", "a"); got != "new" {
+		t.Fatalf("alice/a = %q, want the re-saved value", got)
+	}
+}
+
+func TestSetUntilPastExpiry(t *testing.T) {
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	tests := []struct {
+		name      string
+		existing  bool // k holds "old" at timestamp 10 beforehand
+		expiresAt time.Time
+		ts        int64
+		want      string // value afterwards, "" = missing
+	}{
+		{name: "past expiry deletes", existing: true, expiresAt: past, ts: 11},
+		{name: "past expiry at the same timestamp deletes", existing: true, expiresAt: past, ts: 10},
+		{name: "older write with past expiry is ignored", existing: true, expiresAt: past, ts: 9, want: "old"},
+		{name: "past expiry on a missing key stores nothing", expiresAt: past, ts: 11},
+		{name: "future expiry stores", existing: true, expiresAt: future, ts: 11, want: "new"},
+		{name: "no expiry stores", existing: true, ts: 11, want: "new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			if tt.existing {
+				if _, err := c.Set("alice", "k", []byte("old"), 0, 10); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+			}
+			created, err := c.SetUntil("alice", "k", []byte("new"), tt.expiresAt, tt.ts)
+			if err != nil {
+				t.Fatalf("SetUntil: %v", err)
+			}
+			if wantCreated := !tt.existing && tt.want != ""; created != wantCreated {
+				t.Fatalf("created = %v, want %v", created, wantCreated)
+			}
+			v, err := c.Get("alice", "k")
+			if tt.want == "" {
+				if err != ErrKeyNotFound {
+					t.Fatalf("get = %q, %v; want the key gone", v, err)
+				}
+				return
+			}
+			if err != nil || string(v) != tt.want {
+				t.Fatalf("get = %q, %v; want %q", v, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetOrSetConcurrent(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string // value stored beforehand, "" = none
+		wantSets int    // callers that report storing their value
+	}{
+		{name: "absent key", wantSets: 1},
+		{name: "existing key", existing: "first"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			if tt.existing != "" {
+				if _, err := c.Set("alice", "k", []byte(tt.existing), 0, 0); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+			}
+
+			const callers = 50
+			type result struct {
+				val string
+				set bool
+			}
+			results := make(chan result, callers)
+			var wg sync.WaitGroup
+			for i := 0; i < callers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					val, set, err := c.GetOrSet("alice", "k", []byte("v"+strconv.Itoa(i)), 0, 0)
+					if err != nil {
+						t.Errorf("GetOrSet: %v", err)
+					}
+					results <- result{string(val), set}
+				}(i)
+			}
+			wg.Wait()
+			close(results)
+
+			stored := mustGet(t, c, "alice", "k")
+			sets := 0
+			for r := range results {
+				if r.val != stored {
+					t.Fatalf("a caller saw %q, stored is %q", r.val, stored)
+				}
+				if r.set {
+					sets++
+				}
+			}
+			if sets != tt.wantSets {
+				t.Fatalf("%d callers stored the value, want %d", sets, tt.wantSets)
+			}
+			if tt.existing != "" && stored != tt.existing {
+				t.Fatalf("existing value replaced by %q", stored)
+			}
+		})
+	}
+}
+func TestGetOrCreateUserConcurrent(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool // user created (with a key) before the race
+		callers  int
+	}{
+		{name: "new user", callers: 16},
+		{name: "existing user", existing: true, callers: 16},
+		{name: "single caller", callers: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			var before *UserCache
+			if tt.existing {
+				if _, err := c.Set("alice", "k", []byte("v"), 0, 0); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+				before = c.getUser("alice")
+			}
+
+			got := make([]*UserCache, tt.callers)
+			var wg sync.WaitGroup
+			for i := range got {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					got[i] = c.GetOrCreateUser("alice")
+				}()
+			}
+			wg.Wait()
+
+			want := c.getUser("alice")
+			for i, uc := range got {
+				if uc != want {
+					t.Fatalf("caller %d got a different *UserCache", i)
+				}
+			}
+			if tt.existing && want != before {
+				t.Fatalf("existing user was replaced")
+			}
+			if users, _ := c.ListUsersMatch("*"); len(users) != 1 {
+				t.Fatalf("users = %v, want just alice", users)
+			}
+			// writes through any returned reference are visible through the cache
+			if _, err := got[0].set("k2", []byte("v2"), 0, 0); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+			if v := mustGet(t, c, "alice", "k2"); v != "v2" {
+				t.Fatalf("k2 = %q", v)
+			}
+		})
+	}
+}
+func TestNormalizeUserID(t *testing.T) {
+	tests := []struct {
+		name      string
+		normalize func(string) string
+		wantSame  bool // "Alice" and "ALICE" are one tenant
+	}{
+		{name: "exact ids", wantSame: false},
+		{name: "lowercase", normalize: strings.ToLower, wantSame: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			mutate := func(cfg *Config) {
+				cfg.DataDir = dir
+				cfg.NormalizeUserID = tt.normalize
+			}
+			c := newTestCache(t, mutate)
+			if _, err := c.Set("Alice", "k", []byte("v"), 0, 0); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+			_, err := c.Get("ALICE", "k")
+			if (err == nil) != tt.wantSame {
+				t.Fatalf("get under another case: %v, want shared tenant = %v", err, tt.wantSame)
+			}
+			if users, _ := c.ListUsersMatch("*"); tt.wantSame && !slices.Equal(users, []string{"alice"}) {
+				t.Fatalf("users = %v, want [alice]", users)
+			}
+
+			// the snapshot file is named after the normalized id, so any casing finds it
+			snap, err := c.SnapshotUser("aLiCe")
+			if (err == nil) != tt.wantSame {
+				t.Fatalf("snapshot under another case: %v", err)
+			}
+			if !tt.wantSame {
+				return
+			}
+			if _, err := c.SaveUserToFile(snap); err != nil {
+				t.Fatalf("save: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "user_alice.json")); err != nil {
+				t.Fatalf("snapshot file: %v", err)
+			}
+
+			fresh := newTestCache(t, mutate)
+			if loaded, err := fresh.LoadUser("ALICE"); err != nil || !loaded {
+				t.Fatalf("load = %v, %v", loaded, err)
+			}
+			if v := mustGet(t, fresh, "Alice", "k"); v != "v" {
+				t.Fatalf("k = %q after reload", v)
+			}
+		})
+	}
+}
+
+func TestLoadAllUsersParallel(t *testing.T) {
+	const users = 200
+	tests := []struct {
+		name    string
+		workers int // Config.LoadConcurrency
+	}{
+		{name: "sequential", workers: 1},
+		{name: "four workers", workers: 4},
+		{name: "default", workers: 0},
+		{name: "more workers than files", workers: users * 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			mutate := func(cfg *Config) {
+				cfg.DataDir = dir
+				cfg.LoadConcurrency = tt.workers
+			}
+			src := newTestCache(t, mutate)
+			for i := 0; i < users; i++ {
+				id := "u" + strconv.Itoa(i)
+				saveUser(t, src, id, 1, "k", id, "k2", "v2")
+			}
+			if err := os.WriteFile(getUserFilePath(dir, "broken"), []byte("{not json"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			c := newTestCache(t, mutate)
+			report, err := c.LoadAllUsersFromDirReport()
+			if err != nil {
+				t.Fatalf("load all: %v", err)
+			}
+			if report.Loaded != users || len(report.Failed) != 1 {
+				t.Fatalf("report = loaded %d, failed %v; want %d loaded and the broken file failed", report.Loaded, report.Failed, users)
+			}
+			for i := 0; i < users; i++ {
+				id := "u" + strconv.Itoa(i)
+				if v := mustGet(t, c, id, "k"); v != id {
+					t.Fatalf("%s/k = %q", id, v)
+				}
+			}
+			if res := c.RecomputeStats(); len(res) != users {
+				t.Fatalf("%d users after load, want %d", len(res), users)
+			}
+			for id, r := range c.RecomputeStats() {
+				if r.BytesDrift != 0 {
+					t.Fatalf("%s byte count drifted by %d during load", id, r.BytesDrift)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLoadAllUsers(b *testing.B) {
+	for _, workers := range []int{1, 4, 16} {
+		b.Run("workers="+strconv.Itoa(workers), func(b *testing.B) {
+			cfg := DefaultConfig()
+			cfg.MaxEntries = 0
+			cfg.DataDir = b.TempDir()
+			cfg.LoadConcurrency = workers
+			src := NewCache(cfg)
+			value := strings.Repeat("x", 256)
+			for i := 0; i < 500; i++ {
+				snap := &UserSnapshot{UserID: "u" + strconv.Itoa(i)}
+				for k := 0; k < 50; k++ {
+					snap.Items = append(snap.Items, PersistedItem{Key: "k" + strconv.Itoa(k), Value: []byte(value), Timestamp: 1})
+				}
+				if _, err := src.SaveUserToFile(snap); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c := NewCache(cfg)
+				if _, err := c.LoadAllUsersFromDir(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSetMany(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxEntries  int
+		existing    []string // keys set before the batch
+		batch       []string
+		ttl         time.Duration
+		wantCreated int
+		wantEntries int
+	}{
+		{name: "no ttl", batch: []string{"a", "b", "c"}, wantCreated: 3, wantEntries: 3},
+		{name: "shared ttl", batch: []string{"a", "b", "c", "d"}, ttl: time.Minute, wantCreated: 4, wantEntries: 4},
+		{name: "overwrites", existing: []string{"a", "b"}, batch: []string{"b", "c"}, wantCreated: 1, wantEntries: 3},
+		{name: "evicts once at the end", maxEntries: 3, existing: []string{"x", "y"}, batch: []string{"a", "b", "c", "d"}, wantCreated: 4, wantEntries: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &evictionCalls{}
+			c := newTestCache(t, func(cfg *Config) {
+				cfg.MaxEntries = tt.maxEntries
+				cfg.MetricsSink = sink
+			})
+			for _, k := range tt.existing {
+				if _, err := c.Set("alice", k, []byte("old"), 0, 0); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+			}
+			values := make(map[string][]byte, len(tt.batch))
+			for _, k := range tt.batch {
+				values[k] = []byte("new-" + k)
+			}
+
+			created, err := c.SetMany("alice", values, tt.ttl, 0)
+			if err != nil || created != tt.wantCreated {
+				t.Fatalf("SetMany = %d, %v; want %d created", created, err, tt.wantCreated)
+			}
+			st, _ := c.UserStats("alice")
+			if st.Entries != tt.wantEntries {
+				t.Fatalf("entries = %d, want %d", st.Entries, tt.wantEntries)
+			}
+
+			overflow := len(tt.existing) + tt.wantCreated - tt.wantEntries
+			if overflow > 0 {
+				// one eviction pass for the whole batch, and it took the older keys first
+				if len(sink.deltas) != 1 || sink.deltas[0] != int64(overflow) {
+					t.Fatalf("eviction increments = %v, want one of %d", sink.deltas, overflow)
+				}
+				for _, k := range tt.existing {
+					if _, err := c.Peek("alice", k); err == nil {
+						t.Fatalf("pre-batch key %s survived eviction", k)
+					}
+				}
+				return
+			}
+			for _, k := range tt.batch {
+				if v := mustGet(t, c, "alice", k); v != "new-"+k {
+					t.Fatalf("%s = %q", k, v)
+				}
+				left, err := c.TTL("alice", k)
+				if err != nil {
+					t.Fatalf("ttl: %v", err)
+				}
+				if tt.ttl == 0 && left > 0 || tt.ttl > 0 && (left > tt.ttl || left < tt.ttl-time.Second) {
+					t.Fatalf("%s ttl = %s, want %s", k, left, tt.ttl)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSetMany(b *testing.B) {
+	cfg := DefaultConfig()
+	cfg.MaxEntries = 0
+	cfg.DataDir = b.TempDir()
+	values := make(map[string][]byte, 1000)
+	for i := 0; i < 1000; i++ {
+		values["k"+strconv.Itoa(i)] = []byte("value")
+	}
+
+	b.Run("individual", func(b *testing.B) {
+		c := NewCache(cfg)
+		for i := 0; i < b.N; i++ {
+			for k, v := range values {
+				c.Set("alice", k, v, time.Minute, 0)
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		c := NewCache(cfg)
+		for i := 0; i < b.N; i++ {
+			c.SetMany("alice", values, time.Minute, 0)
+		}
+	})
+}
+
+func TestMaxValueBytes(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		spill   int // SpillThresholdBytes
+		wantErr error
+	}{
+		{name: "at the limit", size: 16},
+		{name: "just over", size: 17, wantErr: ErrValueTooLarge},
+		{name: "empty", size: 0},
+		{name: "over and spilled", size: 17, spill: 4, wantErr: ErrValueTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, func(cfg *Config) {
+				cfg.MaxValueBytes = 16
+				cfg.SpillThresholdBytes = tt.spill
+			})
+			value := bytes.Repeat([]byte("x"), tt.size)
+			if _, err := c.Set("alice", "k", value, 0, 0); err != tt.wantErr {
+				t.Fatalf("Set = %v, want %v", err, tt.wantErr)
+			}
+			_, err := c.Get("alice", "k")
+			if tt.wantErr != nil {
+				if err != ErrKeyNotFound {
+					t.Fatalf("rejected value stored: Get = %v", err)
+				}
+				if c.Bytes() != 0 {
+					t.Fatalf("bytes = %d after rejected write", c.Bytes())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+		})
+	}
+}
+
+func TestSnapshotAll(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestCache(t, func(cfg *Config) { cfg.DataDir = dir })
+	users := []string{"carol", "alice", "bob"}
+	for _, id := range users {
+		c.Set(id, "k", []byte("v-"+id), 0, 0)
+	}
+	if got := c.ListUsers(); !slices.Equal(got, []string{"alice", "bob", "carol"}) {
+		t.Fatalf("ListUsers = %v", got)
+	}
+	if err := c.SnapshotAll(); err != nil {
+		t.Fatalf("SnapshotAll: %v", err)
+	}
+
+	restored := newTestCache(t, func(cfg *Config) { cfg.DataDir = dir })
+	if n, err := restored.LoadAllUsersFromDir(); err != nil || n != len(users) {
+		t.Fatalf("load = %d, %v; want %d", n, err, len(users))
+	}
+	for _, id := range users {
+		if got := mustGet(t, restored, id, "k"); got != "v-"+id {
+			t.Fatalf("%s/k = %q", id, got)
+		}
+	}
+
+	// a data dir that can't be created fails every user, without stopping early
+	file := filepath.Join(t.TempDir(), "not-a-dir")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	broken := newTestCache(t, func(cfg *Config) { cfg.DataDir = file })
+	for _, id := range users {
+		broken.Set(id, "k", []byte("v"), 0, 0)
+	}
+	report := broken.SnapshotAllReport()
+	if report.Saved != 0 || len(report.Failed) != len(users) {
+		t.Fatalf("report = %+v, want %d failures", report, len(users))
+	}
+	if err := broken.SnapshotAll(); err == nil {
+		t.Fatal("SnapshotAll succeeded with an unusable data dir")
+	}
+}
+
+func TestSnapshotDirty(t *testing.T) {
+	c := newTestCache(t)
+	c.Set("alice", "k", []byte("v1"), 0, 0)
+	c.Set("bob", "k", []byte("v1"), 0, 0)
+
+	if rep := c.SnapshotDirty(); rep.Saved != 2 || rep.Unchanged != 0 {
+		t.Fatalf("first cycle = %+v, want both saved", rep)
+	}
+	if rep := c.SnapshotDirty(); rep.Saved != 0 || rep.Unchanged != 2 {
+		t.Fatalf("idle cycle = %+v, want both unchanged", rep)
+	}
+
+	tests := []struct {
+		name   string
+		change func()
+	}{
+		{name: "set", change: func() { c.Set("alice", "k", []byte("v2"), 0, 0) }},
+		{name: "delete", change: func() { c.Delete("alice", "k") }},
+		{name: "expire", change: func() { c.Set("alice", "t", []byte("v"), 0, 0); c.SnapshotDirty(); c.Expire("alice", "t", time.Hour) }},
+		{name: "flush", change: func() { c.Flush("alice") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change()
+			if rep := c.SnapshotDirty(); rep.Saved != 1 || rep.Unchanged != 1 {
+				t.Fatalf("cycle = %+v, want alice saved and bob unchanged", rep)
+			}
+		})
+	}
+
+	// reads don't dirty a user
+	c.Get("bob", "k")
+	if rep := c.SnapshotDirty(); rep.Saved != 0 {
+		t.Fatalf("cycle after read = %+v, want nothing saved", rep)
+	}
+}
+
+func TestCompressedSnapshotRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestCache(t, func(cfg *Config) {
+		cfg.DataDir = dir
+		cfg.CompressSnapshots = true
+	})
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	c.Set("alice", "a", []byte("one"), 0, 10)
+	c.SetUntil("alice", "b", bytes.Repeat([]byte("xyz"), 1000), expires, 20)
+
+	snap, err := c.SnapshotUser("alice")
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	filename, err := c.SaveUserToFile(snap)
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if !strings.HasSuffix(filename, "user_alice.json.gz") {
+		t.Fatalf("saved to %s, want user_alice.json.gz", filename)
+	}
+	if info, _ := os.Stat(filename); info.Size() > 1000 {
+		t.Fatalf("compressed snapshot is %d bytes", info.Size())
+	}
+
+	loaded, err := c.LoadUserFromFile("alice")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	byKey := func(s *UserSnapshot) map[string]PersistedItem {
+		m := make(map[string]PersistedItem)
+		for _, it := range s.Items {
+			m[it.Key] = it
+		}
+		return m
+	}
+	want, got := byKey(snap), byKey(loaded)
+	if len(got) != len(want) {
+		t.Fatalf("loaded %d items, want %d", len(got), len(want))
+	}
+	for k, w := range want {
+		g := got[k]
+		if !bytes.Equal(g.Value, w.Value) || !g.ExpiresAt.Equal(w.ExpiresAt) || g.Timestamp != w.Timestamp {
+			t.Fatalf("%s = %+v, want %+v", k, g, w)
+		}
+	}
+
+	// uncompressed files from before the switch still load, and a user saved in both
+	// formats is loaded once, from the configured one
+	plain := newTestCache(t, func(cfg *Config) { cfg.DataDir = dir })
+	saveUser(t, plain, "bob", 1, "k", "plain")
+	saveUser(t, plain, "carol", 1, "k", "plain")
+	if _, err := c.writeSnapshotFile(dir, &UserSnapshot{UserID: "bob", Items: []PersistedItem{{Key: "k", Value: []byte("gz"), Timestamp: 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(getUserFilePath(dir, "bob"), []byte(`{"user_id":"bob","items":[]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestCache(t, func(cfg *Config) {
+		cfg.DataDir = dir
+		cfg.CompressSnapshots = true
+	})
+	report, err := restored.LoadAllUsersFromDirReport()
+	if err != nil {
+		t.Fatalf("load all: %v", err)
+	}
+	if report.Loaded != 3 || len(report.Failed) != 0 {
+		t.Fatalf("report = %+v, want alice, bob and carol loaded", report)
+	}
+	for _, kv := range [][3]string{{"alice", "a", "one"}, {"bob", "k", "gz"}, {"carol", "k", "plain"}} {
+		if got := mustGet(t, restored, kv[0], kv[1]); got != kv[2] {
+			t.Fatalf("%s/%s = %q, want %q", kv[0], kv[1], got, kv[2])
+		}
+	}
+}
+
+func TestDeleteOutOfOrder(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	tests := []struct {
+		name    string
+		del     func(c *Cache, ts int64) error // delete at ts
+		lateTS  int64                          // relative to the delete
+		present bool
+	}{
+		{name: "older set after delete", del: deleteNow, lateTS: -1, present: false},
+		{name: "newer set after delete", del: deleteNow, lateTS: 1, present: true},
+		{name: "older set after replicated delete", del: expiredWrite(past), lateTS: -1, present: false},
+		{name: "equal set after replicated delete", del: expiredWrite(past), lateTS: 0, present: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			ts := time.Now().UnixNano()
+			if _, err := c.Set("alice", "k", []byte("v1"), 0, ts-10); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+			if err := tt.del(c, ts); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			// Delete stamps its own time; read back what was recorded
+			del := ts
+			if recorded, ok := c.getUser("alice").deletedAt["k"]; ok {
+				del = recorded
+			}
+			if _, err := c.Set("alice", "k", []byte("late"), 0, del+tt.lateTS); err != nil {
+				t.Fatalf("late set: %v", err)
+			}
+			_, err := c.Get("alice", "k")
+			if present := err == nil; present != tt.present {
+				t.Fatalf("key present = %v (err %v), want %v", present, err, tt.present)
+			}
+		})
+	}
+}
+
+func TestDeleteTombstonePruned(t *testing.T) {
+	c := newTestCache(t, func(cfg *Config) { cfg.DeleteTombstoneTTL = time.Millisecond })
+	if _, err := c.Set("alice", "k", []byte("v"), 0, 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := c.Delete("alice", "k"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	uc := c.getUser("alice")
+	uc.pruneDeleted()
+
+	// with the tombstone gone an old write is accepted again
+	if _, err := c.Set("alice", "k", []byte("old"), 0, 1); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if got := mustGet(t, c, "alice", "k"); got != "old" {
+		t.Fatalf("got %q, want old", got)
+	}
+}
+
+func deleteNow(c *Cache, _ int64) error {
+	return c.Delete("alice", "k")
+}
+
+// expiredWrite deletes like a replica does: a write at ts that is already expired.
+func expiredWrite(expires time.Time) func(c *Cache, ts int64) error {
+	return func(c *Cache, ts int64) error {
+		_, err := c.SetUntil("alice", "k", []byte("gone"), expires, ts)
+		return err
+	}
+}
@@ -11,8 +11,108 @@ type Config struct {
 
 	MaxEntries int    // per-user LRU capacity; 0 means unlimited
 	DataDir    string // directory for per-user persistence
+
+	// MaxBytes caps the total value size per user; writes evict entries (by
+	// EvictionPolicy) until the user fits again. A single value larger than this is
+	// rejected with ErrValueTooLarge unless it is spilled. 0 means unlimited.
+	MaxBytes int64
+
+	// MaxValueBytes rejects any single value larger than this with ErrValueTooLarge,
+	// spilled or not, so one huge SET can't blow up memory or snapshot files.
+	// 0 means unlimited.
+	MaxValueBytes int
+
+	// EvictionPolicy picks the key a user evicts: EvictLRU (default), EvictLFU or
+	// EvictRandom.
+	EvictionPolicy EvictionPolicy
+
+	// JanitorCrashOnPanic re-panics after logging a panic in the TTL sweeper instead
+	// of recovering and continuing on the next tick.
+	JanitorCrashOnPanic bool
+
+	// CheckInvariants makes every janitor tick verify (and repair) the LRU index against
+	// the items map. Debug aid; it walks every key under the write lock.
+	CheckInvariants bool
+
+	// NormalizeUserID maps user IDs to a canonical form (e.g. strings.ToLower) at every
+	// entry point, so differently-cased IDs share one tenant and snapshot file. It must
+	// be idempotent. nil keeps IDs as-is.
+	NormalizeUserID func(string) string
+
+	// DeleteTombstoneTTL is how long a deleted key remembers its delete time, so a
+	// delayed write older than the delete (e.g. a replicated SET) can't bring it back
+	// (0 = 5m).
+	DeleteTombstoneTTL time.Duration
+
+	// TrackInsertionOrder keeps a per-user insertion-order index so KEYS returns keys
+	// in the order they were created. Costs one list element per key.
+	TrackInsertionOrder bool
+
+	// SnapshotOnDelete writes a user's snapshot to <DataDir>/trash/ before DeleteUser
+	// drops it, so it can be brought back with UndeleteUser within TrashRetention.
+	SnapshotOnDelete bool
+	// TrashRetention is how long trash snapshots are kept (0 = 24h).
+	TrashRetention time.Duration
+
+	// SpillThresholdBytes moves values larger than this to per-key files under
+	// <DataDir>/spill/, keeping only a reference in memory; reads load them back from
+	// disk. 0 disables spilling. Spilled values don't count toward byte limits.
+	SpillThresholdBytes int
+
+	// CompressSnapshots gzips snapshot files (user_<id>.json.gz). Loading detects gzip
+	// either way, so the setting can be flipped without converting existing files.
+	CompressSnapshots bool
+	// SnapshotFormat is SnapshotJSON (default) or SnapshotBinary. Like compression it
+	// is detected on load, so old files keep loading after a change.
+	SnapshotFormat SnapshotFormat
+
+	// WALEnabled appends every write to a write-ahead log so changes since the last
+	// snapshot survive a restart; ReplayWAL applies it at startup. Writes are logged
+	// only after ReplayWAL has run.
+	WALEnabled bool
+	// WALDir holds the log segments (default <DataDir>/wal).
+	WALDir string
+	// WALSync fsyncs after every record. Safer against power loss, much slower;
+	// without it a crash of the process alone still loses nothing.
+	WALSync bool
+
+	// LoadConcurrency is the number of workers LoadAllUsersFromDir uses (0 = NumCPU).
+	LoadConcurrency int
+
+	// MetricsSink receives counters, latencies and gauges from the cache and server
+	// (nil = NopSink).
+	MetricsSink MetricsSink
+
+	// QuarantineCorruptSnapshots moves empty/invalid snapshot files to <DataDir>/corrupt/
+	// when LoadAllUsersFromDir finds them, instead of leaving them in place.
+	QuarantineCorruptSnapshots bool
+
+	// GlobalMaxBytes caps the total value size across all users; 0 means unlimited.
+	GlobalMaxBytes int64
+	// GlobalEvictionPolicy picks which user to evict from when GlobalMaxBytes is exceeded.
+	GlobalEvictionPolicy GlobalEvictionPolicy
+
+	// OnEvict, if set, is called whenever a key is removed by expiry, capacity
+	// eviction or an explicit delete. Calls happen on a single background worker,
+	// outside any cache lock, in removal order; if the callback falls behind by more
+	// than a few thousand events, further events are dropped (see DroppedEvictEvents).
+	// Bulk removals (Flush, DeleteUser, restores) are not reported.
+	OnEvict func(userID, key string, reason EvictReason)
 }
 
+// GlobalEvictionPolicy selects the victim user under global memory pressure.
+type GlobalEvictionPolicy string
+
+const (
+	// GlobalEvictOldest evicts the LRU tail whose last write is oldest across all users.
+	// Simple, but a quiet user with few old entries can be starved.
+	GlobalEvictOldest GlobalEvictionPolicy = "oldest"
+	// GlobalEvictLargest evicts from the user currently using the most bytes.
+	GlobalEvictLargest GlobalEvictionPolicy = "largest"
+	// GlobalEvictRoundRobin rotates evictions across users.
+	GlobalEvictRoundRobin GlobalEvictionPolicy = "round-robin"
+)
+
 func DefaultConfig() Config {
 	return Config{
 		JanitorInterval: 5 * time.Second,
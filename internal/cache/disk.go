@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"os"
+	"time"
+)
+
+// DiskStatus reports whether DataDir can hold snapshots.
+type DiskStatus struct {
+	Dir       string    `json:"dir"`
+	Writable  bool      `json:"writable"`
+	Error     string    `json:"error,omitempty"`
+	FreeBytes int64     `json:"free_bytes"` // -1 when unknown
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// CheckDisk creates DataDir if needed, writes and removes a probe file, and reports free space.
+func (c *Cache) CheckDisk() DiskStatus {
+	dir := c.dataDir()
+	st := DiskStatus{Dir: dir, FreeBytes: -1, CheckedAt: time.Now()}
+
+	if err := probeWrite(dir); err != nil {
+		st.Error = err.Error()
+	} else {
+		st.Writable = true
+	}
+	if free, err := freeBytes(dir); err == nil {
+		st.FreeBytes = free
+	}
+	return st
+}
+
+func probeWrite(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	defer os.Remove(name)
+
+	if _, err := f.Write([]byte("ok")); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package cache
+
+import "errors"
+
+func freeBytes(dir string) (int64, error) {
+	return 0, errors.New("free space not supported on this platform")
+}
@@ -6,4 +6,12 @@ var (
 	ErrUserNotFound = errors.New("user not found")
 	ErrKeyNotFound  = errors.New("key not found")
 	ErrUserExists   = errors.New("user exists")
+
+	ErrNotInteger      = errors.New("value is not an integer")
+	ErrIntegerOverflow = errors.New("increment would overflow")
+	ErrValueTooLarge   = errors.New("value too large")
+
+	ErrSnapshotEmpty   = errors.New("snapshot file is empty")
+	ErrSnapshotInvalid = errors.New("snapshot file is invalid")
+	ErrSnapshotCorrupt = errors.New("snapshot file is corrupt")
 )
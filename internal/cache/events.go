@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// EvictReason says why a key was removed, as reported to Config.OnEvict.
+type EvictReason int
+
+const (
+	// ReasonExpired: the key's TTL passed (janitor sweep, lazy expiry on access, or a
+	// write whose expiry was already in the past).
+	ReasonExpired EvictReason = iota
+	// ReasonCapacity: evicted to get back under MaxEntries, MaxBytes or GlobalMaxBytes.
+	ReasonCapacity
+	// ReasonDeleted: removed explicitly (Delete, EXPIRE with ttl <= 0, a reverted write).
+	ReasonDeleted
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case ReasonExpired:
+		return "expired"
+	case ReasonCapacity:
+		return "capacity"
+	case ReasonDeleted:
+		return "deleted"
+	default:
+		return "unknown"
+	}
+}
+
+// evictQueueSize bounds the events waiting for the OnEvict worker. When it is full
+// further events are dropped (and counted) rather than blocking the cache.
+const evictQueueSize = 4096
+
+// MetricEvictEventsDropped counts OnEvict events dropped because the queue was full.
+const MetricEvictEventsDropped = "cache.evict_events_dropped"
+
+type evictEvent struct {
+	userID string
+	key    string
+	reason EvictReason
+}
+
+// evictNotifier delivers removal events to Config.OnEvict on a single worker
+// goroutine, so callbacks never run under a user's lock and a slow callback can't
+// stall the janitor or writers. A nil notifier ignores events.
+type evictNotifier struct {
+	fn      func(userID, key string, reason EvictReason)
+	ch      chan evictEvent
+	sink    MetricsSink
+	dropped atomic.Int64
+}
+
+// newEvictNotifier starts the worker. It returns nil when fn is nil.
+func newEvictNotifier(fn func(userID, key string, reason EvictReason), sink MetricsSink) *evictNotifier {
+	if fn == nil {
+		return nil
+	}
+	n := &evictNotifier{fn: fn, ch: make(chan evictEvent, evictQueueSize), sink: sink}
+	go n.run()
+	return n
+}
+
+// notify queues an event without blocking. Safe to call while holding uc.mu.
+func (n *evictNotifier) notify(userID, key string, reason EvictReason) {
+	if n == nil {
+		return
+	}
+	select {
+	case n.ch <- evictEvent{userID: userID, key: key, reason: reason}:
+	default:
+		n.dropped.Add(1)
+		n.sink.IncrCounter(MetricEvictEventsDropped, 1)
+	}
+}
+
+func (n *evictNotifier) run() {
+	for ev := range n.ch {
+		n.call(ev)
+	}
+}
+
+// call runs the callback, recovering from a panic so one bad event doesn't stop delivery.
+func (n *evictNotifier) call(ev evictEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[cache] OnEvict panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	n.fn(ev.userID, ev.key, ev.reason)
+}
+
+// DroppedEvictEvents returns how many OnEvict events were dropped because the
+// callback fell behind.
+func (c *Cache) DroppedEvictEvents() int64 {
+	if c.events == nil {
+		return 0
+	}
+	return c.events.dropped.Load()
+}
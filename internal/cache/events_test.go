@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOnEvictReasons(t *testing.T) {
+	type event struct {
+		user, key string
+		reason    EvictReason
+	}
+	events := make(chan event, 16)
+	c := newTestCache(t, func(cfg *Config) {
+		cfg.MaxEntries = 2
+		cfg.JanitorInterval = 10 * time.Millisecond
+		cfg.OnEvict = func(userID, key string, reason EvictReason) {
+			events <- event{userID, key, reason}
+		}
+	})
+
+	next := func() event {
+		t.Helper()
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(2 * time.Second):
+			t.Fatal("no OnEvict event")
+			return event{}
+		}
+	}
+
+	c.Set("alice", "a", []byte("v"), 0, 0)
+	c.Set("alice", "b", []byte("v"), 0, 0)
+	c.Set("alice", "c", []byte("v"), 0, 0)
+	if ev := next(); ev != (event{"alice", "a", ReasonCapacity}) {
+		t.Fatalf("event = %+v, want a evicted for capacity", ev)
+	}
+
+	c.Delete("alice", "b")
+	if ev := next(); ev != (event{"alice", "b", ReasonDeleted}) {
+		t.Fatalf("event = %+v, want b deleted", ev)
+	}
+	// deleting a missing key reports nothing
+	c.Delete("alice", "b")
+
+	c.Set("alice", "d", []byte("v"), 20*time.Millisecond, 0)
+	if ev := next(); ev != (event{"alice", "d", ReasonExpired}) {
+		t.Fatalf("event = %+v, want d expired", ev)
+	}
+
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestOnEvictSlowCallback checks that a blocked callback doesn't stall writes.
+func TestOnEvictSlowCallback(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	c := newTestCache(t, func(cfg *Config) {
+		cfg.MaxEntries = 1
+		cfg.OnEvict = func(string, string, EvictReason) { <-block }
+	})
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < evictQueueSize+100; i++ {
+			c.Set("alice", "k"+strconv.Itoa(i), []byte("v"), 0, 0)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked on OnEvict")
+	}
+	if c.DroppedEvictEvents() == 0 {
+		t.Fatal("expected dropped events once the queue filled")
+	}
+}
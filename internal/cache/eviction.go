@@ -0,0 +1,166 @@
+package cache
+
+import "container/list"
+
+// EvictionPolicy selects which of a user's keys is evicted when the user is over
+// MaxEntries or is picked by the global byte budget.
+type EvictionPolicy string
+
+const (
+	// EvictLRU evicts the least recently used key (default).
+	EvictLRU EvictionPolicy = "lru"
+	// EvictLFU evicts the least frequently used key; ties go to the least recently used.
+	// Suits skewed workloads where a few hot keys should survive bursts of one-off keys.
+	EvictLFU EvictionPolicy = "lfu"
+	// EvictRandom evicts an arbitrary key. No per-access bookkeeping at all.
+	EvictRandom EvictionPolicy = "random"
+)
+
+// evictor picks eviction victims for one user. The LRU list is kept whatever the
+// policy (it also orders global "oldest" eviction and snapshot restores); policies
+// keep their own bookkeeping on top through these hooks. Caller must hold uc.mu lock.
+type evictor interface {
+	inserted(key string) // new key, or an existing key written again
+	accessed(key string) // read or overwrite of an existing key
+	removed(key string)
+	victim() (string, bool)
+}
+
+func newEvictor(uc *UserCache) evictor {
+	switch uc.cfg.EvictionPolicy {
+	case EvictLFU:
+		return newLFUEvictor()
+	case EvictRandom:
+		return randomEvictor{uc: uc}
+	default:
+		return lruEvictor{uc: uc}
+	}
+}
+
+// resetEvictorLocked rebuilds the policy state after items or the LRU list were
+// replaced wholesale (restore, flush, invariant repair). Access counts start over.
+// Caller must hold uc.mu lock.
+func (uc *UserCache) resetEvictorLocked() {
+	uc.evict = newEvictor(uc)
+	// oldest first, so LFU ties still fall back to recency
+	for el := uc.lruList.Back(); el != nil; el = el.Prev() {
+		uc.evict.inserted(el.Value.(*lruEntry).key)
+	}
+}
+
+// lruEvictor uses the UserCache's own LRU list.
+type lruEvictor struct {
+	uc *UserCache
+}
+
+func (lruEvictor) inserted(string) {}
+func (lruEvictor) accessed(string) {}
+func (lruEvictor) removed(string)  {}
+
+func (e lruEvictor) victim() (string, bool) {
+	back := e.uc.lruList.Back()
+	if back == nil {
+		return "", false
+	}
+	return back.Value.(*lruEntry).key, true
+}
+
+// randomEvictor evicts whichever key map iteration yields first; Go starts map
+// iteration at a random position, which is random enough for eviction.
+type randomEvictor struct {
+	uc *UserCache
+}
+
+func (randomEvictor) inserted(string) {}
+func (randomEvictor) accessed(string) {}
+func (randomEvictor) removed(string)  {}
+
+func (e randomEvictor) victim() (string, bool) {
+	for k := range e.uc.items {
+		return k, true
+	}
+	return "", false
+}
+
+// lfuEvictor keeps keys in per-count buckets so every hook and victim are O(1):
+// a key moves from bucket n to n+1 on access, and the victim is the least recently
+// bumped key of the lowest non-empty bucket.
+type lfuEvictor struct {
+	counts  map[string]uint64
+	elems   map[string]*list.Element
+	buckets map[uint64]*list.List // count -> keys, front = most recently bumped
+	min     uint64                // lowest count with a bucket (may be stale after removals)
+}
+
+func newLFUEvictor() *lfuEvictor {
+	return &lfuEvictor{
+		counts:  make(map[string]uint64),
+		elems:   make(map[string]*list.Element),
+		buckets: make(map[uint64]*list.List),
+	}
+}
+
+func (e *lfuEvictor) inserted(key string) {
+	if _, ok := e.counts[key]; ok {
+		e.accessed(key)
+		return
+	}
+	e.push(key, 1)
+	e.min = 1
+}
+
+func (e *lfuEvictor) accessed(key string) {
+	n, ok := e.counts[key]
+	if !ok {
+		return
+	}
+	e.unlink(key, n)
+	if e.min == n && e.buckets[n] == nil {
+		e.min = n + 1
+	}
+	e.push(key, n+1)
+}
+
+func (e *lfuEvictor) removed(key string) {
+	if n, ok := e.counts[key]; ok {
+		e.unlink(key, n)
+		delete(e.counts, key)
+	}
+}
+
+func (e *lfuEvictor) victim() (string, bool) {
+	if len(e.counts) == 0 {
+		return "", false
+	}
+	b := e.buckets[e.min]
+	if b == nil {
+		// the lowest bucket emptied through removals; find the new minimum
+		first := true
+		for n := range e.buckets {
+			if first || n < e.min {
+				e.min, first = n, false
+			}
+		}
+		b = e.buckets[e.min]
+	}
+	return b.Back().Value.(string), true
+}
+
+func (e *lfuEvictor) push(key string, n uint64) {
+	b := e.buckets[n]
+	if b == nil {
+		b = list.New()
+		e.buckets[n] = b
+	}
+	e.counts[key] = n
+	e.elems[key] = b.PushFront(key)
+}
+
+func (e *lfuEvictor) unlink(key string, n uint64) {
+	b := e.buckets[n]
+	b.Remove(e.elems[key])
+	delete(e.elems, key)
+	if b.Len() == 0 {
+		delete(e.buckets, n)
+	}
+}
@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"math/rand"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestEvictionPolicies(t *testing.T) {
+	tests := []struct {
+		policy EvictionPolicy
+		want   []string // possible victims when d is added
+	}{
+		{policy: EvictLRU, want: []string{"a"}},                   // a is read most but least recently
+		{policy: EvictLFU, want: []string{"b"}},                   // b and c tie on reads; b is older
+		{policy: EvictRandom, want: []string{"a", "b", "c", "d"}}, // the new key too
+		{policy: "", want: []string{"a"}},                         // unset means LRU
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			c := newTestCache(t, func(cfg *Config) {
+				cfg.MaxEntries = 3
+				cfg.EvictionPolicy = tt.policy
+			})
+			c.Set("alice", "a", []byte("v"), 0, 0)
+			mustGet(t, c, "alice", "a")
+			c.Set("alice", "b", []byte("v"), 0, 0)
+			c.Set("alice", "c", []byte("v"), 0, 0)
+			mustGet(t, c, "alice", "c")
+			c.Set("alice", "d", []byte("v"), 0, 0)
+
+			keys, _ := c.ListKeys("alice")
+			if len(keys) != 3 {
+				t.Fatalf("keys = %v, want 3", keys)
+			}
+			var evicted []string
+			for _, k := range []string{"a", "b", "c", "d"} {
+				if !slices.Contains(keys, k) {
+					evicted = append(evicted, k)
+				}
+			}
+			if len(evicted) != 1 || !slices.Contains(tt.want, evicted[0]) {
+				t.Fatalf("evicted %v, want one of %v", evicted, tt.want)
+			}
+			if rep := c.getUser("alice").checkInvariants(false); !rep.OK() {
+				t.Fatalf("lru drift: %+v", rep)
+			}
+		})
+	}
+}
+
+// TestLFUEvictsColdNewcomer pins plain LFU semantics: a new key starts at one access,
+// so it is the victim when every existing key has been read.
+func TestLFUEvictsColdNewcomer(t *testing.T) {
+	c := newTestCache(t, func(cfg *Config) {
+		cfg.MaxEntries = 2
+		cfg.EvictionPolicy = EvictLFU
+	})
+	for _, k := range []string{"a", "b"} {
+		c.Set("alice", k, []byte("v"), 0, 0)
+		mustGet(t, c, "alice", k)
+	}
+	c.Set("alice", "new", []byte("v"), 0, 0)
+	if keys, _ := c.ListKeys("alice"); len(keys) != 2 || slices.Contains(keys, "new") {
+		t.Fatalf("keys = %v, want a and b", keys)
+	}
+}
+
+// TestLFUAfterRestore checks that a restore rebuilds LFU state for the restored keys,
+// oldest timestamp first, so the oldest unread key is evicted.
+func TestLFUAfterRestore(t *testing.T) {
+	c := newTestCache(t, func(cfg *Config) {
+		cfg.MaxEntries = 2
+		cfg.EvictionPolicy = EvictLFU
+	})
+	snap := &UserSnapshot{UserID: "alice", Items: []PersistedItem{
+		{Key: "old", Value: []byte("v"), Timestamp: 1},
+		{Key: "new", Value: []byte("v"), Timestamp: 2},
+	}}
+	if err := c.RestoreUserFromSnapshot(snap); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	mustGet(t, c, "alice", "new")
+	c.Set("alice", "extra", []byte("v"), 0, 0)
+	if _, err := c.Peek("alice", "old"); err == nil {
+		t.Fatalf("old survived; restored keys are missing from the LFU state")
+	}
+}
+
+// BenchmarkEvictionZipf reports the hit rate of each policy on a Zipfian key workload
+// with read-through on miss.
+func BenchmarkEvictionZipf(b *testing.B) {
+	for _, policy := range []EvictionPolicy{EvictLRU, EvictLFU, EvictRandom} {
+		b.Run(string(policy), func(b *testing.B) {
+			cfg := DefaultConfig()
+			cfg.MaxEntries = 100
+			cfg.DataDir = b.TempDir()
+			cfg.EvictionPolicy = policy
+			c := NewCache(cfg)
+
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, 10000)
+			var hits int
+			for i := 0; i < b.N; i++ {
+				key := strconv.FormatUint(zipf.Uint64(), 10)
+				if _, err := c.Get("alice", key); err == nil {
+					hits++
+					continue
+				}
+				c.Set("alice", key, []byte("v"), 0, 0)
+			}
+			b.ReportMetric(float64(hits)/float64(b.N), "hit-rate")
+		})
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	c := newTestCache(t, func(cfg *Config) { cfg.MaxBytes = 10 })
+	set := func(key, value string) {
+		t.Helper()
+		if _, err := c.Set("alice", key, []byte(value), 0, 0); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+	// check compares the user's keys, byte count and evictions, and the cache-wide
+	// byte count
+	check := func(step string, wantKeys []string, wantBytes, wantEvictions int64) {
+		t.Helper()
+		keys, _ := c.ListKeys("alice")
+		slices.Sort(keys)
+		st, err := c.UserStats("alice")
+		if err != nil {
+			t.Fatalf("%s: stats: %v", step, err)
+		}
+		if !slices.Equal(keys, wantKeys) || st.Bytes != wantBytes || st.Evictions != wantEvictions || c.Bytes() != wantBytes {
+			t.Fatalf("%s: keys %v, bytes %d (cache %d), evictions %d; want %v, %d, %d",
+				step, keys, st.Bytes, c.Bytes(), st.Evictions, wantKeys, wantBytes, wantEvictions)
+		}
+		if st.MaxBytes != 10 {
+			t.Fatalf("%s: stats max_bytes = %d, want 10", step, st.MaxBytes)
+		}
+		if rep := c.getUser("alice").checkInvariants(false); !rep.OK() {
+			t.Fatalf("%s: drift: %+v", step, rep)
+		}
+	}
+
+	set("a", "aaaa")
+	set("b", "bbbb")
+	check("two keys", []string{"a", "b"}, 8, 0)
+
+	set("a", "aa")
+	check("overwrite shrinks", []string{"a", "b"}, 6, 0)
+
+	set("b", "bbbbbbbb")
+	check("overwrite grows to the limit", []string{"a", "b"}, 10, 0)
+
+	set("c", "c")
+	check("new key over the limit evicts the LRU key", []string{"b", "c"}, 9, 1)
+
+	set("c", "ccccc")
+	check("overwrite over the limit evicts", []string{"c"}, 5, 2)
+
+	if _, err := c.Set("alice", "d", []byte("ddddddddddd"), 0, 0); err != ErrValueTooLarge {
+		t.Fatalf("11-byte value: err = %v, want ErrValueTooLarge", err)
+	}
+	if _, err := c.Set("alice", "c", []byte("ccccccccccc"), 0, 0); err != ErrValueTooLarge {
+		t.Fatalf("11-byte overwrite: err = %v, want ErrValueTooLarge", err)
+	}
+	check("too large values change nothing", []string{"c"}, 5, 2)
+	if got := mustGet(t, c, "alice", "c"); got != "ccccc" {
+		t.Fatalf("c = %q after a rejected overwrite", got)
+	}
+
+	if _, err := c.GetSet("alice", "c", []byte("cc"), 0); err != nil {
+		t.Fatalf("getset: %v", err)
+	}
+	check("getset shrinks", []string{"c"}, 2, 2)
+
+	if _, err := c.Incr("alice", "n", 1000); err != nil {
+		t.Fatalf("incr: %v", err)
+	}
+	check("incr counts its digits", []string{"c", "n"}, 6, 2)
+
+	if err := c.Expire("alice", "n", 0); err != nil {
+		t.Fatalf("expire: %v", err)
+	}
+	check("expiry", []string{"c"}, 2, 2)
+
+	if err := c.Delete("alice", "c"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	check("delete", []string{}, 0, 2)
+}
@@ -0,0 +1,71 @@
+package cache
+
+import "sort"
+
+// enforceGlobalBudget evicts entries until the total size is within GlobalMaxBytes,
+// choosing victim users according to GlobalEvictionPolicy.
+func (c *Cache) enforceGlobalBudget() {
+	defer func() { c.cfg.MetricsSink.SetGauge(MetricBytes, float64(c.bytes.Load())) }()
+	if c.cfg.GlobalMaxBytes <= 0 || c.bytes.Load() <= c.cfg.GlobalMaxBytes {
+		return
+	}
+
+	c.evictMu.Lock()
+	defer c.evictMu.Unlock()
+
+	for c.bytes.Load() > c.cfg.GlobalMaxBytes {
+		users := c.usersSnapshot()
+		victim := c.pickVictim(users)
+		if victim == nil || !victim.evictOne() {
+			return
+		}
+	}
+}
+
+// pickVictim returns the user to evict from next, or nil if no user has entries.
+// Caller must hold c.evictMu.
+func (c *Cache) pickVictim(users map[string]*UserCache) *UserCache {
+	switch c.cfg.GlobalEvictionPolicy {
+	case GlobalEvictLargest:
+		var victim *UserCache
+		var most int64
+		for _, uc := range users {
+			if used := uc.usage(); used > most {
+				victim, most = uc, used
+			}
+		}
+		return victim
+
+	case GlobalEvictRoundRobin:
+		ids := make([]string, 0, len(users))
+		for id := range users {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		// start after the last victim and wrap around
+		start := sort.SearchStrings(ids, c.rrCursor)
+		if start < len(ids) && ids[start] == c.rrCursor {
+			start++
+		}
+		for i := 0; i < len(ids); i++ {
+			id := ids[(start+i)%len(ids)]
+			if uc := users[id]; uc.usage() > 0 {
+				c.rrCursor = id
+				return uc
+			}
+		}
+		return nil
+
+	default: // GlobalEvictOldest
+		var victim *UserCache
+		var oldest int64
+		for _, uc := range users {
+			ts, ok := uc.tailTimestamp()
+			if ok && (victim == nil || ts < oldest) {
+				victim, oldest = uc, ts
+			}
+		}
+		return victim
+	}
+}
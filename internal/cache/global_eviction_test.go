@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestGlobalEvictionPolicies(t *testing.T) {
+	// "small" writes two 10-byte values first, then "big" fills the rest of the
+	// 100-byte budget and writes two more, forcing two evictions
+	tests := []struct {
+		policy    GlobalEvictionPolicy
+		wantSmall []string
+		wantBig   []string
+	}{
+		{policy: GlobalEvictOldest, wantSmall: nil, wantBig: keyRange("b", 1, 10)},
+		{policy: GlobalEvictLargest, wantSmall: []string{"s1", "s2"}, wantBig: keyRange("b", 3, 10)},
+		{policy: GlobalEvictRoundRobin, wantSmall: []string{"s2"}, wantBig: keyRange("b", 2, 10)},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			c := newTestCache(t, func(cfg *Config) {
+				cfg.GlobalMaxBytes = 100
+				cfg.GlobalEvictionPolicy = tt.policy
+			})
+			set := func(user, key string) {
+				if _, err := c.Set(user, key, []byte("0123456789"), 0, 0); err != nil {
+					t.Fatalf("set %s/%s: %v", user, key, err)
+				}
+			}
+			for _, k := range keyRange("s", 1, 2) {
+				set("small", k)
+			}
+			for _, k := range keyRange("b", 1, 10) {
+				set("big", k)
+			}
+
+			if got := c.Bytes(); got != 100 {
+				t.Fatalf("total bytes = %d, want the 100-byte budget", got)
+			}
+			for user, want := range map[string][]string{"small": tt.wantSmall, "big": tt.wantBig} {
+				got, _ := c.ListKeys(user)
+				slices.Sort(got)
+				slices.Sort(want)
+				if !slices.Equal(got, want) {
+					t.Fatalf("%s keeps %v, want %v", user, got, want)
+				}
+			}
+		})
+	}
+}
+
+// keyRange returns prefix+from .. prefix+to.
+func keyRange(prefix string, from, to int) []string {
+	var out []string
+	for i := from; i <= to; i++ {
+		out = append(out, fmt.Sprintf("%s%d", prefix, i))
+	}
+	return out
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"container/list"
+	"log"
+)
+
+// InvariantReport describes how a user's LRU index had drifted from its items map.
+type InvariantReport struct {
+	Items       int      `json:"items"`
+	LRUElements int      `json:"lru_elements"`
+	MissingLRU  []string `json:"missing_lru,omitempty"` // items without an LRU element
+	OrphanLRU   []string `json:"orphan_lru,omitempty"`  // LRU elements without an item
+	Duplicates  []string `json:"duplicates,omitempty"`  // keys with more than one LRU element
+	StaleMap    []string `json:"stale_map,omitempty"`   // lruMap entries not pointing at the key's list element
+	Repaired    bool     `json:"repaired"`
+}
+
+// OK reports whether no drift was found.
+func (r InvariantReport) OK() bool {
+	return len(r.MissingLRU) == 0 && len(r.OrphanLRU) == 0 && len(r.Duplicates) == 0 && len(r.StaleMap) == 0
+}
+
+// checkInvariants verifies that every item has exactly one LRU element and every LRU
+// element belongs to an item. With repair it rebuilds the LRU from the items map,
+// keeping the recency order of valid elements and putting unindexed items at the tail.
+func (uc *UserCache) checkInvariants(repair bool) InvariantReport {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	rep := InvariantReport{Items: len(uc.items), LRUElements: uc.lruList.Len()}
+
+	seen := make(map[string]*list.Element, len(uc.items))
+	for el := uc.lruList.Front(); el != nil; el = el.Next() {
+		key := el.Value.(*lruEntry).key
+		if _, dup := seen[key]; dup {
+			rep.Duplicates = append(rep.Duplicates, key)
+			continue
+		}
+		seen[key] = el
+		if _, ok := uc.items[key]; !ok {
+			rep.OrphanLRU = append(rep.OrphanLRU, key)
+		}
+		if uc.lruMap[key] != el {
+			rep.StaleMap = append(rep.StaleMap, key)
+		}
+	}
+	for key := range uc.lruMap {
+		if _, ok := seen[key]; !ok {
+			rep.StaleMap = append(rep.StaleMap, key)
+		}
+	}
+	for key := range uc.items {
+		if _, ok := seen[key]; !ok {
+			rep.MissingLRU = append(rep.MissingLRU, key)
+		}
+	}
+
+	if repair && !rep.OK() {
+		uc.rebuildLRULocked()
+		rep.Repaired = true
+	}
+	return rep
+}
+
+// rebuildLRULocked recreates lruList and lruMap from the items map, and the eviction
+// policy state from them. Caller must hold uc.mu lock.
+func (uc *UserCache) rebuildLRULocked() {
+	oldList := uc.lruList
+	uc.lruList = list.New()
+	uc.lruMap = make(map[string]*list.Element, len(uc.items))
+
+	for el := oldList.Front(); el != nil; el = el.Next() {
+		key := el.Value.(*lruEntry).key
+		if _, ok := uc.items[key]; !ok {
+			continue
+		}
+		if _, dup := uc.lruMap[key]; dup {
+			continue
+		}
+		uc.lruMap[key] = uc.lruList.PushBack(&lruEntry{key: key})
+	}
+	for key := range uc.items {
+		if _, ok := uc.lruMap[key]; !ok {
+			uc.lruMap[key] = uc.lruList.PushBack(&lruEntry{key: key})
+		}
+	}
+	uc.resetEvictorLocked()
+}
+
+// CheckInvariants runs the LRU/map consistency check for every user and returns the
+// reports of users with drift. With repair, drifted users are rebuilt.
+func (c *Cache) CheckInvariants(repair bool) map[string]InvariantReport {
+	out := make(map[string]InvariantReport)
+	for userID, uc := range c.usersSnapshot() {
+		if rep := uc.checkInvariants(repair); !rep.OK() {
+			log.Printf("[cache] lru drift for user %s: %d missing, %d orphan, %d duplicate, %d stale (repaired=%v)",
+				userID, len(rep.MissingLRU), len(rep.OrphanLRU), len(rep.Duplicates), len(rep.StaleMap), rep.Repaired)
+			out[userID] = rep
+		}
+	}
+	return out
+}
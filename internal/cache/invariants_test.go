@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCheckInvariants(t *testing.T) {
+	tests := []struct {
+		name   string
+		desync func(uc *UserCache) // called with uc.mu held
+		check  func(rep InvariantReport) []string
+	}{
+		{
+			name: "missing lru element",
+			desync: func(uc *UserCache) {
+				uc.lruList.Remove(uc.lruMap["b"])
+				delete(uc.lruMap, "b")
+			},
+			check: func(rep InvariantReport) []string { return rep.MissingLRU },
+		},
+		{
+			name: "orphan lru element",
+			desync: func(uc *UserCache) {
+				uc.lruMap["ghost"] = uc.lruList.PushFront(&lruEntry{key: "ghost"})
+			},
+			check: func(rep InvariantReport) []string { return rep.OrphanLRU },
+		},
+		{
+			name: "duplicate lru element",
+			desync: func(uc *UserCache) {
+				uc.lruList.PushBack(&lruEntry{key: "a"})
+			},
+			check: func(rep InvariantReport) []string { return rep.Duplicates },
+		},
+		{
+			name: "stale map entry",
+			desync: func(uc *UserCache) {
+				uc.lruMap["c"] = uc.lruMap["a"]
+			},
+			check: func(rep InvariantReport) []string { return rep.StaleMap },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			for _, k := range []string{"a", "b", "c"} {
+				if _, err := c.Set("alice", k, []byte("v"), 0, 0); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+			}
+			uc := c.getUser("alice")
+			if rep := uc.checkInvariants(false); !rep.OK() {
+				t.Fatalf("fresh user drifted: %+v", rep)
+			}
+
+			uc.mu.Lock()
+			tt.desync(uc)
+			uc.mu.Unlock()
+
+			// detection alone leaves the drift in place
+			if rep := uc.checkInvariants(false); rep.OK() || rep.Repaired || len(tt.check(rep)) == 0 {
+				t.Fatalf("check = %+v, want drift reported and not repaired", rep)
+			}
+			reports := c.CheckInvariants(true)
+			rep, ok := reports["alice"]
+			if !ok || !rep.Repaired || len(tt.check(rep)) == 0 {
+				t.Fatalf("repair reports = %+v", reports)
+			}
+			if again := uc.checkInvariants(false); !again.OK() || again.Items != 3 || again.LRUElements != 3 {
+				t.Fatalf("after repair: %+v, want 3 items with 3 lru elements", again)
+			}
+
+			// every key can still be evicted through the rebuilt index
+			var evicted []string
+			uc.mu.Lock()
+			for uc.lruList.Len() > 0 {
+				key := uc.lruList.Back().Value.(*lruEntry).key
+				evicted = append(evicted, key)
+				uc.removeItem(key, ReasonCapacity)
+			}
+			uc.mu.Unlock()
+			slices.Sort(evicted)
+			if !slices.Equal(evicted, []string{"a", "b", "c"}) {
+				t.Fatalf("evicted %v, want a, b and c", evicted)
+			}
+		})
+	}
+}
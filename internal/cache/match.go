@@ -0,0 +1,46 @@
+package cache
+
+// matchGlob reports whether key matches pattern, where '*' matches any run of
+// characters (including none) and '?' matches exactly one. Unlike path.Match, '/' is
+// an ordinary character and there are no character classes, so keys like "a/b" match
+// "a*". A backslash escapes the next character.
+func matchGlob(pattern, key string) bool {
+	p, k := []rune(pattern), []rune(key)
+	// position to resume from after the last '*': backtrack there on mismatch
+	starP, starK := -1, 0
+	i, j := 0, 0
+	for j < len(k) {
+		if i < len(p) {
+			switch c := p[i]; {
+			case c == '*':
+				starP, starK = i, j
+				i++
+				continue
+			case c == '?':
+				i++
+				j++
+				continue
+			case c == '\\' && i+1 < len(p):
+				if p[i+1] == k[j] {
+					i += 2
+					j++
+					continue
+				}
+			case c == k[j]:
+				i++
+				j++
+				continue
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		// let the last '*' swallow one more character
+		starK++
+		i, j = starP+1, starK
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"strconv"
+	"time"
+)
+
+// DefaultMerkleDepth gives 256 leaf buckets, enough to keep per-bucket digests small
+// for users with a few hundred thousand keys.
+const DefaultMerkleDepth = 8
+
+// MaxMerkleDepth bounds the tree size a caller can request (2^16 leaves).
+const MaxMerkleDepth = 16
+
+// MerkleTree is a fixed-shape hash tree over a user's (key, timestamp) pairs.
+// Levels[0] holds the root, Levels[Depth] the 2^Depth leaf buckets. Keys land in a
+// bucket by hash, so two nodes with the same depth can compare level by level and
+// only fetch the keys of buckets whose hashes differ.
+type MerkleTree struct {
+	Depth  int        `json:"depth"`
+	Levels [][]uint64 `json:"levels"`
+}
+
+// Root returns the tree's root hash.
+func (t *MerkleTree) Root() uint64 {
+	return t.Levels[0][0]
+}
+
+// DiffBuckets returns the leaf buckets whose hashes differ from other's leaves.
+// Both trees must have the same depth.
+func (t *MerkleTree) DiffBuckets(leaves []uint64) []int {
+	mine := t.Levels[t.Depth]
+	var out []int
+	for i := range mine {
+		if i >= len(leaves) || mine[i] != leaves[i] {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// MerkleBucket returns the leaf bucket for key in a tree of the given depth.
+func MerkleBucket(key string, depth int) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() >> (64 - uint(depth)))
+}
+
+func clampMerkleDepth(depth int) int {
+	if depth <= 0 {
+		return DefaultMerkleDepth
+	}
+	if depth > MaxMerkleDepth {
+		return MaxMerkleDepth
+	}
+	return depth
+}
+
+// leafEntryHash hashes one (key, timestamp) pair. Leaves XOR these together so the
+// result doesn't depend on map iteration order.
+func leafEntryHash(key string, ts int64) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatInt(ts, 10)))
+	return h.Sum64()
+}
+
+func parentHash(left, right uint64) uint64 {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], left)
+	binary.BigEndian.PutUint64(buf[8:], right)
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return h.Sum64()
+}
+
+// merkle builds the tree over live keys.
+func (uc *UserCache) merkle(depth int) *MerkleTree {
+	now := time.Now()
+	leaves := make([]uint64, 1<<uint(depth))
+
+	uc.mu.RLock()
+	for k, v := range uc.items {
+		if !v.isExpired(now) {
+			leaves[MerkleBucket(k, depth)] ^= leafEntryHash(k, v.Timestamp)
+		}
+	}
+	uc.mu.RUnlock()
+
+	levels := make([][]uint64, depth+1)
+	levels[depth] = leaves
+	for d := depth - 1; d >= 0; d-- {
+		below := levels[d+1]
+		cur := make([]uint64, len(below)/2)
+		for i := range cur {
+			cur[i] = parentHash(below[2*i], below[2*i+1])
+		}
+		levels[d] = cur
+	}
+	return &MerkleTree{Depth: depth, Levels: levels}
+}
+
+// digestBucket is digest restricted to keys in one leaf bucket.
+func (uc *UserCache) digestBucket(depth, bucket int) map[string]int64 {
+	now := time.Now()
+
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+
+	out := make(map[string]int64)
+	for k, v := range uc.items {
+		if !v.isExpired(now) && MerkleBucket(k, depth) == bucket {
+			out[k] = v.Timestamp
+		}
+	}
+	return out
+}
+
+// Merkle returns the user's hash tree. depth <= 0 uses DefaultMerkleDepth; larger
+// values are capped at MaxMerkleDepth.
+func (c *Cache) Merkle(userID string, depth int) (*MerkleTree, error) {
+	uc := c.getUser(userID)
+	if uc == nil {
+		return nil, ErrUserNotFound
+	}
+	return uc.merkle(clampMerkleDepth(depth)), nil
+}
+
+// EmptyMerkle returns the tree of a user with no keys, for comparing against unknown users.
+func EmptyMerkle(depth int) *MerkleTree {
+	return (&UserCache{}).merkle(clampMerkleDepth(depth))
+}
+
+// DigestBucket returns key -> timestamp for the keys that fall in one leaf bucket.
+func (c *Cache) DigestBucket(userID string, depth, bucket int) (map[string]int64, error) {
+	uc := c.getUser(userID)
+	if uc == nil {
+		return nil, ErrUserNotFound
+	}
+	return uc.digestBucket(clampMerkleDepth(depth), bucket), nil
+}
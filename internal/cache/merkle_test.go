@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestMerkleDiff(t *testing.T) {
+	const depth = 6
+	tests := []struct {
+		name   string
+		change func(c *Cache) // applied to the second cache only
+		key    string         // the key whose bucket should differ; "" for none
+	}{
+		{name: "identical", change: func(c *Cache) {}},
+		{
+			name:   "newer write",
+			change: func(c *Cache) { c.Set("alice", "k17", []byte("new"), 0, 999) },
+			key:    "k17",
+		},
+		{
+			name:   "missing key",
+			change: func(c *Cache) { c.Delete("alice", "k3") },
+			key:    "k3",
+		},
+		{
+			name:   "extra key",
+			change: func(c *Cache) { c.Set("alice", "extra", []byte("v"), 0, 1) },
+			key:    "extra",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newTestCache(t), newTestCache(t)
+			for i := 0; i < 200; i++ {
+				key := "k" + strconv.Itoa(i)
+				a.Set("alice", key, []byte("v"), 0, int64(i+1))
+				b.Set("alice", key, []byte("v"), 0, int64(i+1))
+			}
+			tt.change(b)
+
+			ta, err := a.Merkle("alice", depth)
+			if err != nil {
+				t.Fatalf("merkle: %v", err)
+			}
+			tb, err := b.Merkle("alice", depth)
+			if err != nil {
+				t.Fatalf("merkle: %v", err)
+			}
+
+			diff := ta.DiffBuckets(tb.Levels[depth])
+			if tt.key == "" {
+				if ta.Root() != tb.Root() || len(diff) != 0 {
+					t.Fatalf("identical users differ: roots %x/%x, buckets %v", ta.Root(), tb.Root(), diff)
+				}
+				return
+			}
+			bucket := MerkleBucket(tt.key, depth)
+			if !slices.Equal(diff, []int{bucket}) {
+				t.Fatalf("differing buckets = %v, want [%d]", diff, bucket)
+			}
+			// only the path from that leaf to the root differs
+			for d := depth; d >= 0; d-- {
+				node := bucket >> uint(depth-d)
+				for i := range ta.Levels[d] {
+					if same := ta.Levels[d][i] == tb.Levels[d][i]; same == (i == node) {
+						t.Fatalf("level %d node %d: equal = %v", d, i, same)
+					}
+				}
+			}
+
+			keys, err := b.DigestBucket("alice", depth, bucket)
+			if err != nil {
+				t.Fatalf("digest bucket: %v", err)
+			}
+			for k := range keys {
+				if MerkleBucket(k, depth) != bucket {
+					t.Fatalf("bucket %d digest holds %s from bucket %d", bucket, k, MerkleBucket(k, depth))
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyMerkle(t *testing.T) {
+	c := newTestCache(t)
+	c.CreateUser("alice")
+	tree, err := c.Merkle("alice", 0)
+	if err != nil {
+		t.Fatalf("merkle: %v", err)
+	}
+	if tree.Depth != DefaultMerkleDepth || tree.Root() != EmptyMerkle(0).Root() {
+		t.Fatalf("empty user tree depth %d root %x, want depth %d root %x", tree.Depth, tree.Root(), DefaultMerkleDepth, EmptyMerkle(0).Root())
+	}
+	if _, err := c.Merkle("bob", 0); err != ErrUserNotFound {
+		t.Fatalf("unknown user err = %v, want ErrUserNotFound", err)
+	}
+	if deep := EmptyMerkle(MaxMerkleDepth + 4); deep.Depth != MaxMerkleDepth {
+		t.Fatalf("depth not capped: %d", deep.Depth)
+	}
+}
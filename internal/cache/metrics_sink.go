@@ -0,0 +1,34 @@
+package cache
+
+import "time"
+
+// MetricsSink receives metrics at instrumentation points in the cache and server, so
+// they can be forwarded to StatsD, OpenTelemetry or a custom system. Implementations
+// must be safe for concurrent use and should not block.
+type MetricsSink interface {
+	IncrCounter(name string, delta int64)
+	ObserveLatency(name string, d time.Duration)
+	SetGauge(name string, value float64)
+}
+
+// NopSink discards all metrics. It is the default.
+type NopSink struct{}
+
+func (NopSink) IncrCounter(string, int64)            {}
+func (NopSink) ObserveLatency(string, time.Duration) {}
+func (NopSink) SetGauge(string, float64)             {}
+
+// Metric names reported by the cache.
+const (
+	MetricHits      = "cache.hits"
+	MetricMisses    = "cache.misses"
+	MetricEvictions = "cache.evictions" // MaxEntries and global-budget evictions
+	MetricExpired   = "cache.expired"   // keys removed by the janitor
+	MetricBytes     = "cache.bytes"     // gauge: total value bytes
+	MetricUsers     = "cache.users"     // gauge: number of users
+)
+
+// MetricsSink returns the configured sink (NopSink when unset).
+func (c *Cache) MetricsSink() MetricsSink {
+	return c.cfg.MetricsSink
+}
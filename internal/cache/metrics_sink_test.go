@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink keeps counters and gauges; the cache itself observes no latencies.
+type recordingSink struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	gauges   map[string]float64
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{counters: map[string]int64{}, gauges: map[string]float64{}}
+}
+
+func (r *recordingSink) IncrCounter(name string, delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] += delta
+}
+
+func (r *recordingSink) ObserveLatency(string, time.Duration) {}
+
+func (r *recordingSink) SetGauge(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gauges[name] = value
+}
+
+func (r *recordingSink) counter(name string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counters[name]
+}
+
+func (r *recordingSink) gauge(name string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.gauges[name]
+}
+
+func TestMetricsSink(t *testing.T) {
+	tests := []struct {
+		name       string
+		run        func(t *testing.T, c *Cache)
+		counters   map[string]int64
+		gauges     map[string]float64
+		maxEntries int
+	}{
+		{
+			name: "hit and miss",
+			run: func(t *testing.T, c *Cache) {
+				c.Set("alice", "k", []byte("v"), 0, 0)
+				c.Get("alice", "k")
+				c.Get("alice", "k")
+				c.Get("alice", "missing")
+			},
+			counters: map[string]int64{MetricHits: 2, MetricMisses: 1},
+			gauges:   map[string]float64{MetricUsers: 1, MetricBytes: 1},
+		},
+		{
+			name:       "lru eviction",
+			maxEntries: 2,
+			run: func(t *testing.T, c *Cache) {
+				for _, k := range []string{"a", "b", "c", "d"} {
+					c.Set("alice", k, []byte("vv"), 0, 0)
+				}
+			},
+			counters: map[string]int64{MetricEvictions: 2},
+			gauges:   map[string]float64{MetricUsers: 1, MetricBytes: 4},
+		},
+		{
+			name: "users gauge",
+			run: func(t *testing.T, c *Cache) {
+				c.Set("alice", "k", []byte("v"), 0, 0)
+				c.Set("bob", "k", []byte("v"), 0, 0)
+				c.Set("carol", "k", []byte("v"), 0, 0)
+				c.DeleteUser("bob")
+			},
+			gauges: map[string]float64{MetricUsers: 2},
+		},
+		{
+			name: "janitor expiry",
+			run: func(t *testing.T, c *Cache) {
+				c.Set("alice", "k1", []byte("v"), 10*time.Millisecond, 0)
+				c.Set("alice", "k2", []byte("v"), 10*time.Millisecond, 0)
+				time.Sleep(20 * time.Millisecond)
+				c.getUser("alice").sweep()
+			},
+			counters: map[string]int64{MetricExpired: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := newRecordingSink()
+			c := newTestCache(t, func(cfg *Config) {
+				cfg.MetricsSink = sink
+				cfg.MaxEntries = tt.maxEntries
+			})
+			tt.run(t, c)
+			for name, want := range tt.counters {
+				if got := sink.counter(name); got != want {
+					t.Errorf("%s = %d, want %d", name, got, want)
+				}
+			}
+			for name, want := range tt.gauges {
+				if got := sink.gauge(name); got != want {
+					t.Errorf("%s = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultMetricsSink(t *testing.T) {
+	c := newTestCache(t)
+	if _, ok := c.MetricsSink().(NopSink); !ok {
+		t.Fatalf("default sink = %T, want NopSink", c.MetricsSink())
+	}
+}
+
+// evictionCalls records each MetricEvictions increment separately.
+type evictionCalls struct {
+	NopSink
+	mu     sync.Mutex
+	deltas []int64
+}
+
+func (e *evictionCalls) IncrCounter(name string, delta int64) {
+	if name != MetricEvictions {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.deltas = append(e.deltas, delta)
+}
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math"
+	"sort"
+	"time"
+)
+
+// Scan cursors are positions in a 64-bit hash space rather than offsets into a
+// key list. Go maps have no stable order and the LRU list reorders on every read, so
+// each call hashes the live keys and returns the `count` smallest hashes at or after
+// the cursor; the next cursor is just past the largest one returned. Nothing is kept
+// between calls, and the guarantees match Redis SCAN: a key present for the whole scan
+// is returned exactly once, a key added or removed mid-scan may or may not be.
+
+func scanHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// hashHeap is a max-heap of hashes, used to keep the count smallest.
+type hashHeap []uint64
+
+func (h hashHeap) Len() int           { return len(h) }
+func (h hashHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h hashHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *hashHeap) Push(x any)        { *h = append(*h, x.(uint64)) }
+func (h *hashHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// scan returns up to count live keys (more only on hash ties) whose hash is >= cursor,
+// in hash order, and the cursor to resume from (0 once the keyspace is exhausted).
+// It runs in O(n log count) under the read lock without building a full key slice.
+func (uc *UserCache) scan(cursor uint64, count int) ([]string, uint64) {
+	now := time.Now()
+
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+
+	// first pass: the count smallest hashes at or after the cursor
+	h := make(hashHeap, 0, count)
+	for k, v := range uc.items {
+		if v.isExpired(now) {
+			continue
+		}
+		hv := scanHash(k)
+		if hv < cursor {
+			continue
+		}
+		if len(h) < count {
+			heap.Push(&h, hv)
+		} else if hv < h[0] {
+			h[0] = hv
+			heap.Fix(&h, 0)
+		}
+	}
+	if len(h) == 0 {
+		return nil, 0
+	}
+	last := h[0]
+
+	// second pass: every key up to the boundary, so colliding hashes aren't split
+	type entry struct {
+		hash uint64
+		key  string
+	}
+	entries := make([]entry, 0, len(h))
+	for k, v := range uc.items {
+		if v.isExpired(now) {
+			continue
+		}
+		if hv := scanHash(k); hv >= cursor && hv <= last {
+			entries = append(entries, entry{hv, k})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].hash != entries[j].hash {
+			return entries[i].hash < entries[j].hash
+		}
+		return entries[i].key < entries[j].key
+	})
+
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.key
+	}
+	if len(h) < count || last == math.MaxUint64 {
+		return keys, 0
+	}
+	return keys, last + 1
+}
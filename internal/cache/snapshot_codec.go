@@ -0,0 +1,257 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SnapshotFormat selects how snapshot files are encoded.
+type SnapshotFormat string
+
+const (
+	// SnapshotJSON writes indented JSON (user_<id>.json). Values are base64, so files
+	// are about a third larger than the data, but they are easy to inspect. Default.
+	SnapshotJSON SnapshotFormat = "json"
+	// SnapshotBinary writes length-prefixed binary records (user_<id>.bin): raw value
+	// bytes and no text parsing, so it is smaller and faster to encode and decode.
+	SnapshotBinary SnapshotFormat = "binary"
+)
+
+// snapshotCodec encodes one user's snapshot to a file body and back.
+type snapshotCodec interface {
+	encode(w io.Writer, snap *UserSnapshot) error
+	decode(r io.Reader) (*UserSnapshot, error)
+}
+
+func codecFor(format SnapshotFormat) snapshotCodec {
+	if format == SnapshotBinary {
+		return binaryCodec{}
+	}
+	return jsonCodec{}
+}
+
+// snapshotExts lists every snapshot file extension. Loads accept all of them, so the
+// format and compression settings can change without converting existing files.
+var snapshotExts = []string{".json", ".json.gz", ".bin", ".bin.gz"}
+
+// snapshotExt returns the extension snapshots are written with.
+func (c *Cache) snapshotExt() string {
+	ext := ".json"
+	if c.cfg.SnapshotFormat == SnapshotBinary {
+		ext = ".bin"
+	}
+	if c.cfg.CompressSnapshots {
+		ext += ".gz"
+	}
+	return ext
+}
+
+// snapshotPath returns dir/user_<userID><ext>.
+func snapshotPath(dir, userID, ext string) string {
+	return filepath.Join(dir, "user_"+userID+ext)
+}
+
+// tombstoneExt marks a user deleted after its snapshot was saved (see tombstoneUser).
+const tombstoneExt = ".deleted"
+
+// tombstonePath returns dir/user_<userID>.deleted.
+func tombstonePath(dir, userID string) string {
+	return filepath.Join(dir, "user_"+userID+tombstoneExt)
+}
+
+// snapshotFileExt returns the snapshot extension filename ends with, or "".
+func snapshotFileExt(filename string) string {
+	for _, ext := range snapshotExts {
+		if strings.HasSuffix(filename, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) encode(w io.Writer, snap *UserSnapshot) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snap)
+}
+
+func (jsonCodec) decode(r io.Reader) (*UserSnapshot, error) {
+	var snap UserSnapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// binaryMagic starts every binary snapshot (after gzip, if any). The last byte is the
+// format version: 1 had no checksum, 2 ends with one.
+var binaryMagic = []byte("DCSNAP\x00\x02")
+
+// isBinarySnapshot reports whether header starts with the magic of any binary version.
+func isBinarySnapshot(header []byte) bool {
+	n := len(binaryMagic) - 1
+	return len(header) > n && bytes.Equal(header[:n], binaryMagic[:n]) && header[n] >= 1 && header[n] <= binaryMagic[n]
+}
+
+// maxBinaryField bounds a single length-prefixed field, so a corrupt length can't
+// make decode allocate an absurd buffer.
+const maxBinaryField = 1 << 31
+
+// binaryCodec frames a snapshot as:
+//
+//	magic | uvarint len + user ID | uvarint item count |
+//	per item: uvarint len + key, uvarint len + value, varint expiry (UnixNano, 0 = none), varint timestamp |
+//	uint32 LE checksum (version 2)
+type binaryCodec struct{}
+
+func (binaryCodec) encode(w io.Writer, snap *UserSnapshot) error {
+	bw := bufio.NewWriterSize(w, 64<<10)
+	bw.Write(binaryMagic)
+	writeSnapshotBody(bw, snap)
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], checksumOf(snap))
+	bw.Write(sum[:])
+	// bufio keeps the first write error and returns it here
+	return bw.Flush()
+}
+
+// writeSnapshotBody writes everything between the magic and the checksum. Write
+// errors are left to the caller's bufio.Writer.
+func writeSnapshotBody(bw *bufio.Writer, snap *UserSnapshot) {
+	var scratch [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		bw.Write(scratch[:binary.PutUvarint(scratch[:], v)])
+	}
+	putVarint := func(v int64) {
+		bw.Write(scratch[:binary.PutVarint(scratch[:], v)])
+	}
+	putBytes := func(b []byte) {
+		putUvarint(uint64(len(b)))
+		bw.Write(b)
+	}
+
+	putBytes([]byte(snap.UserID))
+	putUvarint(uint64(len(snap.Items)))
+	for _, item := range snap.Items {
+		putBytes([]byte(item.Key))
+		putBytes(item.Value)
+		var expires int64
+		if !item.ExpiresAt.IsZero() {
+			expires = item.ExpiresAt.UnixNano()
+		}
+		putVarint(expires)
+		putVarint(item.Timestamp)
+	}
+}
+
+func (binaryCodec) decode(r io.Reader) (*UserSnapshot, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+
+	magic := make([]byte, len(binaryMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	}
+	if !isBinarySnapshot(magic) {
+		return nil, errors.New("bad magic header")
+	}
+	version := magic[len(magic)-1]
+
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if n > maxBinaryField {
+			return nil, fmt.Errorf("field length %d too large", n)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+
+	userID, err := readBytes()
+	if err != nil {
+		return nil, err
+	}
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &UserSnapshot{UserID: string(userID)}
+	// don't trust count for the allocation; a corrupt one would just fail below
+	snap.Items = make([]PersistedItem, 0, min(count, 1<<16))
+	for i := uint64(0); i < count; i++ {
+		key, err := readBytes()
+		if err != nil {
+			return nil, err
+		}
+		value, err := readBytes()
+		if err != nil {
+			return nil, err
+		}
+		expires, err := binary.ReadVarint(br)
+		if err != nil {
+			return nil, err
+		}
+		ts, err := binary.ReadVarint(br)
+		if err != nil {
+			return nil, err
+		}
+		item := PersistedItem{Key: string(key), Value: value, Timestamp: ts}
+		if expires != 0 {
+			item.ExpiresAt = time.Unix(0, expires)
+		}
+		snap.Items = append(snap.Items, item)
+	}
+
+	if version >= 2 {
+		var sum [4]byte
+		if _, err := io.ReadFull(br, sum[:]); err != nil {
+			return nil, err
+		}
+		snap.Checksum = formatChecksum(binary.LittleEndian.Uint32(sum[:]))
+	}
+	return snap, nil
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumOf returns the CRC-32C of the snapshot's contents (user ID and items, in
+// order), independent of the file format and compression it is stored with.
+func checksumOf(snap *UserSnapshot) uint32 {
+	h := crc32.New(castagnoli)
+	bw := bufio.NewWriterSize(h, 64<<10)
+	writeSnapshotBody(bw, snap)
+	bw.Flush() // a hash never fails to write
+	return h.Sum32()
+}
+
+func formatChecksum(sum uint32) string {
+	return fmt.Sprintf("%08x", sum)
+}
+
+// verifyChecksum returns ErrSnapshotCorrupt if snap carries a checksum that doesn't
+// match its contents. Snapshots written before checksums existed have none and pass.
+func verifyChecksum(snap *UserSnapshot) error {
+	if snap.Checksum == "" {
+		return nil
+	}
+	if got := formatChecksum(checksumOf(snap)); got != snap.Checksum {
+		return fmt.Errorf("%w: stored %s, computed %s", ErrSnapshotCorrupt, snap.Checksum, got)
+	}
+	return nil
+}
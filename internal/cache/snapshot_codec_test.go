@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSnapshotFormats(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	snap := &UserSnapshot{UserID: "alice", Items: []PersistedItem{
+		{Key: "a", Value: []byte("one"), Timestamp: 10},
+		{Key: "b", Value: []byte{0, 1, 2, 0xff}, ExpiresAt: expires, Timestamp: 20},
+		{Key: "", Value: []byte{}, Timestamp: 30},
+	}}
+
+	tests := []struct {
+		format   SnapshotFormat
+		compress bool
+		wantExt  string
+	}{
+		{format: "", wantExt: ".json"},
+		{format: SnapshotJSON, compress: true, wantExt: ".json.gz"},
+		{format: SnapshotBinary, wantExt: ".bin"},
+		{format: SnapshotBinary, compress: true, wantExt: ".bin.gz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wantExt, func(t *testing.T) {
+			dir := t.TempDir()
+			// an older JSON snapshot is replaced, not left to shadow the new file
+			saveUser(t, newTestCache(t, func(cfg *Config) { cfg.DataDir = dir }), "alice", 1, "old", "v")
+
+			c := newTestCache(t, func(cfg *Config) {
+				cfg.DataDir = dir
+				cfg.SnapshotFormat = tt.format
+				cfg.CompressSnapshots = tt.compress
+			})
+			filename, err := c.SaveUserToFile(snap)
+			if err != nil {
+				t.Fatalf("save: %v", err)
+			}
+			if filename != snapshotPath(dir, "alice", tt.wantExt) {
+				t.Fatalf("saved to %s, want %s extension", filename, tt.wantExt)
+			}
+
+			// any configuration loads it, whatever it was written with
+			reader := newTestCache(t, func(cfg *Config) { cfg.DataDir = dir })
+			got, err := reader.LoadUserFromFile("alice")
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if got.UserID != "alice" || len(got.Items) != len(snap.Items) {
+				t.Fatalf("loaded %+v", got)
+			}
+			for i, want := range snap.Items {
+				g := got.Items[i]
+				if g.Key != want.Key || !bytes.Equal(g.Value, want.Value) || !g.ExpiresAt.Equal(want.ExpiresAt) || g.Timestamp != want.Timestamp {
+					t.Fatalf("item %d = %+v, want %+v", i, g, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBinarySnapshotCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	snap := &UserSnapshot{UserID: "alice", Items: []PersistedItem{{Key: "k", Value: []byte("value")}}}
+	if err := (binaryCodec{}).encode(&buf, snap); err != nil {
+		t.Fatal(err)
+	}
+	full := buf.Bytes()
+
+	c := newTestCache(t)
+	for _, n := range []int{len(binaryMagic) + 1, len(full) - 1} {
+		filename := snapshotPath(c.dataDir(), "alice", ".bin")
+		if err := os.MkdirAll(c.dataDir(), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, full[:n], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.LoadUserFromFile("alice"); !errors.Is(err, ErrSnapshotInvalid) {
+			t.Fatalf("truncated to %d bytes: err = %v, want ErrSnapshotInvalid", n, err)
+		}
+	}
+}
+
+func TestSnapshotChecksum(t *testing.T) {
+	for _, format := range []SnapshotFormat{SnapshotJSON, SnapshotBinary} {
+		t.Run(string(format), func(t *testing.T) {
+			c := newTestCache(t, func(cfg *Config) { cfg.SnapshotFormat = format })
+			snap := &UserSnapshot{UserID: "alice", Items: []PersistedItem{{Key: "hello", Value: []byte("world"), Timestamp: 1}}}
+			filename, err := c.SaveUserToFile(snap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snap.Checksum != "" {
+				t.Fatal("save modified the caller's snapshot")
+			}
+			if _, err := c.LoadUserFromFile("alice"); err != nil {
+				t.Fatalf("intact file: %v", err)
+			}
+
+			// flip one bit of the key: still decodes, but no longer matches the checksum
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			i := bytes.Index(data, []byte("hello"))
+			data[i] ^= 0x01
+			if err := os.WriteFile(filename, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := c.LoadUserFromFile("alice"); !errors.Is(err, ErrSnapshotCorrupt) {
+				t.Fatalf("err = %v, want ErrSnapshotCorrupt", err)
+			}
+			report, err := c.LoadAllUsersFromDirReport()
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := filepath.Base(filename)
+			if report.Loaded != 0 || len(report.Corrupt) != 1 || report.Corrupt[0] != name || !errors.Is(report.Failed[name], ErrSnapshotCorrupt) {
+				t.Fatalf("report = %+v, want %s reported corrupt", report, name)
+			}
+			if c.getUser("alice") != nil {
+				t.Fatal("corrupt snapshot was loaded")
+			}
+		})
+	}
+
+	t.Run("files without a checksum still load", func(t *testing.T) {
+		c := newTestCache(t)
+		if err := os.MkdirAll(c.dataDir(), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		legacy := `{"user_id":"alice","items":[{"key":"k","value":"dg==","timestamp":1}]}`
+		if err := os.WriteFile(snapshotPath(c.dataDir(), "alice", ".json"), []byte(legacy), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.LoadUserFromFile("alice"); err != nil {
+			t.Fatalf("legacy file: %v", err)
+		}
+	})
+}
+
+func BenchmarkSnapshotCodec(b *testing.B) {
+	snap := &UserSnapshot{UserID: "bench"}
+	value := bytes.Repeat([]byte("v"), 64)
+	now := time.Now()
+	for i := 0; i < 100_000; i++ {
+		snap.Items = append(snap.Items, PersistedItem{
+			Key:       "key-" + strconv.Itoa(i),
+			Value:     value,
+			ExpiresAt: now.Add(time.Hour),
+			Timestamp: now.UnixNano(),
+		})
+	}
+
+	for _, format := range []SnapshotFormat{SnapshotJSON, SnapshotBinary} {
+		codec := codecFor(format)
+		var encoded bytes.Buffer
+		if err := codec.encode(&encoded, snap); err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(string(format)+"/encode", func(b *testing.B) {
+			b.SetBytes(int64(encoded.Len()))
+			var buf bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := codec.encode(&buf, snap); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(string(format)+"/decode", func(b *testing.B) {
+			b.SetBytes(int64(encoded.Len()))
+			for i := 0; i < b.N; i++ {
+				if _, err := codec.decode(bytes.NewReader(encoded.Bytes())); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
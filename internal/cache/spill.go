@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// spillSeq makes spill file names unique within the process.
+var spillSeq atomic.Int64
+
+func spillDir(cfg Config) string {
+	dir := cfg.DataDir
+	if dir == "" {
+		dir = "data"
+	}
+	return filepath.Join(dir, "spill")
+}
+
+// newValue copies value into a new Item, or writes it to a spill file when it is
+// larger than SpillThresholdBytes. Values over MaxValueBytes (or, unless spilled,
+// MaxBytes) are rejected with ErrValueTooLarge. Called before taking uc.mu so file I/O doesn't
+// block other operations on the user.
+func (uc *UserCache) newValue(value []byte) (Item, error) {
+	if uc.cfg.MaxValueBytes > 0 && len(value) > uc.cfg.MaxValueBytes {
+		return Item{}, ErrValueTooLarge
+	}
+	if uc.cfg.SpillThresholdBytes <= 0 || len(value) <= uc.cfg.SpillThresholdBytes {
+		// spilled values don't count toward MaxBytes, in-memory ones can never fit
+		if uc.cfg.MaxBytes > 0 && int64(len(value)) > uc.cfg.MaxBytes {
+			return Item{}, ErrValueTooLarge
+		}
+		vCopy := make([]byte, len(value))
+		copy(vCopy, value)
+		return Item{Value: vCopy}, nil
+	}
+
+	dir := spillDir(uc.cfg)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return Item{}, fmt.Errorf("spill: %w", err)
+	}
+	name := strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatInt(spillSeq.Add(1), 36) + ".bin"
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, value, 0o644); err != nil {
+		os.Remove(path)
+		return Item{}, fmt.Errorf("spill: %w", err)
+	}
+	item := Item{spill: path}
+	if uc.wal != nil {
+		item.raw = value
+	}
+	return item, nil
+}
+
+// loadValue returns item with its value read back from disk if it was spilled.
+func loadValue(item Item) (Item, error) {
+	if item.spill == "" {
+		return item, nil
+	}
+	data, err := os.ReadFile(item.spill)
+	if err != nil {
+		return Item{}, fmt.Errorf("spill: %w", err)
+	}
+	item.Value = data
+	item.spill = ""
+	return item, nil
+}
+
+// loadStored is loadValue for an item read from key under uc.mu, called after the
+// lock was released. An overwrite or delete in between may already have removed the
+// file; the key is then looked up again and what it holds now is loaded instead, so a
+// reader gets the old or the new value, and ErrKeyNotFound only if the key is gone.
+func (uc *UserCache) loadStored(key string, item Item) (Item, error) {
+	for {
+		loaded, err := loadValue(item)
+		if !errors.Is(err, os.ErrNotExist) {
+			return loaded, err
+		}
+		uc.mu.RLock()
+		current, ok := uc.items[key]
+		uc.mu.RUnlock()
+		if !ok || current.spill == item.spill || current.isExpired(time.Now()) {
+			return Item{}, ErrKeyNotFound
+		}
+		item = current
+	}
+}
+
+// dropSpill removes item's spill file, if any.
+func dropSpill(item Item) {
+	if item.spill == "" {
+		return
+	}
+	if err := os.Remove(item.spill); err != nil && !os.IsNotExist(err) {
+		log.Printf("[cache] remove spill file %s: %v", item.spill, err)
+	}
+}
@@ -0,0 +1,212 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// spillFiles returns the spill files currently on disk.
+func spillFiles(t *testing.T, c *Cache) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(spillDir(c.cfg), "*.bin"))
+	if err != nil {
+		t.Fatalf("glob spill dir: %v", err)
+	}
+	return files
+}
+
+func TestSpillRoundTrip(t *testing.T) {
+	c := newTestCache(t, func(cfg *Config) { cfg.SpillThresholdBytes = 8 })
+	big := bytes.Repeat([]byte("0123456789"), 100)
+
+	if _, err := c.Set("alice", "small", []byte("tiny"), 0, 0); err != nil {
+		t.Fatalf("set small: %v", err)
+	}
+	if files := spillFiles(t, c); len(files) != 0 {
+		t.Fatalf("small value spilled: %v", files)
+	}
+
+	if _, err := c.Set("alice", "big", big, 0, 0); err != nil {
+		t.Fatalf("set big: %v", err)
+	}
+	files := spillFiles(t, c)
+	if len(files) != 1 {
+		t.Fatalf("spill files = %v, want one", files)
+	}
+	if onDisk, err := os.ReadFile(files[0]); err != nil || !bytes.Equal(onDisk, big) {
+		t.Fatalf("spill file holds %d bytes (%v), want the value", len(onDisk), err)
+	}
+	if got := mustGet(t, c, "alice", "big"); got != string(big) {
+		t.Fatalf("get big = %d bytes, want the spilled value back", len(got))
+	}
+	if got := mustGet(t, c, "alice", "small"); got != "tiny" {
+		t.Fatalf("get small = %q", got)
+	}
+	if c.Bytes() != int64(len("tiny")) {
+		t.Fatalf("bytes = %d, spilled values should not count", c.Bytes())
+	}
+
+	if err := c.Delete("alice", "big"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if files := spillFiles(t, c); len(files) != 0 {
+		t.Fatalf("spill files after delete = %v", files)
+	}
+	if _, err := c.Get("alice", "big"); err != ErrKeyNotFound {
+		t.Fatalf("get after delete = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestSpillFileRemoved(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 64)
+	tests := []struct {
+		name string
+		cfg  func(*Config)
+		// act runs after "k" was set to a spilled value
+		act       func(t *testing.T, c *Cache)
+		wantFiles int
+		wantValue string // value of "k" afterwards; "" = gone
+	}{
+		{
+			name: "overwrite with a spilled value",
+			act: func(t *testing.T, c *Cache) {
+				if _, err := c.Set("alice", "k", bytes.Repeat([]byte("y"), 64), 0, 0); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+			},
+			wantFiles: 1,
+			wantValue: string(bytes.Repeat([]byte("y"), 64)),
+		},
+		{
+			name: "overwrite with a small value",
+			act: func(t *testing.T, c *Cache) {
+				if _, err := c.Set("alice", "k", []byte("small"), 0, 0); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+			},
+			wantValue: "small",
+		},
+		{
+			name: "evicted",
+			cfg:  func(cfg *Config) { cfg.MaxEntries = 1 },
+			act: func(t *testing.T, c *Cache) {
+				if _, err := c.Set("alice", "other", []byte("v"), 0, 0); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+			},
+		},
+		{
+			name: "expired",
+			act: func(t *testing.T, c *Cache) {
+				if err := c.Expire("alice", "k", 0); err != nil {
+					t.Fatalf("expire: %v", err)
+				}
+			},
+		},
+		{
+			name: "user deleted",
+			act: func(t *testing.T, c *Cache) {
+				if err := c.DeleteUser("alice"); err != nil {
+					t.Fatalf("delete user: %v", err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, func(cfg *Config) {
+				cfg.SpillThresholdBytes = 8
+				if tt.cfg != nil {
+					tt.cfg(cfg)
+				}
+			})
+			if _, err := c.Set("alice", "k", big, time.Hour, 0); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+			tt.act(t, c)
+
+			if files := spillFiles(t, c); len(files) != tt.wantFiles {
+				t.Fatalf("spill files = %v, want %d", files, tt.wantFiles)
+			}
+			v, err := c.Get("alice", "k")
+			if tt.wantValue == "" {
+				if err == nil {
+					t.Fatalf("k still readable: %d bytes", len(v))
+				}
+				return
+			}
+			if err != nil || string(v) != tt.wantValue {
+				t.Fatalf("get = %d bytes (%v), want the new value", len(v), err)
+			}
+		})
+	}
+}
+
+// TestSpillOverwriteDuringGet reads a spilled key while it is overwritten: the
+// overwrite removes the file a reader may be about to open, which must not turn
+// into a miss.
+func TestSpillOverwriteDuringGet(t *testing.T) {
+	c := newTestCache(t, func(cfg *Config) { cfg.SpillThresholdBytes = 8 })
+	values := [][]byte{bytes.Repeat([]byte("a"), 64), bytes.Repeat([]byte("b"), 64)}
+	if _, err := c.Set("alice", "k", values[1], 0, 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	// the interleaving the readers below only hit now and then: an item read under
+	// the lock whose file is removed by an overwrite before it is loaded
+	uc := c.getUser("alice")
+	uc.mu.RLock()
+	stale := uc.items["k"]
+	uc.mu.RUnlock()
+	if _, err := c.Set("alice", "k", values[0], 0, 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if item, err := uc.loadStored("k", stale); err != nil || !bytes.Equal(item.Value, values[0]) {
+		t.Fatalf("load after overwrite = %d bytes (%v), want the new value", len(item.Value), err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := c.Set("alice", "k", values[i%2], 0, 0); err != nil {
+				t.Errorf("set: %v", err)
+				return
+			}
+		}
+	}()
+
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := 0; i < 2000; i++ {
+				v, err := c.Get("alice", "k")
+				if err != nil || (!bytes.Equal(v, values[0]) && !bytes.Equal(v, values[1])) {
+					t.Errorf("get = %d bytes (%v), want one of the written values", len(v), err)
+					return
+				}
+				got, err := c.MGet("alice", []string{"k"})
+				if err != nil || len(got["k"]) != 64 {
+					t.Errorf("mget = %d bytes (%v), want one of the written values", len(got["k"]), err)
+					return
+				}
+			}
+		}()
+	}
+	readers.Wait()
+	close(done)
+	wg.Wait()
+}
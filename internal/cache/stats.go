@@ -0,0 +1,69 @@
+package cache
+
+import "sync/atomic"
+
+// UserStats is a point-in-time view of one user's counters.
+type UserStats struct {
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes,omitempty"` // Config.MaxBytes; omitted when unlimited
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"` // MaxEntries, MaxBytes and global-budget evictions
+}
+
+// CacheStats aggregates counters across users. PerUser is only filled when requested.
+type CacheStats struct {
+	Users     int                  `json:"users"`
+	Entries   int                  `json:"entries"`
+	Bytes     int64                `json:"bytes"`
+	Hits      int64                `json:"hits"`
+	Misses    int64                `json:"misses"`
+	Evictions int64                `json:"evictions"`
+	PerUser   map[string]UserStats `json:"per_user,omitempty"`
+}
+
+func (uc *UserCache) stats() UserStats {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+	return UserStats{
+		Entries:   len(uc.items),
+		Bytes:     uc.bytes,
+		MaxBytes:  uc.cfg.MaxBytes,
+		Hits:      atomic.LoadInt64(&uc.hits),
+		Misses:    atomic.LoadInt64(&uc.misses),
+		Evictions: atomic.LoadInt64(&uc.evictions),
+	}
+}
+
+// UserStats returns one user's counters. They are read atomically, so this is safe
+// alongside ongoing operations.
+func (c *Cache) UserStats(userID string) (UserStats, error) {
+	uc := c.getUser(userID)
+	if uc == nil {
+		return UserStats{}, ErrUserNotFound
+	}
+	return uc.stats(), nil
+}
+
+// Stats returns global counters, plus per-user counters when perUser is true.
+func (c *Cache) Stats(perUser bool) CacheStats {
+	users := c.usersSnapshot()
+
+	out := CacheStats{Users: len(users)}
+	if perUser {
+		out.PerUser = make(map[string]UserStats, len(users))
+	}
+	for id, uc := range users {
+		st := uc.stats()
+		out.Entries += st.Entries
+		out.Bytes += st.Bytes
+		out.Hits += st.Hits
+		out.Misses += st.Misses
+		out.Evictions += st.Evictions
+		if perUser {
+			out.PerUser[id] = st
+		}
+	}
+	return out
+}
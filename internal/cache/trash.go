@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultTrashRetention applies when SnapshotOnDelete is set without a TrashRetention.
+const defaultTrashRetention = 24 * time.Hour
+
+func (c *Cache) trashDir() string {
+	return filepath.Join(c.dataDir(), "trash")
+}
+
+func (c *Cache) trashRetention() time.Duration {
+	if c.cfg.TrashRetention > 0 {
+		return c.cfg.TrashRetention
+	}
+	return defaultTrashRetention
+}
+
+// trashUser snapshots a user into the trash dir. A missing user is not an error here;
+// DeleteUser reports it.
+func (c *Cache) trashUser(userID string) error {
+	snap, err := c.SnapshotUser(userID)
+	if err == ErrUserNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.writeSnapshotFile(c.trashDir(), snap); err != nil {
+		return err
+	}
+	c.purgeTrash()
+	return nil
+}
+
+// purgeTrash removes trash snapshots older than the retention period.
+func (c *Cache) purgeTrash() {
+	entries, err := os.ReadDir(c.trashDir())
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-c.trashRetention())
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), "user_") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.trashDir(), e.Name())); err != nil {
+			log.Printf("[cache] purge trash %s: %v", e.Name(), err)
+		}
+	}
+}
+
+// UndeleteUser restores a user deleted with SnapshotOnDelete from its trash snapshot
+// and removes the snapshot. It returns ErrUserExists if the user was recreated in the
+// meantime and ErrUserNotFound if there is no (unexpired) trash snapshot.
+func (c *Cache) UndeleteUser(userID string) error {
+	userID = c.NormalizeUserID(userID)
+	c.purgeTrash()
+
+	if c.getUser(userID) != nil {
+		return ErrUserExists
+	}
+
+	filename := c.findSnapshotFile(c.trashDir(), userID)
+	snap, err := readSnapshotFile(filename)
+	if os.IsNotExist(err) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := c.RestoreUserFromSnapshot(snap); err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUndeleteUser(t *testing.T) {
+	tests := []struct {
+		name      string
+		onDelete  bool
+		retention time.Duration
+		recreate  bool // write to the user again between delete and undelete
+		wantTrash bool // a trash snapshot exists after the delete
+		wantErr   error
+	}{
+		{name: "restored", onDelete: true, wantTrash: true},
+		{name: "option off", wantErr: ErrUserNotFound},
+		{name: "user recreated", onDelete: true, recreate: true, wantTrash: true, wantErr: ErrUserExists},
+		// purged as soon as it is written
+		{name: "retention expired", onDelete: true, retention: time.Nanosecond, wantErr: ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, func(cfg *Config) {
+				cfg.SnapshotOnDelete = tt.onDelete
+				cfg.TrashRetention = tt.retention
+			})
+			for _, k := range []string{"a", "b", "c"} {
+				if _, err := c.Set("alice", k, []byte("v-"+k), 0, 0); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+			}
+			if err := c.DeleteUser("alice"); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			if _, err := os.Stat(getUserFilePath(c.trashDir(), "alice")); (err == nil) != tt.wantTrash {
+				t.Fatalf("trash snapshot present = %v, want %v", err == nil, tt.wantTrash)
+			}
+			if tt.recreate {
+				if _, err := c.Set("alice", "new", []byte("v"), 0, 0); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+			}
+
+			if err := c.UndeleteUser("alice"); err != tt.wantErr {
+				t.Fatalf("undelete = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			for _, k := range []string{"a", "b", "c"} {
+				if v := mustGet(t, c, "alice", k); v != "v-"+k {
+					t.Fatalf("%s = %q after undelete", k, v)
+				}
+			}
+			// the trash snapshot is consumed
+			if _, err := os.Stat(getUserFilePath(c.trashDir(), "alice")); !os.IsNotExist(err) {
+				t.Fatalf("trash snapshot left after undelete: %v", err)
+			}
+		})
+	}
+}
@@ -2,6 +2,11 @@ package cache
 
 import (
 	"container/list"
+	"log"
+	"math"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,6 +16,31 @@ type Item struct {
 	Value     []byte
 	ExpiresAt time.Time
 	Timestamp int64 // // UnixNano timestamp of last write. it is in Int format
+
+	// spill is the file holding the value when it exceeded SpillThresholdBytes;
+	// Value is nil then and the value is not counted in the user's bytes.
+	spill string
+	// raw is a spilled value's bytes, kept by newValue only until the write is logged
+	// to the WAL. Never set on stored items.
+	raw []byte
+}
+
+// defaultDeleteTombstoneTTL applies when Config.DeleteTombstoneTTL is unset.
+const defaultDeleteTombstoneTTL = 5 * time.Minute
+
+// janitorPanics counts sweeps that panicked and were recovered, across all users.
+var janitorPanics atomic.Int64
+
+// sweepHook, when set, runs at the start of every sweep. Tests use it to inject panics.
+var sweepHook atomic.Pointer[func()]
+
+// snapshotHook, when set, runs in Snapshot after the lock is released and before the
+// values are copied. Tests use it to write in the middle of a snapshot.
+var snapshotHook atomic.Pointer[func()]
+
+// JanitorPanics returns how many janitor sweeps have panicked since process start.
+func JanitorPanics() int64 {
+	return janitorPanics.Load()
 }
 
 type lruEntry struct {
@@ -25,31 +55,72 @@ func (item Item) isExpired(now time.Time) bool {
 }
 
 type UserCache struct {
-	mu    sync.RWMutex
-	items map[string]Item
-	cfg   Config
+	userID string
+	mu     sync.RWMutex
+	items  map[string]Item
+	cfg    Config
 
 	stopOnce  sync.Once
 	stopCh    chan struct{}
 	stoppedCH chan struct{}
+	// stopped is set once the user is deleted; reads and writes on a stale
+	// reference then fail with ErrUserNotFound. Guarded by mu.
+	stopped bool
 
 	// LRU data structures
 	lruList *list.List               // front = most recent, back = least recent
 	lruMap  map[string]*list.Element // key -> element in lruList
+	// evict picks victims according to cfg.EvictionPolicy
+	evict evictor
+
+	// insertion-order index, only when cfg.TrackInsertionOrder (nil otherwise)
+	order    *list.List               // front = oldest insert
+	orderMap map[string]*list.Element // key -> element in order
+
+	// deletedAt holds the delete timestamp of recently deleted keys; storeLocked
+	// rejects older writes to them. Pruned by the janitor. Guarded by mu.
+	deletedAt map[string]int64
+
+	// bytes is the total size of stored values. Guarded by mu.
+	bytes int64
+	// globalBytes is the owning Cache's total across users (nil when standalone).
+	globalBytes *atomic.Int64
+	// events reports removals to Config.OnEvict (nil when unset).
+	events *evictNotifier
+	// wal logs every change to items (nil unless Config.WALEnabled).
+	wal *walLog
+
+	// dirty is set by every change to items and cleared when a periodic snapshot
+	// picks the user up, so unchanged users aren't rewritten.
+	dirty atomic.Bool
 
 	// stats (simple)
-	hits   int64
-	misses int64
+	hits      int64
+	misses    int64
+	evictions int64
 }
 
-func newUserCache(cfg Config) *UserCache {
+func newUserCache(userID string, cfg Config, globalBytes *atomic.Int64, events *evictNotifier, wal *walLog) *UserCache {
+	if cfg.MetricsSink == nil {
+		cfg.MetricsSink = NopSink{}
+	}
 	userCache := &UserCache{
-		items:     make(map[string]Item, cfg.InitialCapacity),
-		cfg:       cfg,
-		stopCh:    make(chan struct{}),
-		stoppedCH: make(chan struct{}),
-		lruList:   list.New(),
-		lruMap:    make(map[string]*list.Element, cfg.InitialCapacity),
+		userID:      userID,
+		items:       make(map[string]Item, cfg.InitialCapacity),
+		cfg:         cfg,
+		globalBytes: globalBytes,
+		events:      events,
+		wal:         wal,
+		stopCh:      make(chan struct{}),
+		stoppedCH:   make(chan struct{}),
+		lruList:     list.New(),
+		lruMap:      make(map[string]*list.Element, cfg.InitialCapacity),
+		deletedAt:   make(map[string]int64),
+	}
+	userCache.evict = newEvictor(userCache)
+	if cfg.TrackInsertionOrder {
+		userCache.order = list.New()
+		userCache.orderMap = make(map[string]*list.Element, cfg.InitialCapacity)
 	}
 	go userCache.janitor()
 	return userCache
@@ -57,30 +128,110 @@ func newUserCache(cfg Config) *UserCache {
 
 func (uc *UserCache) stop() {
 	uc.stopOnce.Do(func() {
+		uc.mu.Lock()
+		uc.stopped = true
+		for _, item := range uc.items {
+			dropSpill(item)
+		}
+		uc.mu.Unlock()
+
 		close(uc.stopCh)
 		<-uc.stoppedCH
 	})
 }
 
-func (uc *UserCache) get(key string) (Item, bool) {
+func (uc *UserCache) get(key string) (Item, error) {
+	item, err := uc.getRef(key)
+	if err != nil {
+		return Item{}, err
+	}
+	valueCopy := make([]byte, len(item.Value))
+	copy(valueCopy, item.Value)
+	item.Value = valueCopy
+
+	return item, nil
+}
+
+// getMany looks up all keys under a single lock acquisition, with the same LRU,
+// expiry and hit/miss handling as get. Missing and expired keys are left out.
+func (uc *UserCache) getMany(keys []string) (map[string][]byte, error) {
+	now := time.Now()
+	found := make(map[string]Item, len(keys))
+	var hits, misses int64
+
+	uc.mu.Lock()
+	if uc.stopped {
+		uc.mu.Unlock()
+		return nil, ErrUserNotFound
+	}
+	for _, key := range keys {
+		if _, dup := found[key]; dup {
+			continue
+		}
+		item, ok := uc.items[key]
+		if ok && item.isExpired(now) {
+			uc.removeItem(key, ReasonExpired)
+			ok = false
+		}
+		if !ok {
+			misses++
+			continue
+		}
+		uc.moveToFront(key)
+		found[key] = item
+		hits++
+	}
+	uc.mu.Unlock()
+
+	atomic.AddInt64(&uc.hits, hits)
+	atomic.AddInt64(&uc.misses, misses)
+	uc.cfg.MetricsSink.IncrCounter(MetricHits, hits)
+	uc.cfg.MetricsSink.IncrCounter(MetricMisses, misses)
+
+	out := make(map[string][]byte, len(found))
+	for key, item := range found {
+		// spilled values are read outside the lock, like getRef
+		item, err := uc.loadStored(key, item)
+		if err != nil {
+			if err != ErrKeyNotFound {
+				log.Printf("[cache] %v", err)
+			}
+			continue
+		}
+		valueCopy := make([]byte, len(item.Value))
+		copy(valueCopy, item.Value)
+		out[key] = valueCopy
+	}
+	return out, nil
+}
+
+// getRef is get without copying the value. The returned Value shares memory with
+// the stored item and must not be mutated. This is safe because stored values are
+// never modified in place: every write replaces the slice with a fresh copy.
+func (uc *UserCache) getRef(key string) (Item, error) {
 	uc.mu.RLock()
+	if uc.stopped {
+		uc.mu.RUnlock()
+		return Item{}, ErrUserNotFound
+	}
 	item, ok := uc.items[key]
 
 	if !ok {
 		atomic.AddInt64(&uc.misses, 1)
 		uc.mu.RUnlock()
-		return Item{}, false
+		uc.cfg.MetricsSink.IncrCounter(MetricMisses, 1)
+		return Item{}, ErrKeyNotFound
 	}
 
 	//  If expired, remove and return not found
 	if item.isExpired(time.Now()) {
 		uc.mu.RUnlock()
 		uc.mu.Lock()
-		delete(uc.items, key)
-		uc.removeFromLRU(key)
+		uc.removeItem(key, ReasonExpired)
 		uc.mu.Unlock()
 		atomic.AddInt64(&uc.misses, 1)
-		return Item{}, false
+		uc.cfg.MetricsSink.IncrCounter(MetricMisses, 1)
+		return Item{}, ErrKeyNotFound
 	}
 
 	uc.mu.RUnlock()
@@ -91,23 +242,333 @@ func (uc *UserCache) get(key string) (Item, bool) {
 	uc.mu.Unlock()
 
 	atomic.AddInt64(&uc.hits, 1)
+	uc.cfg.MetricsSink.IncrCounter(MetricHits, 1)
 
-	valueCopy := make([]byte, len(item.Value))
-	copy(valueCopy, item.Value)
-	item.Value = valueCopy
+	// spilled values are read outside the lock; a concurrent write may replace the file
+	item, err := uc.loadStored(key, item)
+	if err != nil {
+		if err != ErrKeyNotFound {
+			log.Printf("[cache] %v", err)
+		}
+		return Item{}, ErrKeyNotFound
+	}
+	return item, nil
+}
 
-	return item, true
+// incr adds delta to the integer stored under key (a missing or expired key counts
+// as 0) and stores the result as a decimal string, keeping the key's TTL. The
+// read-modify-write happens under one lock acquisition.
+func (uc *UserCache) incr(key string, delta int64, ts int64) (int64, error) {
+	now := time.Now()
+	if ts == 0 {
+		ts = now.UnixNano()
+	}
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	if uc.stopped {
+		return 0, ErrUserNotFound
+	}
+
+	var cur int64
+	var expires time.Time
+	if existing, ok := uc.items[key]; ok && !existing.isExpired(now) {
+		existing, err := loadValue(existing)
+		if err != nil {
+			return 0, err
+		}
+		cur, err = strconv.ParseInt(string(existing.Value), 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+		expires = existing.ExpiresAt
+	}
 
+	if (delta > 0 && cur > math.MaxInt64-delta) || (delta < 0 && cur < math.MinInt64-delta) {
+		return 0, ErrIntegerOverflow
+	}
+	next := cur + delta
+
+	// counters are tiny, never spilled
+	v := Item{Value: []byte(strconv.FormatInt(next, 10)), ExpiresAt: expires, Timestamp: ts}
+	uc.storeLocked(key, v)
+	uc.evictOverflow()
+	return next, nil
 }
 
-// set writes without timestamp checks (used for local writes from clients).
-// It sets Item.Timestamp to provided ts (if ts==0, sets now).
-func (uc *UserCache) set(key string, value []byte, ttl time.Duration, ts int64) {
+// getSet stores value and returns the item it replaced, under one lock acquisition.
+// The returned error is ErrKeyNotFound when there was no live value (the write is
+// still applied).
+func (uc *UserCache) getSet(key string, value []byte, ttl time.Duration, ts int64) (Item, error) {
+	now := time.Now()
+	if ts == 0 {
+		ts = now.UnixNano()
+	}
 	var expires time.Time
 	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+
+	v, err := uc.newValue(value)
+	if err != nil {
+		return Item{}, err
+	}
+	v.ExpiresAt, v.Timestamp = expires, ts
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	if uc.stopped {
+		dropSpill(v)
+		return Item{}, ErrUserNotFound
+	}
+
+	old, ok := uc.items[key]
+	if ok && old.isExpired(now) {
+		ok = false
+	} else if ok && old.spill != "" {
+		// read a spilled value before storeLocked removes its file
+		if old, err = loadValue(old); err != nil {
+			dropSpill(v)
+			return Item{}, err
+		}
+	} else if ok {
+		vCopy := make([]byte, len(old.Value))
+		copy(vCopy, old.Value)
+		old.Value = vCopy
+	}
+
+	uc.storeLocked(key, v)
+	uc.evictOverflow()
+	if !ok {
+		return Item{}, ErrKeyNotFound
+	}
+	return old, nil
+}
+
+// ttl returns the time left before key expires, or NoExpiry. A key that is past its
+// expiry but not yet reaped by the janitor is reported as ErrKeyNotFound.
+func (uc *UserCache) ttl(key string) (time.Duration, error) {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+
+	if uc.stopped {
+		return 0, ErrUserNotFound
+	}
+	item, ok := uc.items[key]
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+	if item.ExpiresAt.IsZero() {
+		return NoExpiry, nil
+	}
+	left := time.Until(item.ExpiresAt)
+	if left <= 0 {
+		return 0, ErrKeyNotFound
+	}
+	return left, nil
+}
+
+// setExpiry changes the expiry of a live key without rewriting its value (zero
+// expires = no expiry; a time in the past removes the key). The item's timestamp is
+// bumped so the change wins last-write-wins ordering when replicated.
+func (uc *UserCache) setExpiry(key string, expires time.Time, ts int64) error {
+	now := time.Now()
+	if ts == 0 {
+		ts = now.UnixNano()
+	}
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	if uc.stopped {
+		return ErrUserNotFound
+	}
+	item, ok := uc.items[key]
+	if !ok || item.isExpired(now) {
+		return ErrKeyNotFound
+	}
+	if !expires.IsZero() && !expires.After(now) {
+		uc.removeItem(key, ReasonDeleted)
+		return nil
+	}
+
+	item.ExpiresAt = expires
+	item.Timestamp = max(ts, item.Timestamp+1)
+	uc.items[key] = item
+	uc.dirty.Store(true)
+	uc.logOp(walExpire, key, expires, item.Timestamp)
+	return nil
+}
+
+// peek returns a copy of the item without touching LRU order or hit counters.
+func (uc *UserCache) peek(key string) (Item, error) {
+	uc.mu.RLock()
+	if uc.stopped {
+		uc.mu.RUnlock()
+		return Item{}, ErrUserNotFound
+	}
+	item, ok := uc.items[key]
+	uc.mu.RUnlock()
+
+	if !ok || item.isExpired(time.Now()) {
+		return Item{}, ErrKeyNotFound
+	}
+	if item.spill != "" {
+		loaded, err := loadValue(item)
+		if err != nil {
+			return Item{}, ErrKeyNotFound
+		}
+		return loaded, nil
+	}
+	vCopy := make([]byte, len(item.Value))
+	copy(vCopy, item.Value)
+	item.Value = vCopy
+	return item, nil
+}
+
+// revert undoes a write made at ts unless a newer write has replaced it: prev is
+// stored again with timestamp revertTS, or the key is removed when prev is nil.
+// It reports whether anything was reverted.
+func (uc *UserCache) revert(key string, ts int64, prev *Item, revertTS int64) (bool, error) {
+	var v Item
+	if prev != nil {
+		var err error
+		if v, err = uc.newValue(prev.Value); err != nil {
+			return false, err
+		}
+		v.ExpiresAt, v.Timestamp = prev.ExpiresAt, revertTS
+	}
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	if uc.stopped {
+		dropSpill(v)
+		return false, ErrUserNotFound
+	}
+
+	cur, ok := uc.items[key]
+	if !ok || cur.Timestamp > ts {
+		dropSpill(v)
+		return false, nil
+	}
+	if prev == nil {
+		uc.removeItem(key, ReasonDeleted)
+		return true, nil
+	}
+	uc.storeLocked(key, v)
+	uc.evictOverflow()
+	return true, nil
+}
+
+// set stores value with last-write-wins ordering: it overwrites an existing key only
+// when ts >= the stored Item.Timestamp (if ts==0, sets now).
+// It reports whether the key was newly created (false for overwrites and ignored older writes).
+func (uc *UserCache) set(key string, value []byte, ttl time.Duration, ts int64) (bool, error) {
+	// a negative TTL yields an expiry in the past, which setUntil treats as a delete
+	var expires time.Time
+	if ttl != 0 {
 		expires = time.Now().Add(ttl)
 	}
+	return uc.setUntil(key, value, expires, ts)
+}
+
+// setNX stores value only if key is absent (or expired). It returns the item now
+// stored under key and whether this call created it. Check and write happen under
+// one lock acquisition, so concurrent callers agree on a single winner.
+func (uc *UserCache) setNX(key string, value []byte, ttl time.Duration, ts int64) (Item, bool, error) {
+	now := time.Now()
+	if ts == 0 {
+		ts = now.UnixNano()
+	}
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+
+	item, err := uc.newValue(value)
+	if err != nil {
+		return Item{}, false, err
+	}
+	item.ExpiresAt, item.Timestamp = expires, ts
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	if uc.stopped {
+		dropSpill(item)
+		return Item{}, false, ErrUserNotFound
+	}
+
+	if existing, ok := uc.items[key]; ok {
+		if !existing.isExpired(now) {
+			dropSpill(item)
+			uc.moveToFront(key)
+			existing, err := loadValue(existing)
+			return existing, false, err
+		}
+		uc.removeItem(key, ReasonExpired)
+	}
+
+	uc.logPut(key, item)
+	item.raw = nil
+	uc.items[key] = item
+	uc.addBytes(int64(len(item.Value)))
+	uc.addToLRU(key)
+	uc.trackInsert(key)
+	uc.dirty.Store(true)
+	uc.evictOverflow()
+	if item.spill != "" {
+		item.Value, item.spill = value, ""
+	}
+	return item, true, nil
+}
+
+// setIfStale writes value only if key is missing, expired, or expires within
+// staleWithin. Keys without a TTL are never stale. Check and write happen under one
+// lock acquisition.
+func (uc *UserCache) setIfStale(key string, value []byte, ttl, staleWithin time.Duration, ts int64) (bool, error) {
+	now := time.Now()
+	if ts == 0 {
+		ts = now.UnixNano()
+	}
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+
+	v, err := uc.newValue(value)
+	if err != nil {
+		return false, err
+	}
+	v.ExpiresAt, v.Timestamp = expires, ts
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
 
+	if uc.stopped {
+		dropSpill(v)
+		return false, ErrUserNotFound
+	}
+
+	if existing, ok := uc.items[key]; ok && !existing.isExpired(now) {
+		if existing.ExpiresAt.IsZero() || existing.ExpiresAt.Sub(now) >= staleWithin {
+			dropSpill(v)
+			return false, nil
+		}
+	}
+
+	uc.storeLocked(key, v)
+	uc.evictOverflow()
+	return true, nil
+}
+
+// setUntil is set with an absolute expiry (zero = no expiry). A write whose expiry is
+// already in the past is treated as a delete (subject to the same timestamp ordering)
+// instead of storing a zombie entry that only the janitor would reap.
+func (uc *UserCache) setUntil(key string, value []byte, expires time.Time, ts int64) (bool, error) {
 	if ts == 0 {
 		ts = time.Now().UnixNano()
 	}
@@ -116,13 +577,93 @@ func (uc *UserCache) set(key string, value []byte, ttl time.Duration, ts int64)
 	// cache.set("k", input, 5*time.Minute)
 	// input[0] = 'X' // update cache value if not copies
 
-	// copy value to avoid caller mutating
-	vCopy := make([]byte, len(value))
-	copy(vCopy, value)
+	// copy value to avoid caller mutating (or spill it to disk)
+	v, err := uc.newValue(value)
+	if err != nil {
+		return false, err
+	}
+	v.ExpiresAt, v.Timestamp = expires, ts
 
 	uc.mu.Lock()
 	defer uc.mu.Unlock()
 
+	if uc.stopped {
+		dropSpill(v)
+		return false, ErrUserNotFound
+	}
+
+	created := uc.storeLocked(key, v)
+	uc.evictOverflow()
+	return created, nil
+}
+
+// setMany stores every value with the same expiry and timestamp under a single lock
+// acquisition, applying MaxEntries eviction once at the end. It returns how many keys
+// were newly created.
+func (uc *UserCache) setMany(values map[string][]byte, expires time.Time, ts int64) (int, error) {
+	if ts == 0 {
+		ts = time.Now().UnixNano()
+	}
+
+	// copy values before taking the lock
+	copies := make(map[string]Item, len(values))
+	for k, value := range values {
+		v, err := uc.newValue(value)
+		if err != nil {
+			for _, c := range copies {
+				dropSpill(c)
+			}
+			return 0, err
+		}
+		v.ExpiresAt, v.Timestamp = expires, ts
+		copies[k] = v
+	}
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	if uc.stopped {
+		for _, c := range copies {
+			dropSpill(c)
+		}
+		return 0, ErrUserNotFound
+	}
+
+	created := 0
+	for k, v := range copies {
+		if uc.storeLocked(k, v) {
+			created++
+		}
+	}
+	uc.evictOverflow()
+	return created, nil
+}
+
+// storeLocked writes v (from newValue, with expiry and timestamp set) with
+// last-write-wins ordering, without eviction. It reports whether the key was created.
+// Caller must hold uc.mu lock.
+func (uc *UserCache) storeLocked(key string, v Item) bool {
+	expires, ts := v.ExpiresAt, v.Timestamp
+	if !expires.IsZero() && !expires.After(time.Now()) {
+		dropSpill(v)
+		existing, ok := uc.items[key]
+		if ok && ts >= existing.Timestamp {
+			uc.removeItem(key, ReasonExpired)
+		}
+		if !ok || ts >= existing.Timestamp {
+			uc.noteDelete(key, ts)
+		}
+		return false
+	}
+	if del, ok := uc.deletedAt[key]; ok {
+		if ts < del {
+			// older than the delete that removed the key
+			dropSpill(v)
+			return false
+		}
+		delete(uc.deletedAt, key)
+	}
+
 	//  only accept updates with a timestamp >= current.
 	// This enforces last-write-wins and prevents overwriting newer data.
 
@@ -130,61 +671,282 @@ func (uc *UserCache) set(key string, value []byte, ttl time.Duration, ts int64)
 	if ok {
 		if ts < existing.Timestamp {
 			// ignore older write
-			return
+			dropSpill(v)
+			return false
 		}
 
-		uc.items[key] = Item{Value: vCopy, ExpiresAt: expires, Timestamp: ts}
+		dropSpill(existing)
+		uc.items[key] = Item{Value: v.Value, ExpiresAt: expires, Timestamp: ts, spill: v.spill}
+		uc.addBytes(int64(len(v.Value)) - int64(len(existing.Value)))
 		uc.moveToFront(key)
-		return
+		uc.dirty.Store(true)
+		uc.logPut(key, v)
+		return existing.isExpired(time.Now()) // an expired key no longer existed for readers
 	}
 
-	// Insert new
-	uc.items[key] = Item{Value: vCopy, ExpiresAt: expires}
+	// Insert new; the timestamp must be kept so later out-of-order writes are ordered
+	uc.items[key] = Item{Value: v.Value, ExpiresAt: expires, Timestamp: ts, spill: v.spill}
+	uc.addBytes(int64(len(v.Value)))
+	uc.dirty.Store(true)
+	uc.logPut(key, v)
 	uc.addToLRU(key)
+	uc.trackInsert(key)
+	return true
+}
 
-	// Evict if necessary
-	if uc.cfg.MaxEntries > 0 {
-		for len(uc.items) > uc.cfg.MaxEntries {
-			// evict back item
-			back := uc.lruList.Back()
-			if back == nil {
-				break
-			}
-
-			entry := back.Value.(*lruEntry)
-			delete(uc.items, entry.key)
-			uc.removeFromLRUElement(back)
+// evictOverflow evicts entries chosen by the eviction policy while over MaxEntries or
+// MaxBytes. Caller must hold uc.mu lock.
+func (uc *UserCache) evictOverflow() {
+	evicted := 0
+	for uc.overLimit() {
+		key, ok := uc.evict.victim()
+		if !ok {
+			break
 		}
+		uc.removeItem(key, ReasonCapacity)
+		evicted++
+	}
+	if evicted > 0 {
+		atomic.AddInt64(&uc.evictions, int64(evicted))
+		uc.cfg.MetricsSink.IncrCounter(MetricEvictions, int64(evicted))
 	}
 }
 
+// overLimit reports whether the user holds more than MaxEntries keys or MaxBytes of
+// values. Caller must hold uc.mu lock.
+func (uc *UserCache) overLimit() bool {
+	return (uc.cfg.MaxEntries > 0 && len(uc.items) > uc.cfg.MaxEntries) ||
+		(uc.cfg.MaxBytes > 0 && uc.bytes > uc.cfg.MaxBytes)
+}
+
+// delete removes key without a tombstone, for WAL replay, whose records are
+// already in order.
 func (uc *UserCache) delete(key string) {
 	uc.mu.Lock()
 	defer uc.mu.Unlock()
-	delete(uc.items, key)
+	uc.removeItem(key, ReasonDeleted)
+}
+
+// deleteAt removes key and records ts as its delete time, so a write older than ts
+// arriving later is ignored.
+func (uc *UserCache) deleteAt(key string, ts int64) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.removeItem(key, ReasonDeleted)
+	uc.noteDelete(key, ts)
+}
+
+// noteDelete records ts as key's delete time unless a later one is recorded.
+// Caller must hold uc.mu lock.
+func (uc *UserCache) noteDelete(key string, ts int64) {
+	if ts > uc.deletedAt[key] {
+		uc.deletedAt[key] = ts
+	}
+}
+
+func (uc *UserCache) deleteTombstoneTTL() time.Duration {
+	if uc.cfg.DeleteTombstoneTTL > 0 {
+		return uc.cfg.DeleteTombstoneTTL
+	}
+	return defaultDeleteTombstoneTTL
+}
+
+// forgetDeletes drops every recorded delete time.
+func (uc *UserCache) forgetDeletes() {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	clear(uc.deletedAt)
+}
+
+// pruneDeleted forgets delete times older than the tombstone TTL.
+func (uc *UserCache) pruneDeleted() {
+	uc.mu.RLock()
+	n := len(uc.deletedAt)
+	uc.mu.RUnlock()
+	if n == 0 {
+		return
+	}
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	cutoff := time.Now().Add(-uc.deleteTombstoneTTL()).UnixNano()
+	for key, ts := range uc.deletedAt {
+		if ts < cutoff {
+			delete(uc.deletedAt, key)
+		}
+	}
+}
+
+// addBytes adjusts the user's and the global byte totals. Caller must hold uc.mu lock.
+func (uc *UserCache) addBytes(delta int64) {
+	uc.bytes += delta
+	if uc.globalBytes != nil {
+		uc.globalBytes.Add(delta)
+	}
+}
+
+// evictOne removes the entry chosen by the eviction policy. It returns false if the
+// cache is empty.
+func (uc *UserCache) evictOne() bool {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	key, ok := uc.evict.victim()
+	if !ok {
+		return false
+	}
+	uc.removeItem(key, ReasonCapacity)
+	atomic.AddInt64(&uc.evictions, 1)
+	uc.cfg.MetricsSink.IncrCounter(MetricEvictions, 1)
+	return true
+}
+
+// tailTimestamp returns the write timestamp of the least recently used entry.
+func (uc *UserCache) tailTimestamp() (int64, bool) {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+
+	back := uc.lruList.Back()
+	if back == nil {
+		return 0, false
+	}
+	return uc.items[back.Value.(*lruEntry).key].Timestamp, true
+}
+
+// usage returns the total size of stored values.
+func (uc *UserCache) usage() int64 {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+	return uc.bytes
+}
+
+// removeItem deletes key from items and LRU, updates byte accounting and reports the
+// removal to OnEvict. Caller must hold uc.mu lock.
+func (uc *UserCache) removeItem(key string, reason EvictReason) {
+	if item, ok := uc.items[key]; ok {
+		uc.addBytes(-int64(len(item.Value)))
+		dropSpill(item)
+		delete(uc.items, key)
+		uc.dirty.Store(true)
+		uc.logOp(walDelete, key, time.Time{}, 0)
+		uc.events.notify(uc.userID, key, reason)
+	}
 	uc.removeFromLRU(key)
+	uc.evict.removed(key)
+	uc.untrackInsert(key)
+}
+
+// trackInsert appends a newly created key to the insertion-order index. Caller must hold uc.mu lock.
+func (uc *UserCache) trackInsert(key string) {
+	if uc.order == nil {
+		return
+	}
+	if _, ok := uc.orderMap[key]; ok {
+		return
+	}
+	uc.orderMap[key] = uc.order.PushBack(key)
+}
+
+// untrackInsert removes key from the insertion-order index. Caller must hold uc.mu lock.
+func (uc *UserCache) untrackInsert(key string) {
+	if uc.order == nil {
+		return
+	}
+	if el, ok := uc.orderMap[key]; ok {
+		uc.order.Remove(el)
+		delete(uc.orderMap, key)
+	}
 }
 
 func (uc *UserCache) keys() []string {
+	return uc.keysMatch("")
+}
+
+// keysMatch returns live keys matching the glob pattern; an empty pattern matches all.
+func (uc *UserCache) keysMatch(pattern string) []string {
 	now := time.Now()
+	match := func(k string) bool { return pattern == "" || matchGlob(pattern, k) }
 
 	uc.mu.RLock()
 	defer uc.mu.RUnlock()
 
 	ks := make([]string, 0, len(uc.items))
 
+	// insertion order when tracked
+	if uc.order != nil {
+		for el := uc.order.Front(); el != nil; el = el.Next() {
+			k := el.Value.(string)
+			if v, ok := uc.items[k]; ok && !v.isExpired(now) && match(k) {
+				ks = append(ks, k)
+			}
+		}
+		return ks
+	}
+
 	for k, v := range uc.items {
-		if !v.isExpired(now) {
+		if !v.isExpired(now) && match(k) {
 			ks = append(ks, k)
 		}
 	}
 	return ks
 }
 
+// digest returns key -> write timestamp for every live key.
+func (uc *UserCache) digest() map[string]int64 {
+	now := time.Now()
+
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+
+	out := make(map[string]int64, len(uc.items))
+	for k, v := range uc.items {
+		if !v.isExpired(now) {
+			out[k] = v.Timestamp
+		}
+	}
+	return out
+}
+
+// nearExpiry returns keys that expire within the window, soonest first.
+// Keys without expiry or already expired are excluded. limit <= 0 means no limit.
+func (uc *UserCache) nearExpiry(within time.Duration, limit int) []string {
+	now := time.Now()
+	deadline := now.Add(within)
+
+	type candidate struct {
+		key       string
+		expiresAt time.Time
+	}
+
+	uc.mu.RLock()
+	var found []candidate
+	for k, v := range uc.items {
+		if v.ExpiresAt.IsZero() || v.isExpired(now) || v.ExpiresAt.After(deadline) {
+			continue
+		}
+		found = append(found, candidate{key: k, expiresAt: v.ExpiresAt})
+	}
+	uc.mu.RUnlock()
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].expiresAt.Before(found[j].expiresAt)
+	})
+	if limit > 0 && len(found) > limit {
+		found = found[:limit]
+	}
+
+	ks := make([]string, 0, len(found))
+	for _, c := range found {
+		ks = append(ks, c.key)
+	}
+	return ks
+}
+
 // ---------- LRU helper methods (must be called with lock) ----------
 
 // addToLRU inserts key at front. Caller must hold uc.mu lock.
 func (uc *UserCache) addToLRU(key string) {
+	uc.evict.inserted(key)
 	if el, ok := uc.lruMap[key]; ok {
 		uc.lruList.MoveToFront(el)
 		return
@@ -199,6 +961,7 @@ func (uc *UserCache) addToLRU(key string) {
 func (uc *UserCache) moveToFront(key string) {
 	if el, ok := uc.lruMap[key]; ok {
 		uc.lruList.MoveToFront(el)
+		uc.evict.accessed(key)
 	}
 }
 
@@ -230,49 +993,109 @@ func (uc *UserCache) janitor() {
 		case <-uc.stopCh:
 			return
 		case <-ticker.C:
-			now := time.Now()
-			var expiredKeys []string
-
-			// gather expired under RLock
-			uc.mu.RLock()
-			for k, v := range uc.items {
-				if v.isExpired(now) {
-					expiredKeys = append(expiredKeys, k)
-				}
-			}
-			uc.mu.RUnlock()
+			uc.safeSweep()
+		}
+	}
+}
 
-			if len(expiredKeys) == 0 {
-				continue
+// safeSweep runs one sweep, recovering from a panic so TTL cleanup keeps running
+// (unless cfg.JanitorCrashOnPanic is set).
+func (uc *UserCache) safeSweep() {
+	defer func() {
+		if r := recover(); r != nil {
+			janitorPanics.Add(1)
+			log.Printf("[cache] janitor panic: %v\n%s", r, debug.Stack())
+			if uc.cfg.JanitorCrashOnPanic {
+				panic(r)
 			}
+		}
+	}()
+	uc.sweep()
+	uc.pruneDeleted()
+	if uc.cfg.CheckInvariants {
+		if rep := uc.checkInvariants(true); !rep.OK() {
+			log.Printf("[cache] janitor repaired lru drift: %d missing, %d orphan, %d duplicate, %d stale",
+				len(rep.MissingLRU), len(rep.OrphanLRU), len(rep.Duplicates), len(rep.StaleMap))
+		}
+	}
+}
 
-			uc.mu.Lock()
-			now = time.Now()
-			for _, key := range expiredKeys {
-				v, ok := uc.items[key]
+// sweep removes expired items. Locks are released via defer so a panic can't leave mu held.
+func (uc *UserCache) sweep() {
+	if hook := sweepHook.Load(); hook != nil {
+		(*hook)()
+	}
+	now := time.Now()
+	var expiredKeys []string
 
-				if ok && v.isExpired(now) {
-					delete(uc.items, key)
-					uc.removeFromLRU(key)
-				}
+	// gather expired under RLock
+	func() {
+		uc.mu.RLock()
+		defer uc.mu.RUnlock()
+		for k, v := range uc.items {
+			if v.isExpired(now) {
+				expiredKeys = append(expiredKeys, k)
 			}
-			uc.mu.Unlock()
+		}
+	}()
+
+	if len(expiredKeys) == 0 {
+		return
+	}
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	now = time.Now()
+	expired := 0
+	for _, key := range expiredKeys {
+		v, ok := uc.items[key]
+
+		if ok && v.isExpired(now) {
+			uc.removeItem(key, ReasonExpired)
+			expired++
 		}
 	}
+	uc.cfg.MetricsSink.IncrCounter(MetricExpired, int64(expired))
 }
 
-// Snapshot returns a snapshot of current items for persistence.
-// It copies items to avoid holding locks during I/O.
+// Snapshot returns a point-in-time snapshot of current items for persistence.
+// Only the item headers are copied under the read lock; in-memory value bytes are
+// copied after releasing it, so writers are blocked for a map copy rather than the
+// full deep copy. This is consistent because stored values are never mutated in
+// place. Spilled values are read under the lock: an overwrite deletes the old file,
+// which would otherwise drop the key from the snapshot.
 func (uc *UserCache) Snapshot() (map[string]Item, error) {
 	uc.mu.RLock()
-	defer uc.mu.RUnlock()
-
 	out := make(map[string]Item, len(uc.items))
-
+	var loaded map[string]bool // keys whose value was read from a spill file
 	for k, v := range uc.items {
+		if v.spill != "" {
+			item, err := loadValue(v)
+			if err != nil {
+				uc.mu.RUnlock()
+				return nil, err
+			}
+			if loaded == nil {
+				loaded = make(map[string]bool)
+			}
+			out[k], loaded[k] = item, true
+			continue
+		}
+		out[k] = v
+	}
+	uc.mu.RUnlock()
+
+	if hook := snapshotHook.Load(); hook != nil {
+		(*hook)()
+	}
+	for k, v := range out {
+		if loaded[k] {
+			continue // already a private copy
+		}
 		vCopy := make([]byte, len(v.Value))
 		copy(vCopy, v.Value)
-		out[k] = Item{Value: vCopy, ExpiresAt: v.ExpiresAt, Timestamp: v.Timestamp}
+		v.Value = vCopy
+		out[k] = v
 	}
 
 	return out, nil
@@ -280,22 +1103,204 @@ func (uc *UserCache) Snapshot() (map[string]Item, error) {
 
 // RestoreFromSnapshot replaces the user cache contents with provided items.
 // Caller should ensure this is used carefully; this will overwrite existing items.
+// The swap and all accounting (entries, bytes, global bytes, hit/miss stats) happen
+// under one write lock, so concurrent readers never see counters for the old contents.
 func (uc *UserCache) RestoreFromSnapshot(items map[string]Item) error {
+	// oldest write first so the LRU tail and the MaxEntries trim drop the stalest keys
+	keys := make([]string, 0, len(items))
+	for k := range items {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return items[keys[i]].Timestamp < items[keys[j]].Timestamp
+	})
+
+	newItems := make(map[string]Item, len(items))
+	var newBytes int64
+	kept := keys[:0]
+	for _, k := range keys {
+		v := items[k]
+		// copy value (large ones go to spill files)
+		nv, err := uc.newValue(v.Value)
+		if err == ErrValueTooLarge {
+			// saved under a larger limit; don't let one key fail the restore
+			log.Printf("[cache] restore: dropping %q, value exceeds the size limit", k)
+			continue
+		}
+		if err != nil {
+			for _, item := range newItems {
+				dropSpill(item)
+			}
+			return err
+		}
+		nv.ExpiresAt, nv.Timestamp, nv.raw = v.ExpiresAt, v.Timestamp, nil
+		newItems[k] = nv
+		newBytes += int64(len(nv.Value))
+		kept = append(kept, k)
+	}
+	keys = kept
+
 	uc.mu.Lock()
 	defer uc.mu.Unlock()
 
-	uc.items = make(map[string]Item, len(items))
+	if uc.stopped {
+		for _, item := range newItems {
+			dropSpill(item)
+		}
+		return ErrUserNotFound
+	}
+
+	for _, item := range uc.items {
+		dropSpill(item)
+	}
+	uc.items = newItems
 	uc.lruList = list.New()
-	uc.lruMap = make(map[string]*list.Element, len(items))
+	uc.lruMap = make(map[string]*list.Element, len(newItems))
+	for _, k := range keys {
+		// add to LRU (snapshot insertion counts as a use, newest write at the front)
+		uc.lruMap[k] = uc.lruList.PushFront(&lruEntry{key: k})
+	}
+	uc.resetEvictorLocked()
+	uc.rebuildOrderLocked(keys)
+	uc.dirty.Store(true)
+	uc.logOp(walFlush, "", time.Time{}, 0)
+	for _, k := range keys {
+		v := items[k]
+		uc.logPut(k, Item{Value: v.Value, ExpiresAt: v.ExpiresAt, Timestamp: v.Timestamp})
+	}
 
-	for k, v := range items {
-		// copy value
-		vCopy := make([]byte, len(v.Value))
-		copy(vCopy, v.Value)
-		uc.items[k] = Item{Value: vCopy, ExpiresAt: v.ExpiresAt, Timestamp: v.Timestamp}
-		// add to LRU (treat snapshot insertion as most-recent)
-		el := uc.lruList.PushFront(&lruEntry{key: k})
-		uc.lruMap[k] = el
+	// replace old contents' bytes with the restored total in one step
+	uc.addBytes(newBytes - uc.bytes)
+
+	// stats describe the replaced contents
+	atomic.StoreInt64(&uc.hits, 0)
+	atomic.StoreInt64(&uc.misses, 0)
+	atomic.StoreInt64(&uc.evictions, 0)
+
+	uc.evictOverflow()
+	return nil
+}
+
+// merge stores each of items whose key is missing, expired, or older (lower
+// timestamp) than the item, leaving every other key alone. Values are copied before
+// taking the lock and applied oldest first, then eviction runs once.
+func (uc *UserCache) merge(items map[string]Item) error {
+	keys := make([]string, 0, len(items))
+	for k := range items {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return items[keys[i]].Timestamp < items[keys[j]].Timestamp
+	})
+
+	copies := make(map[string]Item, len(items))
+	for _, k := range keys {
+		v := items[k]
+		nv, err := uc.newValue(v.Value)
+		if err == ErrValueTooLarge {
+			log.Printf("[cache] merge: dropping %q, value exceeds the size limit", k)
+			continue
+		}
+		if err != nil {
+			for _, c := range copies {
+				dropSpill(c)
+			}
+			return err
+		}
+		nv.ExpiresAt, nv.Timestamp = v.ExpiresAt, v.Timestamp
+		copies[k] = nv
+	}
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	if uc.stopped {
+		for _, c := range copies {
+			dropSpill(c)
+		}
+		return ErrUserNotFound
+	}
+
+	now := time.Now()
+	for _, k := range keys {
+		v, ok := copies[k]
+		if !ok {
+			continue
+		}
+		if existing, ok := uc.items[k]; ok {
+			if existing.isExpired(now) {
+				uc.removeItem(k, ReasonExpired)
+			} else if existing.Timestamp >= v.Timestamp {
+				// the live value is as new or newer than the backup
+				dropSpill(v)
+				continue
+			}
+		}
+		uc.storeLocked(k, v)
 	}
+	uc.evictOverflow()
 	return nil
 }
+
+// flush removes every key but keeps the user (config, stats, janitor) in place.
+func (uc *UserCache) flush() error {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	if uc.stopped {
+		return ErrUserNotFound
+	}
+
+	for _, item := range uc.items {
+		dropSpill(item)
+	}
+	uc.items = make(map[string]Item, uc.cfg.InitialCapacity)
+	uc.lruList = list.New()
+	uc.lruMap = make(map[string]*list.Element, uc.cfg.InitialCapacity)
+	uc.resetEvictorLocked()
+	uc.rebuildOrderLocked(nil)
+	uc.addBytes(-uc.bytes)
+	uc.dirty.Store(true)
+	uc.logOp(walFlush, "", time.Time{}, 0)
+	return nil
+}
+
+// rebuildOrderLocked rebuilds the insertion-order index from keys, which must be sorted
+// by write timestamp (the original insertion order isn't persisted). Caller must hold uc.mu lock.
+func (uc *UserCache) rebuildOrderLocked(keys []string) {
+	if uc.order == nil {
+		return
+	}
+	uc.order = list.New()
+	uc.orderMap = make(map[string]*list.Element, len(keys))
+	for _, k := range keys {
+		uc.orderMap[k] = uc.order.PushBack(k)
+	}
+}
+
+// RecomputeResult reports accounting after a recompute and how far it had drifted.
+type RecomputeResult struct {
+	Entries    int   `json:"entries"`
+	Bytes      int64 `json:"bytes"`
+	BytesDrift int64 `json:"bytes_drift"` // recomputed - previously tracked
+}
+
+// recompute recalculates entry count and byte totals from the items map.
+// Use it after bulk mutations that bypass the normal accounting paths.
+func (uc *UserCache) recompute() RecomputeResult {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return uc.recomputeLocked()
+}
+
+// recomputeLocked is recompute without locking. Caller must hold uc.mu lock.
+func (uc *UserCache) recomputeLocked() RecomputeResult {
+	var total int64
+	for _, v := range uc.items {
+		total += int64(len(v.Value))
+	}
+
+	drift := total - uc.bytes
+	uc.addBytes(drift)
+	return RecomputeResult{Entries: len(uc.items), Bytes: total, BytesDrift: drift}
+}
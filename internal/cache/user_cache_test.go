@@ -0,0 +1,659 @@
+package cache
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRecomputeStats(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+		skew int64 // added to the tracked byte count before recomputing
+	}{
+		{name: "accurate", keys: []string{"a", "bb", "ccc"}},
+		{name: "undercounted", keys: []string{"a", "bb", "ccc"}, skew: -7},
+		{name: "overcounted", keys: []string{"a", "bb", "ccc"}, skew: 40},
+		{name: "empty user overcounted", skew: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			if err := c.CreateUser("alice"); err != nil {
+				t.Fatalf("create user: %v", err)
+			}
+			var want int64
+			for _, k := range tt.keys {
+				if _, err := c.Set("alice", k, []byte("value-"+k), 0, 0); err != nil {
+					t.Fatalf("set %s: %v", k, err)
+				}
+				want += int64(len("value-" + k))
+			}
+			// Every bulk path (RestoreFromSnapshot, flush, merges via storeLocked) keeps
+			// the counters exact, so no public call can desync them; skew the counter
+			// the way a missed increment in one of those paths would.
+			uc := c.getUser("alice")
+			uc.mu.Lock()
+			uc.addBytes(tt.skew)
+			uc.mu.Unlock()
+
+			res := c.RecomputeStats()["alice"]
+			if res.Entries != len(tt.keys) || res.Bytes != want || res.BytesDrift != -tt.skew {
+				t.Fatalf("recompute = %+v, want %d entries, %d bytes, drift %d", res, len(tt.keys), want, -tt.skew)
+			}
+			if got := c.Bytes(); got != want {
+				t.Fatalf("global bytes = %d, want %d", got, want)
+			}
+			if again := c.RecomputeStats()["alice"]; again.BytesDrift != 0 {
+				t.Fatalf("second recompute drifted by %d", again.BytesDrift)
+			}
+		})
+	}
+}
+
+func TestSnapshotWhileWriting(t *testing.T) {
+	const keys = 200
+	tests := []struct {
+		name  string
+		write func(c *Cache, key string, round int) error
+		// valid reports whether a snapshotted value (ok=false: key absent) could have
+		// been stored at some point
+		valid func(key, value string, ok bool) bool
+	}{
+		{
+			name: "overwrites",
+			write: func(c *Cache, key string, round int) error {
+				_, err := c.Set("alice", key, []byte(key+"-"+strconv.Itoa(round)), 0, 0)
+				return err
+			},
+			valid: func(key, value string, ok bool) bool { return ok && strings.HasPrefix(value, key+"-") },
+		},
+		{
+			name: "deletes",
+			write: func(c *Cache, key string, round int) error {
+				if round%2 == 0 {
+					return c.Delete("alice", key)
+				}
+				_, err := c.Set("alice", key, []byte(key+"-0"), 0, 0)
+				return err
+			},
+			valid: func(key, value string, ok bool) bool { return !ok || value == key+"-0" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			for i := 0; i < keys; i++ {
+				key := "k" + strconv.Itoa(i)
+				if _, err := c.Set("alice", key, []byte(key+"-0"), 0, 0); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+			}
+			uc := c.getUser("alice")
+
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for round := 1; ; round++ {
+					for i := 0; i < keys; i++ {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						_ = tt.write(c, "k"+strconv.Itoa(i), round)
+					}
+				}
+			}()
+
+			for n := 0; n < 50; n++ {
+				snap, err := uc.Snapshot()
+				if err != nil {
+					t.Fatalf("snapshot: %v", err)
+				}
+				for i := 0; i < keys; i++ {
+					key := "k" + strconv.Itoa(i)
+					item, ok := snap[key]
+					if !tt.valid(key, string(item.Value), ok) {
+						t.Fatalf("snapshot %d holds %s = %q (present %v)", n, key, item.Value, ok)
+					}
+				}
+				// the snapshot owns its bytes
+				for _, item := range snap {
+					if len(item.Value) > 0 {
+						item.Value[0] = 'X'
+					}
+				}
+			}
+			close(stop)
+			<-done
+
+			for i := 0; i < keys; i++ {
+				key := "k" + strconv.Itoa(i)
+				if v, err := c.Get("alice", key); err == nil && v[0] == 'X' {
+					t.Fatalf("mutating a snapshot changed the stored %s", key)
+				}
+			}
+		})
+	}
+}
+
+func TestSnapshotIsPointInTime(t *testing.T) {
+	tests := []struct {
+		name  string
+		spill int // SpillThresholdBytes
+	}{
+		{name: "in memory"},
+		{name: "spilled", spill: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, func(cfg *Config) { cfg.SpillThresholdBytes = tt.spill })
+			want := make(map[string]string)
+			for i := 0; i < 20; i++ {
+				key := "k" + strconv.Itoa(i)
+				want[key] = "before-" + key
+				if _, err := c.Set("alice", key, []byte(want[key]), 0, 0); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+			}
+
+			// overwrite, delete and add keys between the lock release and the value copy
+			var once sync.Once
+			hook := func() {
+				once.Do(func() {
+					for i := 0; i < 10; i++ {
+						c.Set("alice", "k"+strconv.Itoa(i), []byte("after-write"), 0, 0)
+					}
+					for i := 10; i < 15; i++ {
+						c.Delete("alice", "k"+strconv.Itoa(i))
+					}
+					c.Set("alice", "added", []byte("after-write"), 0, 0)
+				})
+			}
+			snapshotHook.Store(&hook)
+			t.Cleanup(func() { snapshotHook.Store(nil) })
+
+			snap, err := c.getUser("alice").Snapshot()
+			if err != nil {
+				t.Fatalf("snapshot: %v", err)
+			}
+			got := make(map[string]string, len(snap))
+			for k, item := range snap {
+				got[k] = string(item.Value)
+			}
+			if !maps.Equal(got, want) {
+				t.Fatalf("snapshot = %v, want the state before the writes %v", got, want)
+			}
+			if v := mustGet(t, c, "alice", "k0"); v != "after-write" {
+				t.Fatalf("k0 = %q after the snapshot, want the write made during it", v)
+			}
+		})
+	}
+}
+
+func BenchmarkSetDuringSnapshot(b *testing.B) {
+	for _, bb := range []struct {
+		name     string
+		snapshot bool
+	}{
+		{name: "idle"},
+		{name: "snapshotting", snapshot: true},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			cfg := DefaultConfig()
+			cfg.MaxEntries = 0
+			cfg.DataDir = b.TempDir()
+			c := NewCache(cfg)
+			value := make([]byte, 256)
+			for i := 0; i < 100_000; i++ {
+				c.Set("alice", "k"+strconv.Itoa(i), value, 0, 0)
+			}
+			uc := c.getUser("alice")
+
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for bb.snapshot {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					uc.Snapshot()
+				}
+			}()
+
+			lat := make([]time.Duration, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				c.Set("alice", "k"+strconv.Itoa(i%100_000), value, 0, 0)
+				lat[i] = time.Since(start)
+			}
+			b.StopTimer()
+			close(stop)
+			<-done
+
+			slices.Sort(lat)
+			b.ReportMetric(float64(lat[len(lat)*99/100]), "p99-ns")
+			b.ReportMetric(float64(lat[len(lat)-1]), "max-ns")
+		})
+	}
+}
+
+func TestInsertionOrderKeys(t *testing.T) {
+	type op struct {
+		key string
+		del bool
+	}
+	tests := []struct {
+		name string
+		ops  []op
+		want []string
+	}{
+		{name: "creation order", ops: []op{{key: "c"}, {key: "a"}, {key: "b"}}, want: []string{"c", "a", "b"}},
+		{name: "overwrite keeps position", ops: []op{{key: "c"}, {key: "a"}, {key: "b"}, {key: "c"}}, want: []string{"c", "a", "b"}},
+		{name: "delete drops key", ops: []op{{key: "c"}, {key: "a"}, {key: "b"}, {key: "a", del: true}}, want: []string{"c", "b"}},
+		{name: "recreated key moves to the end", ops: []op{{key: "c"}, {key: "a"}, {key: "c", del: true}, {key: "c"}}, want: []string{"a", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, func(cfg *Config) { cfg.TrackInsertionOrder = true })
+			for _, o := range tt.ops {
+				var err error
+				if o.del {
+					err = c.Delete("alice", o.key)
+				} else {
+					_, err = c.Set("alice", o.key, []byte("v"), 0, 0)
+				}
+				if err != nil {
+					t.Fatalf("%+v: %v", o, err)
+				}
+			}
+			if got, _ := c.ListKeys("alice"); !slices.Equal(got, tt.want) {
+				t.Fatalf("keys = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("restored snapshot orders by write time", func(t *testing.T) {
+		c := newTestCache(t, func(cfg *Config) { cfg.TrackInsertionOrder = true })
+		snap := &UserSnapshot{UserID: "alice", Items: []PersistedItem{
+			{Key: "b", Value: []byte("v"), Timestamp: 20},
+			{Key: "c", Value: []byte("v"), Timestamp: 30},
+			{Key: "a", Value: []byte("v"), Timestamp: 10},
+		}}
+		if err := c.RestoreUserFromSnapshot(snap); err != nil {
+			t.Fatalf("restore: %v", err)
+		}
+		if got, _ := c.ListKeys("alice"); !slices.Equal(got, []string{"a", "b", "c"}) {
+			t.Fatalf("keys = %v, want [a b c]", got)
+		}
+	})
+}
+
+func TestRestoreOverLiveUser(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		before     []string // keys set before the restore
+		restored   []string // snapshot keys, oldest timestamp first
+		wantKeys   []string
+	}{
+		{name: "grow", before: []string{"a"}, restored: []string{"a", "b", "c"}, wantKeys: []string{"a", "b", "c"}},
+		{name: "shrink", before: []string{"a", "b", "c", "d"}, restored: []string{"x"}, wantKeys: []string{"x"}},
+		{name: "empty snapshot", before: []string{"a", "b"}, wantKeys: []string{}},
+		{name: "trimmed to max entries", maxEntries: 2, before: []string{"a"}, restored: []string{"p", "q", "r"}, wantKeys: []string{"q", "r"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, func(cfg *Config) { cfg.MaxEntries = tt.maxEntries })
+			for _, k := range tt.before {
+				if _, err := c.Set("alice", k, []byte("old-value-"+k), 0, 0); err != nil {
+					t.Fatalf("set %s: %v", k, err)
+				}
+			}
+			c.Get("alice", "a")
+			c.Get("alice", "missing")
+
+			snap := &UserSnapshot{UserID: "alice"}
+			for i, k := range tt.restored {
+				snap.Items = append(snap.Items, PersistedItem{Key: k, Value: []byte("v-" + k), Timestamp: int64(i + 1)})
+			}
+			if err := c.RestoreUserFromSnapshot(snap); err != nil {
+				t.Fatalf("restore: %v", err)
+			}
+
+			st, err := c.UserStats("alice")
+			if err != nil {
+				t.Fatalf("stats: %v", err)
+			}
+			if st.Entries != len(tt.wantKeys) || st.Hits != 0 || st.Misses != 0 {
+				t.Fatalf("stats = %+v, want %d entries and no hits or misses", st, len(tt.wantKeys))
+			}
+			if got := c.Bytes(); got != st.Bytes {
+				t.Fatalf("global bytes = %d, user bytes = %d", got, st.Bytes)
+			}
+			if res := c.RecomputeStats()["alice"]; res.BytesDrift != 0 {
+				t.Fatalf("byte count drifted by %d after restore", res.BytesDrift)
+			}
+			for _, k := range tt.wantKeys {
+				if v := mustGet(t, c, "alice", k); v != "v-"+k {
+					t.Fatalf("%s = %q, want %q", k, v, "v-"+k)
+				}
+			}
+		})
+	}
+
+	t.Run("concurrent writes", func(t *testing.T) {
+		c := newTestCache(t)
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := "w" + strconv.Itoa(i%50)
+				c.Set("alice", key, []byte(strings.Repeat("x", i%17)), 0, 0)
+				c.Get("alice", key)
+			}
+		}()
+		snap := &UserSnapshot{UserID: "alice"}
+		for i := 0; i < 100; i++ {
+			snap.Items = append(snap.Items, PersistedItem{Key: "r" + strconv.Itoa(i), Value: []byte("restored"), Timestamp: int64(i + 1)})
+		}
+		for n := 0; n < 50; n++ {
+			if err := c.RestoreUserFromSnapshot(snap); err != nil {
+				t.Fatalf("restore: %v", err)
+			}
+		}
+		close(stop)
+		<-done
+
+		st, _ := c.UserStats("alice")
+		if got := c.Bytes(); got != st.Bytes {
+			t.Fatalf("global bytes = %d, user bytes = %d", got, st.Bytes)
+		}
+		if res := c.RecomputeStats()["alice"]; res.BytesDrift != 0 || res.Entries != st.Entries {
+			t.Fatalf("recompute = %+v, stats before = %+v", res, st)
+		}
+	})
+}
+
+func TestRestoreMerge(t *testing.T) {
+	// live state: "newer" written after the backup, "older" before it, "live" not in it
+	setup := func(t *testing.T) *Cache {
+		c := newTestCache(t)
+		c.Set("alice", "newer", []byte("live"), 0, 300)
+		c.Set("alice", "older", []byte("live"), 0, 100)
+		c.Set("alice", "live", []byte("live"), 0, 100)
+		c.Set("alice", "expired", []byte("live"), time.Millisecond, 500)
+		time.Sleep(5 * time.Millisecond)
+		return c
+	}
+	snap := &UserSnapshot{UserID: "alice", Items: []PersistedItem{
+		{Key: "newer", Value: []byte("backup"), Timestamp: 200},
+		{Key: "older", Value: []byte("backup"), Timestamp: 200},
+		{Key: "expired", Value: []byte("backup"), Timestamp: 200},
+		{Key: "missing", Value: []byte("backup"), Timestamp: 200},
+	}}
+
+	tests := []struct {
+		name    string
+		restore func(c *Cache) error
+		want    map[string]string // key -> value, "" = absent
+	}{
+		{
+			name:    "overwrite",
+			restore: func(c *Cache) error { return c.RestoreUserFromSnapshot(snap) },
+			want:    map[string]string{"newer": "backup", "older": "backup", "expired": "backup", "missing": "backup", "live": ""},
+		},
+		{
+			name:    "merge",
+			restore: func(c *Cache) error { return c.RestoreUserMerge(snap) },
+			want:    map[string]string{"newer": "live", "older": "backup", "expired": "backup", "missing": "backup", "live": "live"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := setup(t)
+			if err := tt.restore(c); err != nil {
+				t.Fatalf("restore: %v", err)
+			}
+			for key, want := range tt.want {
+				got, err := c.Get("alice", key)
+				if want == "" {
+					if err != ErrKeyNotFound {
+						t.Fatalf("%s = %q, %v; want absent", key, got, err)
+					}
+					continue
+				}
+				if err != nil || string(got) != want {
+					t.Fatalf("%s = %q, %v; want %q", key, got, err, want)
+				}
+			}
+			if res := c.RecomputeStats()["alice"]; res.BytesDrift != 0 {
+				t.Fatalf("byte count drifted by %d", res.BytesDrift)
+			}
+		})
+	}
+
+	t.Run("equal timestamps keep the live value", func(t *testing.T) {
+		c := newTestCache(t)
+		c.Set("alice", "newer", []byte("live"), 0, 200)
+		if err := c.RestoreUserMerge(snap); err != nil {
+			t.Fatal(err)
+		}
+		if v := mustGet(t, c, "alice", "newer"); v != "live" {
+			t.Fatalf("newer = %q, want the live value", v)
+		}
+	})
+}
+
+func TestJanitorRecoversFromPanic(t *testing.T) {
+	tests := []struct {
+		name  string
+		panic func(sweep int64) bool // whether the given sweep (from 1) panics
+	}{
+		{name: "first sweep", panic: func(n int64) bool { return n == 1 }},
+		{name: "first three sweeps", panic: func(n int64) bool { return n <= 3 }},
+		{name: "every other sweep", panic: func(n int64) bool { return n%2 == 1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sweeps atomic.Int64
+			hook := func() {
+				if n := sweeps.Add(1); tt.panic(n) {
+					panic("injected sweep failure " + strconv.FormatInt(n, 10))
+				}
+			}
+			sweepHook.Store(&hook)
+			t.Cleanup(func() { sweepHook.Store(nil) })
+
+			c := newTestCache(t, func(cfg *Config) { cfg.JanitorInterval = 5 * time.Millisecond })
+			t.Cleanup(func() { c.DeleteUser("alice") })
+			before := JanitorPanics()
+			if _, err := c.Set("alice", "short", []byte("v"), 20*time.Millisecond, 0); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+			if _, err := c.Set("alice", "long", []byte("v"), 0, 0); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				st, _ := c.UserStats("alice")
+				if st.Entries == 1 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("expired key never swept: %d entries after %d sweeps", st.Entries, sweeps.Load())
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			if JanitorPanics() == before {
+				t.Fatalf("no janitor panics counted after %d sweeps", sweeps.Load())
+			}
+			if v := mustGet(t, c, "alice", "long"); v != "v" {
+				t.Fatalf("long = %q", v)
+			}
+			// the user's lock was not left held by a panicking sweep
+			if _, err := c.Set("alice", "after", []byte("v"), 0, 0); err != nil {
+				t.Fatalf("set after panic: %v", err)
+			}
+		})
+	}
+}
+
+func TestStoppedUserRejectsOps(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(uc *UserCache) error
+	}{
+		{name: "get", op: func(uc *UserCache) error { _, err := uc.get("k"); return err }},
+		{name: "getRef", op: func(uc *UserCache) error { _, err := uc.getRef("k"); return err }},
+		{name: "set", op: func(uc *UserCache) error { _, err := uc.set("k", []byte("v"), 0, 0); return err }},
+		{name: "setNX", op: func(uc *UserCache) error { _, _, err := uc.setNX("new", []byte("v"), 0, 0); return err }},
+		{name: "setUntil", op: func(uc *UserCache) error {
+			_, err := uc.setUntil("k", []byte("v"), time.Now().Add(time.Hour), 0)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			if _, err := c.Set("alice", "k", []byte("v"), 0, 0); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+			stale := c.getUser("alice")
+			if err := c.DeleteUser("alice"); err != nil {
+				t.Fatalf("delete user: %v", err)
+			}
+			if err := tt.op(stale); err != ErrUserNotFound {
+				t.Fatalf("%s on a deleted user = %v, want ErrUserNotFound", tt.name, err)
+			}
+			// nothing landed in the dead cache
+			if n := stale.stats().Entries; n != 1 {
+				t.Fatalf("deleted user's cache holds %d entries, want the original 1", n)
+			}
+		})
+	}
+
+	t.Run("delete during writes", func(t *testing.T) {
+		c := newTestCache(t)
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					_, err := c.Set("alice", "k"+strconv.Itoa(i%20), []byte("v"), time.Minute, 0)
+					if err != nil && err != ErrUserNotFound {
+						t.Errorf("set: %v", err)
+						return
+					}
+				}
+			}()
+		}
+		for n := 0; n < 200; n++ {
+			c.DeleteUser("alice")
+		}
+		close(stop)
+		wg.Wait()
+
+		// whatever user survived the churn is live: writes to it stick
+		uc := c.getUser("alice")
+		if uc == nil {
+			return
+		}
+		if _, err := c.Set("alice", "final", []byte("v"), 0, 0); err != nil {
+			t.Fatalf("set on surviving user: %v", err)
+		}
+		if v := mustGet(t, c, "alice", "final"); v != "v" {
+			t.Fatalf("final = %q", v)
+		}
+	})
+}
+
+func TestFlush(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []string
+		user    string // flushed user
+		wantErr error
+	}{
+		{name: "with keys", keys: []string{"a", "b", "c"}, user: "alice"},
+		{name: "empty user", user: "alice"},
+		{name: "unknown user", user: "bob", wantErr: ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, func(cfg *Config) { cfg.TrackInsertionOrder = true })
+			c.CreateUser("alice")
+			c.Set("carol", "k", []byte("other"), 0, 0)
+			for _, k := range tt.keys {
+				c.Set("alice", k, []byte("v-"+k), 0, 0)
+			}
+			c.Get("alice", "a")
+			before := c.getUser("alice")
+			hits := before.stats().Hits
+
+			if err := c.Flush(tt.user); err != tt.wantErr {
+				t.Fatalf("Flush = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			uc := c.getUser("alice")
+			if uc != before {
+				t.Fatalf("flush replaced the user")
+			}
+			select {
+			case <-uc.stoppedCH:
+				t.Fatalf("flush stopped the janitor")
+			default:
+			}
+			st := uc.stats()
+			if st.Entries != 0 || st.Bytes != 0 || st.Hits != hits {
+				t.Fatalf("after flush: %+v, want no entries or bytes and %d hits kept", st, hits)
+			}
+			if keys, _ := c.ListKeys("alice"); len(keys) != 0 {
+				t.Fatalf("keys after flush = %v", keys)
+			}
+			// other users are untouched, and the global byte count only lost alice's bytes
+			if got := c.Bytes(); got != int64(len("other")) {
+				t.Fatalf("global bytes = %d, want %d", got, len("other"))
+			}
+			if rep := uc.checkInvariants(false); !rep.OK() {
+				t.Fatalf("lru drift after flush: %+v", rep)
+			}
+
+			if _, err := c.Set("alice", "after", []byte("v"), 0, 0); err != nil {
+				t.Fatalf("set after flush: %v", err)
+			}
+			if keys, _ := c.ListKeys("alice"); !slices.Equal(keys, []string{"after"}) {
+				t.Fatalf("keys = %v, want [after]", keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,448 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The write-ahead log records every change to stored items so writes made after the
+// last snapshot survive a crash. Records are appended under the user's lock, so the
+// log has the same order as memory. It is split into numbered segment files; a
+// snapshot run starts a new segment and, once every user is saved, deletes the older
+// ones, which the snapshots now cover.
+
+type walOp byte
+
+const (
+	walPut      walOp = iota + 1 // key = value, expiry, timestamp
+	walDelete                    // key removed (delete, expiry, eviction)
+	walExpire                    // key's expiry changed to ExpiresAt (zero = none)
+	walFlush                     // all of the user's keys removed
+	walDropUser                  // user deleted
+)
+
+// walRecord is one logged change.
+type walRecord struct {
+	op        walOp
+	userID    string
+	key       string
+	value     []byte
+	expiresAt int64 // UnixNano, 0 = no expiry
+	timestamp int64
+}
+
+// walHeaderSize is the per-record frame: uint32 payload length + uint32 CRC-32 of it.
+const walHeaderSize = 8
+
+// maxWALRecord bounds a record's payload, so a torn length can't make replay allocate
+// an absurd buffer.
+const maxWALRecord = 1 << 31
+
+// walLog appends records to the current segment. Appends are no-ops until open is
+// called (by ReplayWAL), so loading snapshots and replaying aren't logged again.
+type walLog struct {
+	dir  string
+	sync bool // fsync after every record
+
+	mu  sync.Mutex
+	f   *os.File
+	seq int // current segment number
+}
+
+func newWALLog(cfg Config) *walLog {
+	if !cfg.WALEnabled {
+		return nil
+	}
+	dir := cfg.WALDir
+	if dir == "" {
+		dir = cfg.DataDir
+		if dir == "" {
+			dir = "data"
+		}
+		dir = filepath.Join(dir, "wal")
+	}
+	return &walLog{dir: dir, sync: cfg.WALSync}
+}
+
+func walSegmentName(seq int) string {
+	return fmt.Sprintf("wal-%08d.log", seq)
+}
+
+// segments returns the sequence numbers of the segment files in dir, oldest first.
+func (w *walLog) segments() ([]int, error) {
+	entries, err := os.ReadDir(w.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, "wal-") || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "wal-"), ".log"))
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+// open starts a new segment after the existing ones and enables appends.
+func (w *walLog) open() error {
+	if err := os.MkdirAll(w.dir, 0o755); err != nil {
+		return err
+	}
+	seqs, err := w.segments()
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(seqs) > 0 {
+		next = seqs[len(seqs)-1] + 1
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.switchLocked(next)
+}
+
+// switchLocked closes the current segment and opens segment seq. Caller must hold w.mu.
+func (w *walLog) switchLocked(seq int) error {
+	f, err := os.OpenFile(filepath.Join(w.dir, walSegmentName(seq)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if w.f != nil {
+		if err := w.f.Close(); err != nil {
+			log.Printf("[cache] wal: close segment %d: %v", w.seq, err)
+		}
+	}
+	w.f, w.seq = f, seq
+	return nil
+}
+
+// rotate starts a new segment and returns its number, or 0 if the log isn't open.
+// Every record in earlier segments was applied before rotate returned.
+func (w *walLog) rotate() int {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return 0
+	}
+	if err := w.switchLocked(w.seq + 1); err != nil {
+		log.Printf("[cache] wal: rotate: %v", err)
+		return 0
+	}
+	return w.seq
+}
+
+// truncateBefore deletes the segments older than seq.
+func (w *walLog) truncateBefore(seq int) {
+	if w == nil || seq == 0 {
+		return
+	}
+	seqs, err := w.segments()
+	if err != nil {
+		log.Printf("[cache] wal: list segments: %v", err)
+		return
+	}
+	for _, s := range seqs {
+		if s >= seq {
+			break
+		}
+		if err := os.Remove(filepath.Join(w.dir, walSegmentName(s))); err != nil && !os.IsNotExist(err) {
+			log.Printf("[cache] wal: remove segment %d: %v", s, err)
+		}
+	}
+}
+
+// append writes one record. Failures are logged; the change is already applied in
+// memory and can't be refused at this point.
+func (w *walLog) append(rec walRecord) {
+	if w == nil {
+		return
+	}
+	payload := encodeWALRecord(rec)
+	frame := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	frame = append(frame, payload...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return
+	}
+	if _, err := w.f.Write(frame); err != nil {
+		log.Printf("[cache] wal: append: %v", err)
+		return
+	}
+	if w.sync {
+		if err := w.f.Sync(); err != nil {
+			log.Printf("[cache] wal: sync: %v", err)
+		}
+	}
+}
+
+func encodeWALRecord(rec walRecord) []byte {
+	buf := make([]byte, 0, 1+3*binary.MaxVarintLen64+len(rec.userID)+len(rec.key)+len(rec.value)+2*binary.MaxVarintLen64)
+	buf = append(buf, byte(rec.op))
+	buf = binary.AppendUvarint(buf, uint64(len(rec.userID)))
+	buf = append(buf, rec.userID...)
+	buf = binary.AppendUvarint(buf, uint64(len(rec.key)))
+	buf = append(buf, rec.key...)
+	buf = binary.AppendUvarint(buf, uint64(len(rec.value)))
+	buf = append(buf, rec.value...)
+	buf = binary.AppendVarint(buf, rec.expiresAt)
+	buf = binary.AppendVarint(buf, rec.timestamp)
+	return buf
+}
+
+var errWALRecord = errors.New("malformed wal record")
+
+func decodeWALRecord(b []byte) (walRecord, error) {
+	if len(b) == 0 {
+		return walRecord{}, errWALRecord
+	}
+	rec := walRecord{op: walOp(b[0])}
+	b = b[1:]
+
+	readBytes := func() []byte {
+		n, k := binary.Uvarint(b)
+		if k <= 0 || n > uint64(len(b)-k) {
+			b = nil
+			return nil
+		}
+		out := b[k : k+int(n)]
+		b = b[k+int(n):]
+		return out
+	}
+	readVarint := func() (int64, bool) {
+		v, k := binary.Varint(b)
+		if k <= 0 {
+			return 0, false
+		}
+		b = b[k:]
+		return v, true
+	}
+
+	userID, key := readBytes(), readBytes()
+	value := readBytes()
+	if b == nil {
+		return walRecord{}, errWALRecord
+	}
+	rec.userID, rec.key = string(userID), string(key)
+	rec.value = append([]byte(nil), value...)
+
+	var ok bool
+	if rec.expiresAt, ok = readVarint(); !ok {
+		return walRecord{}, errWALRecord
+	}
+	if rec.timestamp, ok = readVarint(); !ok {
+		return walRecord{}, errWALRecord
+	}
+	return rec, nil
+}
+
+// WALReport summarizes a ReplayWAL run.
+type WALReport struct {
+	Segments int
+	Records  int
+	// Torn is the number of bytes dropped from the end of the last segment: a record
+	// cut short by a crash. Non-zero is expected after an unclean shutdown.
+	Torn     int64
+	Duration time.Duration
+}
+
+// ReplayWAL applies the write-ahead log on top of whatever LoadAllUsersFromDir loaded,
+// then starts logging new writes. Call it once at startup, after loading snapshots and
+// before serving; with WALEnabled, writes are not logged until it has run. A partially
+// written record at the end of the newest segment is truncated away; a bad record
+// elsewhere stops the replay with an error.
+func (c *Cache) ReplayWAL() (*WALReport, error) {
+	start := time.Now()
+	report := &WALReport{}
+	if c.wal == nil {
+		return report, nil
+	}
+
+	seqs, err := c.wal.segments()
+	if err != nil {
+		return nil, err
+	}
+	for i, seq := range seqs {
+		last := i == len(seqs)-1
+		n, torn, err := c.replaySegment(filepath.Join(c.wal.dir, walSegmentName(seq)), last)
+		report.Records += n
+		report.Torn += torn
+		report.Segments++
+		if err != nil {
+			return report, fmt.Errorf("wal segment %d: %w", seq, err)
+		}
+	}
+	// the log is already in order, so puts that expired during replay must not leave
+	// delete times behind that would reject older writes from peers
+	for _, uc := range c.usersSnapshot() {
+		uc.forgetDeletes()
+	}
+
+	if err := c.wal.open(); err != nil {
+		return report, err
+	}
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// replaySegment applies every record in one segment file. In the last segment a torn
+// trailing record is cut off the file; elsewhere it is an error.
+func (c *Cache) replaySegment(filename string, last bool) (records int, torn int64, err error) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	r := bufio.NewReader(f)
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for {
+		payload, err := readWALFrame(r, header)
+		if err == io.EOF {
+			return records, 0, nil
+		}
+		if err != nil {
+			if !last {
+				return records, 0, fmt.Errorf("offset %d: %w", offset, err)
+			}
+			torn = info.Size() - offset
+			log.Printf("[cache] wal: dropping %d torn bytes at the end of %s: %v", torn, filepath.Base(filename), err)
+			return records, torn, f.Truncate(offset)
+		}
+		rec, err := decodeWALRecord(payload)
+		if err != nil {
+			return records, 0, fmt.Errorf("offset %d: %w", offset, err)
+		}
+		c.applyWALRecord(rec)
+		records++
+		offset += walHeaderSize + int64(len(payload))
+	}
+}
+
+// readWALFrame reads one frame and checks its CRC. It returns io.EOF only at a clean
+// record boundary.
+func readWALFrame(r io.Reader, header []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[0:4])
+	if uint64(size) > maxWALRecord {
+		return nil, errWALRecord
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+// applyWALRecord replays one record. Logging is off during replay, so nothing here is
+// appended again.
+func (c *Cache) applyWALRecord(rec walRecord) {
+	switch rec.op {
+	case walPut:
+		var expires time.Time
+		if rec.expiresAt != 0 {
+			expires = time.Unix(0, rec.expiresAt)
+		}
+		if _, err := c.SetUntil(rec.userID, rec.key, rec.value, expires, rec.timestamp); err != nil {
+			log.Printf("[cache] wal: replay put %s/%s: %v", rec.userID, rec.key, err)
+		}
+	case walDelete:
+		if uc := c.getUser(rec.userID); uc != nil {
+			uc.delete(rec.key)
+		}
+	case walExpire:
+		var expires time.Time
+		if rec.expiresAt != 0 {
+			expires = time.Unix(0, rec.expiresAt)
+		}
+		if uc := c.getUser(rec.userID); uc != nil {
+			_ = uc.setExpiry(rec.key, expires, rec.timestamp)
+		}
+	case walFlush:
+		_ = c.Flush(rec.userID)
+	case walDropUser:
+		// a snapshot taken later truncates this record, but the user's file stays on
+		// disk; tombstone it so the next start doesn't load the user again
+		if err := c.tombstoneUser(rec.userID); err != nil {
+			log.Printf("[cache] wal: replay drop user %s: tombstone: %v", rec.userID, err)
+		}
+		c.dropUser(rec.userID)
+	default:
+		log.Printf("[cache] wal: skipping unknown op %d", rec.op)
+	}
+}
+
+// logPut records key's new value. v comes from newValue, so a spilled value is still
+// in v.raw. Caller must hold uc.mu lock.
+func (uc *UserCache) logPut(key string, v Item) {
+	if uc.wal == nil {
+		return
+	}
+	value := v.Value
+	if v.spill != "" {
+		value = v.raw
+	}
+	var expires int64
+	if !v.ExpiresAt.IsZero() {
+		expires = v.ExpiresAt.UnixNano()
+	}
+	uc.wal.append(walRecord{op: walPut, userID: uc.userID, key: key, value: value, expiresAt: expires, timestamp: v.Timestamp})
+}
+
+// logOp records a change that carries no value. Caller must hold uc.mu lock.
+func (uc *UserCache) logOp(op walOp, key string, expires time.Time, ts int64) {
+	if uc.wal == nil {
+		return
+	}
+	var exp int64
+	if !expires.IsZero() {
+		exp = expires.UnixNano()
+	}
+	uc.wal.append(walRecord{op: op, userID: uc.userID, key: key, expiresAt: exp, timestamp: ts})
+}
@@ -0,0 +1,244 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// restart opens a new cache on dir the way main does: snapshots, then the WAL.
+func restart(t *testing.T, dir string, mutate ...func(*Config)) (*Cache, *WALReport) {
+	t.Helper()
+	c := newTestCache(t, append([]func(*Config){func(cfg *Config) {
+		cfg.DataDir = dir
+		cfg.WALEnabled = true
+	}}, mutate...)...)
+	if _, err := c.LoadAllUsersFromDirReport(); err != nil {
+		t.Fatalf("load snapshots: %v", err)
+	}
+	report, err := c.ReplayWAL()
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	return c, report
+}
+
+func walSegments(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "wal", "wal-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	spill := func(cfg *Config) { cfg.SpillThresholdBytes = 16 }
+	c, _ := restart(t, dir, spill)
+
+	big := bytes.Repeat([]byte("x"), 64)
+	c.Set("alice", "a", []byte("1"), 0, 0)
+	c.Set("alice", "a", []byte("2"), 0, 0)
+	c.Set("alice", "big", big, 0, 0)
+	c.SetNX("alice", "nx", []byte("v"), 0, 0)
+	c.Set("alice", "gone", []byte("v"), 0, 0)
+	c.Delete("alice", "gone")
+	c.Set("alice", "ttl", []byte("v"), 0, 0)
+	c.Expire("alice", "ttl", time.Hour)
+	c.Set("bob", "k", []byte("v"), 0, 0)
+	c.Flush("bob")
+	c.Set("carol", "k", []byte("v"), 0, 0)
+	c.DeleteUser("carol")
+
+	r, report := restart(t, dir, spill)
+	if report.Records == 0 || report.Torn != 0 {
+		t.Fatalf("report = %+v", report)
+	}
+	for key, want := range map[string]string{"a": "2", "big": string(big), "nx": "v", "ttl": "v"} {
+		if got, err := r.Get("alice", key); err != nil || string(got) != want {
+			t.Fatalf("alice/%s = %q, %v; want %q", key, got, err, want)
+		}
+	}
+	if _, err := r.Get("alice", "gone"); err != ErrKeyNotFound {
+		t.Fatalf("deleted key: err = %v", err)
+	}
+	if ttl, err := r.TTL("alice", "ttl"); err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("ttl = %v, %v", ttl, err)
+	}
+	if keys, err := r.ListKeys("bob"); err != nil || len(keys) != 0 {
+		t.Fatalf("flushed user keys = %v, %v", keys, err)
+	}
+	if r.getUser("carol") != nil {
+		t.Fatal("deleted user came back")
+	}
+}
+
+func TestWALTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	c, _ := restart(t, dir)
+	c.Set("alice", "a", []byte("1"), 0, 0)
+	c.Set("alice", "b", []byte("2"), 0, 0)
+
+	// simulate a crash part-way through writing the last record
+	segs := walSegments(t, dir)
+	last := segs[len(segs)-1]
+	data, err := os.ReadFile(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(last, data[:len(data)-3], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, report := restart(t, dir)
+	if report.Torn == 0 {
+		t.Fatalf("report = %+v, want torn bytes", report)
+	}
+	if got, err := r.Get("alice", "a"); err != nil || string(got) != "1" {
+		t.Fatalf("a = %q, %v", got, err)
+	}
+	if _, err := r.Get("alice", "b"); err != ErrKeyNotFound {
+		t.Fatalf("torn write b: err = %v", err)
+	}
+	if info, err := os.Stat(last); err != nil || info.Size() >= int64(len(data)-3) {
+		t.Fatalf("torn segment not truncated: %+v, %v", info, err)
+	}
+
+	// writes after the truncation replay normally
+	r.Set("alice", "c", []byte("3"), 0, 0)
+	again, report := restart(t, dir)
+	if report.Torn != 0 {
+		t.Fatalf("second replay = %+v", report)
+	}
+	if got, err := again.Get("alice", "c"); err != nil || string(got) != "3" {
+		t.Fatalf("c = %q, %v", got, err)
+	}
+}
+
+func TestWALCorruptMiddleSegment(t *testing.T) {
+	dir := t.TempDir()
+	c, _ := restart(t, dir)
+	c.Set("alice", "a", []byte("1"), 0, 0)
+	first := walSegments(t, dir)[0]
+
+	// a second segment makes the first one non-final
+	restart(t, dir)
+	if err := os.WriteFile(first, []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestCache(t, func(cfg *Config) {
+		cfg.DataDir = dir
+		cfg.WALEnabled = true
+	})
+	if _, err := r.ReplayWAL(); err == nil || !strings.Contains(err.Error(), "wal segment") {
+		t.Fatalf("err = %v, want a wal segment error", err)
+	}
+}
+
+func TestWALTruncatedAfterSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	c, _ := restart(t, dir)
+	c.Set("alice", "a", []byte("1"), 0, 0)
+	c.Set("bob", "b", []byte("1"), 0, 0)
+
+	if err := c.SnapshotAll(); err != nil {
+		t.Fatal(err)
+	}
+	segs := walSegments(t, dir)
+	if len(segs) != 1 {
+		t.Fatalf("segments after snapshot = %v, want only the new one", segs)
+	}
+	if info, err := os.Stat(segs[0]); err != nil || info.Size() != 0 {
+		t.Fatalf("new segment should be empty: %+v, %v", info, err)
+	}
+
+	c.Set("alice", "a", []byte("2"), 0, 0)
+	r, report := restart(t, dir)
+	if report.Records != 1 {
+		t.Fatalf("replayed %d records, want only the write after the snapshot", report.Records)
+	}
+	if got, err := r.Get("alice", "a"); err != nil || string(got) != "2" {
+		t.Fatalf("a = %q, %v", got, err)
+	}
+	if got, err := r.Get("bob", "b"); err != nil || string(got) != "1" {
+		t.Fatalf("b = %q, %v", got, err)
+	}
+}
+
+func TestWALDeletedUserStaysDeleted(t *testing.T) {
+	tests := []struct {
+		name   string
+		delete func(t *testing.T, c *Cache)
+	}{
+		{name: "delete user", delete: func(t *testing.T, c *Cache) {
+			if err := c.DeleteUser("alice"); err != nil {
+				t.Fatalf("delete user: %v", err)
+			}
+		}},
+		{name: "flush all", delete: func(t *testing.T, c *Cache) {
+			c.FlushAll()
+			c.Set("bob", "b", []byte("1"), 0, 0)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			c, _ := restart(t, dir)
+			c.Set("alice", "a", []byte("1"), 0, 0)
+			c.Set("bob", "b", []byte("1"), 0, 0)
+			if err := c.SnapshotAll(); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.delete(t, c)
+			// the next snapshot truncates the WAL, drop record included, while
+			// user_alice.json stays on disk
+			if err := c.SnapshotAll(); err != nil {
+				t.Fatal(err)
+			}
+
+			r, _ := restart(t, dir)
+			if r.getUser("alice") != nil {
+				t.Fatal("deleted user came back from its snapshot")
+			}
+			if got, err := r.Get("bob", "b"); err != nil || string(got) != "1" {
+				t.Fatalf("bob/b = %q, %v", got, err)
+			}
+		})
+	}
+
+	t.Run("replay tombstones", func(t *testing.T) {
+		dir := t.TempDir()
+		c, _ := restart(t, dir)
+		c.Set("alice", "a", []byte("1"), 0, 0)
+		if err := c.SnapshotAll(); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.DeleteUser("alice"); err != nil {
+			t.Fatalf("delete user: %v", err)
+		}
+		// as if the delete crashed before its tombstone was written
+		if err := os.Remove(tombstonePath(dir, "alice")); err != nil {
+			t.Fatal(err)
+		}
+
+		r, _ := restart(t, dir)
+		if r.getUser("alice") != nil {
+			t.Fatal("replayed drop left the user in memory")
+		}
+		if !r.isTombstoned("alice") {
+			t.Fatal("replayed drop did not tombstone the snapshot")
+		}
+		if err := r.SnapshotAll(); err != nil {
+			t.Fatal(err)
+		}
+		if r2, _ := restart(t, dir); r2.getUser("alice") != nil {
+			t.Fatal("deleted user came back once the WAL was truncated")
+		}
+	})
+}
@@ -2,6 +2,8 @@ package cluster
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"sort"
 	"sync"
@@ -13,17 +15,41 @@ type ClusterState struct {
 	mu       sync.RWMutex
 	ring     *HashRing
 	nodesMap map[string]NodeInfo // id -> NodeInfo
-	Replicas int
+	pins     map[string]string   // ring key ("uid:|:key") -> node id (manual placement overrides)
 	self     NodeInfo
+
+	VirtualNodes int // virtual nodes per node on the ring
+
+	transport http.RoundTripper // for PollLeader; nil = http.DefaultTransport
+
+	// leadership (see leader.go)
+	leaderID    string    // "" while no leader is known
+	term        uint64    // election term leaderID leads
+	votedTerm   uint64    // highest term this node voted in
+	lastContact time.Time // last time the leader was heard from
+}
+
+// StatePayload is the JSON form of the cluster state shared by the leader
+// (join response, /v1/cluster/state) and consumed by followers.
+type StatePayload struct {
+	VirtualNodes int                 `json:"replicas"` // per node; the JSON name predates replication factors
+	Nodes        []NodeInfo          `json:"nodes"`
+	Ring         map[string]NodeInfo `json:"ring"` // hash->node
+	Pins         map[string]string   `json:"pins,omitempty"`
+	Leader       string              `json:"leader,omitempty"` // leader ID as the sender sees it
+	Term         uint64              `json:"term,omitempty"`
 }
 
-func NewClusterState(self NodeInfo, replicas int) *ClusterState {
+// NewClusterState returns a one-node cluster of self, with virtualNodes virtual
+// nodes per node on the ring (0 = the ring's default).
+func NewClusterState(self NodeInfo, virtualNodes int) *ClusterState {
 	cs := &ClusterState{
-		self:     self,
-		Replicas: replicas,
-		ring:     NewHashRing(replicas),
-		nodesMap: make(map[string]NodeInfo),
-		mu:       sync.RWMutex{},
+		self:         self,
+		VirtualNodes: virtualNodes,
+		ring:         NewHashRing(virtualNodes),
+		nodesMap:     make(map[string]NodeInfo),
+		pins:         make(map[string]string),
+		mu:           sync.RWMutex{},
 	}
 
 	cs.nodesMap[self.ID] = self
@@ -32,14 +58,64 @@ func NewClusterState(self NodeInfo, replicas int) *ClusterState {
 }
 
 // AddNode adds a node to membership (leader action).
-func (cs *ClusterState) AddNode(node NodeInfo) {
+// Re-adding an identical node is a no-op; reusing an ID or addr of a different node
+// returns ErrNodeConflict.
+func (cs *ClusterState) AddNode(node NodeInfo) error {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	if _, ok := cs.nodesMap[node.ID]; ok {
-		return
+	if err := cs.checkNewNodeLocked(node); err != nil {
+		if err == errNodeKnown {
+			return nil
+		}
+		return err
 	}
 	cs.nodesMap[node.ID] = node
 	cs.ring.AddNode(node)
+	return nil
+}
+
+// AddNodes adds several nodes at once, sorting the ring a single time (leader action).
+// Invalid or conflicting nodes are skipped and reported in the returned error.
+func (cs *ClusterState) AddNodes(nodes []NodeInfo) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var errs []error
+	added := make([]NodeInfo, 0, len(nodes))
+	for _, node := range nodes {
+		if err := cs.checkNewNodeLocked(node); err != nil {
+			if err != errNodeKnown {
+				errs = append(errs, fmt.Errorf("%s: %w", node.ID, err))
+			}
+			continue
+		}
+		cs.nodesMap[node.ID] = node
+		added = append(added, node)
+	}
+	cs.ring.AddNodes(added)
+	return errors.Join(errs...)
+}
+
+// errNodeKnown marks a node that is already registered with identical info.
+var errNodeKnown = errors.New("node already registered")
+
+// checkNewNodeLocked validates node against current membership. Caller must hold cs.mu.
+func (cs *ClusterState) checkNewNodeLocked(node NodeInfo) error {
+	if err := node.Validate(); err != nil {
+		return err
+	}
+	if existing, ok := cs.nodesMap[node.ID]; ok {
+		if existing != node {
+			return ErrNodeConflict
+		}
+		return errNodeKnown
+	}
+	for _, existing := range cs.nodesMap {
+		if existing.Addr == node.Addr {
+			return ErrNodeConflict
+		}
+	}
+	return nil
 }
 
 // RemoveNode removes a node from membership (leader action).
@@ -57,6 +133,11 @@ func (cs *ClusterState) RemoveNode(nodeID string) {
 func (cs *ClusterState) Nodes() []NodeInfo {
 	cs.mu.RLock()
 	defer cs.mu.RUnlock()
+	return cs.nodesLocked()
+}
+
+// nodesLocked is Nodes without locking. Caller must hold cs.mu.
+func (cs *ClusterState) nodesLocked() []NodeInfo {
 	out := make([]NodeInfo, 0, len(cs.nodesMap))
 	for _, node := range cs.nodesMap {
 		out = append(out, node)
@@ -68,83 +149,161 @@ func (cs *ClusterState) Nodes() []NodeInfo {
 }
 
 // LookupOwner returns the node responsible for the key.
+// A pinned key resolves to its pinned node as long as that node is a member.
 func (cs *ClusterState) LookupOwner(key string) (NodeInfo, bool) {
+	cs.mu.RLock()
+	node, ok := cs.pinnedLocked(key)
+	cs.mu.RUnlock()
+	if ok {
+		return node, true
+	}
 	return cs.ring.Lookup(key)
 }
 
+// pinnedLocked returns the node key is pinned to, if that node is a member.
+// Caller must hold cs.mu.
+func (cs *ClusterState) pinnedLocked(key string) (NodeInfo, bool) {
+	nodeID, ok := cs.pins[key]
+	if !ok {
+		return NodeInfo{}, false
+	}
+	node, ok := cs.nodesMap[nodeID]
+	return node, ok
+}
+
+// Ready reports whether the ring has at least one node to route keys to.
+func (cs *ClusterState) Ready() bool {
+	return cs.ring.Len() > 0
+}
+
+// PinKey overrides ring placement so key (the ring key, "uid:|:key") is owned by
+// nodeID (leader action).
+func (cs *ClusterState) PinKey(key, nodeID string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.nodesMap[nodeID]; !ok {
+		return ErrUnknownNode
+	}
+	cs.pins[key] = nodeID
+	return nil
+}
+
+// UnpinKey removes a placement override; the key reverts to ring placement.
+func (cs *ClusterState) UnpinKey(key string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.pins, key)
+}
+
+// Self returns this node's identity.
+func (cs *ClusterState) Self() NodeInfo {
+	return cs.self
+}
+
+// SetMaxVirtualNodes caps the total virtual nodes on the ring (0 = no cap); per-node
+// virtual nodes are scaled down proportionally as the cluster grows past the cap.
+func (cs *ClusterState) SetMaxVirtualNodes(max int) {
+	cs.ring.SetMaxVirtualNodes(max)
+}
+
+// SetTransport sets the HTTP transport PollLeader uses, e.g. one configured for TLS.
+func (cs *ClusterState) SetTransport(rt http.RoundTripper) {
+	cs.transport = rt
+}
+
+// RingCopy returns a copy of the current ring that later membership changes don't
+// affect, e.g. to compare ownership before and after a change.
+func (cs *ClusterState) RingCopy() *HashRing {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	r := NewHashRing(cs.VirtualNodes)
+	r.ReplaceFromSnapshot(cs.ring.Snapshot(), cs.VirtualNodes)
+	return r
+}
+
+// Distribution returns the share of the keyspace owned by each node.
+func (cs *ClusterState) Distribution() []NodeShare {
+	return cs.ring.Distribution()
+}
+
 // Snapshot returns JSON serializable snapshot of state.
 func (cs *ClusterState) Snapshot() ([]byte, error) {
 	cs.mu.RLock()
 	defer cs.mu.RUnlock()
 
-	type payload struct {
-		Replicas int                 `json:"replicas"`
-		Nodes    []NodeInfo          `json:"nodes"`
-		Ring     map[string]NodeInfo `json:"ring"` // hash->node
+	pins := make(map[string]string, len(cs.pins))
+	for k, v := range cs.pins {
+		pins[k] = v
 	}
-	p := payload{
-		Replicas: cs.Replicas,
-		Nodes:    cs.Nodes(),
-		Ring:     cs.ring.Snapshot(),
+
+	p := StatePayload{
+		VirtualNodes: cs.VirtualNodes,
+		Nodes:        cs.nodesLocked(), // Nodes() would re-acquire the read lock and can deadlock behind a waiting writer
+		Ring:         cs.ring.Snapshot(),
+		Pins:         pins,
+		Leader:       cs.leaderID,
+		Term:         cs.term,
 	}
 	return json.Marshal(p)
 }
 
 // ServeJoin and ServeState removed to decouple from HTTP.
 // The server package should handle HTTP encoding/decoding and call AddNode/Snapshot.
-// IsLeader determines if this node is leader by lowest ID rule.
-func (cs *ClusterState) IsLeader() bool {
-	cs.mu.RLock()
-	defer cs.mu.RUnlock()
-	// lowest lexicographic ID is leader
-	min := cs.self.ID
-	for id := range cs.nodesMap {
-		if id < min {
-			min = id
-		}
-	}
-	return cs.self.ID == min
-}
 
 // ReplaceFromPayload replaces state from snapshot payload (used by follower to sync).
-func (cs *ClusterState) ReplaceFromPayload(replicas int, nodes []NodeInfo, ring map[string]NodeInfo) {
+// A payload from an older term than this node knows is ignored (it comes from a
+// deposed leader); it reports whether the payload was applied.
+func (cs *ClusterState) ReplaceFromPayload(p StatePayload) bool {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	cs.Replicas = replicas
-	cs.nodesMap = make(map[string]NodeInfo, len(nodes))
-	for _, n := range nodes {
+	if p.Term < cs.term {
+		return false
+	}
+	if p.Term > cs.term || cs.leaderID == "" {
+		cs.leaderID, cs.term = p.Leader, p.Term
+	}
+	cs.VirtualNodes = p.VirtualNodes
+	cs.nodesMap = make(map[string]NodeInfo, len(p.Nodes))
+	for _, n := range p.Nodes {
 		cs.nodesMap[n.ID] = n
 	}
+	cs.pins = make(map[string]string, len(p.Pins))
+	for k, v := range p.Pins {
+		cs.pins[k] = v
+	}
 	// replace hashring
-	cs.ring.ReplaceFromSnapshot(ring, replicas)
+	cs.ring.ReplaceFromSnapshot(p.Ring, p.VirtualNodes)
+	return true
 }
 
-// PollLeader polls leader state and updates local view periodically.
+// PollLeader polls the current leader's state and updates local view periodically,
+// following the leader as it changes. A poll the leader answers as leader counts as
+// contact for its lease. scheme is "http" or "https".
 // caller should run in goroutine and stop when context canceled.
-func (cs *ClusterState) PollLeader(leaderAddr string, interval time.Duration, stop <-chan struct{}) {
-	// leaderAddr is full http address, e.g., "http://127.0.0.1:8080"
+func (cs *ClusterState) PollLeader(scheme string, interval time.Duration, stop <-chan struct{}) {
 	t := time.NewTicker(interval)
 	defer t.Stop()
-	client := &http.Client{Timeout: 2 * time.Second}
+	client := &http.Client{Timeout: 2 * time.Second, Transport: cs.transport}
 
 	for {
 		select {
 		case <-stop:
 			return
 		case <-t.C:
+			leader, _, ok := cs.Leader()
+			if !ok || leader.ID == cs.self.ID {
+				continue
+			}
 			// fetch /v1/cluster/state
-			resp, err := client.Get(leaderAddr + "/v1/cluster/state")
+			resp, err := client.Get(scheme + "://" + leader.Addr + "/v1/cluster/state")
 			if err != nil {
 				continue
 			}
-			var payload struct {
-				Replicas int                 `json:"replicas"`
-				Nodes    []NodeInfo          `json:"nodes"`
-				Ring     map[string]NodeInfo `json:"ring"`
-			}
-
+			var payload StatePayload
 			if err := json.NewDecoder(resp.Body).Decode(&payload); err == nil {
-				cs.ReplaceFromPayload(payload.Replicas, payload.Nodes, payload.Ring)
+				if cs.ReplaceFromPayload(payload) && payload.Leader == leader.ID {
+					cs.ObserveLeader(payload.Leader, payload.Term)
+				}
 			}
 
 			resp.Body.Close()
@@ -152,9 +311,22 @@ func (cs *ClusterState) PollLeader(leaderAddr string, interval time.Duration, st
 	}
 }
 
-// GetReplicaNodes returns up to 'count' replica nodes (primary + successors).
+// GetReplicaNodes returns up to 'count' replica nodes (primary + successors); count is
+// the replication factor, independent of the virtual node count. A pinned key's
+// pinned node comes first, followed by the key's ring nodes.
 func (cs *ClusterState) GetReplicaNodes(key string, count int) []NodeInfo {
-	cs.mu.RLocker()
+	cs.mu.RLock()
 	defer cs.mu.RUnlock()
-	return cs.ring.GetSuccessorNodes(key, count)
+	nodes := cs.ring.GetSuccessorNodes(key, count)
+	pinned, ok := cs.pinnedLocked(key)
+	if !ok || count <= 0 {
+		return nodes
+	}
+	out := append(make([]NodeInfo, 0, count), pinned)
+	for _, n := range nodes {
+		if n.ID != pinned.ID && len(out) < count {
+			out = append(out, n)
+		}
+	}
+	return out
 }
@@ -0,0 +1,187 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestState returns a cluster state with nodes a, b, c ... (size of them).
+func newTestState(t *testing.T, size int) *ClusterState {
+	t.Helper()
+	cs := NewClusterState(NodeInfo{ID: "a", Addr: "127.0.0.1:7000"}, 50)
+	for i := 1; i < size; i++ {
+		node := NodeInfo{ID: string(rune('a' + i)), Addr: fmt.Sprintf("127.0.0.1:%d", 7000+i)}
+		if err := cs.AddNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cs
+}
+
+func TestNodeValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		node NodeInfo
+		want error
+	}{
+		{name: "valid", node: NodeInfo{ID: "a", Addr: "127.0.0.1:7000"}},
+		{name: "valid host name", node: NodeInfo{ID: "a", Addr: "cache-1:7000"}},
+		{name: "valid empty host", node: NodeInfo{ID: "a", Addr: ":7000"}},
+		{name: "missing id", node: NodeInfo{Addr: "127.0.0.1:7000"}, want: ErrInvalidNodeID},
+		{name: "missing addr", node: NodeInfo{ID: "a"}, want: ErrInvalidNodeAddr},
+		{name: "addr without port", node: NodeInfo{ID: "a", Addr: "127.0.0.1"}, want: ErrInvalidNodeAddr},
+		{name: "addr with empty port", node: NodeInfo{ID: "a", Addr: "127.0.0.1:"}, want: ErrInvalidNodeAddr},
+		{name: "negative memory", node: NodeInfo{ID: "a", Addr: ":7000", Capacity: NodeCapacity{MemoryBytes: -1}}, want: ErrInvalidCapacity},
+		{name: "negative cpus", node: NodeInfo{ID: "a", Addr: ":7000", Capacity: NodeCapacity{CPUs: -2}}, want: ErrInvalidCapacity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.node.Validate(); err != tt.want {
+				t.Fatalf("Validate = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPinKey(t *testing.T) {
+	cs := newTestState(t, 3)
+	const key = "alice:|:k"
+	ringOwner, _ := cs.LookupOwner(key)
+	ringReplicas := cs.GetReplicaNodes(key, 2)
+	var pinTo string // a node outside the key's ring replicas
+	for _, n := range cs.Nodes() {
+		if n.ID != ringReplicas[0].ID && n.ID != ringReplicas[1].ID {
+			pinTo = n.ID
+		}
+	}
+
+	if err := cs.PinKey(key, "nope"); err != ErrUnknownNode {
+		t.Fatalf("pin to an unknown node: err = %v, want ErrUnknownNode", err)
+	}
+	if err := cs.PinKey(key, pinTo); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := cs.LookupOwner(key); owner.ID != pinTo {
+		t.Fatalf("pinned owner = %s, want %s", owner.ID, pinTo)
+	}
+	// the pinned node holds the key first, then the key's ring nodes
+	if got := ids(cs.GetReplicaNodes(key, 2)); got != pinTo+","+ringOwner.ID {
+		t.Fatalf("pinned replicas = %s, want %s,%s", got, pinTo, ringOwner.ID)
+	}
+	if got := ids(cs.GetReplicaNodes(key, 3)); got != pinTo+","+ids(ringReplicas) {
+		t.Fatalf("pinned replicas = %s, want %s,%s", got, pinTo, ids(ringReplicas))
+	}
+
+	cs.UnpinKey(key)
+	if owner, _ := cs.LookupOwner(key); owner.ID != ringOwner.ID {
+		t.Fatalf("owner after unpin = %s, want %s", owner.ID, ringOwner.ID)
+	}
+	if got := ids(cs.GetReplicaNodes(key, 2)); got != ids(ringReplicas) {
+		t.Fatalf("replicas after unpin = %s, want %s", got, ids(ringReplicas))
+	}
+
+	// a pin to a node that left no longer applies
+	if err := cs.PinKey(key, pinTo); err != nil {
+		t.Fatal(err)
+	}
+	cs.RemoveNode(pinTo)
+	if owner, _ := cs.LookupOwner(key); owner.ID != ringOwner.ID {
+		t.Fatalf("owner after the pinned node left = %s, want %s", owner.ID, ringOwner.ID)
+	}
+}
+
+// ids joins the nodes' IDs with commas.
+func ids(nodes []NodeInfo) string {
+	out := make([]string, len(nodes))
+	for i, n := range nodes {
+		out[i] = n.ID
+	}
+	return strings.Join(out, ",")
+}
+
+func TestSnapshotDuringChurn(t *testing.T) {
+	extra := NodeInfo{ID: "z", Addr: "127.0.0.1:7999"}
+	tests := []struct {
+		name  string
+		churn func(cs *ClusterState, i int)
+	}{
+		{name: "membership", churn: func(cs *ClusterState, i int) {
+			if i%2 == 0 {
+				_ = cs.AddNode(extra)
+			} else {
+				cs.RemoveNode(extra.ID)
+			}
+		}},
+		{name: "pins", churn: func(cs *ClusterState, i int) {
+			if i%2 == 0 {
+				_ = cs.PinKey("alice:|:k", "b")
+			} else {
+				cs.UnpinKey("alice:|:k")
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := newTestState(t, 3)
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					tt.churn(cs, i)
+				}
+			}()
+
+			finished := make(chan struct{})
+			go func() {
+				defer close(finished)
+				for n := 0; n < 500; n++ {
+					data, err := cs.Snapshot()
+					if err != nil {
+						t.Errorf("snapshot: %v", err)
+						return
+					}
+					var p StatePayload
+					if err := json.Unmarshal(data, &p); err != nil {
+						t.Errorf("decode: %v", err)
+						return
+					}
+					// members and ring must come from the same moment
+					members := make(map[string]bool)
+					for _, node := range p.Nodes {
+						members[node.ID] = true
+					}
+					onRing := make(map[string]bool)
+					for _, node := range p.Ring {
+						onRing[node.ID] = true
+					}
+					if len(members) != len(onRing) {
+						t.Errorf("snapshot %d: members %v, ring nodes %v", n, members, onRing)
+						return
+					}
+					for id := range onRing {
+						if !members[id] {
+							t.Errorf("snapshot %d: ring holds %s, not a member", n, id)
+							return
+						}
+					}
+				}
+			}()
+			select {
+			case <-finished:
+			case <-time.After(10 * time.Second):
+				t.Fatal("snapshots stalled behind concurrent writers")
+			}
+			close(stop)
+			<-done
+		})
+	}
+}
@@ -3,6 +3,7 @@ package cluster
 import (
 	"fmt"
 	"hash/fnv"
+	"math"
 	"slices"
 	"sort"
 	"strconv"
@@ -14,6 +15,12 @@ import (
 type HashRing struct {
 	replicas int // number of virtual nodes per node
 
+	// maxVirtualNodes caps the total virtual nodes (0 = no cap). When the cap would be
+	// exceeded, every node gets perNode = maxVirtualNodes/len(members) virtual nodes.
+	maxVirtualNodes int
+	perNode         int                 // effective virtual nodes per node
+	members         map[string]NodeInfo // id -> node
+
 	nodes  map[int64]NodeInfo //hash => node
 	hashes []int64            //sorted
 
@@ -26,26 +33,163 @@ func NewHashRing(replicas int) *HashRing {
 	}
 	return &HashRing{
 		replicas: replicas,
+		perNode:  replicas,
+		members:  make(map[string]NodeInfo),
 		nodes:    make(map[int64]NodeInfo),
 		hashes:   make([]int64, 0),
 	}
 }
 
+// SetMaxVirtualNodes caps the total number of virtual nodes (0 = no cap) and
+// rebuilds the ring if the per-node count changes.
+func (hr *HashRing) SetMaxVirtualNodes(max int) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.maxVirtualNodes = max
+	hr.rescaleLocked()
+}
+
+// effectivePerNode returns how many virtual nodes each member gets under the cap.
+// Caller must hold hr.mu.
+func (hr *HashRing) effectivePerNode() int {
+	n := len(hr.members)
+	if hr.maxVirtualNodes <= 0 || n == 0 || hr.replicas*n <= hr.maxVirtualNodes {
+		return hr.replicas
+	}
+	per := hr.maxVirtualNodes / n
+	if per < 1 {
+		per = 1
+	}
+	return per
+}
+
+// rescaleLocked rebuilds all virtual nodes if the effective per-node count changed.
+// Caller must hold hr.mu.
+func (hr *HashRing) rescaleLocked() {
+	per := hr.effectivePerNode()
+	if per == hr.perNode {
+		return
+	}
+	hr.perNode = per
+	hr.rebuildLocked()
+}
+
+// rebuildLocked regenerates every member's virtual nodes. Caller must hold hr.mu.
+func (hr *HashRing) rebuildLocked() {
+	hr.nodes = make(map[int64]NodeInfo, hr.perNode*len(hr.members))
+	hr.hashes = hr.hashes[:0]
+	for _, node := range hr.members {
+		hr.addVirtualNodesLocked(node)
+	}
+	slices.Sort(hr.hashes)
+}
+
+// weightedLocked reports whether any member advertises capacity, in which case
+// virtual node counts depend on the whole membership. Caller must hold hr.mu.
+func (hr *HashRing) weightedLocked() bool {
+	for _, node := range hr.members {
+		if !node.Capacity.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// virtualNodesFor returns node's virtual node count: perNode scaled by its capacity
+// relative to the members' average. Memory and CPUs each count for half when every
+// member advertises them; a dimension some member lacks is ignored. Nodes end up
+// with at least one virtual node. Caller must hold hr.mu.
+func (hr *HashRing) virtualNodesFor(node NodeInfo) int {
+	var memSum, cpuSum float64
+	memAll, cpuAll := true, true
+	for _, m := range hr.members {
+		memSum += float64(m.Capacity.MemoryBytes)
+		cpuSum += float64(m.Capacity.CPUs)
+		memAll = memAll && m.Capacity.MemoryBytes > 0
+		cpuAll = cpuAll && m.Capacity.CPUs > 0
+	}
+	n := float64(len(hr.members))
+
+	var weight float64
+	var dims int
+	if memAll && memSum > 0 {
+		weight += float64(node.Capacity.MemoryBytes) / (memSum / n)
+		dims++
+	}
+	if cpuAll && cpuSum > 0 {
+		weight += float64(node.Capacity.CPUs) / (cpuSum / n)
+		dims++
+	}
+	if dims == 0 {
+		return hr.perNode
+	}
+
+	count := int(math.Round(float64(hr.perNode) * weight / float64(dims)))
+	if count < 1 {
+		count = 1
+	}
+	return count
+}
+
+// addVirtualNodesLocked appends node's virtual nodes without sorting.
+// Caller must hold hr.mu.
+func (hr *HashRing) addVirtualNodesLocked(node NodeInfo) {
+	count := hr.perNode
+	if hr.weightedLocked() {
+		count = hr.virtualNodesFor(node)
+	}
+	for i := 0; i < count; i++ {
+		key := fmt.Sprintf("%s#%d", node.Addr, i)
+		hash := hashStr(key)
+		hr.nodes[hash] = node
+		hr.hashes = append(hr.hashes, hash)
+	}
+}
+
 func hashStr(s string) int64 {
 	h := fnv.New64a()
 	h.Write([]byte(s))
-	return int64(h.Sum64())
+	return int64(mix64(h.Sum64()))
+}
+
+// mix64 is MurmurHash3's 64-bit finalizer. FNV alone barely spreads strings that
+// differ only in their last bytes, like a node's "addr#0".."addr#N" virtual nodes,
+// which bunched them up and left some nodes most of the ring.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
 }
 
 // AddNode inserts an actual node with virtual nodes.
 func (hr *HashRing) AddNode(node NodeInfo) {
+	hr.AddNodes([]NodeInfo{node})
+}
+
+// AddNodes inserts several nodes, appending all their virtual nodes and sorting once,
+// so bulk additions cost one sort instead of one per node.
+func (hr *HashRing) AddNodes(nodes []NodeInfo) {
 	hr.mu.Lock()
 	defer hr.mu.Unlock()
-	for i := 0; i < hr.replicas; i++ {
-		key := fmt.Sprintf("%s#%d", node.Addr, i)
-		hash := hashStr(key)
-		hr.nodes[hash] = node
-		hr.hashes = append(hr.hashes, hash)
+	for _, node := range nodes {
+		hr.members[node.ID] = node
+	}
+
+	// if the cap forces fewer virtual nodes per node, rebuild everything
+	if hr.effectivePerNode() != hr.perNode {
+		hr.rescaleLocked()
+		return
+	}
+	// capacity weights are relative to the membership, so every node's count may change
+	if hr.weightedLocked() {
+		hr.rebuildLocked()
+		return
+	}
+	for _, node := range nodes {
+		hr.addVirtualNodesLocked(node)
 	}
 	slices.Sort(hr.hashes)
 }
@@ -75,6 +219,20 @@ func (hr *HashRing) RemoveNode(nodeID string) {
 		delete(hr.nodes, hash)
 	}
 	hr.hashes = newHashes
+	delete(hr.members, nodeID)
+	if hr.weightedLocked() {
+		hr.perNode = hr.effectivePerNode()
+		hr.rebuildLocked()
+		return
+	}
+	hr.rescaleLocked()
+}
+
+// Len returns the number of virtual nodes on the ring.
+func (hr *HashRing) Len() int {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	return len(hr.hashes)
 }
 
 // Lookup returns the NodeInfo responsible for the given key.
@@ -121,7 +279,9 @@ func (hr *HashRing) ReplaceFromSnapshot(snapshot map[string]NodeInfo, replicas i
 	hr.mu.Lock()
 	defer hr.mu.Unlock()
 
-	hr.replicas = replicas
+	if replicas > 0 { // 0 keeps NewHashRing's default, or nodes added later get no virtual nodes
+		hr.replicas = replicas
+	}
 	hr.hashes = hr.hashes[:0]
 	hr.nodes = make(map[int64]NodeInfo, len(snapshot))
 
@@ -137,6 +297,15 @@ func (hr *HashRing) ReplaceFromSnapshot(snapshot map[string]NodeInfo, replicas i
 		hr.nodes[int64(h)] = node
 	}
 	slices.Sort(hr.hashes)
+
+	// the snapshot already reflects the leader's cap; adopt its membership as-is
+	hr.members = make(map[string]NodeInfo)
+	for _, node := range hr.nodes {
+		hr.members[node.ID] = node
+	}
+	if len(hr.members) > 0 {
+		hr.perNode = len(hr.hashes) / len(hr.members)
+	}
 }
 
 // GetSuccessorNodes returns up to 'count' unique real nodes starting from the primary for the given key.
@@ -180,3 +349,53 @@ func (hr *HashRing) GetSuccessorNodes(key string, count int) []NodeInfo {
 	}
 	return res
 }
+
+// NodeShare describes how much of the keyspace a single node owns on the ring.
+type NodeShare struct {
+	Node         NodeInfo `json:"node"`
+	VirtualNodes int      `json:"virtual_nodes"`
+	Fraction     float64  `json:"fraction"` // 0..1 share of the hash space
+}
+
+// Distribution returns, per real node, the number of virtual nodes and the
+// fraction of the hash space it owns. A virtual node owns the arc between its
+// predecessor's hash (exclusive) and its own hash (inclusive).
+func (hr *HashRing) Distribution() []NodeShare {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+
+	shares := make(map[string]*NodeShare)
+	n := len(hr.hashes)
+
+	for i, hash := range hr.hashes {
+		node := hr.nodes[hash]
+		share, ok := shares[node.ID]
+		if !ok {
+			share = &NodeShare{Node: node}
+			shares[node.ID] = share
+		}
+		share.VirtualNodes++
+
+		if n == 1 {
+			share.Fraction = 1
+			continue
+		}
+
+		// arc length on the uint64 ring; the subtraction wraps for i == 0
+		prev := hr.hashes[(i-1+n)%n]
+		arc := uint64(hash) - uint64(prev)
+		share.Fraction += float64(arc) / ringSize
+	}
+
+	out := make([]NodeShare, 0, len(shares))
+	for _, share := range shares {
+		out = append(out, *share)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Node.ID < out[j].Node.ID
+	})
+	return out
+}
+
+// ringSize is the size of the 64-bit hash space as a float.
+const ringSize = float64(1<<63) * 2
@@ -0,0 +1,213 @@
+package cluster
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestDistribution(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes int
+	}{
+		{name: "empty", nodes: 0},
+		{name: "single node owns everything", nodes: 1},
+		{name: "three nodes", nodes: 3},
+		{name: "ten nodes", nodes: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hr := NewHashRing(50)
+			for i := 0; i < tt.nodes; i++ {
+				hr.AddNode(NodeInfo{ID: "n" + strconv.Itoa(i), Addr: "127.0.0.1:" + strconv.Itoa(9000+i)})
+			}
+			shares := hr.Distribution()
+			if len(shares) != tt.nodes {
+				t.Fatalf("got %d shares, want %d", len(shares), tt.nodes)
+			}
+			total := 0.0
+			for i, s := range shares {
+				if i > 0 && shares[i-1].Node.ID >= s.Node.ID {
+					t.Fatalf("shares not sorted by node ID: %v", shares)
+				}
+				if s.VirtualNodes != 50 {
+					t.Errorf("%s has %d virtual nodes, want 50", s.Node.ID, s.VirtualNodes)
+				}
+				if s.Fraction <= 0 || s.Fraction > 1 {
+					t.Errorf("%s owns %v of the ring", s.Node.ID, s.Fraction)
+				}
+				total += s.Fraction
+			}
+			if tt.nodes > 0 && (total < 0.999999 || total > 1.000001) {
+				t.Fatalf("fractions sum to %v, want 1", total)
+			}
+		})
+	}
+}
+
+func TestDistributionBalance(t *testing.T) {
+	t.Run("balanced ring is near even", func(t *testing.T) {
+		hr := NewHashRing(100)
+		for i := 0; i < 4; i++ {
+			hr.AddNode(NodeInfo{ID: "n" + strconv.Itoa(i), Addr: "127.0.0.1:" + strconv.Itoa(9000+i)})
+		}
+		for _, s := range hr.Distribution() {
+			if s.Fraction < 0.20 || s.Fraction > 0.30 {
+				t.Errorf("%s owns %.3f of the ring, want about 0.25", s.Node.ID, s.Fraction)
+			}
+		}
+
+		// the reported fractions match where keys actually land
+		owned := make(map[string]int)
+		const keys = 20000
+		for i := 0; i < keys; i++ {
+			node, _ := hr.Lookup("user:|:key-" + strconv.Itoa(i))
+			owned[node.ID]++
+		}
+		for _, s := range hr.Distribution() {
+			got := float64(owned[s.Node.ID]) / keys
+			if d := got - s.Fraction; d < -0.03 || d > 0.03 {
+				t.Errorf("%s got %.3f of sampled keys, distribution says %.3f", s.Node.ID, got, s.Fraction)
+			}
+		}
+	})
+
+	t.Run("uneven weights skew proportionally", func(t *testing.T) {
+		hr := NewHashRing(100)
+		hr.AddNode(NodeInfo{ID: "big", Addr: "127.0.0.1:9000", Capacity: NodeCapacity{MemoryBytes: 3 << 30, CPUs: 3}})
+		hr.AddNode(NodeInfo{ID: "small", Addr: "127.0.0.1:9001", Capacity: NodeCapacity{MemoryBytes: 1 << 30, CPUs: 1}})
+		shares := hr.Distribution() // sorted: big, small
+		if shares[0].VirtualNodes != 3*shares[1].VirtualNodes {
+			t.Fatalf("virtual nodes big=%d small=%d, want 3:1", shares[0].VirtualNodes, shares[1].VirtualNodes)
+		}
+		if f := shares[0].Fraction; f < 0.65 || f > 0.85 {
+			t.Fatalf("big owns %.3f of the ring, want about 0.75", f)
+		}
+	})
+}
+
+func TestMaxVirtualNodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		nodes   int
+		remove  int // nodes removed again afterwards
+		wantPer int
+	}{
+		{name: "no cap", nodes: 10, wantPer: 50},
+		{name: "under the cap", max: 200, nodes: 3, wantPer: 50},
+		{name: "exactly at the cap", max: 200, nodes: 4, wantPer: 50},
+		{name: "over the cap", max: 200, nodes: 8, wantPer: 25},
+		{name: "uneven split rounds down", max: 200, nodes: 9, wantPer: 22},
+		{name: "at least one each", max: 5, nodes: 10, wantPer: 1},
+		{name: "scales back up after removals", max: 200, nodes: 8, remove: 5, wantPer: 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hr := NewHashRing(50)
+			hr.SetMaxVirtualNodes(tt.max)
+			for i := 0; i < tt.nodes; i++ {
+				hr.AddNode(NodeInfo{ID: "n" + strconv.Itoa(i), Addr: "127.0.0.1:" + strconv.Itoa(9000+i)})
+			}
+			for i := 0; i < tt.remove; i++ {
+				hr.RemoveNode("n" + strconv.Itoa(i))
+			}
+			members := tt.nodes - tt.remove
+			if got := hr.perNode; got != tt.wantPer {
+				t.Fatalf("perNode = %d, want %d", got, tt.wantPer)
+			}
+			if got := hr.Len(); got != tt.wantPer*members {
+				t.Fatalf("ring holds %d virtual nodes, want %d", got, tt.wantPer*members)
+			}
+			for _, share := range hr.Distribution() {
+				if share.VirtualNodes != tt.wantPer {
+					t.Fatalf("%s has %d virtual nodes, want %d", share.Node.ID, share.VirtualNodes, tt.wantPer)
+				}
+			}
+		})
+	}
+}
+
+func TestAddNodeAfterSnapshotWithDefaultReplicas(t *testing.T) {
+	src := NewHashRing(0)
+	src.AddNode(NodeInfo{ID: "a", Addr: "127.0.0.1:9000"})
+
+	// followers load the leader's ring with replicas 0 when it runs on the default
+	hr := NewHashRing(0)
+	hr.ReplaceFromSnapshot(src.Snapshot(), 0)
+	hr.AddNode(NodeInfo{ID: "b", Addr: "127.0.0.1:9001"})
+	if got := hr.Len(); got != 2*src.Len() {
+		t.Fatalf("ring holds %d virtual nodes, want %d", got, 2*src.Len())
+	}
+}
+
+func TestAddNodesMatchesAddNode(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodes    int
+		capacity bool // every other node advertises twice the capacity
+		max      int  // SetMaxVirtualNodes
+	}{
+		{name: "plain", nodes: 20},
+		{name: "weighted", nodes: 20, capacity: true},
+		{name: "capped", nodes: 20, max: 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes := testNodes(tt.nodes, tt.capacity)
+			one, batch := NewHashRing(50), NewHashRing(50)
+			one.SetMaxVirtualNodes(tt.max)
+			batch.SetMaxVirtualNodes(tt.max)
+			for _, n := range nodes {
+				one.AddNode(n)
+			}
+			batch.AddNodes(nodes)
+
+			if !slices.Equal(one.hashes, batch.hashes) {
+				t.Fatalf("rings differ: %d vs %d virtual nodes", len(one.hashes), len(batch.hashes))
+			}
+			if !maps.Equal(one.Snapshot(), batch.Snapshot()) {
+				t.Fatal("virtual nodes map to different nodes")
+			}
+			for i := 0; i < 1000; i++ {
+				key := "user:|:key-" + strconv.Itoa(i)
+				a, _ := one.Lookup(key)
+				b, _ := batch.Lookup(key)
+				if a.ID != b.ID {
+					t.Fatalf("%s: AddNode ring says %s, AddNodes ring says %s", key, a.ID, b.ID)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAddNodes(b *testing.B) {
+	nodes := testNodes(100, false)
+	b.Run("per node", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			hr := NewHashRing(100)
+			for _, n := range nodes {
+				hr.AddNode(n)
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			NewHashRing(100).AddNodes(nodes)
+		}
+	})
+}
+
+// testNodes returns n nodes; with capacity, every other one is twice as large.
+func testNodes(n int, capacity bool) []NodeInfo {
+	nodes := make([]NodeInfo, n)
+	for i := range nodes {
+		nodes[i] = NodeInfo{ID: "n" + strconv.Itoa(i), Addr: "127.0.0.1:" + strconv.Itoa(9000+i)}
+		if capacity {
+			nodes[i].Capacity = NodeCapacity{MemoryBytes: int64(1+i%2) << 30, CPUs: 1 + i%2}
+		}
+	}
+	return nodes
+}
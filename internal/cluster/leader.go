@@ -0,0 +1,107 @@
+package cluster
+
+import "time"
+
+// Leadership is term based. The first node leads term 1; a new leader is elected
+// for a higher term when the old one's lease runs out (see the server's election
+// loop). Every node follows the leader of the highest term it has heard of, so a
+// deposed leader that comes back is ignored and steps down once it learns the term.
+
+// IsLeader reports whether this node is the current leader.
+func (cs *ClusterState) IsLeader() bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.leaderID != "" && cs.leaderID == cs.self.ID
+}
+
+// Leader returns the current leader and its term; ok is false while no leader is
+// known or the leader is not a member.
+func (cs *ClusterState) Leader() (leader NodeInfo, term uint64, ok bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if cs.leaderID == cs.self.ID {
+		return cs.self, cs.term, true
+	}
+	leader, ok = cs.nodesMap[cs.leaderID]
+	return leader, cs.term, ok
+}
+
+// Term returns the highest term this node knows.
+func (cs *ClusterState) Term() uint64 {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.term
+}
+
+// LastContact returns when the leader was last heard from (or, on the leader, when
+// it took office).
+func (cs *ClusterState) LastContact() time.Time {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.lastContact
+}
+
+// BecomeLeader makes this node the leader of term.
+func (cs *ClusterState) BecomeLeader(term uint64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.leaderID, cs.term = cs.self.ID, term
+	cs.votedTerm = max(cs.votedTerm, term)
+	cs.lastContact = time.Now()
+}
+
+// StepDown gives up leadership, leaving no known leader, so followers' leases run
+// out and they elect a new one.
+func (cs *ClusterState) StepDown() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.leaderID == cs.self.ID {
+		cs.leaderID = ""
+	}
+}
+
+// ObserveLeader records a heartbeat from leaderID for term. It adopts a higher
+// term (stepping down if this node led an older one) and renews the current
+// leader's lease; it reports false for a stale term or a rival leader of the same
+// term, which the sender should treat as a rejection.
+func (cs *ClusterState) ObserveLeader(leaderID string, term uint64) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	switch {
+	case term < cs.term:
+		return false
+	case term == cs.term && cs.leaderID != "" && cs.leaderID != leaderID:
+		return false
+	}
+	cs.leaderID, cs.term = leaderID, term
+	cs.lastContact = time.Now()
+	return true
+}
+
+// StartElection returns a fresh term for this node to campaign in and records its
+// own vote for it.
+func (cs *ClusterState) StartElection() uint64 {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.votedTerm = max(cs.term, cs.votedTerm) + 1
+	return cs.votedTerm
+}
+
+// GrantVote decides a vote request from candidate for term. A node votes at most
+// once per term, only for terms newer than it knows, and only once its own lease on
+// the current leader has run out, so a live leader isn't deposed.
+func (cs *ClusterState) GrantVote(term uint64, candidate string, lease time.Duration) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.leaderID == cs.self.ID && cs.self.ID != candidate {
+		return false
+	}
+	if term <= cs.term || term <= cs.votedTerm {
+		return false
+	}
+	if cs.leaderID != "" && time.Since(cs.lastContact) < lease {
+		return false
+	}
+	cs.votedTerm = term
+	return true
+}
@@ -1,7 +1,52 @@
 package cluster
 
+import (
+	"errors"
+	"net"
+)
+
+var (
+	ErrInvalidNodeID   = errors.New("node id is required")
+	ErrInvalidNodeAddr = errors.New("node addr must be host:port")
+	ErrNodeConflict    = errors.New("node id or addr already registered to a different node")
+	ErrUnknownNode     = errors.New("unknown node")
+	ErrInvalidCapacity = errors.New("node capacity must not be negative")
+)
+
+// NodeCapacity is the hardware a node advertises when joining. The leader turns it
+// into a ring weight so bigger nodes own a proportionally larger share of keys.
+// Zero fields mean "not advertised".
+type NodeCapacity struct {
+	MemoryBytes int64 `json:"memory_bytes,omitempty"`
+	CPUs        int   `json:"cpus,omitempty"`
+}
+
+// IsZero reports whether nothing was advertised.
+func (c NodeCapacity) IsZero() bool {
+	return c.MemoryBytes == 0 && c.CPUs == 0
+}
+
 // NodeInfo represents a cluster node identity.
 type NodeInfo struct {
 	ID   string `json:"id"`   // unique node id
 	Addr string `json:"addr"` // HTTP address, e.g. "127.0.0.1:8080"
+
+	Capacity NodeCapacity `json:"capacity,omitempty"`
+}
+
+// Validate checks that the node has an ID and a well-formed host:port address.
+func (n NodeInfo) Validate() error {
+	if n.ID == "" {
+		return ErrInvalidNodeID
+	}
+	if n.Addr == "" {
+		return ErrInvalidNodeAddr
+	}
+	if _, port, err := net.SplitHostPort(n.Addr); err != nil || port == "" {
+		return ErrInvalidNodeAddr
+	}
+	if n.Capacity.MemoryBytes < 0 || n.Capacity.CPUs < 0 {
+		return ErrInvalidCapacity
+	}
+	return nil
 }
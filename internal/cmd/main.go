@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,25 +17,107 @@ import (
 
 func main() {
 	httpAddr := flag.String("addr", ":8080", "http listen addr")
+	advertiseAddr := flag.String("advertise", "", "addr other nodes use to reach this node (default: -addr)")
 	tcpAddr := flag.String("tcp", ":9000", "tcp listen addr")
+	respAddr := flag.String("resp", "", "Redis protocol (RESP) listen addr, e.g. :6379 (empty = off)")
 	nodeID := flag.String("id", "", "node id (optional)")
 	join := flag.String("join", "", "leader http addr to join, e.g. http://127.0.0.1:8080")
 	dataDir := flag.String("data", "data", "data directory for snapshots")
+	clusterSecret := flag.String("cluster-secret", os.Getenv("CACHE_CLUSTER_SECRET"), "shared secret for internal node-to-node endpoints")
+	enableFlushAll := flag.Bool("enable-flushall", false, "allow POST /v1/admin/flushall (test environments only)")
+	advertiseCapacity := flag.Bool("advertise-capacity", false, "advertise memory/CPU so the leader weights this node's ring share")
+	lowercaseUsers := flag.Bool("lowercase-users", false, "treat user IDs case-insensitively")
+	maxValueBytes := flag.Int("max-value-bytes", 0, "reject values larger than this many bytes (0 = unlimited)")
+	snapshotFormat := flag.String("snapshot-format", string(cache.SnapshotJSON), "snapshot file encoding: json or binary")
+	compressSnapshots := flag.Bool("compress-snapshots", false, "gzip snapshot files (user_<id>.json.gz)")
+	snapshotInterval := flag.Duration("snapshot-interval", 0, "save changed users to -data this often (0 = only on request)")
+	walEnabled := flag.Bool("wal", false, "log every write to <data>/wal and replay it on startup")
+	walSync := flag.Bool("wal-sync", false, "fsync the write-ahead log after every write")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; enables TLS on all listeners and node-to-node requests")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA file that client certificates must chain to (mTLS)")
+	tlsCA := flag.String("tls-ca", "", "CA file used to verify other nodes (default: system roots)")
+	healthInterval := flag.Duration("health-interval", 2*time.Second, "leader pings members this often and removes dead ones (0 = off)")
+	vnodes := flag.Int("vnodes", 10, "virtual nodes per node on the hash ring")
+	replicationFactor := flag.Int("replication-factor", 3, "nodes holding each key, the primary included (1 = no replicas)")
+	writeConsistency := flag.String("write-consistency", server.ConsistencyOne, "holders that must acknowledge a write: one, quorum or all")
+	readConsistency := flag.String("read-consistency", server.ConsistencyOne, "holders a read must hear from: one, quorum or all")
+	healthFailures := flag.Int("health-failures", 3, "consecutive failed pings before a member is removed")
+	rebalanceRate := flag.Float64("rebalance-rate", 1000, "keys per second moved to new owners after a membership change (0 = unlimited)")
+	leaderLease := flag.Duration("leader-lease", 10*time.Second, "elect a new leader after hearing nothing from it this long")
+	leaveOnShutdown := flag.Bool("leave-on-shutdown", true, "leave the cluster and hand off keys before shutting down")
+	requireAuth := flag.Bool("require-auth", false, "require AUTH <userID> <password> on TCP and RESP connections")
+	authSecret := flag.String("auth-secret", os.Getenv("CACHE_AUTH_SECRET"), "password for users without their own -auth-users entry")
+	authUsers := flag.String("auth-users", os.Getenv("CACHE_AUTH_USERS"), "per-user passwords as user:password,user:password")
+	eviction := flag.String("eviction", string(cache.EvictLRU), "per-user eviction policy: lru, lfu or random")
 	flag.Parse()
 
 	cfg := cache.DefaultConfig()
 	cfg.DataDir = *dataDir
+	cfg.MaxValueBytes = *maxValueBytes
+	cfg.CompressSnapshots = *compressSnapshots
+	cfg.WALEnabled = *walEnabled
+	cfg.WALSync = *walSync
+	if *lowercaseUsers {
+		cfg.NormalizeUserID = strings.ToLower
+	}
+	switch p := cache.EvictionPolicy(*eviction); p {
+	case cache.EvictLRU, cache.EvictLFU, cache.EvictRandom:
+		cfg.EvictionPolicy = p
+	default:
+		log.Fatalf("unknown eviction policy %q", *eviction)
+	}
+	switch f := cache.SnapshotFormat(*snapshotFormat); f {
+	case cache.SnapshotJSON, cache.SnapshotBinary:
+		cfg.SnapshotFormat = f
+	default:
+		log.Fatalf("unknown snapshot format %q", *snapshotFormat)
+	}
+
+	passwords := make(map[string]string)
+	for _, entry := range strings.Split(*authUsers, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		user, pw, ok := strings.Cut(entry, ":")
+		if !ok || user == "" {
+			// never echo the entry: it holds a password
+			log.Fatalf("malformed -auth-users entry (want user:password)")
+		}
+		passwords[user] = pw
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalf("-tls-cert and -tls-key must be set together")
+	}
+	if *requireAuth && *authSecret == "" && len(passwords) == 0 {
+		log.Fatalf("-require-auth needs -auth-secret or -auth-users")
+	}
 
 	c := cache.NewCache(cfg)
 
 	// restore any saved users on startup (best-effort)
-	if _, err := c.LoadAllUsersFromDir(); err != nil {
+	if report, err := c.LoadAllUsersFromDirReport(); err != nil {
 		fmt.Println("warning: unable to load snapshots:", err)
+	} else {
+		fmt.Printf("loaded %d user snapshots in %s (%d skipped)\n", report.Loaded, report.Duration.Round(time.Millisecond), len(report.Failed))
+		for name, err := range report.Failed {
+			fmt.Printf("warning: skipped snapshot %s: %v\n", name, err)
+		}
+	}
+	// then the writes made after those snapshots, before any new ones are accepted
+	if cfg.WALEnabled {
+		report, err := c.ReplayWAL()
+		if err != nil {
+			log.Fatalf("replay write-ahead log: %v", err)
+		}
+		fmt.Printf("replayed %d wal records from %d segments in %s\n", report.Records, report.Segments, report.Duration.Round(time.Millisecond))
 	}
 
 	srvConfig := server.ServerConfig{
 		HTTPAddr:              *httpAddr,
+		AdvertiseAddr:         *advertiseAddr,
 		TCPAddr:               *tcpAddr,
+		RESPAddr:              *respAddr,
 		CmdTimeout:            5 * time.Second,
 		ReadTimeout:           10 * time.Second,
 		WriteTimeout:          10 * time.Second,
@@ -42,15 +125,36 @@ func main() {
 		ShutdownTimeout:       5 * time.Second,
 		NodeID:                *nodeID,
 		JoinAddr:              *join,
-		ClusterReplicas:       10,
+		VirtualNodes:          *vnodes,
+		ReplicationFactor:     *replicationFactor,
+		WriteConsistency:      *writeConsistency,
+		ReadConsistency:       *readConsistency,
 		PollInterval:          2 * time.Second,
+		LeaderLease:           *leaderLease,
+		HealthCheckInterval:   *healthInterval,
+		HealthCheckFailures:   *healthFailures,
+		RebalanceKeysPerSec:   *rebalanceRate,
 		ReplicationWorkers:    4,
 		ReplicationQueueSize:  100,
 		ReplicationTimeout:    300 * time.Millisecond,
 		ReplicationMaxRetries: 3,
+		ClusterSecret:         *clusterSecret,
+		TLSCertFile:           *tlsCert,
+		TLSKeyFile:            *tlsKey,
+		TLSClientCAFile:       *tlsClientCA,
+		TLSCAFile:             *tlsCA,
+		RequireAuth:           *requireAuth,
+		AuthSecret:            *authSecret,
+		AuthUsers:             passwords,
+		EnableFlushAll:        *enableFlushAll,
+		AdvertiseCapacity:     *advertiseCapacity,
+		SnapshotInterval:      *snapshotInterval,
 	}
 
-	s := server.NewServer(c, srvConfig)
+	s, err := server.NewServer(c, srvConfig)
+	if err != nil {
+		log.Fatalf("configure server: %v", err)
+	}
 
 	if err := s.Start(); err != nil {
 		log.Fatalf("start server: %v", err)
@@ -64,6 +168,17 @@ func main() {
 	<-sig
 	fmt.Println("shutting down...")
 
+	if *leaveOnShutdown {
+		// before Shutdown, so the handoff runs while this node still serves and replicates
+		leaveCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if report, err := s.LeaveCluster(leaveCtx); err != nil {
+			fmt.Println("warning: leave cluster:", err)
+		} else if report.Keys > 0 {
+			fmt.Printf("left the cluster: handed off %d keys (%d failed) in %s\n", report.Keys, report.Failed, report.Duration.Round(time.Millisecond))
+		}
+		cancel()
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := s.Shutdown(ctx); err != nil {
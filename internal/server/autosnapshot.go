@@ -0,0 +1,35 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// snapshotLoop saves users changed since the last cycle every SnapshotInterval, and
+// once more on shutdown so writes since the last tick aren't lost.
+func (s *Server) snapshotLoop() {
+	ticker := time.NewTicker(s.cfg.SnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdownCh:
+			s.snapshotDirty()
+			return
+		case <-ticker.C:
+			s.snapshotDirty()
+		}
+	}
+}
+
+// snapshotDirty runs one background snapshot cycle and logs how it went.
+func (s *Server) snapshotDirty() {
+	report := s.cache.SnapshotDirty()
+	for uid, err := range report.Failed {
+		log.Printf("[server] auto snapshot: user %s err: %v", uid, err)
+	}
+	if report.Saved > 0 || len(report.Failed) > 0 {
+		log.Printf("[server] auto snapshot: saved %d users (%d unchanged, %d failed) in %s",
+			report.Saved, report.Unchanged, len(report.Failed), report.Duration.Round(time.Millisecond))
+	}
+}
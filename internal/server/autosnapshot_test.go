@@ -0,0 +1,27 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+)
+
+func TestAutoSnapshot(t *testing.T) {
+	cc := testCacheConfig(t)
+	n := startNodeWithCache(t, ServerConfig{SnapshotInterval: 20 * time.Millisecond}, cache.NewCache(cc))
+	n.set(t, "alice", "k", "v1")
+
+	waitFor(t, 5*time.Second, func() bool {
+		snap, err := n.c.LoadUserFromFile("alice")
+		return err == nil && len(snap.Items) == 1 && string(snap.Items[0].Value) == "v1"
+	})
+
+	// a write right before shutdown is saved by the final cycle
+	n.set(t, "alice", "k", "v2")
+	n.stop()
+	snap, err := n.c.LoadUserFromFile("alice")
+	if err != nil || len(snap.Items) != 1 || string(snap.Items[0].Value) != "v2" {
+		t.Fatalf("snapshot after shutdown = %+v, %v; want k=v2", snap, err)
+	}
+}
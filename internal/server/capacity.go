@@ -0,0 +1,55 @@
+package server
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+// selfCapacity returns the capacity this node advertises when joining. Configured
+// values win; otherwise CPUs come from the runtime and memory from /proc/meminfo
+// (left zero where unavailable). Nothing is advertised unless AdvertiseCapacity is set.
+func (s *Server) selfCapacity() cluster.NodeCapacity {
+	if !s.cfg.AdvertiseCapacity {
+		return cluster.NodeCapacity{}
+	}
+
+	c := cluster.NodeCapacity{
+		MemoryBytes: s.cfg.CapacityMemoryBytes,
+		CPUs:        s.cfg.CapacityCPUs,
+	}
+	if c.CPUs == 0 {
+		c.CPUs = runtime.NumCPU()
+	}
+	if c.MemoryBytes == 0 {
+		c.MemoryBytes = totalMemory()
+	}
+	return c
+}
+
+// totalMemory reads MemTotal from /proc/meminfo; 0 if unavailable.
+func totalMemory() int64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// MemTotal:       16318684 kB
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb * 1024
+		}
+	}
+	return 0
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+func TestSelfCapacity(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ServerConfig
+		want cluster.NodeCapacity
+	}{
+		{name: "not advertised", cfg: ServerConfig{CapacityCPUs: 4, CapacityMemoryBytes: 1 << 30}},
+		{name: "configured", cfg: ServerConfig{AdvertiseCapacity: true, CapacityCPUs: 4, CapacityMemoryBytes: 1 << 30}, want: cluster.NodeCapacity{CPUs: 4, MemoryBytes: 1 << 30}},
+		{name: "detected", cfg: ServerConfig{AdvertiseCapacity: true}, want: cluster.NodeCapacity{CPUs: runtime.NumCPU(), MemoryBytes: totalMemory()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{cfg: tt.cfg}
+			if got := s.selfCapacity(); got != tt.want {
+				t.Fatalf("selfCapacity = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdvertisedCapacityWeightsRing(t *testing.T) {
+	// a, b and c advertise 1, 2 and 3 units of memory and CPU
+	weights := map[string]int{"a": 1, "b": 2, "c": 3}
+	var nodes []*testNode
+	for _, id := range []string{"a", "b", "c"} {
+		cfg := ServerConfig{
+			NodeID:              id,
+			VirtualNodes:        200, // the average node (weight 2) gets 200
+			AdvertiseCapacity:   true,
+			CapacityCPUs:        weights[id],
+			CapacityMemoryBytes: int64(weights[id]) << 30,
+		}
+		if len(nodes) > 0 {
+			cfg.JoinAddr = nodes[0].url
+		}
+		nodes = append(nodes, startNode(t, cfg))
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		for _, n := range nodes {
+			if len(n.s.cluster.Nodes()) != 3 {
+				return false
+			}
+		}
+		return true
+	})
+
+	// every node sees the same weighted ring. Owned fractions depend on where the
+	// (random-port) addresses hash to, so only the virtual node counts are exact.
+	for _, n := range nodes {
+		code, body := n.do(t, http.MethodGet, "/v1/cluster/distribution", "", nil)
+		var resp distributionResponse
+		if err := json.Unmarshal(body, &resp); err != nil || code != http.StatusOK {
+			t.Fatalf("distribution = %d %s", code, body)
+		}
+		shares := make(map[string]cluster.NodeShare, len(resp.Nodes))
+		for _, s := range resp.Nodes {
+			shares[s.Node.ID] = s
+		}
+		self := n.s.cluster.Self().ID
+		for id, w := range weights {
+			if got, want := shares[id].VirtualNodes, 100*w; got != want {
+				t.Errorf("%s sees %s with %d virtual nodes, want %d", self, id, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+// nodeKeysResult is one node's share of a user's keys.
+type nodeKeysResult struct {
+	Keys  []string `json:"keys"`
+	Found bool     `json:"found"` // whether the node knows the user at all
+}
+
+// keysLocal lists this node's live keys of the user matching pattern.
+func (s *Server) keysLocal(uid, pattern string) (nodeKeysResult, error) {
+	keys, err := s.cache.ListKeysMatch(uid, pattern)
+	if err == cache.ErrUserNotFound {
+		return nodeKeysResult{}, nil
+	}
+	if err != nil {
+		return nodeKeysResult{}, err
+	}
+	return nodeKeysResult{Keys: keys, Found: true}, nil
+}
+
+// keysCluster collects the user's keys from every node, since they are spread over
+// the ring, and returns their union (replicas make duplicates). Keys keep each node's
+// order, nodes are taken by ID, so a single node lists exactly what it holds. found
+// reports whether any node knows the user; failed lists nodes that didn't answer.
+func (s *Server) keysCluster(ctx context.Context, timeout time.Duration, uid, pattern string) (keys []string, found bool, failed []failedNode) {
+	path := "/v1/internal/keys?user=" + url.QueryEscape(uid) + "&pattern=" + url.QueryEscape(pattern)
+
+	results, failed := scatterGather(ctx, s.cluster.Nodes(), timeout,
+		func(ctx context.Context, node cluster.NodeInfo) (nodeKeysResult, error) {
+			if s.isSelf(node) {
+				return s.keysLocal(uid, pattern)
+			}
+			var out nodeKeysResult
+			err := s.callInternal(ctx, http.MethodGet, node.Addr, path, nil, &out)
+			return out, err
+		})
+
+	ids := make([]string, 0, len(results))
+	for id := range results {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	seen := make(map[string]struct{})
+	keys = []string{}
+	for _, id := range ids {
+		res := results[id]
+		found = found || res.Found
+		for _, k := range res.Keys {
+			if _, dup := seen[k]; !dup {
+				seen[k] = struct{}{}
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys, found, failed
+}
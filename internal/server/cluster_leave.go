@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+// Leaving the cluster (LeaveCluster, then Shutdown) happens in this order so writes
+// aren't lost:
+//
+//  1. A leader first hands leadership to another live member (handOverLeadership),
+//     since the leader can't remove itself from the ring.
+//  2. The leader removes the node from the ring (POST /v1/cluster/leave) and the node
+//     adopts the new ring at once: from then on it forwards every request it gets,
+//     and other nodes stop routing to it on their next poll of the leader.
+//  3. The node hands off every key it holds to the key's owner and replicas under the
+//     new ring, with the original write timestamps, so a newer write that already
+//     reached the new owner wins over the handed-off copy.
+//  4. Shutdown drains in-flight HTTP and TCP requests, then sends what is still in
+//     the replication queue, which covers writes that were being applied locally
+//     while the ring changed. Failed sends waiting on their retry backoff are dropped
+//     at this point, so LeaveReport.Failed keys may not reach every new holder.
+
+var (
+	errLeaderCannotLeave = errors.New("the leader cannot leave the cluster")
+	errNoLeader          = errors.New("no leader is known")
+)
+
+type leaveRequest struct {
+	NodeID string `json:"node_id"`
+}
+
+// LeaveReport describes a LeaveCluster call.
+type LeaveReport struct {
+	Keys     int           // keys handed off
+	Failed   int           // keys not acknowledged by every new holder (retried in the background)
+	Duration time.Duration // total time, handoff included
+}
+
+// LeaveCluster asks the leader to remove this node from the ring and hands off the
+// keys it holds to their new owners. On the leader it hands leadership over first.
+// Call it before Shutdown when scaling down.
+func (s *Server) LeaveCluster(ctx context.Context) (*LeaveReport, error) {
+	start := time.Now()
+	self := s.cluster.Self()
+	nodes := s.cluster.Nodes()
+	if len(nodes) <= 1 {
+		return &LeaveReport{Duration: time.Since(start)}, nil // nobody to leave or hand off to
+	}
+	var leader cluster.NodeInfo
+	if s.cluster.IsLeader() {
+		successor, err := s.handOverLeadership(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("leave: %w", err)
+		}
+		leader = successor
+	} else {
+		var ok bool
+		if leader, _, ok = s.cluster.Leader(); !ok {
+			return nil, errNoLeader
+		}
+	}
+
+	var state cluster.StatePayload
+	if err := s.callInternal(ctx, http.MethodPost, leader.Addr, "/v1/cluster/leave", leaveRequest{NodeID: self.ID}, &state); err != nil {
+		return nil, fmt.Errorf("leave: %w", err)
+	}
+	s.cluster.ReplaceFromPayload(state)
+
+	sent, failed := s.handoffKeys(ctx)
+	report := &LeaveReport{Keys: sent, Failed: failed, Duration: time.Since(start)}
+	log.Printf("[server] left the cluster: handed off %d keys (%d failed) in %s", sent, failed, report.Duration.Round(time.Millisecond))
+	return report, nil
+}
+
+// handoffKeys sends every live local key to its owner and replicas under the current
+// ring (except this node), keeping its timestamp and absolute expiry. It returns the
+// number of keys sent and of keys some target did not acknowledge; those are retried
+// by the replicator like any failed replication.
+func (s *Server) handoffKeys(ctx context.Context) (sent, failed int) {
+	for _, uid := range s.cache.ListUsers() {
+		snap, err := s.cache.SnapshotUser(uid)
+		if err != nil {
+			continue
+		}
+		now := time.Now()
+		for _, it := range snap.Items {
+			if ctx.Err() != nil {
+				return sent, failed
+			}
+			if !it.ExpiresAt.IsZero() && !it.ExpiresAt.After(now) {
+				continue
+			}
+			tasks := s.handoffTasks(uid, it.Key, it.Value, it.ExpiresAt, it.Timestamp)
+			if len(tasks) == 0 {
+				continue
+			}
+			sent++
+			for _, ack := range s.replicator.replicateSync(ctx, tasks) {
+				if !ack.Acked {
+					failed++
+					break
+				}
+			}
+		}
+	}
+	return sent, failed
+}
+
+// handoffTasks builds replication tasks sending a key to every node that should hold
+// it under the current ring: its owner (pins included) and replicas, minus this node.
+func (s *Server) handoffTasks(uid, key string, value []byte, expiresAt time.Time, timestamp int64) []replicationTask {
+	hashKey := uid + ":|:" + key
+	var targets []cluster.NodeInfo
+	if owner, ok := s.cluster.LookupOwner(hashKey); ok {
+		targets = append(targets, owner)
+	}
+	for _, n := range s.replicaNodes(hashKey) {
+		if !isMember(targets, n.ID) {
+			targets = append(targets, n)
+		}
+	}
+
+	var exp, ttlSec int64
+	if !expiresAt.IsZero() {
+		exp = expiresAt.UnixNano()
+		ttlSec = int64((time.Until(expiresAt) + time.Second - 1) / time.Second)
+	}
+	tasks := make([]replicationTask, 0, len(targets))
+	for _, n := range targets {
+		if s.isSelf(n) {
+			continue
+		}
+		tasks = append(tasks, replicationTask{
+			To:        n,
+			UserID:    uid,
+			Key:       key,
+			Value:     value,
+			TTLSec:    ttlSec,
+			ExpiresAt: exp,
+			Timestamp: timestamp,
+		})
+	}
+	return tasks
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLeaveCluster(t *testing.T) {
+	nodes := startCluster(t, 3, ServerConfig{ClusterSecret: "s3cret"})
+	a, c := nodes[0], nodes[2]
+
+	// keys c owns, written through a
+	var keys []string
+	for i := 0; len(keys) < 5; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if owner, _ := a.s.cluster.LookupOwner("alice:|:" + key); owner.ID == "c" {
+			a.set(t, "alice", key, "v"+key)
+			keys = append(keys, key)
+		}
+	}
+	// one with a TTL keeps its expiry through the handoff
+	if _, err := c.c.Set("alice", keys[0], []byte("v"+keys[0]), time.Hour, time.Now().UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _ := a.doWith(t, http.MethodPost, "/v1/cluster/leave", "", leaveRequest{NodeID: "a"}, http.Header{"X-Cluster-Secret": {"s3cret"}}); code != http.StatusConflict {
+		t.Fatalf("leader removing itself = %d, want 409", code)
+	}
+	if code, _ := a.doWith(t, http.MethodPost, "/v1/cluster/leave", "", leaveRequest{NodeID: "zz"}, http.Header{"X-Cluster-Secret": {"s3cret"}}); code != http.StatusNotFound {
+		t.Fatalf("leave of unknown node = %d, want 404", code)
+	}
+	if code, _ := a.do(t, http.MethodPost, "/v1/cluster/leave", "", leaveRequest{NodeID: "c"}); code != http.StatusUnauthorized {
+		t.Fatalf("leave without cluster secret = %d, want 401", code)
+	}
+
+	report, err := c.s.LeaveCluster(context.Background())
+	if err != nil {
+		t.Fatalf("leave: %v", err)
+	}
+	if report.Keys != len(keys) || report.Failed != 0 {
+		t.Fatalf("report = %+v, want %d keys handed off", report, len(keys))
+	}
+	c.stop()
+
+	waitFor(t, 5*time.Second, func() bool {
+		return len(a.s.cluster.Nodes()) == 2 && len(nodes[1].s.cluster.Nodes()) == 2
+	})
+	for _, key := range keys {
+		for _, n := range nodes[:2] {
+			if code, v := n.get(t, "alice", key); code != http.StatusOK || v != "v"+key {
+				t.Fatalf("get %s via %s after leave = %d %q", key, n.s.cluster.Self().ID, code, v)
+			}
+		}
+	}
+	owner, _ := a.s.cluster.LookupOwner("alice:|:" + keys[0])
+	holder := a
+	if owner.ID == "b" {
+		holder = nodes[1]
+	}
+	if ttl, err := holder.c.TTL("alice", keys[0]); err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("handed-off TTL = %v, %v", ttl, err)
+	}
+}
+
+func TestLeaderLeavesCluster(t *testing.T) {
+	nodes := startCluster(t, 3, ServerConfig{})
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	key := keyOwnedBy(t, a, "alice", "a")
+	a.set(t, "alice", key, "v")
+
+	report, err := a.s.LeaveCluster(context.Background())
+	if err != nil {
+		t.Fatalf("leader leave: %v", err)
+	}
+	if report.Keys == 0 || report.Failed != 0 {
+		t.Fatalf("report = %+v, want keys handed off", report)
+	}
+	if a.s.cluster.IsLeader() {
+		t.Fatal("a still leads after leaving")
+	}
+	a.stop()
+
+	// b, the smallest remaining ID, took over; c follows it
+	waitFor(t, 5*time.Second, func() bool {
+		for _, n := range []*testNode{b, c} {
+			leader, _, ok := n.s.cluster.Leader()
+			if !ok || leader.ID != "b" || len(n.s.cluster.Nodes()) != 2 {
+				return false
+			}
+		}
+		return true
+	})
+	for _, n := range []*testNode{b, c} {
+		if code, v := n.get(t, "alice", key); code != http.StatusOK || v != "v" {
+			t.Fatalf("get via %s after the leader left = %d %q", n.s.cluster.Self().ID, code, v)
+		}
+	}
+}
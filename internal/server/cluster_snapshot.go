@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+// nodeSnapshotResult is one node's part of a cluster-wide snapshot or restore.
+type nodeSnapshotResult struct {
+	Keys int `json:"keys"`
+}
+
+// snapshotLocal saves this node's share of the user to its DataDir. A node that holds
+// nothing for the user drops any older snapshot, so a later restore can't resurrect it.
+func (s *Server) snapshotLocal(uid string) (nodeSnapshotResult, error) {
+	snap, err := s.cache.SnapshotUser(uid)
+	if err == cache.ErrUserNotFound {
+		return nodeSnapshotResult{}, s.cache.RemoveUserSnapshot(uid)
+	}
+	if err != nil {
+		return nodeSnapshotResult{}, err
+	}
+	if _, err := s.cache.SaveUserToFile(snap); err != nil {
+		return nodeSnapshotResult{}, err
+	}
+	return nodeSnapshotResult{Keys: len(snap.Items)}, nil
+}
+
+// restoreLocal restores this node's share of the user from its DataDir. A node without
+// a snapshot for the user has nothing to restore.
+func (s *Server) restoreLocal(uid string) (nodeSnapshotResult, error) {
+	snap, err := s.cache.LoadUserFromFile(uid)
+	if errors.Is(err, os.ErrNotExist) {
+		return nodeSnapshotResult{}, nil
+	}
+	if err != nil {
+		return nodeSnapshotResult{}, err
+	}
+	if err := s.cache.RestoreUserFromSnapshot(snap); err != nil {
+		return nodeSnapshotResult{}, err
+	}
+	return nodeSnapshotResult{Keys: len(snap.Items)}, nil
+}
+
+// snapshotCluster runs snapshotLocal (restore=false) or restoreLocal (restore=true)
+// on every node, since a user's keys are spread across the ring.
+func (s *Server) snapshotCluster(ctx context.Context, uid string, restore bool) (map[string]nodeSnapshotResult, []failedNode) {
+	path := "/v1/internal/snapshot?user=" + url.QueryEscape(uid)
+	local := s.snapshotLocal
+	if restore {
+		path = "/v1/internal/restore?user=" + url.QueryEscape(uid)
+		local = s.restoreLocal
+	}
+
+	self := s.cluster.Self()
+	return scatterGather(ctx, s.cluster.Nodes(), s.cfg.CmdTimeout,
+		func(ctx context.Context, node cluster.NodeInfo) (nodeSnapshotResult, error) {
+			if node.ID == self.ID {
+				return local(uid)
+			}
+			var out nodeSnapshotResult
+			err := s.callInternal(ctx, http.MethodPost, node.Addr, path, nil, &out)
+			return out, err
+		})
+}
+
+// flushLocal empties this node's share of the user. A node that has never seen the
+// user has nothing to flush.
+func (s *Server) flushLocal(uid string) error {
+	if err := s.cache.Flush(uid); err != nil && err != cache.ErrUserNotFound {
+		return err
+	}
+	return nil
+}
+
+// flushCluster runs flushLocal on every node. Flush is its own operation rather than
+// per-key replication: owners and replicas of the user's keys are spread over the
+// whole ring, so every node drops its share, user and janitor stay in place.
+func (s *Server) flushCluster(ctx context.Context, uid string) (map[string]flushUserResult, []failedNode) {
+	path := "/v1/internal/flush-user?user=" + url.QueryEscape(uid)
+
+	self := s.cluster.Self()
+	return scatterGather(ctx, s.cluster.Nodes(), s.cfg.CmdTimeout,
+		func(ctx context.Context, node cluster.NodeInfo) (flushUserResult, error) {
+			if node.ID == self.ID {
+				return flushUserResult{Status: "ok"}, s.flushLocal(uid)
+			}
+			var out flushUserResult
+			err := s.callInternal(ctx, http.MethodPost, node.Addr, path, nil, &out)
+			return out, err
+		})
+}
+
+// failedNodeIDs joins the IDs of failed nodes for short error replies.
+func failedNodeIDs(failed []failedNode) string {
+	ids := make([]string, len(failed))
+	for i, f := range failed {
+		ids[i] = f.ID
+	}
+	return strings.Join(ids, ",")
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestClusterSnapshotRoundTrip(t *testing.T) {
+	nodes := startCluster(t, 2, ServerConfig{})
+	a, b := nodes[0], nodes[1]
+
+	keys := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		key := "key-" + strconv.Itoa(i)
+		keys[key] = "v" + strconv.Itoa(i)
+		a.set(t, "alice", key, keys[key])
+	}
+	for _, n := range nodes {
+		if ks, _ := n.c.ListKeys("alice"); len(ks) == 0 {
+			t.Fatalf("%s holds none of alice's keys; the test needs them spread", n.s.cluster.Self().ID)
+		}
+	}
+
+	c := dialTCP(t, b.tcp)
+	if got := c.cmd(t, "SNAPSHOT alice"); got != "OK nodes=2" {
+		t.Fatalf("snapshot = %q", got)
+	}
+
+	// change everything after the snapshot
+	for key := range keys {
+		b.set(t, "alice", key, "changed")
+	}
+	b.set(t, "alice", "extra", "v")
+
+	if got := c.cmd(t, "RESTORE alice"); got != "OK nodes=2" {
+		t.Fatalf("restore = %q", got)
+	}
+	for key, want := range keys {
+		for _, n := range nodes {
+			if code, v := n.get(t, "alice", key); code != http.StatusOK || v != want {
+				t.Fatalf("%s via %s = %d %q after restore, want %q", key, n.s.cluster.Self().ID, code, v, want)
+			}
+		}
+	}
+	if code, _ := a.get(t, "alice", "extra"); code != http.StatusNotFound {
+		t.Fatalf("key written after the snapshot = %d after restore, want 404", code)
+	}
+
+	if got := c.cmd(t, "RESTORE bob"); got != "ERR snapshot not found" {
+		t.Fatalf("restore without a snapshot = %q", got)
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+// Consistency levels for ServerConfig.WriteConsistency and ReadConsistency, counted
+// over the nodes that hold a key (its owner and replicas, ReplicationFactor in all).
+// A write at QUORUM or ALL is acknowledged by that many holders, the owner's own
+// write included, before /v1/set answers; a read at QUORUM or ALL asks every holder,
+// needs that many replies and answers with the newest value by write timestamp. ONE
+// (or unset) keeps writes asynchronous (unless WriteAcks is set) and reads served by
+// the owner alone. Only the HTTP API honours these levels.
+const (
+	ConsistencyOne    = "one"
+	ConsistencyQuorum = "quorum"
+	ConsistencyAll    = "all"
+)
+
+var errReadQuorum = errors.New("read quorum not met")
+
+// quorum is a majority of n.
+func quorum(n int) int {
+	return n/2 + 1
+}
+
+// holdersNeeded returns how many of n holders a consistency level requires.
+func holdersNeeded(level string, n int) int {
+	switch level {
+	case ConsistencyQuorum:
+		return quorum(n)
+	case ConsistencyAll:
+		return n
+	}
+	return 1
+}
+
+// validConsistency reports whether level (lower-cased) is a known consistency level;
+// unset means ONE.
+func validConsistency(level string) bool {
+	switch level {
+	case "", ConsistencyOne, ConsistencyQuorum, ConsistencyAll:
+		return true
+	}
+	return false
+}
+
+// syncWrites reports whether writes wait for replica acknowledgements.
+func (s *Server) syncWrites() bool {
+	return s.cfg.WriteAcks > 0 || s.cfg.WriteConsistency == ConsistencyQuorum || s.cfg.WriteConsistency == ConsistencyAll
+}
+
+// replicaAcksNeeded returns how many of replicas (the holders besides this node) must
+// acknowledge a write: WriteConsistency if set, else WriteAcks.
+func (s *Server) replicaAcksNeeded(replicas int) int {
+	if s.cfg.WriteConsistency == "" {
+		return min(s.cfg.WriteAcks, replicas)
+	}
+	return holdersNeeded(s.cfg.WriteConsistency, replicas+1) - 1 // this node's write counts
+}
+
+// versionedValue is one holder's copy of a key.
+type versionedValue struct {
+	value     []byte
+	timestamp int64
+	found     bool
+}
+
+// readConsistent reads uid/key from every holder, each within timeout, and returns
+// the newest value among the replies with the node it came from. It returns
+// errReadQuorum if fewer holders than ReadConsistency requires replied, and
+// cache.ErrKeyNotFound if none of those that did has the key.
+func (s *Server) readConsistent(ctx context.Context, uid, key string, timeout time.Duration) ([]byte, cluster.NodeInfo, error) {
+	hashKey := uid + ":|:" + key
+	holders := s.replicaNodes(hashKey)
+	if owner, ok := s.cluster.LookupOwner(hashKey); ok && !isMember(holders, owner.ID) {
+		holders = append([]cluster.NodeInfo{owner}, holders...) // no replicas configured
+	}
+
+	results, failed := scatterGather(ctx, holders, timeout, func(ctx context.Context, node cluster.NodeInfo) (versionedValue, error) {
+		var (
+			val []byte
+			ts  int64
+			err error
+		)
+		if s.isSelf(node) {
+			var item cache.Item
+			item, err = s.cache.Peek(uid, key)
+			val, ts = item.Value, item.Timestamp
+		} else {
+			val, ts, err = s.fetchReplica(ctx, node, uid, key)
+		}
+		switch err {
+		case nil:
+			return versionedValue{value: val, timestamp: ts, found: true}, nil
+		case cache.ErrKeyNotFound, cache.ErrUserNotFound:
+			return versionedValue{}, nil
+		}
+		return versionedValue{}, err
+	})
+
+	if len(results) < holdersNeeded(s.cfg.ReadConsistency, len(holders)) {
+		for _, f := range failed {
+			log.Printf("[http] consistent read %s/%s from %s: %s", uid, key, f.ID, f.Error)
+		}
+		return nil, cluster.NodeInfo{}, errReadQuorum
+	}
+
+	var newest versionedValue
+	var from cluster.NodeInfo
+	for _, node := range holders {
+		if v, ok := results[node.ID]; ok && v.found && (!newest.found || v.timestamp > newest.timestamp) {
+			newest, from = v, node
+		}
+	}
+	if !newest.found {
+		return nil, cluster.NodeInfo{}, cache.ErrKeyNotFound
+	}
+	return newest.value, from, nil
+}
+
+// getConsistent answers /v1/get at ReadConsistency. Any node can coordinate the read,
+// so it isn't forwarded to the owner first.
+func (s *Server) getConsistent(w http.ResponseWriter, r *http.Request, uid, key string) {
+	timeout, err := s.requestTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	val, _, err := s.readConsistent(ctx, uid, key, timeout)
+	switch err {
+	case nil:
+		s.writeValue(w, val)
+	case cache.ErrKeyNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+)
+
+func TestHoldersNeeded(t *testing.T) {
+	tests := []struct {
+		level string
+		n     int
+		want  int
+	}{
+		{level: "", n: 3, want: 1},
+		{level: ConsistencyOne, n: 3, want: 1},
+		{level: ConsistencyQuorum, n: 1, want: 1},
+		{level: ConsistencyQuorum, n: 2, want: 2},
+		{level: ConsistencyQuorum, n: 3, want: 2},
+		{level: ConsistencyQuorum, n: 5, want: 3},
+		{level: ConsistencyAll, n: 3, want: 3},
+	}
+	for _, tt := range tests {
+		if got := holdersNeeded(tt.level, tt.n); got != tt.want {
+			t.Errorf("holdersNeeded(%q, %d) = %d, want %d", tt.level, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestWriteConsistency(t *testing.T) {
+	for _, tt := range []struct {
+		level   string
+		downOne int // status with one replica down
+		downTwo int // status with both replicas down
+	}{
+		{level: "QUORUM", downOne: http.StatusOK, downTwo: http.StatusGatewayTimeout},
+		{level: "ALL", downOne: http.StatusGatewayTimeout, downTwo: http.StatusGatewayTimeout},
+	} {
+		t.Run(tt.level, func(t *testing.T) {
+			nodes := startCluster(t, 3, ServerConfig{VirtualNodes: 50, ReplicationFactor: 3, WriteConsistency: tt.level,
+				ReplicationTimeout: 200 * time.Millisecond, ReplicationMaxRetries: 1})
+			a := nodes[0]
+			key := keyOwnedBy(t, a, "alice", "a")
+
+			set := func() (int, setResponse) {
+				code, body := a.do(t, http.MethodPost, "/v1/set", "alice", map[string]any{"key": key, "value": "v"})
+				var resp setResponse
+				_ = json.Unmarshal(body, &resp)
+				return code, resp
+			}
+			if code, resp := set(); code != http.StatusOK || resp.Acks != 2 {
+				t.Fatalf("write with every replica up = %d %+v, want 200 with 2 acks", code, resp)
+			}
+
+			nodes[2].stop()
+			if code, resp := set(); code != tt.downOne || resp.Acks != 1 {
+				t.Fatalf("write with one replica down = %d %+v, want %d with 1 ack", code, resp, tt.downOne)
+			}
+			nodes[1].stop()
+			if code, resp := set(); code != tt.downTwo || resp.Status != "insufficient_acks" {
+				t.Fatalf("write with both replicas down = %d %+v, want %d insufficient_acks", code, resp, tt.downTwo)
+			}
+		})
+	}
+}
+
+func TestReadConsistency(t *testing.T) {
+	nodes := startCluster(t, 3, ServerConfig{VirtualNodes: 50, ReplicationFactor: 3, ReadConsistency: ConsistencyQuorum})
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	key := keyOwnedBy(t, a, "alice", "a")
+
+	// the owner's copy is stale; b holds a newer write, c none at all
+	now := time.Now().UnixNano()
+	if _, err := a.c.Set("alice", key, []byte("old"), 0, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.c.Set("alice", key, []byte("new"), 0, now+1); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		if code, v := n.get(t, "alice", key); code != http.StatusOK || v != "new" {
+			t.Fatalf("get via %s = %d %q, want the newest value", n.s.cluster.Self().ID, code, v)
+		}
+	}
+	if code, _ := c.get(t, "alice", "missing"); code != http.StatusNotFound {
+		t.Fatalf("get of a missing key = %d, want 404", code)
+	}
+
+	b.stop()
+	if code, v := c.get(t, "alice", key); code != http.StatusOK || v != "old" {
+		t.Fatalf("get with a quorum left = %d %q, want the old value", code, v)
+	}
+	c.stop()
+	if code, _ := a.get(t, "alice", key); code != http.StatusGatewayTimeout {
+		t.Fatalf("get without a quorum = %d, want 504", code)
+	}
+}
+
+func TestNewServerRejectsUnknownConsistency(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ServerConfig
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "known levels, any case", cfg: ServerConfig{WriteConsistency: "QUORUM", ReadConsistency: "All"}},
+		{name: "one", cfg: ServerConfig{WriteConsistency: ConsistencyOne, ReadConsistency: ConsistencyOne}},
+		{name: "misspelt write level", cfg: ServerConfig{WriteConsistency: "quorom"}, wantErr: true},
+		{name: "misspelt read level", cfg: ServerConfig{ReadConsistency: "majority"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewServer(cache.NewCache(testCacheConfig(t)), tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewServer err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && s == nil {
+				t.Fatal("NewServer returned neither a server nor an error")
+			}
+		})
+	}
+}
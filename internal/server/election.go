@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+// Leader election. The node that starts the cluster leads term 1. Every PollInterval
+// the leader sends a heartbeat (POST /v1/cluster/heartbeat) with its term to every
+// member; a majority of acknowledgements renews its lease, and a leader that cannot
+// renew within LeaderLease steps down. Followers renew the lease on each heartbeat
+// and on each poll the leader answers.
+//
+// When a follower's lease runs out, the smallest-ID member that still answers
+// /v1/ping (the old leader excluded) asks every member for its vote in a new term
+// (POST /v1/cluster/vote). Members vote once per term and only once their own lease
+// has run out, so a live leader isn't deposed. With a majority of the current
+// members the candidate leads the new term and removes the old leader from the ring.
+// A node that hears of a higher term follows its leader, so a deposed leader steps
+// down as soon as it talks to the cluster again.
+
+const defaultLeaseIntervals = 5 // default LeaderLease in PollIntervals
+
+type heartbeatRequest struct {
+	LeaderID string `json:"leader_id"`
+	Term     uint64 `json:"term"`
+}
+
+type heartbeatResponse struct {
+	Accepted bool   `json:"accepted"`
+	LeaderID string `json:"leader_id,omitempty"` // leader as the receiver sees it
+	Term     uint64 `json:"term"`
+}
+
+type voteRequest struct {
+	CandidateID string `json:"candidate_id"`
+	Term        uint64 `json:"term"`
+}
+
+type voteResponse struct {
+	Granted bool   `json:"granted"`
+	Term    uint64 `json:"term"`
+}
+
+// electionLoop sends heartbeats while leading and holds elections when the lease
+// runs out, until shutdown.
+func (s *Server) electionLoop() {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-s.shutdownCh:
+			return
+		case <-ticker.C:
+			leader, term, ok := s.cluster.Leader()
+			switch {
+			case ok && leader.ID == s.cluster.Self().ID:
+				if s.sendHeartbeats(term) {
+					renewed = time.Now()
+				} else if s.cluster.IsLeader() && time.Since(renewed) > s.cfg.LeaderLease {
+					log.Printf("[election] lost contact with a majority; stepping down as leader of term %d", term)
+					s.cluster.StepDown()
+				}
+			case time.Since(s.cluster.LastContact()) > s.cfg.LeaderLease:
+				if s.shouldCampaign(leader.ID) && s.campaign(leader.ID) {
+					renewed = time.Now()
+				}
+			}
+		}
+	}
+}
+
+// sendHeartbeats sends a heartbeat for term to every other member and reports
+// whether a majority of members (this node included) accepted it. A member that
+// knows a higher term makes this node follow that term's leader.
+func (s *Server) sendHeartbeats(term uint64) bool {
+	self := s.cluster.Self()
+	members := s.cluster.Nodes()
+	req := heartbeatRequest{LeaderID: self.ID, Term: term}
+
+	results, _ := scatterGather(context.Background(), peersOf(members, self.ID), s.cfg.PollInterval,
+		func(ctx context.Context, node cluster.NodeInfo) (heartbeatResponse, error) {
+			var resp heartbeatResponse
+			err := s.callInternal(ctx, http.MethodPost, node.Addr, "/v1/cluster/heartbeat", req, &resp)
+			return resp, err
+		})
+
+	acks := 1
+	for _, resp := range results {
+		if resp.Term > term {
+			log.Printf("[election] node %s is in term %d; following %s", self.ID, resp.Term, resp.LeaderID)
+			s.cluster.ObserveLeader(resp.LeaderID, resp.Term)
+			return false
+		}
+		if resp.Accepted {
+			acks++
+		}
+	}
+	return acks*2 > len(members)
+}
+
+// shouldCampaign reports whether this node is the smallest-ID live member besides
+// oldLeader, i.e. the one that should stand for election.
+func (s *Server) shouldCampaign(oldLeader string) bool {
+	self := s.cluster.Self()
+	for _, n := range s.cluster.Nodes() {
+		switch n.ID {
+		case oldLeader:
+			continue
+		case self.ID:
+			return true
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.PollInterval)
+		_, err := s.pingNode(ctx, n)
+		cancel()
+		if err == nil {
+			return false // a smaller live node will run
+		}
+	}
+	return false
+}
+
+// campaign asks every other member for its vote in a new term and takes over as
+// leader with a majority, removing oldLeader from the ring. It reports whether it won.
+func (s *Server) campaign(oldLeader string) bool {
+	self := s.cluster.Self()
+	members := s.cluster.Nodes()
+	term := s.cluster.StartElection()
+	req := voteRequest{CandidateID: self.ID, Term: term}
+
+	results, _ := scatterGather(context.Background(), peersOf(members, self.ID), s.cfg.PollInterval,
+		func(ctx context.Context, node cluster.NodeInfo) (voteResponse, error) {
+			var resp voteResponse
+			err := s.callInternal(ctx, http.MethodPost, node.Addr, "/v1/cluster/vote", req, &resp)
+			return resp, err
+		})
+
+	votes := 1
+	for _, resp := range results {
+		if resp.Granted {
+			votes++
+		}
+	}
+	if votes*2 <= len(members) {
+		return false
+	}
+
+	s.cluster.BecomeLeader(term)
+	if oldLeader != "" && oldLeader != self.ID {
+		s.cluster.RemoveNode(oldLeader)
+	}
+	log.Printf("[election] %s elected leader of term %d with %d/%d votes", self.ID, term, votes, len(members))
+	s.sendHeartbeats(term)
+	return true
+}
+
+// handleHeartbeat renews the lease of the sending leader, or tells it of a newer term.
+func (s *Server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var req heartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.LeaderID == "" {
+		http.Error(w, "leader_id and term are required", http.StatusBadRequest)
+		return
+	}
+	accepted := s.cluster.ObserveLeader(req.LeaderID, req.Term)
+	leader, term, _ := s.cluster.Leader()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(heartbeatResponse{Accepted: accepted, LeaderID: leader.ID, Term: term})
+}
+
+// handleVote answers a candidate's vote request.
+func (s *Server) handleVote(w http.ResponseWriter, r *http.Request) {
+	var req voteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CandidateID == "" {
+		http.Error(w, "candidate_id and term are required", http.StatusBadRequest)
+		return
+	}
+	granted := s.cluster.GrantVote(req.Term, req.CandidateID, s.cfg.LeaderLease)
+	if granted {
+		log.Printf("[election] voted for %s in term %d", req.CandidateID, req.Term)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(voteResponse{Granted: granted, Term: s.cluster.Term()})
+}
+
+// handOverLeadership makes another member leader of the next term so this node can
+// leave. The successor is the smallest-ID member that answers /v1/ping; it is sent a
+// heartbeat naming itself leader of that term, which it adopts like any newer term,
+// and the other members are told the same so they don't wait out their lease.
+func (s *Server) handOverLeadership(ctx context.Context) (cluster.NodeInfo, error) {
+	self := s.cluster.Self()
+	var successor cluster.NodeInfo
+	for _, n := range peersOf(s.cluster.Nodes(), self.ID) {
+		pingCtx, cancel := context.WithTimeout(ctx, s.cfg.PollInterval)
+		_, err := s.pingNode(pingCtx, n)
+		cancel()
+		if err == nil {
+			successor = n
+			break
+		}
+	}
+	if successor.ID == "" {
+		return cluster.NodeInfo{}, errors.New("no live member to hand leadership to")
+	}
+
+	req := heartbeatRequest{LeaderID: successor.ID, Term: s.cluster.Term() + 1}
+	var resp heartbeatResponse
+	if err := s.callInternal(ctx, http.MethodPost, successor.Addr, "/v1/cluster/heartbeat", req, &resp); err != nil {
+		return cluster.NodeInfo{}, fmt.Errorf("hand leadership to %s: %w", successor.ID, err)
+	}
+	if !resp.Accepted {
+		return cluster.NodeInfo{}, fmt.Errorf("%s refused leadership of term %d", successor.ID, req.Term)
+	}
+	s.cluster.ObserveLeader(successor.ID, req.Term)
+	log.Printf("[election] %s handed leadership to %s for term %d", self.ID, successor.ID, req.Term)
+
+	// best effort: the successor's own heartbeats reach anyone missed here
+	scatterGather(ctx, peersOf(peersOf(s.cluster.Nodes(), self.ID), successor.ID), s.cfg.PollInterval,
+		func(ctx context.Context, node cluster.NodeInfo) (heartbeatResponse, error) {
+			var resp heartbeatResponse
+			err := s.callInternal(ctx, http.MethodPost, node.Addr, "/v1/cluster/heartbeat", req, &resp)
+			return resp, err
+		})
+	return successor, nil
+}
+
+// peersOf returns nodes without the one with ID self.
+func peersOf(nodes []cluster.NodeInfo, self string) []cluster.NodeInfo {
+	peers := make([]cluster.NodeInfo, 0, len(nodes))
+	for _, n := range nodes {
+		if n.ID != self {
+			peers = append(peers, n)
+		}
+	}
+	return peers
+}
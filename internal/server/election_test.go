@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLeaderElection(t *testing.T) {
+	nodes := startCluster(t, 3, ServerConfig{ClusterSecret: "s3cret", LeaderLease: 500 * time.Millisecond})
+	a, b, c := nodes[0], nodes[1], nodes[2]
+
+	for _, n := range nodes {
+		if leader, term, ok := n.s.cluster.Leader(); !ok || leader.ID != "a" || term != 1 {
+			t.Fatalf("%s sees leader %q term %d, want a in term 1", n.s.cluster.Self().ID, leader.ID, term)
+		}
+	}
+	// heartbeats keep the leader in office past the lease
+	time.Sleep(time.Second)
+	if !a.s.cluster.IsLeader() || b.s.cluster.IsLeader() || c.s.cluster.IsLeader() {
+		t.Fatal("leadership moved while the leader was alive")
+	}
+
+	a.stop()
+
+	// b is the smallest live node, so it takes over, and c follows
+	waitFor(t, 5*time.Second, func() bool {
+		leader, term, ok := c.s.cluster.Leader()
+		return b.s.cluster.IsLeader() && ok && leader.ID == "b" && term > 1 && term == b.s.cluster.Term()
+	})
+	if c.s.cluster.IsLeader() {
+		t.Fatal("c also believes it leads")
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		return len(b.s.cluster.Nodes()) == 2 && len(c.s.cluster.Nodes()) == 2
+	})
+
+	// the new leader accepts joins, including ones sent to a follower
+	d := startNode(t, ServerConfig{NodeID: "d", ClusterSecret: "s3cret", JoinAddr: c.url})
+	waitFor(t, 5*time.Second, func() bool {
+		return len(b.s.cluster.Nodes()) == 3 && len(c.s.cluster.Nodes()) == 3
+	})
+	if leader, term, _ := d.s.cluster.Leader(); leader.ID != "b" || term != b.s.cluster.Term() {
+		t.Fatalf("d sees leader %q term %d, want b in term %d", leader.ID, term, b.s.cluster.Term())
+	}
+	if code, _ := c.do(t, http.MethodPost, "/v1/cluster/pin", "", pinRequest{UserID: "alice", Key: "k", NodeID: "d"}); code != http.StatusOK {
+		t.Fatalf("pin via follower = %d, want 200", code)
+	}
+}
+
+func TestStaleLeaderStepsDown(t *testing.T) {
+	nodes := startCluster(t, 3, ServerConfig{ClusterSecret: "s3cret", LeaderLease: 500 * time.Millisecond})
+	a, b := nodes[0], nodes[1]
+
+	// a newer term elsewhere deposes a on its next heartbeat
+	b.s.cluster.BecomeLeader(5)
+	waitFor(t, 5*time.Second, func() bool {
+		leader, term, ok := a.s.cluster.Leader()
+		return !a.s.cluster.IsLeader() && ok && leader.ID == "b" && term == 5
+	})
+	if code, _ := a.do(t, http.MethodPost, "/v1/cluster/vote", "", voteRequest{CandidateID: "c", Term: 6}); code != http.StatusUnauthorized {
+		t.Fatalf("vote without cluster secret = %d, want 401", code)
+	}
+}
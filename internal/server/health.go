@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+// Health checks run on every node but only act on the leader: each
+// HealthCheckInterval it pings every other member's /v1/ping, and a member that fails
+// HealthCheckFailures checks in a row is removed from the ring, so its keys re-route
+// to the survivors. Followers see the removal through their usual PollLeader sync.
+// A removed node has to join again once it recovers.
+
+const defaultHealthCheckFailures = 3
+
+// healthLoop runs health checks until shutdown.
+func (s *Server) healthLoop() {
+	ticker := time.NewTicker(s.cfg.HealthCheckInterval)
+	defer ticker.Stop()
+
+	failures := make(map[string]int) // node ID -> consecutive failed checks
+	for {
+		select {
+		case <-s.shutdownCh:
+			return
+		case <-ticker.C:
+			if !s.cluster.IsLeader() {
+				clear(failures)
+				continue
+			}
+			s.checkHealth(failures)
+		}
+	}
+}
+
+// checkHealth pings every other member once, updates failures and removes members
+// that reached the threshold.
+func (s *Server) checkHealth(failures map[string]int) {
+	peers := peersOf(s.cluster.Nodes(), s.cluster.Self().ID)
+
+	healthy, failed := scatterGather(context.Background(), peers, s.healthCheckTimeout(), s.pingNode)
+
+	// forget nodes that left or answered
+	for id := range failures {
+		if _, ok := healthy[id]; ok || !isMember(peers, id) {
+			delete(failures, id)
+		}
+	}
+	for _, f := range failed {
+		failures[f.ID]++
+		if failures[f.ID] < s.cfg.HealthCheckFailures {
+			log.Printf("[health] node %s (%s) failed check %d/%d: %s", f.ID, f.Addr, failures[f.ID], s.cfg.HealthCheckFailures, f.Error)
+			continue
+		}
+		log.Printf("[health] node %s (%s) unhealthy after %d failed checks; removing it from the ring", f.ID, f.Addr, failures[f.ID])
+		s.cluster.RemoveNode(f.ID)
+		delete(failures, f.ID)
+	}
+}
+
+// pingNode checks that node answers /v1/ping with 200.
+func (s *Server) pingNode(ctx context.Context, node cluster.NodeInfo) (struct{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.nodeURL(node.Addr)+"/v1/ping", nil)
+	if err != nil {
+		return struct{}{}, err
+	}
+	resp, err := s.forwardClient.Do(req)
+	if err != nil {
+		return struct{}{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return struct{}{}, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return struct{}{}, nil
+}
+
+// healthCheckTimeout bounds one ping: HealthCheckTimeout, else the check interval.
+func (s *Server) healthCheckTimeout() time.Duration {
+	if s.cfg.HealthCheckTimeout > 0 {
+		return s.cfg.HealthCheckTimeout
+	}
+	return s.cfg.HealthCheckInterval
+}
+
+func isMember(nodes []cluster.NodeInfo, id string) bool {
+	for _, n := range nodes {
+		if n.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckRemovesDeadNode(t *testing.T) {
+	nodes := startCluster(t, 3, ServerConfig{
+		HealthCheckInterval: 50 * time.Millisecond,
+		HealthCheckFailures: 2,
+	})
+
+	// healthy members survive several rounds
+	time.Sleep(300 * time.Millisecond)
+	if got := len(nodes[0].s.cluster.Nodes()); got != 3 {
+		t.Fatalf("leader sees %d nodes with all healthy, want 3", got)
+	}
+
+	nodes[2].stop()
+	// the leader removes c, and the follower picks that up from the leader's state
+	waitFor(t, 5*time.Second, func() bool {
+		for _, n := range nodes[:2] {
+			if len(n.s.cluster.Nodes()) != 2 {
+				return false
+			}
+		}
+		return true
+	})
+	for i := 0; i < 100; i++ {
+		key := "alice:|:key-" + strconv.Itoa(i)
+		if owner, _ := nodes[1].s.cluster.LookupOwner(key); owner.ID == "c" {
+			t.Fatalf("%s still owned by removed node c", key)
+		}
+	}
+	nodes[0].set(t, "alice", "k", "v")
+	if code, v := nodes[1].get(t, "alice", "k"); v != "v" {
+		t.Fatalf("get after removal = %d %q", code, v)
+	}
+}
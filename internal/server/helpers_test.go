@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+)
+
+// testNode is a started Server listening on loopback ports.
+type testNode struct {
+	s   *Server
+	c   *cache.Cache
+	url string // http://host:port (https with TLS)
+	tcp string // host:port
+
+	client *http.Client // trusts the node's certificate when it serves TLS
+}
+
+// freeAddr returns a loopback address with a port that was free a moment ago.
+func freeAddr(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// testCacheConfig is the cache config test nodes use, with snapshots in a temp dir.
+func testCacheConfig(t testing.TB) cache.Config {
+	t.Helper()
+	cfg := cache.DefaultConfig()
+	cfg.MaxEntries = 0
+	cfg.DataDir = t.TempDir()
+	return cfg
+}
+
+// startNode starts a server on free ports with a fresh cache. Fields left zero in cfg
+// get the server defaults; the node is shut down when the test ends.
+func startNode(t testing.TB, cfg ServerConfig) *testNode {
+	t.Helper()
+	return startNodeWithCache(t, cfg, cache.NewCache(testCacheConfig(t)))
+}
+
+func startNodeWithCache(t testing.TB, cfg ServerConfig, c *cache.Cache) *testNode {
+	t.Helper()
+	if cfg.HTTPAddr == "" {
+		cfg.HTTPAddr = freeAddr(t)
+	}
+	if cfg.TCPAddr == "" {
+		cfg.TCPAddr = freeAddr(t)
+	}
+	if cfg.NodeID == "" {
+		cfg.NodeID = cfg.HTTPAddr
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = 100 * time.Millisecond
+	}
+
+	s, err := NewServer(c, cfg)
+	if err != nil {
+		t.Fatalf("new server %s: %v", cfg.NodeID, err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("start %s: %v", cfg.NodeID, err)
+	}
+	n := &testNode{s: s, c: c, url: s.nodeURL(cfg.HTTPAddr), tcp: cfg.TCPAddr, client: http.DefaultClient}
+	if cfg.TLSCertFile != "" {
+		n.client = &http.Client{Transport: s.forwardClient.Transport}
+	}
+	t.Cleanup(func() { n.stop() })
+
+	waitFor(t, 5*time.Second, func() bool {
+		resp, err := n.client.Get(n.url + "/v1/ping")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+	return n
+}
+
+// stop shuts the node down; calling it again is a no-op.
+func (n *testNode) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = n.s.Shutdown(ctx)
+}
+
+// startCluster starts size nodes, the first one leading and the others joining it,
+// and waits until every node sees all of them.
+func startCluster(t *testing.T, size int, cfg ServerConfig) []*testNode {
+	t.Helper()
+	nodes := make([]*testNode, 0, size)
+	for i := 0; i < size; i++ {
+		c := cfg
+		c.NodeID = string(rune('a' + i))
+		if i > 0 {
+			c.JoinAddr = nodes[0].url
+		}
+		nodes = append(nodes, startNode(t, c))
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		for _, n := range nodes {
+			if len(n.s.cluster.Nodes()) != size {
+				return false
+			}
+		}
+		return true
+	})
+	return nodes
+}
+
+// keyOwnedBy returns a key of user whose owner (as n sees the ring) is nodeID.
+func keyOwnedBy(t *testing.T, n *testNode, user, nodeID string) string {
+	t.Helper()
+	for i := 0; i < 10000; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if owner, ok := n.s.cluster.LookupOwner(user + ":|:" + key); ok && owner.ID == nodeID {
+			return key
+		}
+	}
+	t.Fatalf("no key of %s owned by %s", user, nodeID)
+	return ""
+}
+
+// waitFor polls cond until it holds, failing the test after timeout.
+func waitFor(t testing.TB, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met within %v", timeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// do sends a request to the node with X-User-Id user (if set) and a JSON body (if
+// not nil), and returns the status code and response body.
+func (n *testNode) do(t *testing.T, method, path, user string, body any) (int, []byte) {
+	t.Helper()
+	return n.doWith(t, method, path, user, body, nil)
+}
+
+func (n *testNode) doWith(t *testing.T, method, path, user string, body any, header http.Header) (int, []byte) {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, n.url+path, r)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	for k, vv := range header {
+		req.Header[k] = vv
+	}
+	if user != "" {
+		req.Header.Set("X-User-Id", user)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, data
+}
+
+// set writes key=value for user through the node's HTTP API.
+func (n *testNode) set(t *testing.T, user, key, value string) {
+	t.Helper()
+	code, body := n.do(t, http.MethodPost, "/v1/set", user, map[string]any{"key": key, "value": value})
+	if code != http.StatusOK {
+		t.Fatalf("set %s/%s: %d %s", user, key, code, body)
+	}
+}
+
+// get reads key for user through the node's HTTP API and returns the status code
+// and, on 200, the value.
+func (n *testNode) get(t *testing.T, user, key string) (int, string) {
+	t.Helper()
+	code, body := n.do(t, http.MethodGet, "/v1/get?key="+key, user, nil)
+	if code != http.StatusOK {
+		return code, ""
+	}
+	var v valueResponse
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("decode get: %v (%s)", err, body)
+	}
+	return code, v.Value
+}
+
+// holds reports whether n has user/key locally.
+func (n *testNode) holds(user, key string) bool {
+	_, err := n.c.Peek(user, key)
+	return err == nil
+}
+
+// lineClient speaks the line protocol to a node's TCP listener.
+type lineClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTCP(t testing.TB, addr string) *lineClient {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &lineClient{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// cmd sends one command line and returns the first reply line, without the newline.
+func (c *lineClient) cmd(t testing.TB, line string) string {
+	t.Helper()
+	_ = c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		t.Fatalf("write %q: %v", line, err)
+	}
+	return c.line(t)
+}
+
+// line reads the next reply line.
+func (c *lineClient) line(t testing.TB) string {
+	t.Helper()
+	reply, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	return strings.TrimRight(reply, "\r\n")
+}
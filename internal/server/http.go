@@ -2,39 +2,117 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/sanke08/Distributed-Cache/internal/cluster"
 )
 
 var (
 	errMissingUser = errors.New("missing user ID")
+	errReadOnly    = errors.New("node is read-only")
+
+	// errClusterNotReady is returned while the ring has no nodes (during startup or after a bad sync).
+	errClusterNotReady = errors.New("cluster not ready")
 )
 
 func registerHTTPHandlers(mux *http.ServeMux, s *Server) {
 	mux.HandleFunc("POST /v1/user", s.handleUserCreate)
 	mux.HandleFunc("DELETE /v1/user/{userID}", s.handleUserDelete)
+	mux.HandleFunc("GET /v1/users", s.handleUsers)
 	mux.HandleFunc("POST /v1/set", s.handleSet)
+	mux.HandleFunc("POST /v1/getorset", s.handleGetOrSet)
+	mux.HandleFunc("POST /v1/mset", s.handleMSet)
+	mux.HandleFunc("POST /v1/mget", s.handleMGet)
+	mux.HandleFunc("POST /v1/setifstale", s.handleSetIfStale)
+	mux.HandleFunc("POST /v1/setnx", s.handleSetNX)
+	mux.HandleFunc("POST /v1/getset", s.handleGetSet)
+	mux.HandleFunc("POST /v1/incr", s.handleIncr)
+	mux.HandleFunc("POST /v1/decr", s.handleIncr)
 	mux.HandleFunc("GET /v1/get", s.handleGet)
+	mux.HandleFunc("GET /v1/ttl", s.handleTTL)
+	mux.HandleFunc("POST /v1/expire", s.handleExpire)
+	mux.HandleFunc("POST /v1/persist", s.handleExpire)
 	mux.HandleFunc("DELETE /v1/delete", s.handleDelete)
 	mux.HandleFunc("GET /v1/keys", s.handleKeys)
+	mux.HandleFunc("GET /v1/scan", s.handleScan)
+	mux.HandleFunc("GET /v1/near-expiry", s.handleNearExpiry)
 	mux.HandleFunc("GET /v1/ping", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte(`{"status":"ok"}`))
 	})
 
+	mux.HandleFunc("GET /v1/ready", s.handleReady)
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+	mux.HandleFunc("GET /v1/stats/json", s.handleStatsJSON)
+	mux.HandleFunc("GET /v1/stats", s.handleUserStats)
+
 	// persistence endpoint
 	mux.HandleFunc("POST /v1/user/snapshot", s.handleSaveSnapshot)   // POST {user_id} or header
 	mux.HandleFunc("POST /v1/user/restore", s.handleRestoreSnapshot) // POST {user_id} or header
+	mux.HandleFunc("POST /v1/flush", s.handleFlushUser)
+	mux.HandleFunc("POST /v1/snapshot/all", s.handleSnapshotAll) // admin: every local user
 
 	// cluster
 	mux.HandleFunc("POST /v1/cluster/join", s.handleClusterJoin)
+	mux.HandleFunc("POST /v1/cluster/leave", s.requireClusterSecret(s.handleClusterLeave))
+	mux.HandleFunc("POST /v1/cluster/heartbeat", s.requireClusterSecret(s.handleHeartbeat))
+	mux.HandleFunc("POST /v1/cluster/vote", s.requireClusterSecret(s.handleVote))
 	mux.HandleFunc("GET /v1/cluster/state", s.handleStat)
+	mux.HandleFunc("GET /v1/cluster/distribution", s.handleDistribution)
+	mux.HandleFunc("POST /v1/cluster/pin", s.handlePinKey)
+	mux.HandleFunc("DELETE /v1/cluster/pin", s.handleUnpinKey)
 
 	// replication
-	mux.HandleFunc("/v1/internal/replicate", s.handleInternalReplicate)
+	mux.HandleFunc("/v1/internal/replicate", s.requireClusterSecret(s.handleInternalReplicate))
+	mux.HandleFunc("POST /v1/internal/replicate-raw", s.requireClusterSecret(s.handleInternalReplicateRaw))
+	mux.HandleFunc("GET /v1/internal/digest", s.requireClusterSecret(s.handleInternalDigest))
+	mux.HandleFunc("GET /v1/internal/merkle", s.requireClusterSecret(s.handleInternalMerkle))
+	mux.HandleFunc("POST /v1/internal/flush", s.requireClusterSecret(s.handleInternalFlush))
+	mux.HandleFunc("POST /v1/internal/flush-user", s.requireClusterSecret(s.handleInternalFlushUser))
+	mux.HandleFunc("POST /v1/internal/snapshot", s.requireClusterSecret(s.handleInternalSnapshot))
+	mux.HandleFunc("POST /v1/internal/restore", s.requireClusterSecret(s.handleInternalRestore))
+	mux.HandleFunc("GET /v1/internal/keys", s.requireClusterSecret(s.handleInternalKeys))
+	mux.HandleFunc("GET /v1/internal/get", s.requireClusterSecret(s.handleInternalGet))
+
+	// admin
+	mux.HandleFunc("GET /v1/admin/readonly", s.handleReadOnlyGet)
+	mux.HandleFunc("POST /v1/admin/readonly", s.requireClusterSecret(s.handleReadOnlySet))
+	mux.HandleFunc("POST /v1/admin/recompute-stats", s.handleRecomputeStats)
+	mux.HandleFunc("POST /v1/admin/check-invariants", s.handleCheckInvariants)
+	mux.HandleFunc("DELETE /v1/admin/users", s.handleDeleteUsersMatch)
+	mux.HandleFunc("GET /v1/admin/dump-keys", s.handleDumpKeys)
+	mux.HandleFunc("GET /v1/admin/connections", s.handleConnections)
+	mux.HandleFunc("GET /v1/admin/operations", s.handleOperations)
+	mux.HandleFunc("GET /v1/admin/under-replicated", s.handleUnderReplicated)
+	mux.HandleFunc("POST /v1/admin/repair", s.handleRepair)
+	mux.HandleFunc("DELETE /v1/admin/operations/{id}", s.handleCancelOperation)
+	mux.HandleFunc("GET /v1/admin/compare", s.handleCompare)
+	mux.HandleFunc("GET /v1/admin/disk", s.handleDisk)
+	mux.HandleFunc("POST /v1/admin/flushall", s.requireClusterSecret(s.handleFlushAll))
+	mux.HandleFunc("GET /v1/admin/slowlog", s.handleSlowLog)
+	mux.HandleFunc("POST /v1/admin/undelete", s.handleUndelete)
+	mux.HandleFunc("GET /v1/admin/owned", s.handleOwnedKeys)
+}
+
+type setResponse struct {
+	Status   string       `json:"status"`
+	Created  bool         `json:"created"`
+	Acks     int          `json:"acks,omitempty"`     // replica acks, synchronous writes only
+	Replicas []replicaAck `json:"replicas,omitempty"` // per-replica results with ?verbose=true
+	Outcome  string       `json:"outcome,omitempty"`  // with too few acks: degraded, rolled_back, rollback_skipped or repair_scheduled
+}
+
+type getOrSetResponse struct {
+	Value string `json:"value"`
+	Set   bool   `json:"set"` // true if this request stored the value
 }
 
 type valueResponse struct {
@@ -42,46 +120,239 @@ type valueResponse struct {
 }
 
 type keyResponse struct {
-	Keys []string `json:"keys"`
+	Keys   []string     `json:"keys"`
+	Failed []failedNode `json:"failed,omitempty"` // nodes whose keys are missing from Keys
+}
+
+type distributionResponse struct {
+	Nodes []cluster.NodeShare `json:"nodes"`
 }
 
-func userIDFromHeader(r *http.Request) (string, error) {
+// userIDFromHeader returns the normalized X-User-Id, so ring hashing agrees with the cache.
+func (s *Server) userIDFromHeader(r *http.Request) (string, error) {
 	userID := r.Header.Get("X-User-Id")
 	if userID == "" {
 		return "", errMissingUser
 	}
-	return userID, nil
+	return s.cache.NormalizeUserID(userID), nil
+}
+
+// readJSONBody decodes the request body into v and restores r.Body, so the same
+// request can still be forwarded to the owner afterwards. The body is capped at
+// MaxRequestBodyBytes; the buffered bytes are shared with the forward, not copied.
+func (s *Server) readJSONBody(w http.ResponseWriter, r *http.Request, v any) error {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.cfg.MaxRequestBodyBytes))
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeBodyError responds 413 when the body exceeded the size cap and 400 otherwise.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "invalid json", http.StatusBadRequest)
+}
+
+// parseDurationParam parses a Go duration ("1m30s") or a plain number of seconds.
+func parseDurationParam(v string) (time.Duration, error) {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// timeoutHeader lets a client shorten the server-side deadline of a request.
+const timeoutHeader = "X-Timeout-Ms"
+
+// requestTimeout returns the deadline budget for r: X-Timeout-Ms when set, capped at
+// CmdTimeout. Forwarded requests keep the header, so the owner applies it too.
+func (s *Server) requestTimeout(r *http.Request) (time.Duration, error) {
+	v := r.Header.Get(timeoutHeader)
+	if v == "" {
+		return s.cfg.CmdTimeout, nil
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, errors.New("invalid " + timeoutHeader)
+	}
+	return min(time.Duration(ms)*time.Millisecond, s.cfg.CmdTimeout), nil
+}
+
+// writeClusterNotReady responds 503 with a Retry-After hint while the ring is empty.
+func writeClusterNotReady(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, errClusterNotReady.Error(), http.StatusServiceUnavailable)
+}
+
+// clusterReady reports whether the ring can route keys.
+func (s *Server) clusterReady() bool {
+	return s.cluster != nil && s.cluster.Ready()
+}
+
+// clusterSecretHeader carries the shared cluster secret on node-to-node requests.
+const clusterSecretHeader = "X-Cluster-Secret"
+
+// setClusterSecret attaches the cluster secret to an outgoing node-to-node request.
+func setClusterSecret(req *http.Request, secret string) {
+	if secret != "" {
+		req.Header.Set(clusterSecretHeader, secret)
+	}
+}
+
+// requireClusterSecret rejects requests without the configured cluster secret with 401.
+// When no secret is configured every request is allowed.
+func (s *Server) requireClusterSecret(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.ClusterSecret != "" {
+			got := r.Header.Get(clusterSecretHeader)
+			if subtle.ConstantTimeCompare([]byte(got), []byte(s.cfg.ClusterSecret)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// rejectIfReadOnly writes a 503 and returns true when the node is in read-only mode.
+func (s *Server) rejectIfReadOnly(w http.ResponseWriter) bool {
+	if !s.readOnly.Load() {
+		return false
+	}
+	http.Error(w, errReadOnly.Error(), http.StatusServiceUnavailable)
+	return true
+}
+
+// acquireForwardSlot reserves one of the owner's forwarding slots without blocking.
+// It returns false when the owner already has MaxForwardsPerOwner requests in flight.
+func (s *Server) acquireForwardSlot(addr string) (release func(), ok bool) {
+	s.forwardMu.Lock()
+	slots, found := s.forwardSlots[addr]
+	if !found {
+		slots = make(chan struct{}, s.cfg.MaxForwardsPerOwner)
+		s.forwardSlots[addr] = slots
+	}
+	s.forwardMu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	default:
+		return nil, false
+	}
+}
+
+// forwardSource identifies who a forwarded request is on behalf of: the user when
+// known, otherwise the client IP.
+func forwardSource(r *http.Request) string {
+	if uid := r.Header.Get("X-User-Id"); uid != "" {
+		return "user:" + uid
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// acquireSourceSlot counts an in-flight forward for source. It returns false when the
+// source already has MaxForwardsPerSource forwards in flight.
+func (s *Server) acquireSourceSlot(source string) bool {
+	s.forwardMu.Lock()
+	defer s.forwardMu.Unlock()
+	if s.sourceInFlight[source] >= s.cfg.MaxForwardsPerSource {
+		return false
+	}
+	s.sourceInFlight[source]++
+	return true
+}
+
+func (s *Server) releaseSourceSlot(source string) {
+	s.forwardMu.Lock()
+	defer s.forwardMu.Unlock()
+	if s.sourceInFlight[source] <= 1 {
+		delete(s.sourceInFlight, source)
+		return
+	}
+	s.sourceInFlight[source]--
 }
 
 // forwardToOwner forwards the incoming HTTP request to the owner node and copies response back.
+// Concurrent forwards per owner are bounded; excess requests get 503 instead of piling up.
 func (s *Server) forwardToOwner(owner cluster.NodeInfo, w http.ResponseWriter, r *http.Request) {
-	client := &http.Client{Timeout: s.cfg.CmdTimeout}
+	if err := s.tryForward(r.Context(), owner, w, r); err != nil {
+		http.Error(w, "forward error", http.StatusBadGateway)
+	}
+}
+
+// errOwnerUnreachable is returned by tryForward when the owner could not be reached;
+// nothing has been written to the response then.
+var errOwnerUnreachable = errors.New("owner unreachable")
+
+// tryForward is forwardToOwner bounded by ctx, except that when the owner can't be
+// reached it writes nothing and returns errOwnerUnreachable, so the caller can fall back.
+func (s *Server) tryForward(ctx context.Context, owner cluster.NodeInfo, w http.ResponseWriter, r *http.Request) error {
+	t := s.startOp(opForward, r)
+	t.user, t.key = r.Header.Get("X-User-Id"), r.URL.Query().Get("key")
+	defer t.finish()
+
+	// per-source fairness first, so one client can't eat every owner slot
+	source := forwardSource(r)
+	if !s.acquireSourceSlot(source) {
+		http.Error(w, "too many in-flight forwards", http.StatusTooManyRequests)
+		return nil
+	}
+	defer s.releaseSourceSlot(source)
+
+	release, ok := s.acquireForwardSlot(owner.Addr)
+	if !ok {
+		http.Error(w, "owner busy", http.StatusServiceUnavailable)
+		return nil
+	}
+	defer release()
+
 	// build URL to same path on owner
-	url := "http://" + owner.Addr + r.URL.Path
+	url := s.nodeURL(owner.Addr) + r.URL.Path
 
 	if r.URL.RawQuery != "" {
 		url += "?" + r.URL.RawQuery
 	}
-	// create new request
+	// stream the body instead of buffering it again: handlers that decoded it already
+	// hold it in memory (readJSONBody), others pass the client's stream straight through,
+	// capped at MaxRequestBodyBytes
 	var body io.Reader
-	if r.Body != nil {
-		// we need to read body and recreate because r.Body is a stream; safe approach: read all
-		data, _ := io.ReadAll(r.Body)
-		r.Body.Close()
-		body = bytes.NewReader(data)
-		// also restore r.Body for potential re-use (not necessary here)
-	}
-	req, err := http.NewRequest(r.Method, url, body)
+	if r.Body != nil && r.Body != http.NoBody {
+		body = http.MaxBytesReader(w, r.Body, s.cfg.MaxRequestBodyBytes)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, url, body)
 	if err != nil {
 		http.Error(w, "forward error", http.StatusInternalServerError)
-		return
+		return nil
 	}
+	req.ContentLength = r.ContentLength
+	req.GetBody = r.GetBody
 	// copy headers, especially X-User-ID
 	req.Header = r.Header.Clone()
-	resp, err := client.Do(req)
+	setClusterSecret(req, s.cfg.ClusterSecret)
+	resp, err := s.forwardClient.Do(req)
 	if err != nil {
-		http.Error(w, "forward error", http.StatusBadGateway)
-		return
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		return errOwnerUnreachable
 	}
 
 	defer resp.Body.Close()
@@ -93,4 +364,5 @@ func (s *Server) forwardToOwner(owner cluster.NodeInfo, w http.ResponseWriter, r
 	}
 	w.WriteHeader(resp.StatusCode)
 	_, _ = io.Copy(w, resp.Body)
+	return nil
 }
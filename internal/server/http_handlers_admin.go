@@ -0,0 +1,655 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+type readOnlyRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+type readOnlyResponse struct {
+	ReadOnly bool `json:"read_only"`
+}
+
+type deleteUsersResponse struct {
+	OperationID string            `json:"operation_id"`
+	Deleted     []string          `json:"deleted"`
+	Errors      map[string]string `json:"errors,omitempty"`
+	Cancelled   bool              `json:"cancelled,omitempty"` // stopped early via DELETE /v1/admin/operations/{id}
+}
+
+type flushResult struct {
+	Users int `json:"users"` // users removed on the node
+}
+
+type flushAllResponse struct {
+	Nodes  map[string]flushResult `json:"nodes"` // node ID -> result
+	Failed []failedNode           `json:"failed,omitempty"`
+}
+
+type dumpKeysResponse struct {
+	Users map[string]cache.UserKeyDump `json:"users"`
+}
+
+type connectionsResponse struct {
+	Connections []clientInfo `json:"connections"`
+}
+
+type digestResponse struct {
+	UserID string           `json:"user_id"`
+	Keys   map[string]int64 `json:"keys"` // key -> timestamp
+}
+
+type merkleResponse struct {
+	UserID string   `json:"user_id"`
+	Depth  int      `json:"depth"`
+	Level  int      `json:"level"`
+	Hashes []uint64 `json:"hashes"`
+}
+
+type keyDiff struct {
+	Key     string `json:"key"`
+	LocalTS int64  `json:"local_ts"`
+	PeerTS  int64  `json:"peer_ts"`
+}
+
+type compareResponse struct {
+	UserID       string    `json:"user_id"`
+	Peer         string    `json:"peer"`
+	Buckets      int       `json:"buckets_compared"` // differing merkle leaves fetched
+	MissingLocal []string  `json:"missing_local"`    // on peer only
+	MissingPeer  []string  `json:"missing_peer"`     // local only
+	Differing    []keyDiff `json:"differing"`
+}
+
+type readyResponse struct {
+	Ready        bool             `json:"ready"`
+	ClusterReady bool             `json:"cluster_ready"`
+	Disk         cache.DiskStatus `json:"disk"`
+}
+
+type slowLogResponse struct {
+	ThresholdMs int64    `json:"threshold_ms"` // 0 = slowlog disabled
+	Entries     []slowOp `json:"entries"`      // newest first
+}
+
+type ownedKeysResponse struct {
+	Node    string   `json:"node"`
+	UserID  string   `json:"user_id"`
+	Scanned int      `json:"scanned"` // keys held by this node for the user
+	Keys    []string `json:"keys"`    // of those, the ones node is primary for
+}
+
+type recomputeResponse struct {
+	Users map[string]cache.RecomputeResult `json:"users"`
+}
+
+func (s *Server) handleReadOnlyGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(readOnlyResponse{ReadOnly: s.readOnly.Load()})
+}
+
+// handleReadOnlySet toggles read-only mode at runtime. Body: {"enabled": true|false}
+func (s *Server) handleReadOnlySet(w http.ResponseWriter, r *http.Request) {
+	var req readOnlyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	s.readOnly.Store(req.Enabled)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(readOnlyResponse{ReadOnly: req.Enabled})
+}
+
+// handleRecomputeStats reconciles per-user accounting with the actual stored items.
+func (s *Server) handleRecomputeStats(w http.ResponseWriter, r *http.Request) {
+	results := s.cache.RecomputeStats()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recomputeResponse{Users: results})
+}
+
+type snapshotAllResponse struct {
+	Saved      int               `json:"saved"`
+	Failed     map[string]string `json:"failed,omitempty"` // user ID -> error
+	DurationMS int64             `json:"duration_ms"`
+}
+
+// handleSnapshotAll writes a snapshot file for every user held on this node. Per-user
+// failures are reported without stopping the rest; the reply is 500 if any failed.
+func (s *Server) handleSnapshotAll(w http.ResponseWriter, r *http.Request) {
+	report := s.cache.SnapshotAllReport()
+
+	resp := snapshotAllResponse{Saved: report.Saved, DurationMS: report.Duration.Milliseconds()}
+	for uid, err := range report.Failed {
+		log.Printf("[http] snapshot all: user %s err: %v", uid, err)
+		if resp.Failed == nil {
+			resp.Failed = make(map[string]string)
+		}
+		resp.Failed[uid] = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(resp.Failed) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+type invariantsResponse struct {
+	Users map[string]cache.InvariantReport `json:"users"` // only users with drift
+}
+
+// handleCheckInvariants verifies each user's LRU index against its items;
+// ?repair=true rebuilds drifted ones.
+func (s *Server) handleCheckInvariants(w http.ResponseWriter, r *http.Request) {
+	repair := r.URL.Query().Get("repair") == "true"
+	results := s.cache.CheckInvariants(repair)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invariantsResponse{Users: results})
+}
+
+// handleDeleteUsersMatch deletes every user matching ?pattern=. It requires ?confirm=true
+// to avoid accidents; ?purge=true also removes the users' snapshot files.
+func (s *Server) handleDeleteUsersMatch(w http.ResponseWriter, r *http.Request) {
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	q := r.URL.Query()
+	pattern := q.Get("pattern")
+	if pattern == "" {
+		http.Error(w, "missing pattern", http.StatusBadRequest)
+		return
+	}
+	if q.Get("confirm") != "true" {
+		http.Error(w, "confirm=true required", http.StatusBadRequest)
+		return
+	}
+	purge := q.Get("purge") == "true"
+
+	users, err := s.cache.ListUsersMatch(pattern)
+	if err != nil {
+		http.Error(w, "invalid pattern", http.StatusBadRequest)
+		return
+	}
+
+	op, ctx := s.ops.start(r.Context(), "delete-users", pattern)
+	defer s.ops.finish(op)
+	op.setTotal(len(users))
+
+	resp := deleteUsersResponse{OperationID: op.id, Deleted: make([]string, 0, len(users))}
+	for _, uid := range users {
+		if ctx.Err() != nil {
+			resp.Cancelled = true
+			break
+		}
+		op.advance(1)
+		if err := s.cache.DeleteUser(uid); err != nil && err != cache.ErrUserNotFound {
+			log.Printf("[http] delete user %s err: %v", uid, err)
+			if resp.Errors == nil {
+				resp.Errors = make(map[string]string)
+			}
+			resp.Errors[uid] = err.Error()
+			continue
+		}
+		if purge {
+			if err := s.cache.RemoveUserSnapshot(uid); err != nil {
+				log.Printf("[http] purge snapshot %s err: %v", uid, err)
+				if resp.Errors == nil {
+					resp.Errors = make(map[string]string)
+				}
+				resp.Errors[uid] = err.Error()
+				continue
+			}
+		}
+		resp.Deleted = append(resp.Deleted, uid)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleFlushAll wipes every user on every node in the cluster. Requires EnableFlushAll
+// and ?confirm=true. Membership is left intact; per-node results are reported.
+func (s *Server) handleFlushAll(w http.ResponseWriter, r *http.Request) {
+	if !s.cfg.EnableFlushAll {
+		http.Error(w, "flushall disabled", http.StatusForbidden)
+		return
+	}
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+	if r.URL.Query().Get("confirm") != "true" {
+		http.Error(w, "confirm=true required", http.StatusBadRequest)
+		return
+	}
+
+	self := s.cluster.Self()
+	results, failed := scatterGather(r.Context(), s.cluster.Nodes(), s.cfg.CmdTimeout,
+		func(ctx context.Context, node cluster.NodeInfo) (flushResult, error) {
+			if node.ID == self.ID {
+				return flushResult{Users: s.cache.FlushAll()}, nil
+			}
+			var out flushResult
+			err := s.callInternal(ctx, http.MethodPost, node.Addr, "/v1/internal/flush", nil, &out)
+			return out, err
+		})
+	log.Printf("[http] flushall: %d nodes flushed, %d failed", len(results), len(failed))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flushAllResponse{Nodes: results, Failed: failed})
+}
+
+// handleInternalFlush deletes every local user (internal, fan-out target of flushall).
+func (s *Server) handleInternalFlush(w http.ResponseWriter, r *http.Request) {
+	if !s.cfg.EnableFlushAll {
+		http.Error(w, "flushall disabled", http.StatusForbidden)
+		return
+	}
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flushResult{Users: s.cache.FlushAll()})
+}
+
+// handleUndelete restores ?user= from the trash snapshot taken when it was deleted
+// (requires cache.Config.SnapshotOnDelete).
+func (s *Server) handleUndelete(w http.ResponseWriter, r *http.Request) {
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	uid := r.URL.Query().Get("user")
+	if uid == "" {
+		http.Error(w, "missing user", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.cache.UndeleteUser(uid); err != nil {
+		switch {
+		case err == cache.ErrUserExists:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err == cache.ErrUserNotFound:
+			http.Error(w, "no trash snapshot for user", http.StatusNotFound)
+		case errors.Is(err, cache.ErrSnapshotEmpty) || errors.Is(err, cache.ErrSnapshotInvalid) || errors.Is(err, cache.ErrSnapshotCorrupt):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			log.Printf("[http] undelete %s err: %v", uid, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	_, _ = w.Write([]byte(`{"status":"ok"}`))
+}
+
+// handleOwnedKeys lists the keys of ?user= held on this node whose primary owner on
+// the current ring is ?node=. Useful before decommissioning a node.
+func (s *Server) handleOwnedKeys(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	nodeID, uid := q.Get("node"), q.Get("user")
+	if nodeID == "" || uid == "" {
+		http.Error(w, "node and user are required", http.StatusBadRequest)
+		return
+	}
+
+	known := false
+	for _, n := range s.cluster.Nodes() {
+		if n.ID == nodeID {
+			known = true
+			break
+		}
+	}
+	if !known {
+		http.Error(w, cluster.ErrUnknownNode.Error(), http.StatusNotFound)
+		return
+	}
+
+	keys, err := s.cache.ListKeys(uid)
+	if err != nil && err != cache.ErrUserNotFound {
+		log.Printf("[http] owned keys err: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	uid = s.cache.NormalizeUserID(uid)
+	resp := ownedKeysResponse{Node: nodeID, UserID: uid, Scanned: len(keys), Keys: []string{}}
+	for _, k := range keys {
+		owner, ok := s.cluster.LookupOwner(uid + ":|:" + k)
+		if !ok {
+			writeClusterNotReady(w)
+			return
+		}
+		if owner.ID == nodeID {
+			resp.Keys = append(resp.Keys, k)
+		}
+	}
+	sort.Strings(resp.Keys)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// dumpKeysDefaultLimit bounds the per-user key list in dump-keys responses.
+const dumpKeysDefaultLimit = 1000
+
+// handleDumpKeys reports per-user key counts on this node. ?keys=true includes the keys,
+// capped per user by ?limit= (default 1000, 0 = no cap).
+func (s *Server) handleDumpKeys(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	includeKeys := q.Get("keys") == "true"
+
+	limit := dumpKeysDefaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	resp := dumpKeysResponse{Users: s.cache.DumpKeys(includeKeys, limit)}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleConnections lists active TCP connections.
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(connectionsResponse{Connections: s.clients.list()})
+}
+
+type underReplicatedResponse struct {
+	Keys []underReplicatedKey `json:"keys"`
+}
+
+type repairResponse struct {
+	Repaired  int `json:"repaired"`
+	Remaining int `json:"remaining"`
+}
+
+// handleUnderReplicated lists writes recorded by the repair failure policy.
+func (s *Server) handleUnderReplicated(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(underReplicatedResponse{Keys: s.underReplicated.list()})
+}
+
+// handleRepair re-replicates recorded under-replicated writes. It runs as a
+// cancellable operation.
+func (s *Server) handleRepair(w http.ResponseWriter, r *http.Request) {
+	op, ctx := s.ops.start(r.Context(), "repair", "")
+	defer s.ops.finish(op)
+
+	repaired, remaining := s.repairUnderReplicated(ctx)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(repairResponse{Repaired: repaired, Remaining: remaining})
+}
+
+type operationsResponse struct {
+	Operations []operationInfo `json:"operations"`
+}
+
+// handleOperations lists running long admin operations with their progress.
+func (s *Server) handleOperations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(operationsResponse{Operations: s.ops.list()})
+}
+
+// handleCancelOperation cancels a running operation; it stops at its next checkpoint.
+func (s *Server) handleCancelOperation(w http.ResponseWriter, r *http.Request) {
+	if !s.ops.cancel(r.PathValue("id")) {
+		http.Error(w, "operation not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"cancelling"}`))
+}
+
+// handleInternalDigest returns key -> timestamp for a user (internal, used by compare).
+// With ?bucket=&depth= only the keys of that merkle leaf are returned.
+// An unknown user yields an empty digest so comparisons still work.
+func (s *Server) handleInternalDigest(w http.ResponseWriter, r *http.Request) {
+	uid := r.URL.Query().Get("user")
+	if uid == "" {
+		http.Error(w, "missing user", http.StatusBadRequest)
+		return
+	}
+
+	var keys map[string]int64
+	var err error
+	if b := r.URL.Query().Get("bucket"); b != "" {
+		// one merkle leaf: ?bucket=<i>&depth=<d>
+		bucket, perr := strconv.Atoi(b)
+		depth, derr := strconv.Atoi(r.URL.Query().Get("depth"))
+		if perr != nil || derr != nil || bucket < 0 {
+			http.Error(w, "invalid bucket or depth", http.StatusBadRequest)
+			return
+		}
+		keys, err = s.cache.DigestBucket(uid, depth, bucket)
+	} else {
+		keys, err = s.cache.Digest(uid)
+	}
+	if err != nil && err != cache.ErrUserNotFound {
+		log.Printf("[http] digest err: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = map[string]int64{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(digestResponse{UserID: uid, Keys: keys})
+}
+
+// handleCompare diffs this node's data for ?user= against the node at ?peer=<addr>,
+// listing keys missing on either side or with differing timestamps. It compares merkle
+// roots first and only fetches per-key digests for the leaf buckets that differ.
+func (s *Server) handleCompare(w http.ResponseWriter, r *http.Request) {
+	uid := r.URL.Query().Get("user")
+	peer := r.URL.Query().Get("peer")
+	if uid == "" || peer == "" {
+		http.Error(w, "user and peer are required", http.StatusBadRequest)
+		return
+	}
+
+	tree, err := s.cache.Merkle(uid, cache.DefaultMerkleDepth)
+	if err == cache.ErrUserNotFound {
+		tree = cache.EmptyMerkle(cache.DefaultMerkleDepth)
+	} else if err != nil {
+		log.Printf("[http] merkle err: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	op, opCtx := s.ops.start(r.Context(), "compare", uid+" vs "+peer)
+	defer s.ops.finish(op)
+
+	ctx, cancel := context.WithTimeout(opCtx, s.cfg.CmdTimeout)
+	defer cancel()
+
+	// a fetch cut short by DELETE /v1/admin/operations/{id} is a cancellation,
+	// not an unreachable peer
+	peerFailed := func(what string, err error) {
+		if opCtx.Err() != nil {
+			http.Error(w, "operation cancelled", http.StatusConflict)
+			return
+		}
+		log.Printf("[http] compare: fetch %s from %s err: %v", what, peer, err)
+		http.Error(w, "peer unreachable", http.StatusBadGateway)
+	}
+
+	resp := compareResponse{
+		UserID:       uid,
+		Peer:         peer,
+		MissingLocal: []string{},
+		MissingPeer:  []string{},
+		Differing:    []keyDiff{},
+	}
+
+	// root first: identical users cost one round trip
+	var remoteRoot merkleResponse
+	if err := s.callInternal(ctx, http.MethodGet, peer, merklePath(uid, tree.Depth, 0), nil, &remoteRoot); err != nil {
+		peerFailed("merkle root", err)
+		return
+	}
+	if len(remoteRoot.Hashes) == 1 && remoteRoot.Hashes[0] == tree.Root() {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	var remoteLeaves merkleResponse
+	if err := s.callInternal(ctx, http.MethodGet, peer, merklePath(uid, tree.Depth, tree.Depth), nil, &remoteLeaves); err != nil {
+		peerFailed("merkle leaves", err)
+		return
+	}
+
+	buckets := tree.DiffBuckets(remoteLeaves.Hashes)
+	op.setTotal(len(buckets))
+	for _, bucket := range buckets {
+		if opCtx.Err() != nil {
+			http.Error(w, "operation cancelled", http.StatusConflict)
+			return
+		}
+		op.advance(1)
+		resp.Buckets++
+
+		local, err := s.cache.DigestBucket(uid, tree.Depth, bucket)
+		if err != nil && err != cache.ErrUserNotFound {
+			log.Printf("[http] digest err: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		var remote digestResponse
+		path := fmt.Sprintf("/v1/internal/digest?user=%s&depth=%d&bucket=%d", url.QueryEscape(uid), tree.Depth, bucket)
+		if err := s.callInternal(ctx, http.MethodGet, peer, path, nil, &remote); err != nil {
+			peerFailed("digest", err)
+			return
+		}
+
+		for k, lts := range local {
+			pts, ok := remote.Keys[k]
+			if !ok {
+				resp.MissingPeer = append(resp.MissingPeer, k)
+			} else if pts != lts {
+				resp.Differing = append(resp.Differing, keyDiff{Key: k, LocalTS: lts, PeerTS: pts})
+			}
+		}
+		for k := range remote.Keys {
+			if _, ok := local[k]; !ok {
+				resp.MissingLocal = append(resp.MissingLocal, k)
+			}
+		}
+	}
+	sort.Strings(resp.MissingLocal)
+	sort.Strings(resp.MissingPeer)
+	sort.Slice(resp.Differing, func(i, j int) bool {
+		return resp.Differing[i].Key < resp.Differing[j].Key
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func merklePath(uid string, depth, level int) string {
+	return fmt.Sprintf("/v1/internal/merkle?user=%s&depth=%d&level=%d", url.QueryEscape(uid), depth, level)
+}
+
+// handleInternalMerkle returns one level of a user's merkle tree (internal, used by compare).
+// ?level=0 (default) is the root; ?level=<depth> the leaf buckets. An unknown user
+// yields the empty tree.
+func (s *Server) handleInternalMerkle(w http.ResponseWriter, r *http.Request) {
+	uid := r.URL.Query().Get("user")
+	if uid == "" {
+		http.Error(w, "missing user", http.StatusBadRequest)
+		return
+	}
+
+	depth := cache.DefaultMerkleDepth
+	if v := r.URL.Query().Get("depth"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d <= 0 || d > cache.MaxMerkleDepth {
+			http.Error(w, "invalid depth", http.StatusBadRequest)
+			return
+		}
+		depth = d
+	}
+	level := 0
+	if v := r.URL.Query().Get("level"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 0 || l > depth {
+			http.Error(w, "invalid level", http.StatusBadRequest)
+			return
+		}
+		level = l
+	}
+
+	tree, err := s.cache.Merkle(uid, depth)
+	if err == cache.ErrUserNotFound {
+		tree = cache.EmptyMerkle(depth)
+	} else if err != nil {
+		log.Printf("[http] merkle err: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(merkleResponse{UserID: uid, Depth: depth, Level: level, Hashes: tree.Levels[level]})
+}
+
+// handleReady reports 200 when the node can route keys and persist snapshots, 503 otherwise.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	resp := readyResponse{
+		ClusterReady: s.clusterReady(),
+		Disk:         s.cache.CheckDisk(),
+	}
+	resp.Ready = resp.ClusterReady && resp.Disk.Writable
+	if !resp.Disk.Writable {
+		log.Printf("[http] data dir not writable: %s err: %s", resp.Disk.Dir, resp.Disk.Error)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleDisk reports free space and a test-write result for DataDir.
+func (s *Server) handleDisk(w http.ResponseWriter, r *http.Request) {
+	st := s.cache.CheckDisk()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !st.Writable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(st)
+}
+
+// handleSlowLog returns recent operations that exceeded SlowOpThreshold, newest first.
+func (s *Server) handleSlowLog(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(slowLogResponse{
+		ThresholdMs: s.cfg.SlowOpThreshold.Milliseconds(),
+		Entries:     s.slowlog.recent(),
+	})
+}
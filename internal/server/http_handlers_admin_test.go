@@ -0,0 +1,679 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+func TestReadOnlyMode(t *testing.T) {
+	n := startNode(t, ServerConfig{})
+	n.set(t, "alice", "k", "v")
+	toggle := func(t *testing.T, on bool) {
+		t.Helper()
+		code, body := n.do(t, http.MethodPost, "/v1/admin/readonly", "", map[string]any{"enabled": on})
+		if code != http.StatusOK {
+			t.Fatalf("toggle read-only: %d %s", code, body)
+		}
+	}
+	toggle(t, true)
+	t.Cleanup(func() { n.s.readOnly.Store(false) })
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     any
+		wantCode int
+	}{
+		{name: "get served", method: http.MethodGet, path: "/v1/get?key=k", wantCode: http.StatusOK},
+		{name: "set rejected", method: http.MethodPost, path: "/v1/set", body: map[string]any{"key": "k", "value": "w"}, wantCode: http.StatusServiceUnavailable},
+		{name: "delete rejected", method: http.MethodDelete, path: "/v1/delete?key=k", wantCode: http.StatusServiceUnavailable},
+		{name: "getset rejected", method: http.MethodPost, path: "/v1/getset", body: map[string]any{"key": "k", "value": "w"}, wantCode: http.StatusServiceUnavailable},
+		{name: "flush rejected", method: http.MethodPost, path: "/v1/flush", wantCode: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run("http "+tt.name, func(t *testing.T) {
+			if code, body := n.do(t, tt.method, tt.path, "alice", tt.body); code != tt.wantCode {
+				t.Fatalf("%s %s = %d %s, want %d", tt.method, tt.path, code, body, tt.wantCode)
+			}
+		})
+	}
+
+	tcpTests := []struct {
+		cmd  string
+		want string
+	}{
+		{cmd: "GET alice k", want: "VALUE v"},
+		{cmd: "SET alice k w", want: "ERR read-only"},
+		{cmd: "DELETE alice k", want: "ERR read-only"},
+		{cmd: "INCR alice n", want: "ERR read-only"},
+	}
+	c := dialTCP(t, n.tcp)
+	for _, tt := range tcpTests {
+		t.Run("tcp "+tt.cmd, func(t *testing.T) {
+			if got := c.cmd(t, tt.cmd); got != tt.want {
+				t.Fatalf("%s = %q, want %q", tt.cmd, got, tt.want)
+			}
+		})
+	}
+
+	toggle(t, false)
+	n.set(t, "alice", "k", "w")
+	if _, v := n.get(t, "alice", "k"); v != "w" {
+		t.Fatalf("value after leaving read-only = %q, want w", v)
+	}
+}
+
+func TestReadOnlyToggleRequiresClusterSecret(t *testing.T) {
+	n := startNode(t, ServerConfig{ClusterSecret: "s3cret"})
+	body := map[string]any{"enabled": true}
+
+	for _, send := range []string{"", "guess"} {
+		header := http.Header{}
+		if send != "" {
+			header.Set(clusterSecretHeader, send)
+		}
+		if code, resp := n.doWith(t, http.MethodPost, "/v1/admin/readonly", "", body, header); code != http.StatusUnauthorized {
+			t.Fatalf("toggle with secret %q = %d %s, want 401", send, code, resp)
+		}
+		if n.s.readOnly.Load() {
+			t.Fatalf("toggle with secret %q switched the node to read-only", send)
+		}
+	}
+
+	header := http.Header{clusterSecretHeader: {"s3cret"}}
+	if code, resp := n.doWith(t, http.MethodPost, "/v1/admin/readonly", "", body, header); code != http.StatusOK {
+		t.Fatalf("toggle with the secret = %d %s", code, resp)
+	}
+	if !n.s.readOnly.Load() {
+		t.Fatal("toggle with the secret left the node writable")
+	}
+	// reading the mode stays open
+	if code, resp := n.do(t, http.MethodGet, "/v1/admin/readonly", "", nil); code != http.StatusOK {
+		t.Fatalf("GET readonly = %d %s", code, resp)
+	}
+}
+
+func TestDeleteUsersMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		wantLeft []string // users still present afterwards
+	}{
+		{name: "missing pattern", query: "confirm=true", wantCode: http.StatusBadRequest, wantLeft: []string{"prod_a", "test_a", "test_b"}},
+		{name: "missing confirm", query: "pattern=test_*", wantCode: http.StatusBadRequest, wantLeft: []string{"prod_a", "test_a", "test_b"}},
+		{name: "bad pattern", query: "pattern=[&confirm=true", wantCode: http.StatusBadRequest, wantLeft: []string{"prod_a", "test_a", "test_b"}},
+		{name: "matching users", query: "pattern=test_*&confirm=true", wantCode: http.StatusOK, wantLeft: []string{"prod_a"}},
+		{name: "no match", query: "pattern=nobody*&confirm=true", wantCode: http.StatusOK, wantLeft: []string{"prod_a", "test_a", "test_b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := startNode(t, ServerConfig{})
+			for _, id := range []string{"test_a", "test_b", "prod_a"} {
+				n.set(t, id, "k", "v")
+			}
+			code, body := n.do(t, http.MethodDelete, "/v1/admin/users?"+tt.query, "", nil)
+			if code != tt.wantCode {
+				t.Fatalf("delete users = %d %s, want %d", code, body, tt.wantCode)
+			}
+			if got, _ := n.c.ListUsersMatch("*"); !slices.Equal(got, tt.wantLeft) {
+				t.Fatalf("users left = %v, want %v", got, tt.wantLeft)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			var resp deleteUsersResponse
+			if err := json.Unmarshal(body, &resp); err != nil || len(resp.Deleted) != 3-len(tt.wantLeft) {
+				t.Fatalf("response = %s, want %d deleted", body, 3-len(tt.wantLeft))
+			}
+		})
+	}
+}
+
+func TestDeleteUsersMatchPurge(t *testing.T) {
+	cfg := testCacheConfig(t)
+	n := startNodeWithCache(t, ServerConfig{}, cache.NewCache(cfg))
+	for _, id := range []string{"test_a", "test_b"} {
+		n.set(t, id, "k", "v")
+	}
+	if err := n.c.SnapshotAll(); err != nil {
+		t.Fatal(err)
+	}
+	// a non-empty directory where one of test_b's snapshot files would go can't be removed
+	blocker := filepath.Join(cfg.DataDir, "user_test_b.bin.gz")
+	if err := os.MkdirAll(filepath.Join(blocker, "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := n.do(t, http.MethodDelete, "/v1/admin/users?pattern=test_*&confirm=true&purge=true", "", nil)
+	var resp deleteUsersResponse
+	if err := json.Unmarshal(body, &resp); code != http.StatusOK || err != nil {
+		t.Fatalf("delete users = %d %s", code, body)
+	}
+	if !slices.Equal(resp.Deleted, []string{"test_a"}) {
+		t.Fatalf("deleted = %v, want only test_a", resp.Deleted)
+	}
+	if _, ok := resp.Errors["test_b"]; !ok || len(resp.Errors) != 1 {
+		t.Fatalf("errors = %v, want test_b's purge failure", resp.Errors)
+	}
+	files, _ := filepath.Glob(filepath.Join(cfg.DataDir, "user_test_a*"))
+	if len(files) != 0 {
+		t.Fatalf("test_a's snapshot files left after purge: %v", files)
+	}
+}
+
+func TestClusterNotReady(t *testing.T) {
+	n := startNode(t, ServerConfig{RESPAddr: freeAddr(t)})
+	n.set(t, "alice", "k", "v")
+
+	// a sync that leaves the ring empty, as during startup before it is populated
+	data, err := n.s.cluster.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state cluster.StatePayload
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	n.s.cluster.ReplaceFromPayload(cluster.StatePayload{Leader: state.Leader, Term: state.Term})
+
+	code, body := n.do(t, http.MethodGet, "/v1/ready", "", nil)
+	var ready readyResponse
+	if err := json.Unmarshal(body, &ready); code != http.StatusServiceUnavailable || err != nil || ready.ClusterReady || ready.Ready {
+		t.Fatalf("ready = %d %s, want 503 with cluster_ready false", code, body)
+	}
+	for _, req := range []struct {
+		method, path string
+		body         any
+	}{
+		{http.MethodGet, "/v1/get?key=k", nil},
+		{http.MethodPost, "/v1/set", map[string]any{"key": "k", "value": "v2"}},
+		{http.MethodDelete, "/v1/delete?key=k", nil},
+	} {
+		code, body := n.do(t, req.method, req.path, "alice", req.body)
+		if code != http.StatusServiceUnavailable || strings.TrimSpace(string(body)) != "cluster not ready" {
+			t.Fatalf("%s %s = %d %q, want 503 cluster not ready", req.method, req.path, code, body)
+		}
+	}
+	if got := dialTCP(t, n.tcp).cmd(t, "GET alice k"); got != "ERR cluster not ready" {
+		t.Fatalf("tcp GET = %q, want ERR cluster not ready", got)
+	}
+	resp := dialTCP(t, n.s.cfg.RESPAddr)
+	resp.cmd(t, respCmd("AUTH", "alice"))
+	if got := resp.cmd(t, respCmd("GET", "k")); got != "-ERR cluster not ready" {
+		t.Fatalf("resp GET = %q, want -ERR cluster not ready", got)
+	}
+
+	// the next good sync makes the node serve again
+	n.s.cluster.ReplaceFromPayload(state)
+	if code, _ := n.do(t, http.MethodGet, "/v1/ready", "", nil); code != http.StatusOK {
+		t.Fatalf("ready after the ring is back = %d, want 200", code)
+	}
+	if code, v := n.get(t, "alice", "k"); code != http.StatusOK || v != "v" {
+		t.Fatalf("get after the ring is back = %d %q", code, v)
+	}
+}
+
+func TestDumpKeys(t *testing.T) {
+	n := startNode(t, ServerConfig{})
+	for _, k := range []string{"c", "a", "b"} {
+		n.set(t, "alice", k, "v")
+	}
+	n.set(t, "bob", "x", "v")
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		want     map[string]cache.UserKeyDump
+	}{
+		{name: "counts only", wantCode: http.StatusOK, want: map[string]cache.UserKeyDump{"alice": {Count: 3}, "bob": {Count: 1}}},
+		{name: "with keys", query: "keys=true", wantCode: http.StatusOK, want: map[string]cache.UserKeyDump{
+			"alice": {Count: 3, Keys: []string{"a", "b", "c"}}, "bob": {Count: 1, Keys: []string{"x"}}}},
+		{name: "limited", query: "keys=true&limit=2", wantCode: http.StatusOK, want: map[string]cache.UserKeyDump{
+			"alice": {Count: 3, Keys: []string{"a", "b"}, Truncated: true}, "bob": {Count: 1, Keys: []string{"x"}}}},
+		{name: "no cap", query: "keys=true&limit=0", wantCode: http.StatusOK, want: map[string]cache.UserKeyDump{
+			"alice": {Count: 3, Keys: []string{"a", "b", "c"}}, "bob": {Count: 1, Keys: []string{"x"}}}},
+		{name: "bad limit", query: "limit=-1", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := n.do(t, http.MethodGet, "/v1/admin/dump-keys?"+tt.query, "", nil)
+			if code != tt.wantCode {
+				t.Fatalf("dump-keys = %d %s, want %d", code, body, tt.wantCode)
+			}
+			if tt.want == nil {
+				return
+			}
+			var resp dumpKeysResponse
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatalf("decode: %v (%s)", err, body)
+			}
+			if !reflect.DeepEqual(resp.Users, tt.want) {
+				t.Fatalf("users = %+v, want %+v", resp.Users, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareWithPeer(t *testing.T) {
+	type kv struct {
+		key string
+		ts  int64 // write timestamp, as replication would carry it
+	}
+	tests := []struct {
+		name             string
+		local, peer      []kv
+		wantMissingLocal []string
+		wantMissingPeer  []string
+		wantDiffering    []string
+	}{
+		{name: "identical", local: []kv{{"a", 1}, {"b", 2}}, peer: []kv{{"a", 1}, {"b", 2}}},
+		{name: "no data on either side"},
+		{name: "local only", local: []kv{{"a", 1}, {"b", 2}}, peer: []kv{{"a", 1}}, wantMissingPeer: []string{"b"}},
+		{name: "peer only", peer: []kv{{"a", 1}}, wantMissingLocal: []string{"a"}},
+		{name: "newer write on peer", local: []kv{{"a", 1}, {"b", 2}}, peer: []kv{{"a", 1}, {"b", 3}}, wantDiffering: []string{"b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local := startNode(t, ServerConfig{})
+			peer := startNode(t, ServerConfig{})
+			// written straight into the caches: the nodes are not clustered
+			for _, side := range []struct {
+				n   *testNode
+				kvs []kv
+			}{{local, tt.local}, {peer, tt.peer}} {
+				for _, p := range side.kvs {
+					if _, err := side.n.c.Set("alice", p.key, []byte("v"), 0, p.ts); err != nil {
+						t.Fatalf("set: %v", err)
+					}
+				}
+			}
+
+			path := "/v1/admin/compare?user=alice&peer=" + strings.TrimPrefix(peer.url, "http://")
+			code, body := local.do(t, http.MethodGet, path, "", nil)
+			if code != http.StatusOK {
+				t.Fatalf("compare = %d %s", code, body)
+			}
+			var resp compareResponse
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatalf("decode: %v (%s)", err, body)
+			}
+			var differing []string
+			for _, d := range resp.Differing {
+				differing = append(differing, d.Key)
+			}
+			if !slices.Equal(resp.MissingLocal, tt.wantMissingLocal) || !slices.Equal(resp.MissingPeer, tt.wantMissingPeer) || !slices.Equal(differing, tt.wantDiffering) {
+				t.Fatalf("compare = %s, want missing locally %v, missing on peer %v, differing %v", body, tt.wantMissingLocal, tt.wantMissingPeer, tt.wantDiffering)
+			}
+		})
+	}
+}
+
+func TestCancelOperation(t *testing.T) {
+	n := startNode(t, ServerConfig{CmdTimeout: 30 * time.Second})
+	n.set(t, "alice", "k", "v")
+
+	// a peer whose leaves differ in every bucket; it answers two digests, then hangs
+	// until the request is abandoned
+	var digests atomic.Int64
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/internal/merkle":
+			json.NewEncoder(w).Encode(merkleResponse{Hashes: []uint64{1}})
+		case "/v1/internal/digest":
+			if digests.Add(1) > 2 {
+				<-r.Context().Done()
+				return
+			}
+			json.NewEncoder(w).Encode(digestResponse{Keys: map[string]int64{}})
+		}
+	}))
+	t.Cleanup(peer.Close)
+
+	type result struct {
+		code int
+		body []byte
+	}
+	done := make(chan result, 1)
+	go func() {
+		code, body := n.do(t, http.MethodGet, "/v1/admin/compare?user=alice&peer="+strings.TrimPrefix(peer.URL, "http://"), "", nil)
+		done <- result{code, body}
+	}()
+
+	list := func() []operationInfo {
+		t.Helper()
+		code, body := n.do(t, http.MethodGet, "/v1/admin/operations", "", nil)
+		if code != http.StatusOK {
+			t.Fatalf("list = %d %s", code, body)
+		}
+		var resp operationsResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			t.Fatalf("decode: %v (%s)", err, body)
+		}
+		return resp.Operations
+	}
+	var op operationInfo
+	waitFor(t, 5*time.Second, func() bool {
+		ops := list()
+		if len(ops) != 1 || ops[0].Done != 3 {
+			return false
+		}
+		op = ops[0]
+		return true
+	})
+	if op.Kind != "compare" || op.Total != 1<<cache.DefaultMerkleDepth {
+		t.Fatalf("operation = %+v, want a compare over every bucket", op)
+	}
+
+	if code, body := n.do(t, http.MethodDelete, "/v1/admin/operations/"+op.ID, "", nil); code != http.StatusOK {
+		t.Fatalf("cancel = %d %s", code, body)
+	}
+	select {
+	case res := <-done:
+		if res.code != http.StatusConflict {
+			t.Fatalf("cancelled compare = %d %s, want 409", res.code, res.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("compare still running after cancel")
+	}
+	if got := digests.Load(); got != 3 {
+		t.Fatalf("peer saw %d digest requests, want the compare to stop at 3", got)
+	}
+	if ops := list(); len(ops) != 0 {
+		t.Fatalf("operations after cancel = %+v, want none", ops)
+	}
+	if code, _ := n.do(t, http.MethodDelete, "/v1/admin/operations/"+op.ID, "", nil); code != http.StatusNotFound {
+		t.Fatalf("cancel finished operation = %d, want 404", code)
+	}
+}
+
+func TestUndeleteEndpoint(t *testing.T) {
+	cc := testCacheConfig(t)
+	cc.SnapshotOnDelete = true
+	n := startNodeWithCache(t, ServerConfig{}, cache.NewCache(cc))
+	n.set(t, "alice", "k", "v")
+	if err := n.c.DeleteUser("alice"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+	}{
+		{name: "missing user", query: "", wantCode: http.StatusBadRequest},
+		{name: "no trash", query: "?user=bob", wantCode: http.StatusNotFound},
+		{name: "restored", query: "?user=alice", wantCode: http.StatusOK},
+		{name: "already restored", query: "?user=alice", wantCode: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := n.do(t, http.MethodPost, "/v1/admin/undelete"+tt.query, "", nil)
+			if code != tt.wantCode {
+				t.Fatalf("undelete = %d %s, want %d", code, body, tt.wantCode)
+			}
+		})
+	}
+	if code, v := n.get(t, "alice", "k"); code != http.StatusOK || v != "v" {
+		t.Fatalf("get after undelete = %d %q", code, v)
+	}
+}
+
+func TestOwnedKeys(t *testing.T) {
+	n := startNode(t, ServerConfig{})
+	others := []cluster.NodeInfo{{ID: "b", Addr: "127.0.0.1:1"}, {ID: "c", Addr: "127.0.0.1:2"}}
+	for _, o := range others {
+		if err := n.s.cluster.AddNode(o); err != nil {
+			t.Fatalf("add node: %v", err)
+		}
+	}
+	var keys []string
+	for i := 0; i < 40; i++ {
+		k := strconv.Itoa(i) + "-key"
+		keys = append(keys, k)
+		if _, err := n.c.Set("alice", k, []byte("v"), 0, 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	// ownership computed on a separate ring with the same members
+	ring := cluster.NewHashRing(n.s.cfg.VirtualNodes)
+	ring.AddNodes(append([]cluster.NodeInfo{n.s.cluster.Self()}, others...))
+	want := map[string][]string{}
+	for _, k := range keys {
+		owner, _ := ring.Lookup("alice:|:" + k)
+		want[owner.ID] = append(want[owner.ID], k)
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		wantKeys []string
+	}{
+		{name: "self", query: "?node=" + n.s.cluster.Self().ID + "&user=alice", wantCode: http.StatusOK, wantKeys: want[n.s.cluster.Self().ID]},
+		{name: "node b", query: "?node=b&user=alice", wantCode: http.StatusOK, wantKeys: want["b"]},
+		{name: "node c", query: "?node=c&user=alice", wantCode: http.StatusOK, wantKeys: want["c"]},
+		{name: "unknown user", query: "?node=b&user=nobody", wantCode: http.StatusOK},
+		{name: "unknown node", query: "?node=zz&user=alice", wantCode: http.StatusNotFound},
+		{name: "missing node", query: "?user=alice", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := n.do(t, http.MethodGet, "/v1/admin/owned"+tt.query, "", nil)
+			if code != tt.wantCode {
+				t.Fatalf("owned = %d %s, want %d", code, body, tt.wantCode)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			var resp ownedKeysResponse
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			wantKeys := slices.Clone(tt.wantKeys)
+			slices.Sort(wantKeys)
+			if !slices.Equal(resp.Keys, wantKeys) && len(resp.Keys)+len(wantKeys) > 0 {
+				t.Fatalf("keys = %v, want %v", resp.Keys, wantKeys)
+			}
+		})
+	}
+}
+
+func TestSnapshotAllEndpoint(t *testing.T) {
+	n := startNode(t, ServerConfig{})
+	for _, uid := range []string{"alice", "bob"} {
+		if _, err := n.c.Set(uid, "k", []byte("v"), 0, 0); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+
+	code, body := n.do(t, http.MethodPost, "/v1/snapshot/all", "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("snapshot all = %d %s", code, body)
+	}
+	var resp snapshotAllResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Saved != 2 || len(resp.Failed) != 0 {
+		t.Fatalf("snapshot all = %+v, want 2 saved", resp)
+	}
+	for _, uid := range []string{"alice", "bob"} {
+		if _, err := n.c.LoadUserFromFile(uid); err != nil {
+			t.Fatalf("load %s: %v", uid, err)
+		}
+	}
+}
+
+func TestDiskUnwritable(t *testing.T) {
+	// checkUnwritable asserts both probes report dir as unwritable
+	checkUnwritable := func(t *testing.T, n *testNode) {
+		t.Helper()
+		code, body := n.do(t, http.MethodGet, "/v1/ready", "", nil)
+		var ready readyResponse
+		if err := json.Unmarshal(body, &ready); err != nil || code != http.StatusServiceUnavailable {
+			t.Fatalf("ready = %d %s, want 503", code, body)
+		}
+		if ready.Ready || !ready.ClusterReady || ready.Disk.Writable || ready.Disk.Error == "" {
+			t.Fatalf("ready = %+v, want only the disk failing", ready)
+		}
+
+		code, body = n.do(t, http.MethodGet, "/v1/admin/disk", "", nil)
+		var disk cache.DiskStatus
+		if err := json.Unmarshal(body, &disk); err != nil || code != http.StatusServiceUnavailable {
+			t.Fatalf("disk = %d %s, want 503", code, body)
+		}
+		if disk.Writable || disk.Error == "" {
+			t.Fatalf("disk = %+v, want a write error", disk)
+		}
+	}
+
+	t.Run("read-only dir", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.Chmod(dir, 0o555); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Chmod(dir, 0o755) })
+		if f, err := os.CreateTemp(dir, "probe"); err == nil {
+			f.Close()
+			t.Skip("permissions aren't enforced for this user (running as root?)")
+		}
+
+		cfg := testCacheConfig(t)
+		cfg.DataDir = dir
+		checkUnwritable(t, startNodeWithCache(t, ServerConfig{}, cache.NewCache(cfg)))
+	})
+
+	t.Run("dir replaced by a file while running", func(t *testing.T) {
+		cfg := testCacheConfig(t)
+		n := startNodeWithCache(t, ServerConfig{}, cache.NewCache(cfg))
+		if code, body := n.do(t, http.MethodGet, "/v1/ready", "", nil); code != http.StatusOK {
+			t.Fatalf("ready = %d %s, want 200 before the disk breaks", code, body)
+		}
+
+		if err := os.RemoveAll(cfg.DataDir); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(cfg.DataDir, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		checkUnwritable(t, n)
+
+		// back to normal once the directory is usable again
+		if err := os.Remove(cfg.DataDir); err != nil {
+			t.Fatal(err)
+		}
+		if code, body := n.do(t, http.MethodGet, "/v1/ready", "", nil); code != http.StatusOK {
+			t.Fatalf("ready = %d %s after the fix, want 200", code, body)
+		}
+	})
+}
+
+func TestFlushAllCluster(t *testing.T) {
+	nodes := startCluster(t, 2, ServerConfig{EnableFlushAll: true})
+	a, b := nodes[0], nodes[1]
+
+	// data on both nodes, for users that live on one or both of them
+	for _, user := range []string{"alice", "bob"} {
+		for _, n := range nodes {
+			a.set(t, user, keyOwnedBy(t, a, user, n.s.cluster.Self().ID), "v")
+		}
+	}
+	for _, n := range nodes {
+		if len(n.c.ListUsers()) == 0 {
+			t.Fatalf("%s holds no users before the flush", n.s.cluster.Self().ID)
+		}
+	}
+
+	if code, _ := a.do(t, http.MethodPost, "/v1/admin/flushall", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("flushall without confirm = %d, want 400", code)
+	}
+
+	code, body := b.do(t, http.MethodPost, "/v1/admin/flushall?confirm=true", "", nil)
+	var resp flushAllResponse
+	if err := json.Unmarshal(body, &resp); err != nil || code != http.StatusOK {
+		t.Fatalf("flushall = %d %s", code, body)
+	}
+	if len(resp.Failed) != 0 {
+		t.Fatalf("failed nodes: %+v", resp.Failed)
+	}
+	for _, n := range nodes {
+		id := n.s.cluster.Self().ID
+		if got, ok := resp.Nodes[id]; !ok || got.Users != 2 {
+			t.Errorf("result for %s = %+v (reported %v), want 2 users", id, got, ok)
+		}
+		if users := n.c.ListUsers(); len(users) != 0 {
+			t.Errorf("%s still holds %v", id, users)
+		}
+		// membership is untouched
+		if got := len(n.s.cluster.Nodes()); got != 2 {
+			t.Errorf("%s sees %d nodes after the flush, want 2", id, got)
+		}
+	}
+}
+
+func TestFlushAllRequiresClusterSecret(t *testing.T) {
+	n := startNode(t, ServerConfig{EnableFlushAll: true, ClusterSecret: "s3cret"})
+	n.set(t, "alice", "k", "v")
+
+	for _, send := range []string{"", "guess"} {
+		header := http.Header{}
+		if send != "" {
+			header.Set(clusterSecretHeader, send)
+		}
+		if code, body := n.doWith(t, http.MethodPost, "/v1/admin/flushall?confirm=true", "", nil, header); code != http.StatusUnauthorized {
+			t.Fatalf("flushall with secret %q = %d %s, want 401", send, code, body)
+		}
+		if !n.holds("alice", "k") {
+			t.Fatalf("flushall with secret %q removed the data", send)
+		}
+	}
+
+	header := http.Header{clusterSecretHeader: {"s3cret"}}
+	if code, body := n.doWith(t, http.MethodPost, "/v1/admin/flushall?confirm=true", "", nil, header); code != http.StatusOK {
+		t.Fatalf("flushall with the secret = %d %s", code, body)
+	}
+	if n.holds("alice", "k") {
+		t.Fatal("flushall with the secret kept the data")
+	}
+}
+
+func TestFlushAllDisabled(t *testing.T) {
+	a := startNode(t, ServerConfig{NodeID: "a", EnableFlushAll: true})
+	b := startNode(t, ServerConfig{NodeID: "b", JoinAddr: a.url}) // flushall not enabled
+	waitFor(t, 5*time.Second, func() bool { return len(b.s.cluster.Nodes()) == 2 })
+	a.set(t, "alice", keyOwnedBy(t, a, "alice", "a"), "v")
+	b.set(t, "alice", keyOwnedBy(t, b, "alice", "b"), "v")
+
+	if code, _ := b.do(t, http.MethodPost, "/v1/admin/flushall?confirm=true", "", nil); code != http.StatusForbidden {
+		t.Fatalf("flushall on a disabled node = %d, want 403", code)
+	}
+
+	// the peer refuses its part and is reported; the caller still flushes itself
+	code, body := a.do(t, http.MethodPost, "/v1/admin/flushall?confirm=true", "", nil)
+	var resp flushAllResponse
+	if err := json.Unmarshal(body, &resp); err != nil || code != http.StatusOK {
+		t.Fatalf("flushall = %d %s", code, body)
+	}
+	if len(resp.Failed) != 1 || resp.Failed[0].ID != "b" {
+		t.Fatalf("failed = %+v, want b", resp.Failed)
+	}
+	if len(a.c.ListUsers()) != 0 || len(b.c.ListUsers()) == 0 {
+		t.Fatalf("users left: a=%v b=%v, want only b's", a.c.ListUsers(), b.c.ListUsers())
+	}
+}
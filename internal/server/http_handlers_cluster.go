@@ -2,6 +2,8 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 
 	"github.com/sanke08/Distributed-Cache/internal/cluster"
@@ -17,7 +19,14 @@ func (s *Server) handleClusterJoin(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// add node
-		s.cluster.AddNode(n)
+		if err := s.cluster.AddNode(n); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, cluster.ErrNodeConflict) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
 		// return full snapshot
 		data, err := s.cluster.Snapshot()
 		if err != nil {
@@ -28,18 +37,103 @@ func (s *Server) handleClusterJoin(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write(data)
 
 	} else {
-		// if not leader, respond with 307, redirect to leader address
-		// find leader (smallest id)
-		nodes := s.cluster.Nodes()
+		s.redirectToLeader(w, r)
+	}
+}
 
-		if len(nodes) == 0 {
-			http.Error(w, "no leader", http.StatusServiceUnavailable)
-			return
-		}
-		leader := nodes[0] // smallest ID due to sorted order
+// handleClusterLeave removes ?node_id from membership (leader only) and returns the
+// new state, which the leaving node adopts before handing off its keys.
+func (s *Server) handleClusterLeave(w http.ResponseWriter, r *http.Request) {
+	if !s.cluster.IsLeader() {
+		s.redirectToLeader(w, r)
+		return
+	}
+
+	var req leaveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NodeID == "" {
+		http.Error(w, "node_id is required", http.StatusBadRequest)
+		return
+	}
+	if req.NodeID == s.cluster.Self().ID {
+		http.Error(w, errLeaderCannotLeave.Error(), http.StatusConflict)
+		return
+	}
+	if !isMember(s.cluster.Nodes(), req.NodeID) {
+		http.Error(w, "unknown node", http.StatusNotFound)
+		return
+	}
+
+	s.cluster.RemoveNode(req.NodeID)
+	log.Printf("[cluster] node %s left", req.NodeID)
+
+	data, err := s.cluster.Snapshot()
+	if err != nil {
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// redirectToLeader responds with 307 to the same path on the current leader.
+func (s *Server) redirectToLeader(w http.ResponseWriter, r *http.Request) {
+	leader, _, ok := s.cluster.Leader()
+	if !ok {
+		http.Error(w, "no leader", http.StatusServiceUnavailable)
+		return
+	}
+
+	http.Redirect(w, r, s.nodeURL(leader.Addr)+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
+
+type pinRequest struct {
+	UserID string `json:"user_id"`
+	Key    string `json:"key"`
+	NodeID string `json:"node_id"`
+}
+
+// handlePinKey pins a user's key to a specific node (leader only; followers pick it up via polling).
+func (s *Server) handlePinKey(w http.ResponseWriter, r *http.Request) {
+	if !s.cluster.IsLeader() {
+		s.redirectToLeader(w, r)
+		return
+	}
+
+	var req pinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" || req.Key == "" || req.NodeID == "" {
+		http.Error(w, "user_id, key and node_id are required", http.StatusBadRequest)
+		return
+	}
 
-		http.Redirect(w, r, "http://"+leader.Addr+"/v1/cluster/join", http.StatusTemporaryRedirect)
+	if err := s.cluster.PinKey(req.UserID+":|:"+req.Key, req.NodeID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"status":"pinned"}`))
+}
+
+// handleUnpinKey removes a pin so the key reverts to ring placement.
+func (s *Server) handleUnpinKey(w http.ResponseWriter, r *http.Request) {
+	if !s.cluster.IsLeader() {
+		s.redirectToLeader(w, r)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	key := r.URL.Query().Get("key")
+	if userID == "" || key == "" {
+		http.Error(w, "user_id and key are required", http.StatusBadRequest)
+		return
+	}
+
+	s.cluster.UnpinKey(userID + ":|:" + key)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"status":"unpinned"}`))
 }
 
 func (s *Server) handleStat(w http.ResponseWriter, r *http.Request) {
@@ -51,3 +145,10 @@ func (s *Server) handleStat(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	_, _ = w.Write(data)
 }
+
+// handleDistribution reports how much of the ring each node owns, to spot an unbalanced ring.
+func (s *Server) handleDistribution(w http.ResponseWriter, r *http.Request) {
+	resp := distributionResponse{Nodes: s.cluster.Distribution()}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
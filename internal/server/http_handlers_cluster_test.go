@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPinKeyRouting(t *testing.T) {
+	nodes := startCluster(t, 3, ServerConfig{ReplicationFactor: 2})
+	a := nodes[0]
+	byID := map[string]*testNode{}
+	for _, n := range nodes {
+		byID[n.s.cluster.Self().ID] = n
+	}
+
+	// a key whose ring holders leave one node out; pin it to that node
+	key := keyOwnedBy(t, a, "alice", "a")
+	ring := a.s.replicaNodes("alice:|:" + key)
+	var pinned, ringReplica *testNode
+	for id, n := range byID {
+		switch {
+		case !isMember(ring, id):
+			pinned = n
+		case id != "a":
+			ringReplica = n
+		}
+	}
+	pinnedID := pinned.s.cluster.Self().ID
+
+	if code, body := a.do(t, http.MethodPost, "/v1/cluster/pin", "", pinRequest{UserID: "alice", Key: key, NodeID: pinnedID}); code != http.StatusOK {
+		t.Fatalf("pin = %d %s", code, body)
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		for _, n := range nodes {
+			if owner, _ := n.s.cluster.LookupOwner("alice:|:" + key); owner.ID != pinnedID {
+				return false
+			}
+		}
+		return true
+	})
+
+	// writes through any node land on the pinned node, and it replicates to the
+	// key's ring owner
+	ringReplica.set(t, "alice", key, "pinned")
+	waitFor(t, 5*time.Second, func() bool {
+		return pinned.holds("alice", key) && a.holds("alice", key)
+	})
+	if ringReplica.holds("alice", key) {
+		t.Fatalf("%s holds the pinned key, which it no longer replicates", ringReplica.s.cluster.Self().ID)
+	}
+
+	if code, body := a.do(t, http.MethodDelete, "/v1/cluster/pin?user_id=alice&key="+key, "", nil); code != http.StatusOK {
+		t.Fatalf("unpin = %d %s", code, body)
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		for _, n := range nodes {
+			if owner, _ := n.s.cluster.LookupOwner("alice:|:" + key); owner.ID != "a" {
+				return false
+			}
+		}
+		return true
+	})
+
+	// ring routing is back: the write goes to a and its ring replica
+	pinned.set(t, "alice", key, "unpinned")
+	waitFor(t, 5*time.Second, func() bool {
+		v, err := ringReplica.c.Get("alice", key)
+		return err == nil && string(v) == "unpinned"
+	})
+	if v, err := a.c.Get("alice", key); err != nil || string(v) != "unpinned" {
+		t.Fatalf("ring owner holds %q (%v), want the new value", v, err)
+	}
+}
@@ -1,40 +1,921 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/sanke08/Distributed-Cache/internal/cache"
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
 )
 
 type setRequest struct {
 	Key       string `json:"key"`
 	Value     string `json:"value"`
 	TTLSecond int64  `json:"ttl_second,omitempty"`
+	TTLMs     int64  `json:"ttl_ms,omitempty"` // takes precedence over ttl_second when both are set
+}
+
+var errNegativeTTL = errors.New("ttl must not be negative")
+
+// ttl returns the requested TTL (0 = no expiry). ttl_ms wins over ttl_second.
+func (req setRequest) ttl() (time.Duration, error) {
+	if req.TTLMs < 0 || req.TTLSecond < 0 {
+		return 0, errNegativeTTL
+	}
+	if req.TTLMs > 0 {
+		return time.Duration(req.TTLMs) * time.Millisecond, nil
+	}
+	return time.Duration(req.TTLSecond) * time.Second, nil
 }
 
 type internalReplicationRequest struct {
 	UserID    string `json:"user_id"`
 	Key       string `json:"key"`
-	Value     []byte `json:"value"`
-	TTL       int64  `json:"ttl_secs,"`
-	Timestamp int64  `json:"timestamp"`
+	Value     []byte `json:"value"`
+	TTL       int64  `json:"ttl_secs,"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func (s *Server) handleSet(w http.ResponseWriter, r *http.Request) {
+	t := s.startOp(opSet, r)
+	defer t.finish()
+
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	uid, err := s.userIDFromHeader(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req setRequest
+	if err := s.readJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	if req.Key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	t.user, t.key = uid, req.Key
+
+	ttl, err := req.ttl()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeout, err := s.requestTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// determine owner
+	keyForHash := uid + ":|:" + req.Key
+	owner, ok := s.cluster.LookupOwner(keyForHash)
+	if !ok {
+		writeClusterNotReady(w)
+		return
+	}
+
+	// If not owner, forward the original request (body) to owner
+	if !s.isSelf(owner) {
+		// fforward original body as-is
+		s.forwardToOwner(owner, w, r)
+		return
+	}
+
+	// owner is self -> do fast local write and enqueue replication tasks
+	// synchronous replication inherits the client's deadline (X-Timeout-Ms)
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	// ?verbose=true (or WriteAcks / WriteConsistency) replicates synchronously and reports each replica
+	verbose := r.URL.Query().Get("verbose") == "true"
+	syncRepl := s.syncWrites() || verbose
+
+	// remember the previous value so a rollback can restore it
+	var prev *cache.Item
+	if syncRepl && s.cfg.ReplicationFailurePolicy == ReplicationFailureRollback {
+		if item, err := s.cache.Peek(uid, req.Key); err == nil {
+			prev = &item
+		}
+	}
+
+	timestamp := time.Now().UnixNano()
+
+	// Local fast write; Set creates the user if missing and handles timestamp logic
+	created, err := s.cache.Set(uid, req.Key, []byte(req.Value), ttl, timestamp)
+	if err != nil {
+		if err == cache.ErrValueTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err == cache.ErrUserNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("[http] set err: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if !syncRepl {
+		// enqueue replication to other replicas (non-blocking)
+		s.enqueueReplication(uid, req.Key, []byte(req.Value), ttl, timestamp)
+
+		// immediate success response
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(setResponse{Status: "ok", Created: created})
+		return
+	}
+
+	acks := s.replicateSync(ctx, uid, req.Key, []byte(req.Value), ttl, timestamp)
+	resp := setResponse{Status: "ok", Created: created, Acks: countAcked(acks)}
+	if verbose {
+		resp.Replicas = acks
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if need := s.replicaAcksNeeded(len(acks)); resp.Acks < need {
+		// the local write stands; failed replicas are retried in the background
+		log.Printf("[http] set %s/%s: %d/%d replica acks", uid, req.Key, resp.Acks, need)
+		resp.Status = "insufficient_acks"
+		if ctx.Err() == context.DeadlineExceeded {
+			resp.Status = "deadline_exceeded"
+		}
+		code := http.StatusGatewayTimeout
+		switch s.cfg.ReplicationFailurePolicy {
+		case ReplicationFailureRollback:
+			resp.Outcome = s.revertWrite(uid, req.Key, timestamp, prev)
+		case ReplicationFailureRepair:
+			resp.Outcome = "repair_scheduled"
+			if !s.underReplicated.record(underReplicatedKey{UserID: uid, Key: req.Key, Timestamp: timestamp,
+				Acks: resp.Acks, Needed: need, RecordedAt: time.Now()}) {
+				log.Printf("[http] set %s/%s: repair log full", uid, req.Key)
+				resp.Outcome = "degraded"
+			} else {
+				code = http.StatusAccepted
+			}
+		default:
+			resp.Outcome = "degraded"
+		}
+		w.WriteHeader(code)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleGetOrSet returns the key's value if present, otherwise stores the given value
+// (atomically, like SETNX) and returns it. Concurrent callers all get the winning value.
+func (s *Server) handleGetOrSet(w http.ResponseWriter, r *http.Request) {
+	t := s.startOp(opSet, r)
+	defer t.finish()
+
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	uid, err := s.userIDFromHeader(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req setRequest
+	if err := s.readJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	if req.Key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	t.user, t.key = uid, req.Key
+
+	ttl, err := req.ttl()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// determine owner
+	keyForHash := uid + ":|:" + req.Key
+	owner, ok := s.cluster.LookupOwner(keyForHash)
+	if !ok {
+		writeClusterNotReady(w)
+		return
+	}
+
+	if !s.isSelf(owner) {
+		s.forwardToOwner(owner, w, r)
+		return
+	}
+
+	timestamp := time.Now().UnixNano()
+
+	val, set, err := s.cache.GetOrSet(uid, req.Key, []byte(req.Value), ttl, timestamp)
+	if err != nil {
+		if err == cache.ErrValueTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Printf("[http] getorset err: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if set {
+		s.enqueueReplication(uid, req.Key, val, ttl, timestamp)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getOrSetResponse{Value: string(val), Set: set})
+}
+
+type setNXResponse struct {
+	Set bool `json:"set"`
+}
+
+// handleSetNX stores the value only if the key is absent. Routing sends every SETNX
+// for a key to its primary, whose write lock picks a single winner; replicas receive
+// the winning write as an ordinary timestamped write and never decide on their own.
+func (s *Server) handleSetNX(w http.ResponseWriter, r *http.Request) {
+	t := s.startOp(opSet, r)
+	defer t.finish()
+
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	uid, err := s.userIDFromHeader(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req setRequest
+	if err := s.readJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	if req.Key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	t.user, t.key = uid, req.Key
+
+	ttl, err := req.ttl()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	owner, ok := s.cluster.LookupOwner(uid + ":|:" + req.Key)
+	if !ok {
+		writeClusterNotReady(w)
+		return
+	}
+
+	if !s.isSelf(owner) {
+		s.forwardToOwner(owner, w, r)
+		return
+	}
+
+	set, err := s.setNXLocal(uid, req.Key, []byte(req.Value), ttl)
+	if err != nil {
+		if err == cache.ErrValueTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Printf("[http] setnx err: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(setNXResponse{Set: set})
+}
+
+// setNXLocal stores value under a key this node owns if it is absent, and enqueues
+// replication of the winning write.
+func (s *Server) setNXLocal(uid, key string, value []byte, ttl time.Duration) (bool, error) {
+	timestamp := time.Now().UnixNano()
+	set, err := s.cache.SetNX(uid, key, value, ttl, timestamp)
+	if err != nil || !set {
+		return false, err
+	}
+	s.enqueueReplication(uid, key, value, ttl, timestamp)
+	return true, nil
+}
+
+type getSetResponse struct {
+	Old     string `json:"old"`
+	Existed bool   `json:"existed"` // false when there was no previous value
+}
+
+// handleGetSet stores a value and returns the one it replaced, atomically.
+func (s *Server) handleGetSet(w http.ResponseWriter, r *http.Request) {
+	t := s.startOp(opSet, r)
+	defer t.finish()
+
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	uid, err := s.userIDFromHeader(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req setRequest
+	if err := s.readJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	if req.Key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	t.user, t.key = uid, req.Key
+
+	ttl, err := req.ttl()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	owner, ok := s.cluster.LookupOwner(uid + ":|:" + req.Key)
+	if !ok {
+		writeClusterNotReady(w)
+		return
+	}
+
+	if !s.isSelf(owner) {
+		s.forwardToOwner(owner, w, r)
+		return
+	}
+
+	old, err := s.getSetLocal(uid, req.Key, []byte(req.Value), ttl)
+	if err != nil && err != cache.ErrKeyNotFound {
+		if err == cache.ErrValueTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Printf("[http] getset err: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getSetResponse{Old: string(old), Existed: err == nil})
+}
+
+// getSetLocal swaps the value of a key this node owns and enqueues replication of the
+// stored state. Like cache.GetSet it returns ErrKeyNotFound, with the write applied,
+// when there was no previous value.
+func (s *Server) getSetLocal(uid, key string, value []byte, ttl time.Duration) ([]byte, error) {
+	old, err := s.cache.GetSet(uid, key, value, ttl)
+	if err != nil && err != cache.ErrKeyNotFound {
+		return nil, err
+	}
+	// replicate the stored state with its own timestamp
+	s.replicateItem(uid, key)
+	return old, err
+}
+
+type incrRequest struct {
+	Key   string `json:"key"`
+	Delta *int64 `json:"delta,omitempty"` // default 1
+}
+
+type incrResponse struct {
+	Value int64 `json:"value"`
+}
+
+// handleIncr atomically adds delta to an integer value (/v1/incr) or subtracts it
+// (/v1/decr). The resulting value is replicated like a normal write.
+func (s *Server) handleIncr(w http.ResponseWriter, r *http.Request) {
+	t := s.startOp(opSet, r)
+	defer t.finish()
+
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	uid, err := s.userIDFromHeader(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req incrRequest
+	if err := s.readJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	if req.Key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	t.user, t.key = uid, req.Key
+
+	delta := int64(1)
+	if req.Delta != nil {
+		delta = *req.Delta
+	}
+
+	owner, ok := s.cluster.LookupOwner(uid + ":|:" + req.Key)
+	if !ok {
+		writeClusterNotReady(w)
+		return
+	}
+
+	if !s.isSelf(owner) {
+		s.forwardToOwner(owner, w, r)
+		return
+	}
+
+	n, err := s.incrLocal(uid, req.Key, delta, r.URL.Path == "/v1/decr")
+	if err != nil {
+		if err == cache.ErrNotInteger || err == cache.ErrIntegerOverflow {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("[http] incr err: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(incrResponse{Value: n})
+}
+
+// incrLocal adds delta to (or with decr, subtracts it from) a key this node owns and
+// enqueues replication of the result.
+func (s *Server) incrLocal(uid, key string, delta int64, decr bool) (int64, error) {
+	var n int64
+	var err error
+	if decr {
+		n, err = s.cache.Decr(uid, key, delta)
+	} else {
+		n, err = s.cache.Incr(uid, key, delta)
+	}
+	if err != nil {
+		return 0, err
+	}
+	// replicate the stored state (it may already include a later increment, which
+	// carries its own newer timestamp, so replicas still converge)
+	s.replicateItem(uid, key)
+	return n, nil
+}
+
+type setIfStaleRequest struct {
+	setRequest
+	StaleWithinMs int64 `json:"stale_within_ms"`
+}
+
+type setIfStaleResponse struct {
+	Status string `json:"status"`
+	Wrote  bool   `json:"wrote"`
+}
+
+// handleSetIfStale writes the key only if it is missing or expires within
+// stale_within_ms (refresh-ahead). Keys without a TTL are never stale.
+func (s *Server) handleSetIfStale(w http.ResponseWriter, r *http.Request) {
+	t := s.startOp(opSet, r)
+	defer t.finish()
+
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	uid, err := s.userIDFromHeader(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req setIfStaleRequest
+	if err := s.readJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	if req.Key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	t.user, t.key = uid, req.Key
+
+	ttl, err := req.ttl()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.StaleWithinMs < 0 {
+		http.Error(w, "stale_within_ms must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	owner, ok := s.cluster.LookupOwner(uid + ":|:" + req.Key)
+	if !ok {
+		writeClusterNotReady(w)
+		return
+	}
+
+	if !s.isSelf(owner) {
+		s.forwardToOwner(owner, w, r)
+		return
+	}
+
+	timestamp := time.Now().UnixNano()
+	staleWithin := time.Duration(req.StaleWithinMs) * time.Millisecond
+
+	wrote, err := s.cache.SetIfStaleAt(uid, req.Key, []byte(req.Value), ttl, staleWithin, timestamp)
+	if err != nil {
+		if err == cache.ErrValueTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Printf("[http] setifstale err: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if wrote {
+		s.enqueueReplication(uid, req.Key, []byte(req.Value), ttl, timestamp)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(setIfStaleResponse{Status: "ok", Wrote: wrote})
+}
+
+type msetRequest struct {
+	Items     map[string]string `json:"items"`
+	Pairs     []kvPair          `json:"pairs,omitempty"` // array form; merged into items, later pairs win
+	TTLSecond int64             `json:"ttl_second,omitempty"`
+	TTLMs     int64             `json:"ttl_ms,omitempty"`
+}
+
+type kvPair struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type msetResponse struct {
+	Status  string       `json:"status"`
+	Set     int          `json:"set"`
+	Created int          `json:"created"`
+	Failed  []failedNode `json:"failed,omitempty"` // owners whose batch could not be written
+}
+
+// handleMSet writes many keys with one shared TTL. Keys are grouped by owner: the local
+// batch is written under a single user lock, the rest go to their owners as one
+// /v1/mset each, in parallel.
+func (s *Server) handleMSet(w http.ResponseWriter, r *http.Request) {
+	t := s.startOp(opSet, r)
+	defer t.finish()
+
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	uid, err := s.userIDFromHeader(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t.user = uid
+
+	var req msetRequest
+	if err := s.readJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	if len(req.Pairs) > 0 && req.Items == nil {
+		req.Items = make(map[string]string, len(req.Pairs))
+	}
+	for _, p := range req.Pairs {
+		req.Items[p.Key] = p.Value
+	}
+
+	if len(req.Items) == 0 {
+		http.Error(w, "missing items", http.StatusBadRequest)
+		return
+	}
+	if _, ok := req.Items[""]; ok {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	ttl, err := setRequest{TTLSecond: req.TTLSecond, TTLMs: req.TTLMs}.ttl()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeout, err := s.requestTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	resp, err := s.mset(ctx, uid, req, ttl, timeout)
+	if err != nil {
+		writeClusterNotReady(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(resp.Failed) > 0 {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// mset writes req.Items grouped by owner: the local batch under a single user lock,
+// the rest as one /v1/mset per owner, in parallel. Owners that fail are listed in
+// the response (status "partial"); the only error is errClusterNotReady.
+func (s *Server) mset(ctx context.Context, uid string, req msetRequest, ttl, timeout time.Duration) (msetResponse, error) {
+	// group keys by owner
+	owners := make(map[string]cluster.NodeInfo)
+	batches := make(map[string]map[string]string)
+	for k, v := range req.Items {
+		owner, ok := s.cluster.LookupOwner(uid + ":|:" + k)
+		if !ok {
+			return msetResponse{}, errClusterNotReady
+		}
+		if batches[owner.ID] == nil {
+			owners[owner.ID] = owner
+			batches[owner.ID] = make(map[string]string)
+		}
+		batches[owner.ID][k] = v
+	}
+
+	nodes := make([]cluster.NodeInfo, 0, len(owners))
+	for _, n := range owners {
+		nodes = append(nodes, n)
+	}
+
+	results, failed := scatterGather(ctx, nodes, timeout, func(ctx context.Context, node cluster.NodeInfo) (msetResponse, error) {
+		batch := msetRequest{Items: batches[node.ID], TTLSecond: req.TTLSecond, TTLMs: req.TTLMs}
+		if s.isSelf(node) {
+			return s.msetLocal(uid, batch.Items, ttl)
+		}
+		return s.forwardMSet(ctx, node, uid, batch)
+	})
+
+	resp := msetResponse{Status: "ok", Failed: failed}
+	for _, res := range results {
+		resp.Set += res.Set
+		resp.Created += res.Created
+	}
+	if len(failed) > 0 {
+		log.Printf("[mset] %s: %d/%d owners failed", uid, len(failed), len(nodes))
+		resp.Status = "partial"
+	}
+	return resp, nil
+}
+
+// msetLocal writes a batch this node owns and enqueues its replication.
+func (s *Server) msetLocal(uid string, items map[string]string, ttl time.Duration) (msetResponse, error) {
+	timestamp := time.Now().UnixNano()
+	values := make(map[string][]byte, len(items))
+	for k, v := range items {
+		values[k] = []byte(v)
+	}
+
+	created, err := s.cache.SetMany(uid, values, ttl, timestamp)
+	if err != nil {
+		return msetResponse{}, err
+	}
+	for k, v := range values {
+		s.enqueueReplication(uid, k, v, ttl, timestamp)
+	}
+	return msetResponse{Status: "ok", Set: len(values), Created: created}, nil
+}
+
+// forwardMSet sends one owner's batch to its /v1/mset.
+func (s *Server) forwardMSet(ctx context.Context, owner cluster.NodeInfo, uid string, batch msetRequest) (msetResponse, error) {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return msetResponse{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.nodeURL(owner.Addr)+"/v1/mset", bytes.NewReader(data))
+	if err != nil {
+		return msetResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-Id", uid)
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(timeoutHeader, strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 1), 10))
+	}
+	setClusterSecret(req, s.cfg.ClusterSecret)
+
+	resp, err := s.forwardClient.Do(req)
+	if err != nil {
+		return msetResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var out msetResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return msetResponse{}, fmt.Errorf("mset on %s: status %d", owner.ID, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return msetResponse{}, fmt.Errorf("mset on %s: status %d (%s)", owner.ID, resp.StatusCode, out.Status)
+	}
+	return out, nil
+}
+
+type mgetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type mgetResponse struct {
+	Values  map[string]string `json:"values"`
+	Missing []string          `json:"missing,omitempty"`
+	Failed  []failedNode      `json:"failed,omitempty"` // owners that could not be read
+}
+
+// handleMGet reads many keys. Like /v1/mset, keys are grouped by owner: the local
+// batch is read under a single user lock, the rest are fetched from their owners with
+// one /v1/mget each, in parallel, and the results merged.
+func (s *Server) handleMGet(w http.ResponseWriter, r *http.Request) {
+	t := s.startOp(opGet, r)
+	defer t.finish()
+
+	uid, err := s.userIDFromHeader(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t.user = uid
+
+	var req mgetRequest
+	if err := s.readJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	if len(req.Keys) == 0 {
+		http.Error(w, "missing keys", http.StatusBadRequest)
+		return
+	}
+
+	timeout, err := s.requestTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// group keys by owner
+	owners := make(map[string]cluster.NodeInfo)
+	batches := make(map[string][]string)
+	for _, k := range req.Keys {
+		if k == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+		owner, ok := s.cluster.LookupOwner(uid + ":|:" + k)
+		if !ok {
+			writeClusterNotReady(w)
+			return
+		}
+		owners[owner.ID] = owner
+		batches[owner.ID] = append(batches[owner.ID], k)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	nodes := make([]cluster.NodeInfo, 0, len(owners))
+	for _, n := range owners {
+		nodes = append(nodes, n)
+	}
+
+	results, failed := scatterGather(ctx, nodes, timeout, func(ctx context.Context, node cluster.NodeInfo) (mgetResponse, error) {
+		if s.isSelf(node) {
+			return s.mgetLocal(uid, batches[node.ID])
+		}
+		return s.forwardMGet(ctx, node, uid, batches[node.ID])
+	})
+
+	resp := mgetResponse{Values: make(map[string]string, len(req.Keys)), Failed: failed}
+	for _, res := range results {
+		for k, v := range res.Values {
+			resp.Values[k] = v
+		}
+		resp.Missing = append(resp.Missing, res.Missing...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(failed) > 0 {
+		log.Printf("[http] mget %s: %d/%d owners failed", uid, len(failed), len(nodes))
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// mgetLocal reads a batch this node owns. An unknown user just means every key is missing.
+func (s *Server) mgetLocal(uid string, keys []string) (mgetResponse, error) {
+	values, err := s.cache.MGet(uid, keys)
+	if err != nil && err != cache.ErrUserNotFound {
+		return mgetResponse{}, err
+	}
+	resp := mgetResponse{Values: make(map[string]string, len(values))}
+	for _, k := range keys {
+		if v, ok := values[k]; ok {
+			resp.Values[k] = string(v)
+		} else {
+			resp.Missing = append(resp.Missing, k)
+		}
+	}
+	return resp, nil
+}
+
+// forwardMGet sends one owner's keys to its /v1/mget.
+func (s *Server) forwardMGet(ctx context.Context, owner cluster.NodeInfo, uid string, keys []string) (mgetResponse, error) {
+	data, err := json.Marshal(mgetRequest{Keys: keys})
+	if err != nil {
+		return mgetResponse{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.nodeURL(owner.Addr)+"/v1/mget", bytes.NewReader(data))
+	if err != nil {
+		return mgetResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-Id", uid)
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(timeoutHeader, strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 1), 10))
+	}
+	setClusterSecret(req, s.cfg.ClusterSecret)
+
+	resp, err := s.forwardClient.Do(req)
+	if err != nil {
+		return mgetResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return mgetResponse{}, fmt.Errorf("mget on %s: status %d", owner.ID, resp.StatusCode)
+	}
+	var out mgetResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return mgetResponse{}, fmt.Errorf("mget on %s: %w", owner.ID, err)
+	}
+	return out, nil
+}
+
+type expireRequest struct {
+	Key       string `json:"key"`
+	TTLSecond *int64 `json:"ttl_second,omitempty"`
+	TTLMs     *int64 `json:"ttl_ms,omitempty"` // takes precedence over ttl_second
 }
 
-func (s *Server) handleSet(w http.ResponseWriter, r *http.Request) {
+// handleExpire sets a new TTL on an existing key (/v1/expire) or clears it
+// (/v1/persist) without rewriting the value. A TTL <= 0 deletes the key. The change
+// is replicated with a fresh timestamp so replicas end up with the same expiry.
+func (s *Server) handleExpire(w http.ResponseWriter, r *http.Request) {
+	t := s.startOp(opSet, r)
+	defer t.finish()
 
-	uid, err := userIDFromHeader(r)
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	uid, err := s.userIDFromHeader(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var req setRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid json", http.StatusBadRequest)
+	var req expireRequest
+	if err := s.readJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
 		return
 	}
 
@@ -42,63 +923,135 @@ func (s *Server) handleSet(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing key", http.StatusBadRequest)
 		return
 	}
+	t.user, t.key = uid, req.Key
 
-	// determine owner
-	keyForHash := uid + ":|:" + req.Key
-	owner, ok := s.cluster.LookupOwner(keyForHash)
+	persist := r.URL.Path == "/v1/persist"
+	var ttl time.Duration
+	switch {
+	case persist:
+	case req.TTLMs != nil:
+		ttl = time.Duration(*req.TTLMs) * time.Millisecond
+	case req.TTLSecond != nil:
+		ttl = time.Duration(*req.TTLSecond) * time.Second
+	default:
+		http.Error(w, "missing ttl_second or ttl_ms", http.StatusBadRequest)
+		return
+	}
+
+	owner, ok := s.cluster.LookupOwner(uid + ":|:" + req.Key)
 	if !ok {
-		http.Error(w, "no cluster nodes", http.StatusServiceUnavailable)
+		writeClusterNotReady(w)
 		return
 	}
 
-	// If not owner, forward the original request (body) to owner
-	if owner.Addr != s.cfg.HTTPAddr {
-		// fforward original body as-is
+	if !s.isSelf(owner) {
 		s.forwardToOwner(owner, w, r)
 		return
 	}
 
-	// owner is self -> do fast local write and enqueue replication tasks
-	ttl := time.Duration(0)
-	if req.TTLSecond > 0 {
-		ttl = time.Duration(req.TTLSecond) * time.Second
+	if err := s.expireLocal(uid, req.Key, ttl, persist); err != nil {
+		if err == cache.ErrUserNotFound || err == cache.ErrKeyNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("[http] expire err: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
 	}
 
-	_, cancel := context.WithTimeout(r.Context(), s.cfg.CmdTimeout)
-	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"status":"ok"}`))
+}
 
-	// Ensure user exists
-	if err := s.cache.CreateUser(uid); err != nil {
-		if err != cache.ErrUserExists {
-			log.Printf("[http] create user err: %v", err)
-			http.Error(w, "internal error", http.StatusInternalServerError)
-			return
+// expireLocal sets a new TTL on (or with persist, clears the TTL of) a key this node
+// owns and enqueues replication of the result.
+func (s *Server) expireLocal(uid, key string, ttl time.Duration, persist bool) error {
+	var err error
+	if persist {
+		err = s.cache.Persist(uid, key)
+	} else {
+		err = s.cache.Expire(uid, key, ttl)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.cache.Peek(uid, key); err == cache.ErrKeyNotFound {
+		// expired right away: send an already-expired write so replicas drop the key
+		ts := time.Now().UnixNano()
+		for _, task := range s.replicationTasks(uid, key, nil, 0, ts) {
+			task.ExpiresAt = ts - 1
+			s.replicator.enqueue(task)
 		}
+		return nil
 	}
+	s.replicateItem(uid, key)
+	return nil
+}
 
-	timestamp := time.Now().UnixNano()
+type ttlResponse struct {
+	TTLSeconds int64 `json:"ttl_seconds"` // rounded up; -1 = no expiry
+	TTLMs      int64 `json:"ttl_ms"`      // -1 = no expiry
+}
 
-	// Local fast write (Set inside ReplicateSet handles timestamp logic)
-	if err := s.cache.Set(uid, req.Key, []byte(req.Value), ttl, timestamp); err != nil {
-		if err == cache.ErrUserNotFound {
+// ttlSeconds rounds a remaining TTL up to whole seconds, so a key about to expire
+// never reads as 0; NoExpiry stays -1.
+func ttlSeconds(d time.Duration) int64 {
+	if d == cache.NoExpiry {
+		return -1
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// handleTTL returns how long a key has left before it expires.
+func (s *Server) handleTTL(w http.ResponseWriter, r *http.Request) {
+	uid, err := s.userIDFromHeader(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	owner, ok := s.cluster.LookupOwner(uid + ":|:" + key)
+	if !ok {
+		writeClusterNotReady(w)
+		return
+	}
+
+	if !s.isSelf(owner) {
+		s.forwardToOwner(owner, w, r)
+		return
+	}
+
+	left, err := s.cache.TTL(uid, key)
+	if err != nil {
+		if err == cache.ErrUserNotFound || err == cache.ErrKeyNotFound {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
-		log.Printf("[http] set err: %v", err)
+		log.Printf("[http] ttl err: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
-	// enqueue replication to other replicas (non-blocking)
-	s.enqueueReplication(uid, req.Key, []byte(req.Value), req.TTLSecond, timestamp)
-
-	// immediate success response
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte(`{"status":"ok"}`))
+	resp := ttlResponse{TTLSeconds: -1, TTLMs: -1}
+	if left != cache.NoExpiry {
+		resp = ttlResponse{TTLSeconds: ttlSeconds(left), TTLMs: left.Milliseconds()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
-	uid, err := userIDFromHeader(r)
+	t := s.startOp(opGet, r)
+	defer t.finish()
+
+	uid, err := s.userIDFromHeader(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -109,25 +1062,56 @@ func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing key", http.StatusBadRequest)
 		return
 	}
+	t.user, t.key = uid, key
 
 	// determine owner
 	keyForHash := uid + ":|:" + key
 	owner, ok := s.cluster.LookupOwner(keyForHash)
 	if !ok {
-		http.Error(w, "no cluster nodes", http.StatusServiceUnavailable)
+		writeClusterNotReady(w)
 		return
 	}
 
-	if owner.Addr != s.cfg.HTTPAddr {
-		// forward
-		s.forwardToOwner(owner, w, r)
+	if s.cfg.ReadConsistency == ConsistencyQuorum || s.cfg.ReadConsistency == ConsistencyAll {
+		s.getConsistent(w, r, uid, key)
+		return
+	}
+
+	if !s.isSelf(owner) {
+		// forward; the timeout covers the owner and any replica attempts
+		timeout, err := s.requestTimeout(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		if err := s.tryForward(ctx, owner, w, r); err == nil {
+			return
+		}
+
+		// owner unreachable: a replica's (possibly stale) copy beats an error
+		val, from, err := s.readFromReplicas(ctx, uid, key)
+		switch err {
+		case nil:
+		case cache.ErrUserNotFound, cache.ErrKeyNotFound:
+			w.Header().Set(replicaReadHeader, from.ID)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		default:
+			http.Error(w, "forward error", http.StatusBadGateway)
+			return
+		}
+		log.Printf("[http] get %s/%s: owner %s unreachable, served by replica %s", uid, key, owner.ID, from.ID)
+		w.Header().Set(replicaReadHeader, from.ID)
+		s.writeValue(w, val)
 		return
 	}
 
 	_, cancel := context.WithTimeout(r.Context(), s.cfg.CmdTimeout)
 	defer cancel()
 
-	val, err := s.cache.Get(uid, key)
+	val, err := s.getOwned(uid, key)
 	if err != nil {
 		if err == cache.ErrUserNotFound || err == cache.ErrKeyNotFound {
 			http.Error(w, err.Error(), http.StatusNotFound)
@@ -137,6 +1121,21 @@ func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	s.writeValue(w, val)
+}
+
+// writeValue writes a GET reply, applying MaxResponseBytes.
+func (s *Server) writeValue(w http.ResponseWriter, val []byte) {
+	if max := s.cfg.MaxResponseBytes; max > 0 && len(val) > max {
+		if s.cfg.ResponseCapPolicy != ResponseCapTruncate {
+			http.Error(w, "value exceeds response size cap", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// truncated: report the full size so the client knows what it's missing
+		w.Header().Set("X-Value-Truncated", "true")
+		w.Header().Set("X-Value-Length", strconv.Itoa(len(val)))
+		val = val[:max]
+	}
 
 	resp := valueResponse{Value: string(val)}
 	w.Header().Set("Content-Type", "application/json")
@@ -144,7 +1143,14 @@ func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
-	uid, err := userIDFromHeader(r)
+	t := s.startOp(opDelete, r)
+	defer t.finish()
+
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	uid, err := s.userIDFromHeader(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -154,16 +1160,17 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing key", http.StatusBadRequest)
 		return
 	}
+	t.user, t.key = uid, key
 
 	// determine owner
 	keyForHash := uid + ":|:" + key
 	owner, ok := s.cluster.LookupOwner(keyForHash)
 	if !ok {
-		http.Error(w, "no cluster nodes", http.StatusServiceUnavailable)
+		writeClusterNotReady(w)
 		return
 	}
 
-	if owner.Addr != s.cfg.HTTPAddr {
+	if !s.isSelf(owner) {
 		// forward
 		s.forwardToOwner(owner, w, r)
 		return
@@ -186,30 +1193,137 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request) {
-	uid, err := userIDFromHeader(r)
+	uid, err := s.userIDFromHeader(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// For keys, we might need distributed gathering,
-	// but for now, we only list local keys or we need a way to aggregate.
-	// Current implementation: only local keys for that user.
-	// Production Grade Recommendation: this should probably aggregate from all nodes.
-	// But per "make functionality does not break" (it was local before), we keep it local or modify?
-	// The user added cluster logic to SET/GET but not KEYS in the diff.
-	// Checking the diffs... The user did NOT modify handleKeys in his last edit.
-	// So I will keep it as is (local).
-
-	_, cancel := context.WithTimeout(r.Context(), s.cfg.CmdTimeout)
+	timeout, err := s.requestTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
 	defer cancel()
-	keys, err := s.cache.ListKeys(uid)
+
+	// optional ?pattern= glob; empty lists every key
+	keys, found, failed := s.keysCluster(ctx, timeout, uid, r.URL.Query().Get("pattern"))
+	if !found && len(failed) == 0 {
+		http.Error(w, cache.ErrUserNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(failed) > 0 {
+		// partial: keys of the nodes that answered, and the ones that didn't
+		log.Printf("[http] keys %s: %d nodes failed", uid, len(failed))
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(keyResponse{Keys: keys, Failed: failed})
+}
+
+// handleInternalKeys lists this node's keys of ?user= matching ?pattern= (internal,
+// cluster-wide KEYS).
+func (s *Server) handleInternalKeys(w http.ResponseWriter, r *http.Request) {
+	uid := r.URL.Query().Get("user")
+	if uid == "" {
+		http.Error(w, "missing user", http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.keysLocal(uid, r.URL.Query().Get("pattern"))
+	if err != nil {
+		log.Printf("[http] internal keys %s err: %v", uid, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// maxScanCount caps the chunk size a client can ask /v1/scan for.
+const maxScanCount = 1000
+
+type scanResponse struct {
+	Keys   []string `json:"keys"`
+	Cursor string   `json:"cursor"` // pass back as ?cursor=; "0" when done. A string so JS clients keep all 64 bits
+}
+
+// handleScan returns one chunk of the user's keys (?cursor=&count=). Unlike KEYS it
+// only covers keys held by this node.
+func (s *Server) handleScan(w http.ResponseWriter, r *http.Request) {
+	uid, err := s.userIDFromHeader(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var cursor uint64
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		if cursor, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	count := 10
+	if v := r.URL.Query().Get("count"); v != "" {
+		if count, err = strconv.Atoi(v); err != nil || count <= 0 {
+			http.Error(w, "invalid count", http.StatusBadRequest)
+			return
+		}
+	}
+	count = min(count, maxScanCount)
+
+	keys, next, err := s.cache.Scan(uid, cursor, count)
+	if err != nil {
+		if err == cache.ErrUserNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("[http] scan err: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scanResponse{Keys: keys, Cursor: strconv.FormatUint(next, 10)})
+}
+
+// handleNearExpiry lists keys whose TTL ends within ?within= (duration like "30s" or seconds).
+// Unlike KEYS it only reports keys held by this node.
+func (s *Server) handleNearExpiry(w http.ResponseWriter, r *http.Request) {
+	uid, err := s.userIDFromHeader(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	within, err := parseDurationParam(r.URL.Query().Get("within"))
+	if err != nil || within <= 0 {
+		http.Error(w, "invalid within", http.StatusBadRequest)
+		return
+	}
+
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	keys, err := s.cache.NearExpiry(uid, within, limit)
 	if err != nil {
 		if err == cache.ErrUserNotFound {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
-		log.Printf("[http] keys err: %v", err)
+		log.Printf("[http] near-expiry err: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
@@ -220,30 +1334,80 @@ func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request) {
 }
 
 // Internal replication endpoint - replicas accept these writes from primary.
+// In read-only mode replicated writes are rejected with 503 so the sender retries later.
 func (s *Server) handleInternalReplicate(w http.ResponseWriter, r *http.Request) {
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
 	var req internalReplicationRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid json", http.StatusBadRequest)
 		return
 	}
 
+	s.applyReplicatedWrite(w, req)
+}
+
+// handleInternalReplicateRaw is the binary replication transport: the value is the raw
+// request body and the metadata is carried in X-Repl-* headers.
+func (s *Server) handleInternalReplicateRaw(w http.ResponseWriter, r *http.Request) {
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	userID, err1 := url.QueryUnescape(r.Header.Get(hdrReplUser))
+	key, err2 := url.QueryUnescape(r.Header.Get(hdrReplKey))
+	ttl, err3 := strconv.ParseInt(r.Header.Get(hdrReplTTL), 10, 64)
+	expiresAt, err4 := strconv.ParseInt(r.Header.Get(hdrReplExpiresAt), 10, 64)
+	timestamp, err5 := strconv.ParseInt(r.Header.Get(hdrReplTimestamp), 10, 64)
+	if err := errors.Join(err1, err2, err3, err4, err5); err != nil || userID == "" {
+		http.Error(w, "invalid replication headers", http.StatusBadRequest)
+		return
+	}
+
+	value, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "read error", http.StatusBadRequest)
+		return
+	}
+
+	s.applyReplicatedWrite(w, internalReplicationRequest{
+		UserID:    userID,
+		Key:       key,
+		Value:     value,
+		TTL:       ttl,
+		ExpiresAt: expiresAt,
+		Timestamp: timestamp,
+	})
+}
+
+// applyReplicatedWrite stores a replicated write and responds.
+func (s *Server) applyReplicatedWrite(w http.ResponseWriter, req internalReplicationRequest) {
+	// ordering relies on the primary's timestamp; a zero one would be stamped "now"
+	// and could overwrite newer data
+	if req.Timestamp <= 0 {
+		http.Error(w, "missing timestamp", http.StatusBadRequest)
+		return
+	}
+
 	ttl := time.Duration(0)
 	if req.TTL > 0 {
 		ttl = time.Duration(req.TTL) * time.Second
 	}
 
-	// ensure user exists (create if necessary)
-	if err := s.cache.CreateUser(req.UserID); err != nil && err != cache.ErrUserExists {
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
+	// apply replicated write (creating the user if missing) - Set ensures timestamp ordering.
+	// An absolute expiry already in the past removes the key rather than storing it.
+	var err error
+	if req.ExpiresAt > 0 {
+		_, err = s.cache.SetUntil(req.UserID, req.Key, req.Value, time.Unix(0, req.ExpiresAt), req.Timestamp)
+	} else {
+		_, err = s.cache.Set(req.UserID, req.Key, req.Value, ttl, req.Timestamp)
 	}
-
-	// apply replicated write - replicateSet ensures timestamp ordering
-	if err := s.cache.Set(req.UserID, req.Key, req.Value, ttl, req.Timestamp); err != nil {
+	if err != nil {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte(`{"status":"ok"}`))
-
 }
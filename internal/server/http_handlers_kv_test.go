@@ -0,0 +1,401 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+)
+
+func TestSetReportsCreated(t *testing.T) {
+	n := startNode(t, ServerConfig{})
+	set := func(key string) setResponse {
+		code, body := n.do(t, http.MethodPost, "/v1/set", "alice", map[string]any{"key": key, "value": "v"})
+		var resp setResponse
+		if err := json.Unmarshal(body, &resp); code != http.StatusOK || err != nil {
+			t.Fatalf("set %s = %d %s", key, code, body)
+		}
+		return resp
+	}
+	if resp := set("k"); !resp.Created {
+		t.Fatalf("first set = %+v, want created", resp)
+	}
+	if resp := set("k"); resp.Created {
+		t.Fatalf("overwrite = %+v, want not created", resp)
+	}
+
+	c := dialTCP(t, n.tcp)
+	if got := c.cmd(t, "SET alice t v"); got != "OK CREATED" {
+		t.Fatalf("tcp first set = %q, want OK CREATED", got)
+	}
+	if got := c.cmd(t, "SET alice t v2"); got != "OK UPDATED" {
+		t.Fatalf("tcp overwrite = %q, want OK UPDATED", got)
+	}
+}
+
+func TestSetTTLUnits(t *testing.T) {
+	n := startNode(t, ServerConfig{})
+	tests := []struct {
+		name     string
+		ttl      map[string]any // ttl fields added to the request body
+		wantCode int
+		wantTTL  time.Duration // 0 = no expiry
+	}{
+		{name: "none", wantCode: http.StatusOK},
+		{name: "seconds", ttl: map[string]any{"ttl_second": 30}, wantCode: http.StatusOK, wantTTL: 30 * time.Second},
+		{name: "milliseconds", ttl: map[string]any{"ttl_ms": 1500}, wantCode: http.StatusOK, wantTTL: 1500 * time.Millisecond},
+		{name: "ttl_ms wins", ttl: map[string]any{"ttl_second": 60, "ttl_ms": 2500}, wantCode: http.StatusOK, wantTTL: 2500 * time.Millisecond},
+		{name: "negative seconds", ttl: map[string]any{"ttl_second": -1}, wantCode: http.StatusBadRequest},
+		{name: "negative milliseconds", ttl: map[string]any{"ttl_ms": -1}, wantCode: http.StatusBadRequest},
+		{name: "negative seconds with ttl_ms", ttl: map[string]any{"ttl_second": -1, "ttl_ms": 500}, wantCode: http.StatusBadRequest},
+	}
+	for _, path := range []string{"/v1/set", "/v1/getorset"} {
+		for _, tt := range tests {
+			t.Run(path+" "+tt.name, func(t *testing.T) {
+				key := path + "-" + tt.name
+				body := map[string]any{"key": key, "value": "v"}
+				for k, v := range tt.ttl {
+					body[k] = v
+				}
+				if code, resp := n.do(t, http.MethodPost, path, "alice", body); code != tt.wantCode {
+					t.Fatalf("%s = %d %s, want %d", path, code, resp, tt.wantCode)
+				}
+				if tt.wantCode != http.StatusOK {
+					if _, err := n.c.Peek("alice", key); err == nil {
+						t.Fatalf("rejected request stored %s", key)
+					}
+					return
+				}
+				ttl, err := n.c.TTL("alice", key)
+				if err != nil {
+					t.Fatalf("ttl: %v", err)
+				}
+				if tt.wantTTL == 0 {
+					if ttl > 0 {
+						t.Fatalf("ttl = %s, want no expiry", ttl)
+					}
+					return
+				}
+				if ttl > tt.wantTTL || ttl < tt.wantTTL-time.Second {
+					t.Fatalf("ttl = %s, want about %s", ttl, tt.wantTTL)
+				}
+			})
+		}
+	}
+}
+
+func TestMSetSharedTTL(t *testing.T) {
+	nodes := startCluster(t, 2, ServerConfig{ReplicationFactor: 1})
+	items := map[string]string{}
+	for i := 0; i < 20; i++ {
+		items["k"+strconv.Itoa(i)] = "v" + strconv.Itoa(i)
+	}
+	code, body := nodes[0].do(t, http.MethodPost, "/v1/mset", "alice", map[string]any{"items": items, "ttl_second": 60})
+	if code != http.StatusOK {
+		t.Fatalf("mset = %d %s", code, body)
+	}
+	var resp msetResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Set != len(items) || resp.Created != len(items) {
+		t.Fatalf("mset = %+v, want %d set and created", resp, len(items))
+	}
+
+	for k, v := range items {
+		owner, _ := nodes[0].s.cluster.LookupOwner("alice:|:" + k)
+		var holder *testNode
+		for _, n := range nodes {
+			if n.s.cluster.Self().ID == owner.ID {
+				holder = n
+			}
+		}
+		got, err := holder.c.Get("alice", k)
+		if err != nil || string(got) != v {
+			t.Fatalf("owner %s: %s = %q, %v", owner.ID, k, got, err)
+		}
+		if left, _ := holder.c.TTL("alice", k); left > time.Minute || left < 59*time.Second {
+			t.Fatalf("%s ttl = %s, want about 1m", k, left)
+		}
+	}
+}
+
+func TestMaxValueBytes(t *testing.T) {
+	cfg := testCacheConfig(t)
+	cfg.MaxValueBytes = 8
+	n := startNodeWithCache(t, ServerConfig{}, cache.NewCache(cfg))
+
+	if code, body := n.do(t, http.MethodPost, "/v1/set", "alice", map[string]any{"key": "at", "value": "12345678"}); code != http.StatusOK {
+		t.Fatalf("set at the limit = %d %s", code, body)
+	}
+	if code, body := n.do(t, http.MethodPost, "/v1/set", "alice", map[string]any{"key": "over", "value": "123456789"}); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("set over the limit = %d %s, want 413", code, body)
+	}
+
+	c := dialTCP(t, n.tcp)
+	if got := c.cmd(t, "SET alice tcp-at 12345678"); !strings.HasPrefix(got, "OK") {
+		t.Fatalf("tcp SET at the limit = %q", got)
+	}
+	if got := c.cmd(t, "SET alice tcp-over 123456789"); got != "ERR "+cache.ErrValueTooLarge.Error() {
+		t.Fatalf("tcp SET over the limit = %q", got)
+	}
+	for _, key := range []string{"over", "tcp-over"} {
+		if n.holds("alice", key) {
+			t.Fatalf("%s was stored", key)
+		}
+	}
+}
+
+func TestKeysAcrossCluster(t *testing.T) {
+	nodes := startCluster(t, 3, ServerConfig{})
+	var want []string
+	for _, n := range nodes {
+		key := keyOwnedBy(t, nodes[0], "alice", n.s.cluster.Self().ID)
+		nodes[0].set(t, "alice", key, "v")
+		want = append(want, key)
+	}
+	sort.Strings(want)
+
+	keysVia := func(t *testing.T, n *testNode) (int, keyResponse) {
+		t.Helper()
+		code, body := n.do(t, http.MethodGet, "/v1/keys", "alice", nil)
+		var resp keyResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			t.Fatalf("decode keys: %v (%s)", err, body)
+		}
+		sort.Strings(resp.Keys)
+		return code, resp
+	}
+
+	// every node lists every key, whichever node holds it
+	for _, n := range nodes {
+		if code, resp := keysVia(t, n); code != http.StatusOK || !reflect.DeepEqual(resp.Keys, want) {
+			t.Fatalf("keys via %s = %d %v, want %v", n.s.cluster.Self().ID, code, resp.Keys, want)
+		}
+	}
+	c := dialTCP(t, nodes[1].tcp)
+	c.cmd(t, "AUTH alice")
+	got := strings.Split(strings.TrimPrefix(c.cmd(t, "KEYS"), "KEYS "), ",")
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("TCP KEYS = %v, want %v", got, want)
+	}
+
+	if code, _ := nodes[0].do(t, http.MethodGet, "/v1/keys", "nobody", nil); code != http.StatusNotFound {
+		t.Fatalf("unknown user = %d, want 404", code)
+	}
+
+	// with a node down the others' keys still come back, marked partial
+	nodes[2].stop()
+	code, resp := keysVia(t, nodes[0])
+	if code != http.StatusBadGateway || len(resp.Failed) != 1 || resp.Failed[0].ID != "c" || len(resp.Keys) == 0 {
+		t.Fatalf("keys with c down = %d %+v", code, resp)
+	}
+	if got := c.cmd(t, "KEYS"); got != "PARTIAL c" {
+		t.Fatalf("TCP KEYS with c down = %q", got)
+	}
+	if got := c.line(t); !strings.HasPrefix(got, "KEYS ") {
+		t.Fatalf("TCP KEYS continued %q", got)
+	}
+}
+
+func TestGetLoadsOwnedUser(t *testing.T) {
+	cfg := testCacheConfig(t)
+	n := startNodeWithCache(t, ServerConfig{}, cache.NewCache(cfg))
+
+	// snapshots written by another process sharing the data dir, e.g. before a ring
+	// change moved these users here
+	seed := cache.NewCache(cfg)
+	for _, user := range []string{"alice", "dave"} {
+		if _, err := seed.Set(user, "k", []byte("v-"+user), 0, 0); err != nil {
+			t.Fatalf("seed %s: %v", user, err)
+		}
+		snap, err := seed.SnapshotUser(user)
+		if err != nil {
+			t.Fatalf("snapshot %s: %v", user, err)
+		}
+		if _, err := seed.SaveUserToFile(snap); err != nil {
+			t.Fatalf("save %s: %v", user, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(cfg.DataDir, "user_carol.json"), []byte("{not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("snapshot is loaded on the owner", func(t *testing.T) {
+		if code, v := n.get(t, "alice", "k"); code != http.StatusOK || v != "v-alice" {
+			t.Fatalf("get = %d %q, want 200 v-alice", code, v)
+		}
+		if got := dialTCP(t, n.tcp).cmd(t, "GET dave k"); got != "VALUE v-dave" {
+			t.Fatalf("tcp get = %q, want VALUE v-dave", got)
+		}
+	})
+
+	t.Run("unknown user is not created", func(t *testing.T) {
+		if code, _ := n.get(t, "bob", "k"); code != http.StatusNotFound {
+			t.Fatalf("get = %d, want 404", code)
+		}
+		if got := dialTCP(t, n.tcp).cmd(t, "GET bob k"); got != "ERR "+cache.ErrUserNotFound.Error() {
+			t.Fatalf("tcp get = %q", got)
+		}
+		if users := n.c.ListUsers(); slices.Contains(users, "bob") {
+			t.Fatalf("users = %v, a read created bob", users)
+		}
+	})
+
+	t.Run("corrupt snapshot is an error", func(t *testing.T) {
+		if code, _ := n.get(t, "carol", "k"); code != http.StatusInternalServerError {
+			t.Fatalf("get = %d, want 500", code)
+		}
+		if got := dialTCP(t, n.tcp).cmd(t, "GET carol k"); got != "ERR internal" {
+			t.Fatalf("tcp get = %q, want ERR internal", got)
+		}
+		if users := n.c.ListUsers(); slices.Contains(users, "carol") {
+			t.Fatalf("users = %v, carol was replaced by an empty user", users)
+		}
+	})
+
+	t.Run("deleted user stays deleted", func(t *testing.T) {
+		if code, body := n.do(t, http.MethodDelete, "/v1/user/alice", "", nil); code != http.StatusOK {
+			t.Fatalf("delete = %d %s", code, body)
+		}
+		if code, _ := n.get(t, "alice", "k"); code != http.StatusNotFound {
+			t.Fatalf("get after delete = %d, want 404", code)
+		}
+	})
+}
+
+func TestExpireInPastDeletes(t *testing.T) {
+	nodes := startCluster(t, 2, ServerConfig{ReplicationFactor: 2})
+	a, b := nodes[0], nodes[1]
+
+	tests := []struct {
+		name string
+		body map[string]any
+	}{
+		{name: "negative seconds", body: map[string]any{"ttl_second": -1}},
+		{name: "zero ms", body: map[string]any{"ttl_ms": 0}},
+	}
+	for _, tt := range tests {
+		t.Run("http "+tt.name, func(t *testing.T) {
+			key := keyOwnedBy(t, a, "alice", "a")
+			a.set(t, "alice", key, "v")
+			waitFor(t, 5*time.Second, func() bool { return b.holds("alice", key) })
+
+			tt.body["key"] = key
+			if code, body := a.do(t, http.MethodPost, "/v1/expire", "alice", tt.body); code != http.StatusOK {
+				t.Fatalf("expire = %d %s", code, body)
+			}
+			if a.holds("alice", key) {
+				t.Fatal("owner still holds the key")
+			}
+			if code, _ := a.get(t, "alice", key); code != http.StatusNotFound {
+				t.Fatalf("get = %d, want 404", code)
+			}
+			// replicas drop it too
+			waitFor(t, 5*time.Second, func() bool { return !b.holds("alice", key) })
+		})
+	}
+
+	t.Run("tcp", func(t *testing.T) {
+		// TCP SET writes locally, so use a key a owns (EXPIRE runs on the owner)
+		key := keyOwnedBy(t, a, "alice", "a")
+		c := dialTCP(t, a.tcp)
+		if got := c.cmd(t, "SET alice "+key+" v"); !strings.HasPrefix(got, "OK") {
+			t.Fatalf("set = %q", got)
+		}
+		if got := c.cmd(t, "EXPIRE alice "+key+" -5"); got != "OK" {
+			t.Fatalf("expire = %q, want OK", got)
+		}
+		if got := c.cmd(t, "GET alice "+key); got != "ERR "+cache.ErrKeyNotFound.Error() {
+			t.Fatalf("get after expire = %q, want not found", got)
+		}
+		if a.holds("alice", key) {
+			t.Fatal("the key is still stored")
+		}
+	})
+}
+
+func TestResponseCap(t *testing.T) {
+	const big = "0123456789abcdefghij" // 20 bytes, over the cap of 8
+	tests := []struct {
+		policy    string
+		wantHTTP  int
+		wantValue string // HTTP and TCP value on success
+		wantTCP   []string
+	}{
+		{policy: "", wantHTTP: http.StatusRequestEntityTooLarge, wantTCP: []string{"ERR value too large"}},
+		{policy: ResponseCapReject, wantHTTP: http.StatusRequestEntityTooLarge, wantTCP: []string{"ERR value too large"}},
+		{policy: ResponseCapTruncate, wantHTTP: http.StatusOK, wantValue: "01234567", wantTCP: []string{"TRUNCATED 20", "VALUE 01234567"}},
+	}
+	for _, tt := range tests {
+		name := tt.policy
+		if name == "" {
+			name = "default"
+		}
+		t.Run(name, func(t *testing.T) {
+			n := startNode(t, ServerConfig{MaxResponseBytes: 8, ResponseCapPolicy: tt.policy, RESPAddr: freeAddr(t)})
+			n.set(t, "alice", "big", big)
+			n.set(t, "alice", "small", "tiny")
+
+			// values under the cap are untouched everywhere
+			if code, v := n.get(t, "alice", "small"); code != http.StatusOK || v != "tiny" {
+				t.Fatalf("http small = %d %q", code, v)
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, n.url+"/v1/get?key=big", nil)
+			req.Header.Set("X-User-Id", "alice")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var v valueResponse
+			json.NewDecoder(resp.Body).Decode(&v)
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantHTTP || v.Value != tt.wantValue {
+				t.Fatalf("http big = %d %q, want %d %q", resp.StatusCode, v.Value, tt.wantHTTP, tt.wantValue)
+			}
+			truncated := tt.policy == ResponseCapTruncate
+			if got := resp.Header.Get("X-Value-Truncated") == "true"; got != truncated {
+				t.Fatalf("X-Value-Truncated = %q, want set = %v", resp.Header.Get("X-Value-Truncated"), truncated)
+			}
+			if truncated && resp.Header.Get("X-Value-Length") != "20" {
+				t.Fatalf("X-Value-Length = %q, want 20", resp.Header.Get("X-Value-Length"))
+			}
+
+			c := dialTCP(t, n.tcp)
+			if got := c.cmd(t, "GET alice small"); got != "VALUE tiny" {
+				t.Fatalf("tcp small = %q", got)
+			}
+			if got := c.cmd(t, "GET alice big"); got != tt.wantTCP[0] {
+				t.Fatalf("tcp big = %q, want %q", got, tt.wantTCP[0])
+			}
+			for _, want := range tt.wantTCP[1:] {
+				if got := c.line(t); got != want {
+					t.Fatalf("tcp big continued %q, want %q", got, want)
+				}
+			}
+
+			// RESP can't flag a partial bulk string, so it refuses under either policy
+			r := dialTCP(t, n.s.cfg.RESPAddr)
+			if got := r.cmd(t, respCmd("AUTH", "alice")); got != "+OK" {
+				t.Fatalf("resp auth = %q", got)
+			}
+			if got := r.cmd(t, respCmd("GET", "small")); got != "$4" || r.line(t) != "tiny" {
+				t.Fatalf("resp small = %q", got)
+			}
+			if got := r.cmd(t, respCmd("GET", "big")); got != "-ERR value too large" {
+				t.Fatalf("resp big = %q", got)
+			}
+		})
+	}
+}
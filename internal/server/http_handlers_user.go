@@ -3,13 +3,21 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
 
 	"github.com/sanke08/Distributed-Cache/internal/cache"
 )
 
 func (s *Server) handleUserCreate(w http.ResponseWriter, r *http.Request) {
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
 	var payload struct {
 		UserID string `json:"user_id"`
 	}
@@ -41,6 +49,9 @@ func (s *Server) handleUserCreate(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleUserDelete(w http.ResponseWriter, r *http.Request) {
+	if s.rejectIfReadOnly(w) {
+		return
+	}
 
 	userID := r.PathValue("userID")
 	if userID == "" {
@@ -63,14 +74,54 @@ func (s *Server) handleUserDelete(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte(`{"status":"deleted"}`))
 }
 
+type usersResponse struct {
+	Users []string `json:"users"`
+	Count int      `json:"count"`          // users on this node, across all pages
+	Next  string   `json:"next,omitempty"` // pass back as ?after= for the next page
+}
+
+// handleUsers lists the users held on this node in sorted order. ?limit= pages the
+// result (0 or missing = everything) and ?after= resumes after the given user ID.
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	all := s.cache.ListUsers()
+	resp := usersResponse{Count: len(all)}
+	page := all
+	if after := q.Get("after"); after != "" {
+		page = all[sort.Search(len(all), func(i int) bool { return all[i] > after }):]
+	}
+	if limit > 0 && len(page) > limit {
+		page = page[:limit]
+		resp.Next = page[limit-1]
+	}
+	resp.Users = page
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
 // handleSaveSnapshot triggers saving a user's snapshot to disk.
 func (s *Server) handleSaveSnapshot(w http.ResponseWriter, r *http.Request) {
-	uid, err := userIDFromHeader(r)
+	t := s.startOp(opSnapshot, r)
+	defer t.finish()
+
+	uid, err := s.userIDFromHeader(r)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	t.user = uid
 
 	snap, err := s.cache.SnapshotUser(uid)
 
@@ -94,19 +145,39 @@ func (s *Server) handleSaveSnapshot(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleRestoreSnapshot triggers loading a user's snapshot from disk and restoring into cache.
+// By default the snapshot replaces the user's contents; with ?mode=merge only keys
+// that are missing or older than the snapshot's copy are restored.
 func (s *Server) handleRestoreSnapshot(w http.ResponseWriter, r *http.Request) {
-	uid, err := userIDFromHeader(r)
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	uid, err := s.userIDFromHeader(r)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	restore := s.cache.RestoreUserFromSnapshot
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", "overwrite":
+	case "merge":
+		restore = s.cache.RestoreUserMerge
+	default:
+		http.Error(w, "invalid mode "+strconv.Quote(mode)+": want overwrite or merge", http.StatusBadRequest)
+		return
+	}
+
 	snap, err := s.cache.LoadUserFromFile(uid)
 
 	if err != nil {
-		if err == cache.ErrUserNotFound {
-			http.Error(w, err.Error(), http.StatusNotFound)
+		if err == cache.ErrUserNotFound || errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "snapshot not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, cache.ErrSnapshotEmpty) || errors.Is(err, cache.ErrSnapshotInvalid) || errors.Is(err, cache.ErrSnapshotCorrupt) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
 			return
 		}
 		log.Printf("[http] load user from file err: %v", err)
@@ -119,7 +190,7 @@ func (s *Server) handleRestoreSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.cache.RestoreUserFromSnapshot(snap); err != nil {
+	if err := restore(snap); err != nil {
 		log.Printf("[http] restore user err: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
@@ -127,3 +198,111 @@ func (s *Server) handleRestoreSnapshot(w http.ResponseWriter, r *http.Request) {
 
 	_, _ = w.Write([]byte(`{"status":"ok"}`))
 }
+
+type flushUserResult struct {
+	Status string `json:"status"`
+}
+
+type flushUserResponse struct {
+	Nodes  map[string]flushUserResult `json:"nodes"` // node ID -> result
+	Failed []failedNode               `json:"failed,omitempty"`
+}
+
+// handleFlushUser removes all of the calling user's keys on every node, keeping the
+// user itself (config, counters, janitor).
+func (s *Server) handleFlushUser(w http.ResponseWriter, r *http.Request) {
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	uid, err := s.userIDFromHeader(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results, failed := s.flushCluster(r.Context(), uid)
+	w.Header().Set("Content-Type", "application/json")
+	if len(failed) > 0 {
+		log.Printf("[http] flush %s: %d nodes failed", uid, len(failed))
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(flushUserResponse{Nodes: results, Failed: failed})
+}
+
+// handleInternalFlushUser empties this node's share of ?user= (internal, cluster-wide FLUSH).
+func (s *Server) handleInternalFlushUser(w http.ResponseWriter, r *http.Request) {
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+
+	uid := r.URL.Query().Get("user")
+	if uid == "" {
+		http.Error(w, "missing user", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.flushLocal(uid); err != nil {
+		log.Printf("[http] internal flush %s err: %v", uid, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flushUserResult{Status: "ok"})
+}
+
+// handleInternalSnapshot saves this node's share of ?user= (internal, cluster-wide SNAPSHOT).
+func (s *Server) handleInternalSnapshot(w http.ResponseWriter, r *http.Request) {
+	s.handleInternalSnapshotOp(w, r, s.snapshotLocal)
+}
+
+// handleInternalRestore restores this node's share of ?user= (internal, cluster-wide RESTORE).
+func (s *Server) handleInternalRestore(w http.ResponseWriter, r *http.Request) {
+	if s.rejectIfReadOnly(w) {
+		return
+	}
+	s.handleInternalSnapshotOp(w, r, s.restoreLocal)
+}
+
+func (s *Server) handleInternalSnapshotOp(w http.ResponseWriter, r *http.Request, op func(string) (nodeSnapshotResult, error)) {
+	uid := r.URL.Query().Get("user")
+	if uid == "" {
+		http.Error(w, "missing user", http.StatusBadRequest)
+		return
+	}
+
+	res, err := op(uid)
+	if err != nil {
+		log.Printf("[http] internal snapshot/restore %s err: %v", uid, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// handleUserStats returns the calling user's counters on this node. Keys are spread
+// over the ring, so each node reports only its share.
+func (s *Server) handleUserStats(w http.ResponseWriter, r *http.Request) {
+	uid, err := s.userIDFromHeader(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	st, err := s.cache.UserStats(uid)
+	if err != nil {
+		if err == cache.ErrUserNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("[http] user stats err: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
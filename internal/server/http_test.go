@@ -0,0 +1,448 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+func TestForwardSlotsPerOwner(t *testing.T) {
+	s := &Server{cfg: ServerConfig{MaxForwardsPerOwner: 2}, forwardSlots: make(map[string]chan struct{})}
+	var releases []func()
+	tests := []struct {
+		name    string
+		owner   string
+		release bool // give back the oldest held slot first
+		want    bool // slot granted
+	}{
+		{name: "first to owner 1", owner: "10.0.0.1:8080", want: true},
+		{name: "second to owner 1", owner: "10.0.0.1:8080", want: true},
+		{name: "owner 1 full", owner: "10.0.0.1:8080", want: false},
+		{name: "owner 2 unaffected", owner: "10.0.0.2:8080", want: true},
+		{name: "owner 1 after a release", owner: "10.0.0.1:8080", release: true, want: true},
+		{name: "owner 1 full again", owner: "10.0.0.1:8080", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.release {
+				releases[0]()
+				releases = releases[1:]
+			}
+			release, ok := s.acquireForwardSlot(tt.owner)
+			if ok != tt.want {
+				t.Fatalf("acquireForwardSlot = %v, want %v", ok, tt.want)
+			}
+			if ok {
+				releases = append(releases, release)
+			}
+		})
+	}
+}
+
+func TestForwardToSlowOwnerIsBounded(t *testing.T) {
+	const limit, requests = 2, 6
+	var inFlight, peak atomic.Int32
+	arrived := make(chan struct{}, requests)
+	release := make(chan struct{})
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/set" { // pings and heartbeats: keep the owner in the ring
+			w.Write([]byte(`{"accepted":true}`))
+			return
+		}
+		if n := inFlight.Add(1); n > peak.Load() {
+			peak.Store(n)
+		}
+		defer inFlight.Add(-1)
+		arrived <- struct{}{}
+		<-release
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer owner.Close()
+	defer close(release)
+
+	n := startNode(t, ServerConfig{MaxForwardsPerOwner: limit})
+	if err := n.s.cluster.AddNode(cluster.NodeInfo{ID: "slow", Addr: strings.TrimPrefix(owner.URL, "http://")}); err != nil {
+		t.Fatal(err)
+	}
+	key := keyOwnedBy(t, n, "alice", "slow")
+
+	codes := make(chan int, requests)
+	for range requests {
+		go func() {
+			req, _ := http.NewRequest(http.MethodPost, n.url+"/v1/set", strings.NewReader(`{"key":"`+key+`","value":"v"}`))
+			req.Header.Set("X-User-Id", "alice") // under MaxForwardsPerSource, so only the owner cap applies
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				codes <- 0
+				return
+			}
+			resp.Body.Close()
+			codes <- resp.StatusCode
+		}()
+	}
+
+	// the owner holds limit requests; the rest are turned away instead of queueing
+	for i := 0; i < limit; i++ {
+		<-arrived
+	}
+	for i := 0; i < requests-limit; i++ {
+		select {
+		case code := <-codes:
+			if code != http.StatusServiceUnavailable {
+				t.Fatalf("excess forward = %d, want 503", code)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("excess forwards are waiting on the slow owner")
+		}
+	}
+	if got := peak.Load(); got != limit {
+		t.Fatalf("owner saw %d concurrent forwards, want %d", got, limit)
+	}
+}
+
+func TestForwardShedPerSource(t *testing.T) {
+	const perSource, excess = 2, 3
+	arrived := make(chan string, perSource+excess+1)
+	release := make(chan struct{})
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/set" { // pings and heartbeats: keep the owner in the ring
+			w.Write([]byte(`{"accepted":true}`))
+			return
+		}
+		arrived <- r.Header.Get("X-User-Id")
+		<-release
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer owner.Close()
+
+	n := startNode(t, ServerConfig{MaxForwardsPerSource: perSource})
+	if err := n.s.cluster.AddNode(cluster.NodeInfo{ID: "slow", Addr: strings.TrimPrefix(owner.URL, "http://")}); err != nil {
+		t.Fatal(err)
+	}
+	set := func(user string, codes chan<- int) {
+		key := keyOwnedBy(t, n, user, "slow")
+		go func() {
+			req, _ := http.NewRequest(http.MethodPost, n.url+"/v1/set", strings.NewReader(`{"key":"`+key+`","value":"v"}`))
+			req.Header.Set("X-User-Id", user)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				codes <- 0
+				return
+			}
+			resp.Body.Close()
+			codes <- resp.StatusCode
+		}()
+	}
+
+	// alice fills her share on the slow owner
+	aliceCodes := make(chan int, perSource+excess)
+	for range perSource {
+		set("alice", aliceCodes)
+	}
+	for range perSource {
+		<-arrived
+	}
+
+	// her excess is shed at once instead of queueing
+	for range excess {
+		set("alice", aliceCodes)
+	}
+	for range excess {
+		select {
+		case code := <-aliceCodes:
+			if code != http.StatusTooManyRequests {
+				t.Fatalf("alice's excess forward = %d, want 429", code)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("alice's excess forwards are waiting on the slow owner")
+		}
+	}
+
+	// bob still reaches the same owner
+	bobCodes := make(chan int, 1)
+	set("bob", bobCodes)
+	select {
+	case user := <-arrived:
+		if user != "bob" {
+			t.Fatalf("owner got a forward for %q, want bob", user)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("bob's forward never reached the owner")
+	}
+	close(release)
+	if code := <-bobCodes; code != http.StatusOK {
+		t.Fatalf("bob's forward = %d, want 200", code)
+	}
+	for range perSource {
+		if code := <-aliceCodes; code != http.StatusOK {
+			t.Fatalf("alice's admitted forward = %d, want 200", code)
+		}
+	}
+}
+
+func TestJoinPayloadValidation(t *testing.T) {
+	n := startNode(t, ServerConfig{})
+	self := n.s.cluster.Self()
+	tests := []struct {
+		name     string
+		body     any
+		wantCode int
+	}{
+		{name: "not json", body: "nope", wantCode: http.StatusBadRequest},
+		{name: "missing id", body: map[string]any{"addr": "127.0.0.1:7001"}, wantCode: http.StatusBadRequest},
+		{name: "bad addr", body: map[string]any{"id": "x", "addr": "127.0.0.1"}, wantCode: http.StatusBadRequest},
+		{name: "negative capacity", body: map[string]any{"id": "x", "addr": "127.0.0.1:7001", "capacity": map[string]any{"cpus": -1}}, wantCode: http.StatusBadRequest},
+		{name: "id taken by another addr", body: map[string]any{"id": self.ID, "addr": "127.0.0.1:7001"}, wantCode: http.StatusConflict},
+		{name: "addr taken by another id", body: map[string]any{"id": "x", "addr": self.Addr}, wantCode: http.StatusConflict},
+		{name: "valid", body: map[string]any{"id": "x", "addr": "127.0.0.1:7001"}, wantCode: http.StatusOK},
+		{name: "identical rejoin", body: map[string]any{"id": "x", "addr": "127.0.0.1:7001"}, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, body := n.do(t, http.MethodPost, "/v1/cluster/join", "", tt.body); code != tt.wantCode {
+				t.Fatalf("join = %d %s, want %d", code, body, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestClusterSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string // ServerConfig.ClusterSecret
+		send    string // X-Cluster-Secret sent
+		allowed bool
+	}{
+		{name: "no secret configured", allowed: true},
+		{name: "no secret configured, header sent", send: "anything", allowed: true},
+		{name: "missing header", secret: "s3cret"},
+		{name: "wrong secret", secret: "s3cret", send: "guess"},
+		{name: "right secret", secret: "s3cret", send: "s3cret", allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := startNode(t, ServerConfig{ClusterSecret: tt.secret})
+			header := http.Header{}
+			if tt.send != "" {
+				header.Set(clusterSecretHeader, tt.send)
+			}
+			for _, path := range []string{"/v1/internal/digest?user=alice"} {
+				code, body := n.doWith(t, http.MethodGet, path, "", nil, header)
+				if (code != http.StatusUnauthorized) != tt.allowed {
+					t.Fatalf("GET %s = %d %s, want allowed %v", path, code, body, tt.allowed)
+				}
+			}
+		})
+	}
+
+	// nodes sharing the secret still replicate to each other
+	nodes := startCluster(t, 2, ServerConfig{ClusterSecret: "s3cret", ReplicationFactor: 2})
+	key := keyOwnedBy(t, nodes[0], "alice", "a")
+	nodes[0].set(t, "alice", key, "v")
+	waitFor(t, 5*time.Second, func() bool {
+		v, err := nodes[1].c.Get("alice", key)
+		return err == nil && string(v) == "v"
+	})
+}
+
+func TestForwardLargeBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		cap      int64 // ServerConfig.MaxRequestBodyBytes
+		size     int
+		wantCode int
+		bounded  bool // forwarding must allocate well under size
+	}{
+		{name: "streamed", cap: 64 << 20, size: 16 << 20, wantCode: http.StatusOK, bounded: true},
+		{name: "at the cap", cap: 1 << 20, size: 1 << 20, wantCode: http.StatusOK},
+		{name: "over the cap", cap: 1 << 20, size: 2 << 20, wantCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got [sha256.Size]byte
+			owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h := sha256.New()
+				if _, err := io.Copy(h, r.Body); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				copy(got[:], h.Sum(nil))
+			}))
+			defer owner.Close()
+
+			n := startNode(t, ServerConfig{MaxRequestBodyBytes: tt.cap})
+			data := bytes.Repeat([]byte("0123456789abcdef"), tt.size/16)
+			r := httptest.NewRequest(http.MethodPost, "/v1/raw?key=k", bytes.NewReader(data))
+			w := httptest.NewRecorder()
+
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			n.s.forwardToOwner(cluster.NodeInfo{ID: "owner", Addr: strings.TrimPrefix(owner.URL, "http://")}, w, r)
+			runtime.ReadMemStats(&after)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("forward = %d %s; want %d", w.Code, w.Body, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			if got != sha256.Sum256(data) {
+				t.Fatalf("owner received a different body")
+			}
+			// the body is streamed through, not buffered (which would allocate its size again)
+			if alloc := after.TotalAlloc - before.TotalAlloc; tt.bounded && alloc > uint64(tt.size)/4 {
+				t.Fatalf("forwarding %d bytes allocated %d", tt.size, alloc)
+			}
+		})
+	}
+
+	t.Run("large set through a non-owner", func(t *testing.T) {
+		nodes := startCluster(t, 2, ServerConfig{})
+		key := keyOwnedBy(t, nodes[0], "alice", nodes[1].s.cluster.Self().ID)
+		value := strings.Repeat("v", 4<<20)
+		nodes[0].set(t, "alice", key, value)
+		got, err := nodes[1].c.Get("alice", key)
+		if err != nil || string(got) != value {
+			t.Fatalf("owner holds %d bytes (%v), want %d", len(got), err, len(value))
+		}
+	})
+}
+
+func TestAdvertiseAddr(t *testing.T) {
+	var nodes []*testNode
+	for i := 0; i < 2; i++ {
+		listen := freeAddr(t)
+		_, port, _ := strings.Cut(listen, ":")
+		cfg := ServerConfig{
+			NodeID:        string(rune('a' + i)),
+			HTTPAddr:      listen,
+			AdvertiseAddr: "localhost:" + port, // same socket, different address string
+		}
+		if i > 0 {
+			cfg.JoinAddr = nodes[0].url
+		}
+		nodes = append(nodes, startNode(t, cfg))
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		return len(nodes[0].s.cluster.Nodes()) == 2 && len(nodes[1].s.cluster.Nodes()) == 2
+	})
+	for _, n := range nodes {
+		if self := n.s.cluster.Self(); !strings.HasPrefix(self.Addr, "localhost:") {
+			t.Fatalf("node %s registered %s, want its advertised addr", self.ID, self.Addr)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		via   int // node the client talks to
+		owner int // node owning the key
+	}{
+		{name: "owner is self", via: 0, owner: 0},
+		{name: "forwarded to peer", via: 0, owner: 1},
+		{name: "forwarded back", via: 1, owner: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			via, owner := nodes[tt.via], nodes[tt.owner]
+			key := keyOwnedBy(t, via, "alice", owner.s.cluster.Self().ID)
+			via.set(t, "alice", key, "v")
+			if _, err := owner.c.Get("alice", key); err != nil {
+				t.Fatalf("owner %s does not hold %s", owner.s.cluster.Self().ID, key)
+			}
+			if code, v := via.get(t, "alice", key); code != http.StatusOK || v != "v" {
+				t.Fatalf("get via %s = %d %q", via.s.cluster.Self().ID, code, v)
+			}
+		})
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	n := startNode(t, ServerConfig{})
+	for _, uid := range []string{"dave", "alice", "carol", "bob"} {
+		if err := n.c.CreateUser(uid); err != nil {
+			t.Fatalf("create %s: %v", uid, err)
+		}
+	}
+
+	tests := []struct {
+		query    string
+		wantCode int
+		want     []string
+		wantNext string
+	}{
+		{query: "", wantCode: http.StatusOK, want: []string{"alice", "bob", "carol", "dave"}},
+		{query: "?limit=2", wantCode: http.StatusOK, want: []string{"alice", "bob"}, wantNext: "bob"},
+		{query: "?limit=2&after=bob", wantCode: http.StatusOK, want: []string{"carol", "dave"}},
+		{query: "?after=bz", wantCode: http.StatusOK, want: []string{"carol", "dave"}},
+		{query: "?after=dave", wantCode: http.StatusOK, want: []string{}},
+		{query: "?limit=-1", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			code, body := n.do(t, http.MethodGet, "/v1/users"+tt.query, "", nil)
+			if code != tt.wantCode {
+				t.Fatalf("users = %d %s, want %d", code, body, tt.wantCode)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			var resp usersResponse
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !slices.Equal(resp.Users, tt.want) || resp.Next != tt.wantNext || resp.Count != 4 {
+				t.Fatalf("users = %+v, want %v next %q count 4", resp, tt.want, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestRestoreModes(t *testing.T) {
+	tests := []struct {
+		query    string
+		wantCode int
+		wantK    string // value of k after the restore (saved "backup" at ts 100, then "live" at ts 200)
+		wantNew  bool   // whether "new", written after the save, survives
+	}{
+		{query: "", wantCode: http.StatusOK, wantK: "backup"},
+		{query: "?mode=overwrite", wantCode: http.StatusOK, wantK: "backup"},
+		{query: "?mode=merge", wantCode: http.StatusOK, wantK: "live", wantNew: true},
+		{query: "?mode=bogus", wantCode: http.StatusBadRequest, wantK: "live", wantNew: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			n := startNode(t, ServerConfig{})
+			n.c.Set("alice", "k", []byte("backup"), 0, 100)
+			snap, err := n.c.SnapshotUser("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := n.c.SaveUserToFile(snap); err != nil {
+				t.Fatal(err)
+			}
+			n.c.Set("alice", "k", []byte("live"), 0, 200)
+			n.c.Set("alice", "new", []byte("v"), 0, 200)
+
+			if code, body := n.do(t, http.MethodPost, "/v1/user/restore"+tt.query, "alice", nil); code != tt.wantCode {
+				t.Fatalf("restore = %d %s, want %d", code, body, tt.wantCode)
+			}
+			if v, err := n.c.Get("alice", "k"); err != nil || string(v) != tt.wantK {
+				t.Fatalf("k = %q, %v; want %q", v, err, tt.wantK)
+			}
+			if got := n.holds("alice", "new"); got != tt.wantNew {
+				t.Fatalf("new kept = %v, want %v", got, tt.wantNew)
+			}
+		})
+	}
+}
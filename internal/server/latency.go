@@ -0,0 +1,89 @@
+package server
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencySampleSize bounds the memory of each recorder.
+const latencySampleSize = 1024
+
+// latencyRecorder keeps the most recent latencySampleSize samples in a ring buffer
+// and computes percentiles over them on demand.
+type latencyRecorder struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	count   uint64 // total samples ever recorded
+}
+
+func newLatencyRecorder() *latencyRecorder {
+	return &latencyRecorder{samples: make([]time.Duration, 0, latencySampleSize)}
+}
+
+func (lr *latencyRecorder) record(d time.Duration) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	if len(lr.samples) < latencySampleSize {
+		lr.samples = append(lr.samples, d)
+	} else {
+		lr.samples[lr.next] = d
+		lr.next = (lr.next + 1) % latencySampleSize
+	}
+	lr.count++
+}
+
+// latencySummary holds percentiles of the recent samples.
+type latencySummary struct {
+	Count uint64        `json:"count"`
+	P50   time.Duration `json:"p50_ns"`
+	P95   time.Duration `json:"p95_ns"`
+	P99   time.Duration `json:"p99_ns"`
+}
+
+func (lr *latencyRecorder) summary() latencySummary {
+	lr.mu.Lock()
+	sorted := slices.Clone(lr.samples)
+	count := lr.count
+	lr.mu.Unlock()
+
+	slices.Sort(sorted)
+	return latencySummary{
+		Count: count,
+		P50:   percentile(sorted, 0.50),
+		P95:   percentile(sorted, 0.95),
+		P99:   percentile(sorted, 0.99),
+	}
+}
+
+// percentile returns the nearest-rank percentile of sorted samples.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p*float64(len(sorted))+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+// latency ops tracked by the server
+const (
+	opGet    = "get"
+	opSet    = "set"
+	opDelete = "delete"
+)
+
+func newLatencyRecorders() map[string]*latencyRecorder {
+	return map[string]*latencyRecorder{
+		opGet:    newLatencyRecorder(),
+		opSet:    newLatencyRecorder(),
+		opDelete: newLatencyRecorder(),
+	}
+}
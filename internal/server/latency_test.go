@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLatencyPercentiles(t *testing.T) {
+	tests := []struct {
+		name          string
+		samples       []time.Duration
+		p50, p95, p99 time.Duration
+	}{
+		{name: "empty"},
+		{name: "single sample", samples: ms(7), p50: 7 * time.Millisecond, p95: 7 * time.Millisecond, p99: 7 * time.Millisecond},
+		{name: "1..100ms", samples: msRange(1, 100), p50: 50 * time.Millisecond, p95: 95 * time.Millisecond, p99: 99 * time.Millisecond},
+		// only the most recent latencySampleSize samples count: the slow first batch
+		// is overwritten by 1..1024ms
+		{
+			name:    "old samples age out",
+			samples: append(msRange(5000, 5000+latencySampleSize-1), msRange(1, latencySampleSize)...),
+			p50:     512 * time.Millisecond, p95: 973 * time.Millisecond, p99: 1014 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lr := newLatencyRecorder()
+			for _, d := range tt.samples {
+				lr.record(d)
+			}
+			sum := lr.summary()
+			if sum.Count != uint64(len(tt.samples)) || sum.P50 != tt.p50 || sum.P95 != tt.p95 || sum.P99 != tt.p99 {
+				t.Fatalf("summary = %+v, want count %d, p50 %s, p95 %s, p99 %s", sum, len(tt.samples), tt.p50, tt.p95, tt.p99)
+			}
+		})
+	}
+}
+
+func TestLatencyInStats(t *testing.T) {
+	n := startNode(t, ServerConfig{})
+	// operations that took 1..100ms, by backdating their start
+	for _, d := range msRange(1, 100) {
+		n.s.finishOp(opGet, "test", "alice", "k", time.Now().Add(-d))
+	}
+
+	code, body := n.do(t, http.MethodGet, "/v1/stats/json", "", nil)
+	var st statsResponse
+	if err := json.Unmarshal(body, &st); code != http.StatusOK || err != nil {
+		t.Fatalf("stats = %d %s", code, body)
+	}
+	got := st.Latency[opGet]
+	for _, p := range []struct {
+		name      string
+		got, want time.Duration
+	}{
+		{"p50", got.P50, 50 * time.Millisecond},
+		{"p95", got.P95, 95 * time.Millisecond},
+		{"p99", got.P99, 99 * time.Millisecond},
+	} {
+		if p.got < p.want || p.got > p.want+5*time.Millisecond {
+			t.Errorf("get %s = %s, want about %s", p.name, p.got, p.want)
+		}
+	}
+	if got.Count != 100 {
+		t.Fatalf("get count = %d, want 100", got.Count)
+	}
+}
+
+// ms returns durations of the given milliseconds.
+func ms(vals ...int) []time.Duration {
+	out := make([]time.Duration, len(vals))
+	for i, v := range vals {
+		out[i] = time.Duration(v) * time.Millisecond
+	}
+	return out
+}
+
+// msRange returns from..to milliseconds in order.
+func msRange(from, to int) []time.Duration {
+	out := make([]time.Duration, 0, to-from+1)
+	for v := from; v <= to; v++ {
+		out = append(out, time.Duration(v)*time.Millisecond)
+	}
+	return out
+}
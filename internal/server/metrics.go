@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+)
+
+type replicationStats struct {
+	SentOps        int64 `json:"sent_ops"`
+	SentBytes      int64 `json:"sent_bytes"`
+	Queued         int   `json:"queued"`
+	RetriesPending int64 `json:"retries_pending"`
+	RetriesDropped int64 `json:"retries_dropped"`
+	// averaged over the last few seconds
+	SendOpsPerSec   float64 `json:"send_ops_per_sec"`
+	SendBytesPerSec float64 `json:"send_bytes_per_sec"`
+}
+
+type clusterStats struct {
+	NodeID string `json:"node_id"`
+	Nodes  int    `json:"nodes"`
+	Ready  bool   `json:"ready"`
+}
+
+type statsResponse struct {
+	Cache         cache.CacheStats          `json:"cache"`
+	Latency       map[string]latencySummary `json:"latency"`
+	SlowOps       map[string]uint64         `json:"slow_ops"`
+	JanitorPanics int64                     `json:"janitor_panics"`
+	Replication   replicationStats          `json:"replication"`
+	Cluster       clusterStats              `json:"cluster"`
+	ReadOnly      bool                      `json:"read_only"`
+}
+
+// handleStatsJSON returns the same counters as /metrics as one JSON document.
+// ?users=true adds per-user counters (off by default to bound the response size).
+func (s *Server) handleStatsJSON(w http.ResponseWriter, r *http.Request) {
+	resp := statsResponse{
+		Cache:         s.cache.Stats(r.URL.Query().Get("users") == "true"),
+		Latency:       make(map[string]latencySummary, len(s.latency)),
+		SlowOps:       make(map[string]uint64, len(s.slowlog.counts)),
+		JanitorPanics: cache.JanitorPanics(),
+		ReadOnly:      s.readOnly.Load(),
+	}
+	for op, lr := range s.latency {
+		resp.Latency[op] = lr.summary()
+	}
+	for op, c := range s.slowlog.counts {
+		resp.SlowOps[op] = c.Load()
+	}
+	if s.replicator != nil {
+		resp.Replication = replicationStats{
+			SentOps:         s.replicator.sentOps.Load(),
+			SentBytes:       s.replicator.sentBytes.Load(),
+			Queued:          len(s.replicator.queue),
+			RetriesPending:  s.replicator.retriesOutstanding.Load(),
+			RetriesDropped:  s.replicator.retriesDropped.Load(),
+			SendOpsPerSec:   s.replicator.opsRate.rate(),
+			SendBytesPerSec: s.replicator.bytesRate.rate(),
+		}
+	}
+	if s.cluster != nil {
+		resp.Cluster = clusterStats{
+			NodeID: s.cluster.Self().ID,
+			Nodes:  len(s.cluster.Nodes()),
+			Ready:  s.cluster.Ready(),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleMetrics exposes metrics in the Prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	ops := make([]string, 0, len(s.latency))
+	for op := range s.latency {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	fmt.Fprintln(w, "# HELP cache_op_latency_seconds Latency of cache operations over recent samples.")
+	fmt.Fprintln(w, "# TYPE cache_op_latency_seconds summary")
+	for _, op := range ops {
+		sum := s.latency[op].summary()
+		fmt.Fprintf(w, "cache_op_latency_seconds{op=%q,quantile=\"0.5\"} %g\n", op, sum.P50.Seconds())
+		fmt.Fprintf(w, "cache_op_latency_seconds{op=%q,quantile=\"0.95\"} %g\n", op, sum.P95.Seconds())
+		fmt.Fprintf(w, "cache_op_latency_seconds{op=%q,quantile=\"0.99\"} %g\n", op, sum.P99.Seconds())
+		fmt.Fprintf(w, "cache_op_latency_seconds_count{op=%q} %d\n", op, sum.Count)
+	}
+
+	slowOps := make([]string, 0, len(s.slowlog.counts))
+	for op := range s.slowlog.counts {
+		slowOps = append(slowOps, op)
+	}
+	sort.Strings(slowOps)
+
+	fmt.Fprintln(w, "# HELP cache_slow_ops_total Operations slower than SlowOpThreshold.")
+	fmt.Fprintln(w, "# TYPE cache_slow_ops_total counter")
+	for _, op := range slowOps {
+		fmt.Fprintf(w, "cache_slow_ops_total{op=%q} %d\n", op, s.slowlog.counts[op].Load())
+	}
+
+	fmt.Fprintln(w, "# HELP cache_janitor_panics_total TTL sweeps that panicked and were recovered.")
+	fmt.Fprintln(w, "# TYPE cache_janitor_panics_total counter")
+	fmt.Fprintf(w, "cache_janitor_panics_total %d\n", cache.JanitorPanics())
+
+	if s.replicator != nil {
+		fmt.Fprintln(w, "# HELP cache_replication_sent_total Replication requests acknowledged by replicas.")
+		fmt.Fprintln(w, "# TYPE cache_replication_sent_total counter")
+		fmt.Fprintf(w, "cache_replication_sent_total %d\n", s.replicator.sentOps.Load())
+		fmt.Fprintln(w, "# HELP cache_replication_sent_bytes_total Replication payload bytes acknowledged by replicas.")
+		fmt.Fprintln(w, "# TYPE cache_replication_sent_bytes_total counter")
+		fmt.Fprintf(w, "cache_replication_sent_bytes_total %d\n", s.replicator.sentBytes.Load())
+		fmt.Fprintln(w, "# HELP cache_replication_retries_dropped_total Failed replication tasks dropped because the retry budget was spent.")
+		fmt.Fprintln(w, "# TYPE cache_replication_retries_dropped_total counter")
+		fmt.Fprintf(w, "cache_replication_retries_dropped_total %d\n", s.replicator.retriesDropped.Load())
+		fmt.Fprintln(w, "# HELP cache_replication_send_ops_per_second Replication requests acknowledged per second, over the last few seconds.")
+		fmt.Fprintln(w, "# TYPE cache_replication_send_ops_per_second gauge")
+		fmt.Fprintf(w, "cache_replication_send_ops_per_second %g\n", s.replicator.opsRate.rate())
+		fmt.Fprintln(w, "# HELP cache_replication_send_bytes_per_second Replication payload bytes acknowledged per second, over the last few seconds.")
+		fmt.Fprintln(w, "# TYPE cache_replication_send_bytes_per_second gauge")
+		fmt.Fprintf(w, "cache_replication_send_bytes_per_second %g\n", s.replicator.bytesRate.rate())
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+)
+
+func TestStatsJSON(t *testing.T) {
+	n := startNode(t, ServerConfig{})
+	n.set(t, "alice", "k1", "v1")
+	n.set(t, "alice", "k2", "v2")
+	n.set(t, "bob", "k", "v")
+	if code, _ := n.get(t, "alice", "k1"); code != http.StatusOK {
+		t.Fatalf("get k1 = %d", code)
+	}
+	if code, _ := n.get(t, "alice", "missing"); code != http.StatusNotFound {
+		t.Fatalf("get missing = %d", code)
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		wantUser bool // per_user present
+	}{
+		{name: "global only", query: ""},
+		{name: "per user", query: "?users=true", wantUser: true},
+		{name: "per user off", query: "?users=false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := n.do(t, http.MethodGet, "/v1/stats/json"+tt.query, "", nil)
+			if code != http.StatusOK {
+				t.Fatalf("stats = %d %s", code, body)
+			}
+
+			var doc map[string]json.RawMessage
+			if err := json.Unmarshal(body, &doc); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			for _, field := range []string{"cache", "latency", "slow_ops", "janitor_panics", "replication", "cluster", "read_only"} {
+				if _, ok := doc[field]; !ok {
+					t.Fatalf("stats missing %q: %s", field, body)
+				}
+			}
+
+			var st statsResponse
+			if err := json.Unmarshal(body, &st); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if c := st.Cache; c.Users != 2 || c.Entries != 3 || c.Hits < 1 || c.Misses < 1 || c.Bytes != 5 {
+				t.Fatalf("cache stats = %+v, want 2 users, 3 entries, 5 bytes, a hit and a miss", c)
+			}
+			if got := st.Latency[opSet].Count; got != 3 {
+				t.Fatalf("set latency count = %d, want 3", got)
+			}
+			if st.Cluster.NodeID != n.s.cluster.Self().ID || st.Cluster.Nodes != 1 {
+				t.Fatalf("cluster = %+v", st.Cluster)
+			}
+			if got := len(st.Cache.PerUser) > 0; got != tt.wantUser {
+				t.Fatalf("per_user present = %v, want %v", got, tt.wantUser)
+			}
+			if tt.wantUser {
+				if a := st.Cache.PerUser["alice"]; a.Entries != 2 || a.Hits < 1 || a.Misses < 1 {
+					t.Fatalf("alice = %+v", a)
+				}
+				if b := st.Cache.PerUser["bob"]; b.Entries != 1 {
+					t.Fatalf("bob = %+v", b)
+				}
+			}
+		})
+	}
+}
+
+// latencySink counts ObserveLatency calls per metric name.
+type latencySink struct {
+	cache.NopSink
+	mu       sync.Mutex
+	observed map[string]int
+}
+
+func (l *latencySink) ObserveLatency(name string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.observed[name]++
+}
+
+func TestMetricsSinkObservesOps(t *testing.T) {
+	sink := &latencySink{observed: map[string]int{}}
+	cc := testCacheConfig(t)
+	cc.MetricsSink = sink
+	n := startNodeWithCache(t, ServerConfig{}, cache.NewCache(cc))
+
+	n.set(t, "alice", "k", "v")
+	n.get(t, "alice", "k")
+	n.get(t, "alice", "k")
+	n.do(t, http.MethodDelete, "/v1/delete?key=k", "alice", nil)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	for name, want := range map[string]int{"op." + opSet: 1, "op." + opGet: 2, "op." + opDelete: 1} {
+		if got := sink.observed[name]; got != want {
+			t.Errorf("%s observed %d times, want %d", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// operation is a long-running admin task that can be listed and cancelled.
+type operation struct {
+	id        string
+	kind      string
+	detail    string
+	startedAt time.Time
+	done      atomic.Int64
+	total     atomic.Int64
+	cancel    context.CancelFunc
+}
+
+// setTotal records how many units of work the operation has (0 = unknown).
+func (op *operation) setTotal(n int) {
+	op.total.Store(int64(n))
+}
+
+// advance records n more units of work as done.
+func (op *operation) advance(n int) {
+	op.done.Add(int64(n))
+}
+
+// operationInfo is the introspection view of a running operation.
+type operationInfo struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Detail    string    `json:"detail,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	Done      int64     `json:"done"`
+	Total     int64     `json:"total,omitempty"`
+}
+
+func (op *operation) info() operationInfo {
+	return operationInfo{
+		ID:        op.id,
+		Kind:      op.kind,
+		Detail:    op.detail,
+		StartedAt: op.startedAt,
+		Done:      op.done.Load(),
+		Total:     op.total.Load(),
+	}
+}
+
+// operationRegistry tracks running admin operations. Safe for concurrent use.
+type operationRegistry struct {
+	mu     sync.Mutex
+	nextID int64
+	ops    map[string]*operation
+}
+
+func newOperationRegistry() *operationRegistry {
+	return &operationRegistry{ops: make(map[string]*operation)}
+}
+
+// start registers an operation and returns it with a context that is cancelled when
+// the operation is cancelled or parent ends. Callers must call finish when done.
+func (or *operationRegistry) start(parent context.Context, kind, detail string) (*operation, context.Context) {
+	ctx, cancel := context.WithCancel(parent)
+
+	or.mu.Lock()
+	defer or.mu.Unlock()
+	or.nextID++
+	op := &operation{
+		id:        kind + "-" + strconv.FormatInt(or.nextID, 10),
+		kind:      kind,
+		detail:    detail,
+		startedAt: time.Now(),
+		cancel:    cancel,
+	}
+	or.ops[op.id] = op
+	return op, ctx
+}
+
+// finish unregisters the operation and releases its context.
+func (or *operationRegistry) finish(op *operation) {
+	or.mu.Lock()
+	delete(or.ops, op.id)
+	or.mu.Unlock()
+	op.cancel()
+}
+
+// cancel cancels a running operation. It reports whether id was found.
+func (or *operationRegistry) cancel(id string) bool {
+	or.mu.Lock()
+	op, ok := or.ops[id]
+	or.mu.Unlock()
+	if ok {
+		op.cancel()
+	}
+	return ok
+}
+
+// list returns running operations, oldest first.
+func (or *operationRegistry) list() []operationInfo {
+	or.mu.Lock()
+	out := make([]operationInfo, 0, len(or.ops))
+	for _, op := range or.ops {
+		out = append(out, op.info())
+	}
+	or.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].StartedAt.Before(out[j].StartedAt)
+	})
+	return out
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+// ownerErrors are the cache errors an owner reports (as the http.Error text) for a
+// forwarded write. forwardWrite maps them back, so callers handle a forwarded write
+// like a local one.
+var ownerErrors = []error{
+	cache.ErrUserNotFound,
+	cache.ErrKeyNotFound,
+	cache.ErrNotInteger,
+	cache.ErrIntegerOverflow,
+	cache.ErrValueTooLarge,
+}
+
+// writeOwned runs a write on the node that owns uid/key. When that is this node it
+// calls local, which writes and enqueues replication exactly like the HTTP handler
+// does; otherwise in is posted to path on the owner (the HTTP endpoint for the same
+// write) and its reply decoded into out. It is for protocols that can't proxy the
+// client's request as-is, like the TCP line protocol.
+func (s *Server) writeOwned(ctx context.Context, uid, key, path string, in, out any, local func() error) error {
+	owner, ok := s.cluster.LookupOwner(uid + ":|:" + key)
+	if !ok {
+		return errClusterNotReady
+	}
+	if s.isSelf(owner) {
+		return local()
+	}
+	return s.forwardWrite(ctx, owner, path, uid, in, out)
+}
+
+// forwardWrite posts in as JSON to path on owner on behalf of uid and decodes a 200
+// reply into out (if non-nil).
+func (s *Server) forwardWrite(ctx context.Context, owner cluster.NodeInfo, path, uid string, in, out any) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.nodeURL(owner.Addr)+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-Id", uid)
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(timeoutHeader, strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 1), 10))
+	}
+	setClusterSecret(req, s.cfg.ClusterSecret)
+
+	resp, err := s.forwardClient.Do(req)
+	if err != nil {
+		log.Printf("[forward] %s for %s to %s: %v", path, uid, owner.ID, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		text := string(bytes.TrimSpace(msg))
+		for _, e := range ownerErrors {
+			if text == e.Error() {
+				return e
+			}
+		}
+		return fmt.Errorf("%s on %s: status %d: %s", path, owner.ID, resp.StatusCode, text)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// replicateItem enqueues replication of uid/key as it is stored now, with its own
+// timestamp and expiry. Writes that compute the stored value (INCR, GETSET, ...)
+// use it instead of replicating their input.
+func (s *Server) replicateItem(uid, key string) {
+	item, err := s.cache.Peek(uid, key)
+	if err != nil {
+		return
+	}
+	for _, task := range s.itemReplicationTasks(uid, key, item) {
+		s.replicator.enqueue(task)
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket is a simple token-bucket rate limiter shared by multiple goroutines.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket refilling at rate tokens/sec, holding up to burst tokens.
+// A non-positive rate returns nil, which never limits.
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until n tokens are available or stop is closed. It returns false if stopped.
+// Requests larger than the burst are allowed once the bucket is full, to avoid blocking forever.
+func (tb *tokenBucket) wait(n float64, stop <-chan struct{}) bool {
+	if tb == nil {
+		return true
+	}
+
+	for {
+		tb.mu.Lock()
+		now := time.Now()
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+		tb.last = now
+
+		need := n
+		if need > tb.burst {
+			need = tb.burst
+		}
+		if tb.tokens >= need {
+			tb.tokens -= n // may go negative for oversized requests; later callers wait it off
+			tb.mu.Unlock()
+			return true
+		}
+		delay := time.Duration((need - tb.tokens) / tb.rate * float64(time.Second))
+		tb.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-stop:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+// rateWindow is how many whole seconds a rateMeter averages over.
+const rateWindow = 5
+
+// rateMeter measures a recent rate: per-second totals for the last rateWindow
+// completed seconds, averaged. The current, partial second isn't counted yet.
+type rateMeter struct {
+	mu     sync.Mutex
+	totals [rateWindow + 1]float64
+	secs   [rateWindow + 1]int64 // unix second each total belongs to
+}
+
+func (m *rateMeter) add(n float64) {
+	m.addAt(time.Now(), n)
+}
+
+func (m *rateMeter) addAt(now time.Time, n float64) {
+	sec := now.Unix()
+	i := sec % int64(len(m.totals))
+	m.mu.Lock()
+	if m.secs[i] != sec {
+		m.secs[i], m.totals[i] = sec, 0
+	}
+	m.totals[i] += n
+	m.mu.Unlock()
+}
+
+// rate returns the average per second over the last rateWindow completed seconds.
+func (m *rateMeter) rate() float64 {
+	return m.rateAt(time.Now())
+}
+
+func (m *rateMeter) rateAt(now time.Time) float64 {
+	sec := now.Unix()
+	var sum float64
+	m.mu.Lock()
+	for i, s := range m.secs {
+		if s < sec && s >= sec-rateWindow {
+			sum += m.totals[i]
+		}
+	}
+	m.mu.Unlock()
+	return sum / rateWindow
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name        string
+		rate, burst float64
+		waits       []float64
+		min, max    time.Duration // bounds on the total time spent waiting
+	}{
+		{name: "disabled", waits: []float64{1e9, 1e9}, max: 20 * time.Millisecond},
+		{name: "within burst", rate: 100, burst: 5, waits: []float64{1, 1, 1, 1, 1}, max: 20 * time.Millisecond},
+		{name: "beyond burst", rate: 100, burst: 5, waits: []float64{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}, min: 40 * time.Millisecond, max: time.Second},
+		// a request larger than the burst goes through, and the next caller pays it off
+		{name: "oversized request", rate: 100, burst: 5, waits: []float64{20, 1}, min: 140 * time.Millisecond, max: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := newTokenBucket(tt.rate, tt.burst)
+			start := time.Now()
+			for _, n := range tt.waits {
+				if !tb.wait(n, nil) {
+					t.Fatalf("wait(%v) reported stopped", n)
+				}
+			}
+			if d := time.Since(start); d < tt.min || d > tt.max {
+				t.Fatalf("waited %s, want between %s and %s", d, tt.min, tt.max)
+			}
+		})
+	}
+
+	t.Run("stop", func(t *testing.T) {
+		tb := newTokenBucket(1, 1)
+		tb.wait(1, nil)
+		stop := make(chan struct{})
+		time.AfterFunc(20*time.Millisecond, func() { close(stop) })
+		start := time.Now()
+		if tb.wait(1, stop) {
+			t.Fatal("wait on an empty bucket succeeded before the refill")
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Fatalf("stopped wait returned after %s", d)
+		}
+	})
+}
+
+func TestReplicationBurstIsThrottled(t *testing.T) {
+	const (
+		rate  = 20 // ops/sec, so the burst allowance is 20 sends
+		tasks = 30
+	)
+	var (
+		mu      sync.Mutex
+		arrived []time.Time
+	)
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrived = append(arrived, time.Now())
+		mu.Unlock()
+	}))
+	t.Cleanup(replica.Close)
+
+	rm := newReplicationManager(4, tasks, time.Second, 0, "")
+	rm.setRateLimits(rate, 0)
+	rm.start()
+	t.Cleanup(func() { rm.Stop(context.Background()) })
+
+	to := cluster.NodeInfo{ID: "replica", Addr: strings.TrimPrefix(replica.URL, "http://")}
+	start := time.Now()
+	for i := 0; i < tasks; i++ {
+		if err := rm.enqueue(replicationTask{To: to, UserID: "alice", Key: "k" + strconv.Itoa(i), Value: []byte("v"), Timestamp: 1}); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	waitFor(t, 5*time.Second, func() bool { return rm.sentOps.Load() == tasks })
+
+	mu.Lock()
+	defer mu.Unlock()
+	// the burst allowance goes out at once (plus what refills meanwhile); the other
+	// 10 follow at 20/s
+	const window = 100 * time.Millisecond
+	early := 0
+	for _, at := range arrived {
+		if at.Sub(start) < window {
+			early++
+		}
+	}
+	if max := rate + int(rate*window.Seconds()) + 1; early > max {
+		t.Fatalf("%d sends in the first %s, want at most %d", early, window, max)
+	}
+	if d := arrived[len(arrived)-1].Sub(start); d < 450*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("burst of %d took %s, want about 500ms at %d/s", tasks, d, rate)
+	}
+
+	// once this second is complete, all sends fall inside the averaging window
+	if got := rm.opsRate.rateAt(time.Now().Add(time.Second)); got != float64(tasks)/rateWindow {
+		t.Fatalf("send rate = %v, want %v", got, float64(tasks)/rateWindow)
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	base := time.Unix(1000, 0)
+	var m rateMeter
+	if got := m.rateAt(base); got != 0 {
+		t.Fatalf("empty rate = %v", got)
+	}
+
+	// 10 per second for 5 seconds, then a partial sixth second
+	for sec := 0; sec < 5; sec++ {
+		for i := 0; i < 10; i++ {
+			m.addAt(base.Add(time.Duration(sec)*time.Second+time.Duration(i)*50*time.Millisecond), 1)
+		}
+	}
+	m.addAt(base.Add(5*time.Second), 100)
+
+	tests := []struct {
+		name string
+		at   time.Duration // after base
+		want float64
+	}{
+		{name: "current second not counted", at: 5 * time.Second, want: 10},
+		{name: "full window", at: 6 * time.Second, want: (4*10 + 100) / rateWindow},
+		{name: "old seconds age out", at: 9 * time.Second, want: (1*10 + 100) / rateWindow},
+		{name: "idle", at: time.Minute, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.rateAt(base.Add(tt.at)); got != tt.want {
+				t.Fatalf("rate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+// Rebalancing: when membership changes (a join, a leave, or a removal by health
+// checks), every node compares the ring from before the change with the current one.
+// Keys it owned before and no longer owns are sent to their new owner and replicas
+// with their original timestamp and expiry, then deleted locally unless the node still
+// holds them as a replica. The delete only happens if the key wasn't rewritten in the
+// meantime, and keys a target didn't acknowledge are kept (the replicator retries
+// them). Keys move at most RebalanceKeysPerSec (0 = unlimited); another membership
+// change restarts the pass against the newest ring. Each pass is listed as a
+// "rebalance" operation in /v1/admin/operations and can be cancelled there.
+
+// rebalanceLoop watches membership every PollInterval and rebalances after changes,
+// until shutdown.
+func (s *Server) rebalanceLoop() {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	prev := s.cluster.RingCopy() // ring the local keys were placed by
+	members := membershipKey(s.cluster.Nodes())
+	for {
+		select {
+		case <-s.shutdownCh:
+			return
+		case <-ticker.C:
+			cur := membershipKey(s.cluster.Nodes())
+			if cur == members {
+				continue
+			}
+			ring := s.cluster.RingCopy()
+			if s.rebalance(prev, cur) {
+				prev = ring
+			}
+			members = cur
+		}
+	}
+}
+
+// rebalance moves the local keys this node owned under prev but not under the current
+// ring, whose membership is members. It reports whether the pass finished; it stops
+// early when membership changes again, on shutdown or when cancelled.
+func (s *Server) rebalance(prev *cluster.HashRing, members string) bool {
+	op, ctx := s.ops.start(context.Background(), "rebalance", "")
+	defer s.ops.finish(op)
+
+	start := time.Now()
+	limiter := newTokenBucket(s.cfg.RebalanceKeysPerSec, s.cfg.RebalanceKeysPerSec)
+	stopped := func() bool {
+		select {
+		case <-s.shutdownCh:
+			return true
+		default:
+		}
+		return ctx.Err() != nil || membershipKey(s.cluster.Nodes()) != members
+	}
+
+	var moved, failed int
+	defer func() {
+		if moved+failed > 0 {
+			log.Printf("[rebalance] moved %d keys (%d failed) in %s", moved, failed, time.Since(start).Round(time.Millisecond))
+		}
+	}()
+
+	now := time.Now()
+	for _, uid := range s.cache.ListUsers() {
+		snap, err := s.cache.SnapshotUser(uid)
+		if err != nil {
+			continue
+		}
+		for _, it := range snap.Items {
+			if !it.ExpiresAt.IsZero() && !it.ExpiresAt.After(now) {
+				continue
+			}
+			hashKey := uid + ":|:" + it.Key
+			if owner, ok := prev.Lookup(hashKey); !ok || !s.isSelf(owner) {
+				continue
+			}
+			if owner, ok := s.cluster.LookupOwner(hashKey); !ok || s.isSelf(owner) {
+				continue
+			}
+
+			if stopped() || !limiter.wait(1, s.shutdownCh) {
+				return false
+			}
+			op.advance(1)
+			acked := true
+			for _, ack := range s.replicator.replicateSync(ctx, s.handoffTasks(uid, it.Key, it.Value, it.ExpiresAt, it.Timestamp)) {
+				if !ack.Acked {
+					acked = false
+					break
+				}
+			}
+			if !acked {
+				failed++
+				continue
+			}
+			moved++
+			if !isMember(s.replicaNodes(hashKey), s.cluster.Self().ID) {
+				_, _ = s.cache.Revert(uid, it.Key, it.Timestamp, nil, 0) // no-op if rewritten since
+			}
+		}
+	}
+	return true
+}
+
+// membershipKey identifies a member list, to notice changes cheaply.
+func membershipKey(nodes []cluster.NodeInfo) string {
+	var b strings.Builder
+	for _, n := range nodes {
+		b.WriteString(n.ID)
+		b.WriteByte('@')
+		b.WriteString(n.Addr)
+		b.WriteByte(',')
+	}
+	return b.String()
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+func TestRebalanceOnJoin(t *testing.T) {
+	nodes := startCluster(t, 2, ServerConfig{RebalanceKeysPerSec: 5000})
+	a, b := nodes[0], nodes[1]
+
+	// pick c's address up front, and keys c will own once it joins
+	var cAddr string
+	var moved, stay []string
+	for attempt := 0; len(moved) < 20 && attempt < 10; attempt++ {
+		cAddr = freeAddr(t)
+		ring := a.s.cluster.RingCopy()
+		ring.AddNode(cluster.NodeInfo{ID: "c", Addr: cAddr})
+		moved, stay = nil, nil
+		for i := 0; i < 5000 && len(moved) < 20; i++ {
+			key := "key-" + strconv.Itoa(i)
+			if owner, _ := ring.Lookup("alice:|:" + key); owner.ID == "c" {
+				moved = append(moved, key)
+			} else if len(stay) < 20 {
+				stay = append(stay, key)
+			}
+		}
+	}
+	if len(moved) < 20 {
+		t.Fatal("no address gave c enough keys")
+	}
+	for _, key := range append(moved, stay...) {
+		a.set(t, "alice", key, "v"+key)
+	}
+
+	c := startNode(t, ServerConfig{NodeID: "c", HTTPAddr: cAddr, JoinAddr: a.url})
+	waitFor(t, 5*time.Second, func() bool {
+		return len(a.s.cluster.Nodes()) == 3 && len(b.s.cluster.Nodes()) == 3
+	})
+
+	// the old owners hand c its keys and drop their copies
+	waitFor(t, 5*time.Second, func() bool {
+		for _, key := range moved {
+			if !c.holds("alice", key) || a.holds("alice", key) || b.holds("alice", key) {
+				return false
+			}
+		}
+		return true
+	})
+	for _, key := range append(moved, stay...) {
+		for _, n := range []*testNode{a, c} {
+			if code, v := n.get(t, "alice", key); code != http.StatusOK || v != "v"+key {
+				t.Fatalf("get %s via %s = %d %q", key, n.s.cluster.Self().ID, code, v)
+			}
+		}
+	}
+	// keys that stayed put were not copied to c
+	for _, key := range stay {
+		if c.holds("alice", key) {
+			t.Fatalf("c holds %s, which it doesn't own", key)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+// replicaReadHeader is set on a GET response served by a replica because the owner
+// was unreachable. It names the replica; the value may be stale, since replication
+// is asynchronous.
+const replicaReadHeader = "X-Served-By-Replica"
+
+// writeTimestampHeader carries a value's write timestamp on /v1/internal/get replies.
+const writeTimestampHeader = "X-Write-Timestamp"
+
+// readFromReplicas reads uid/key from the key's replicas, in ring order, after its
+// owner failed to answer. It stops at the first replica that answers (found or not)
+// and gives up with errOwnerUnreachable once every replica failed or ctx is done.
+func (s *Server) readFromReplicas(ctx context.Context, uid, key string) ([]byte, cluster.NodeInfo, error) {
+	nodes := s.replicaNodes(uid + ":|:" + key)
+	for i, node := range nodes {
+		if i == 0 {
+			continue // the owner
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		var (
+			val []byte
+			err error
+		)
+		if s.isSelf(node) {
+			val, err = s.cache.GetRef(uid, key)
+		} else {
+			val, _, err = s.fetchReplica(ctx, node, uid, key)
+		}
+		switch err {
+		case nil, cache.ErrKeyNotFound, cache.ErrUserNotFound:
+			return val, node, err
+		}
+		log.Printf("[http] replica read %s/%s from %s: %v", uid, key, node.ID, err)
+	}
+	return nil, cluster.NodeInfo{}, errOwnerUnreachable
+}
+
+// fetchReplica reads the node's local copy of uid/key, and its write timestamp,
+// through /v1/internal/get.
+func (s *Server) fetchReplica(ctx context.Context, node cluster.NodeInfo, uid, key string) ([]byte, int64, error) {
+	u := s.nodeURL(node.Addr) + "/v1/internal/get?user=" + url.QueryEscape(uid) + "&key=" + url.QueryEscape(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	setClusterSecret(req, s.cfg.ClusterSecret)
+
+	resp, err := s.forwardClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		ts, _ := strconv.ParseInt(resp.Header.Get(writeTimestampHeader), 10, 64)
+		val, err := io.ReadAll(resp.Body)
+		return val, ts, err
+	case http.StatusNotFound:
+		return nil, 0, cache.ErrKeyNotFound
+	default:
+		return nil, 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+// handleInternalGet returns this node's copy of ?user=/?key= as the raw body, with its
+// write timestamp in writeTimestampHeader (internal, replica and quorum reads). Unlike
+// /v1/get it never forwards, so a replica read can't loop back to the unreachable owner.
+func (s *Server) handleInternalGet(w http.ResponseWriter, r *http.Request) {
+	uid, key := r.URL.Query().Get("user"), r.URL.Query().Get("key")
+	if uid == "" || key == "" {
+		http.Error(w, "missing user or key", http.StatusBadRequest)
+		return
+	}
+
+	item, err := s.cache.Peek(uid, key)
+	if err == cache.ErrUserNotFound || err == cache.ErrKeyNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("[http] internal get err: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(writeTimestampHeader, strconv.FormatInt(item.Timestamp, 10))
+	w.Write(item.Value)
+}
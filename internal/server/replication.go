@@ -3,23 +3,31 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
+	neturl "net/url"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/sanke08/Distributed-Cache/internal/cache"
 	"github.com/sanke08/Distributed-Cache/internal/cluster"
 )
 
 type replicationTask struct {
 	To        cluster.NodeInfo
+	Slot      int // position of To among the key's non-primary replicas when enqueued
 	UserID    string
 	Key       string
 	Value     []byte
 	TTLSec    int64
+	ExpiresAt int64 // absolute expiry in UnixNano; 0 = none
 	Timestamp int64
 	Attempts  int
 }
@@ -29,55 +37,100 @@ type replicationManager struct {
 	queue      chan replicationTask
 	workers    int
 	client     *http.Client
-	wg         sync.WaitGroup
+	running    taskGroup
 	stopCh     chan struct{}
+	stopOnce   sync.Once
+	abortCh    chan struct{} // closed when Stop gives up; ends throttle waits
+	abortOnce  sync.Once
 	maxRetries int
 	timeout    time.Duration
+	secret     string // cluster secret sent on internal requests
+	binary     bool   // use the raw header+body transport instead of JSON
+	scheme     string // "http", or "https" once setTLS is called
+
+	// resolve returns the current non-primary replicas for a key, so tasks can be
+	// re-targeted when the ring changes between enqueue and send. Optional.
+	resolve func(userID, key string) []cluster.NodeInfo
+
+	// outbound throttling shared by all workers (nil = unlimited)
+	opsLimit   *tokenBucket
+	bytesLimit *tokenBucket
+
+	// failed tasks wait an exponential backoff (retryBase doubling per attempt up to
+	// retryMax, +/- retryJitter) and come back through retryQueue; workers prefer
+	// fresh tasks, and at most retryBudget retries are outstanding at once
+	retryQueue         chan replicationTask
+	retryBase          time.Duration
+	retryMax           time.Duration
+	retryJitter        float64
+	retryBudget        int64
+	retriesOutstanding atomic.Int64
+
+	// send counters and recent send rates for metrics
+	sentOps        atomic.Int64
+	sentBytes      atomic.Int64
+	retriesDropped atomic.Int64
+	opsRate        rateMeter
+	bytesRate      rateMeter
+
+	sink cache.MetricsSink
 }
 
-func newReplicationManager(workers int, queueSize int, timeout time.Duration, maxRetries int) *replicationManager {
+// defaultRetryBudget bounds outstanding retries when none is configured.
+const defaultRetryBudget = 1000
+
+// Retry backoff defaults.
+const (
+	defaultRetryBase = 500 * time.Millisecond
+	defaultRetryMax  = 30 * time.Second
+)
+
+func newReplicationManager(workers int, queueSize int, timeout time.Duration, maxRetries int, secret string) *replicationManager {
 	transport := &http.Transport{
 		MaxIdleConns:        100,
 		MaxIdleConnsPerHost: 100,
 		IdleConnTimeout:     90 * time.Second,
 	}
 	return &replicationManager{
-		queue:   make(chan replicationTask, queueSize),
-		workers: workers,
+		queue:       make(chan replicationTask, queueSize),
+		retryQueue:  make(chan replicationTask, queueSize),
+		retryBase:   defaultRetryBase,
+		retryMax:    defaultRetryMax,
+		retryBudget: defaultRetryBudget,
+		workers:     workers,
 		client: &http.Client{
 			Transport: transport,
 			Timeout:   timeout,
 		},
 		stopCh:     make(chan struct{}),
+		abortCh:    make(chan struct{}),
 		maxRetries: maxRetries,
 		timeout:    timeout,
+		secret:     secret,
+		scheme:     "http",
+		sink:       cache.NopSink{},
 	}
 }
 
 func (rm *replicationManager) start() {
 	for i := 0; i < rm.workers; i++ {
-		rm.wg.Add(1)
-		go func() {
-			defer rm.wg.Done()
-			rm.workerLoop()
-		}()
+		rm.running.Go(rm.workerLoop)
 	}
 }
 
-func (rm *replicationManager) Stop(ctx context.Context) {
+// Stop signals workers to stop, lets them send what is still queued and waits for
+// them until ctx expires. Retries still waiting out a backoff are dropped. It returns
+// 0 when the workers finished in time, otherwise the number of tasks left unsent
+// (queued, plus 1 per worker still busy).
+func (rm *replicationManager) Stop(ctx context.Context) int {
 	// signal stop, then wait for workers
-	close(rm.stopCh)
-	done := make(chan struct{})
-
-	go func() {
-		rm.wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case <-done:
-	case <-ctx.Done():
+	rm.stopOnce.Do(func() { close(rm.stopCh) })
+	left := rm.running.Wait(ctx)
+	if left == 0 {
+		return 0
 	}
+	rm.abortOnce.Do(func() { close(rm.abortCh) })
+	return len(rm.queue) + len(rm.retryQueue) + left
 }
 
 // enqueue adds a task to the queue; non-blocking when full (drops task and logs)
@@ -94,33 +147,188 @@ func (rm *replicationManager) enqueue(t replicationTask) error {
 
 func (rm *replicationManager) workerLoop() {
 	for {
+		// fresh writes first, so a backlog of retries can't starve them
+		select {
+		case <-rm.stopCh:
+			rm.drain()
+			return
+		case t := <-rm.queue:
+			rm.processTask(t)
+			continue
+		default:
+		}
+
 		select {
 		case <-rm.stopCh:
+			rm.drain()
 			return
 		case t := <-rm.queue:
 			rm.processTask(t)
+		case t := <-rm.retryQueue:
+			rm.retriesOutstanding.Add(-1)
+			rm.processTask(t)
 		}
 	}
 }
 
-func (rm *replicationManager) processTask(t replicationTask) {
-	// attempt with retries and exponential backoff
-	attempt := t.Attempts
+// drain sends the tasks still queued when the manager stops, fresh writes first,
+// until the queues are empty or Stop gives up. Failures aren't retried once stopCh
+// is closed.
+func (rm *replicationManager) drain() {
 	for {
-		if attempt > rm.maxRetries {
-			log.Printf("[replication] max retries reached for %s/%s -> %s", t.UserID, t.Key, t.To.Addr)
+		select {
+		case <-rm.abortCh:
+			return
+		case t := <-rm.queue:
+			rm.processTask(t)
+			continue
+		default:
+		}
+
+		select {
+		case t := <-rm.queue:
+			rm.processTask(t)
+		case t := <-rm.retryQueue:
+			rm.retriesOutstanding.Add(-1)
+			rm.processTask(t)
+		default:
 			return
 		}
+	}
+}
 
-		err := rm.doReplicateOnce(t)
+// processTask makes one delivery attempt; failures are handed to scheduleRetry
+// instead of blocking the worker.
+func (rm *replicationManager) processTask(t replicationTask) {
+	if !rm.retarget(&t) {
+		return
+	}
+
+	if !rm.throttle(len(t.Value)) {
+		return
+	}
+
+	if err := rm.doReplicateOnce(t); err != nil {
+		rm.scheduleRetry(t)
+	}
+}
+
+// scheduleRetry requeues a failed task after its backoff, unless it is out of attempts
+// or the shared retry budget is spent (then it is dropped and counted).
+func (rm *replicationManager) scheduleRetry(t replicationTask) {
+	select {
+	case <-rm.stopCh:
+		log.Printf("[replication] stopping; not retrying %s/%s -> %s", t.UserID, t.Key, t.To.Addr)
+		return
+	default:
+	}
+
+	t.Attempts++
+	if t.Attempts > rm.maxRetries {
+		log.Printf("[replication] max retries reached for %s/%s -> %s", t.UserID, t.Key, t.To.Addr)
+		return
+	}
+
+	if rm.retriesOutstanding.Add(1) > rm.retryBudget {
+		rm.retriesOutstanding.Add(-1)
+		rm.retriesDropped.Add(1)
+		rm.sink.IncrCounter("replication.retries_dropped", 1)
+		log.Printf("[replication] retry budget exhausted; dropping %s/%s -> %s", t.UserID, t.Key, t.To.Addr)
+		return
+	}
 
-		if err == nil {
+	// the timer doesn't hold a worker; shutdown drops the pending retry
+	time.AfterFunc(rm.backoff(t.Attempts), func() {
+		// checked on its own: in the select below a closed stopCh would only win
+		// at random, queueing the retry where no worker reads it any more
+		select {
+		case <-rm.stopCh:
+			rm.retriesOutstanding.Add(-1)
 			return
+		default:
+		}
+		select {
+		case rm.retryQueue <- t:
+		default:
+			rm.retriesOutstanding.Add(-1)
+			rm.retriesDropped.Add(1)
+			rm.sink.IncrCounter("replication.retries_dropped", 1)
+			log.Printf("[replication] retry queue full; dropping %s/%s -> %s", t.UserID, t.Key, t.To.Addr)
 		}
+	})
+}
+
+// backoff returns the delay before retry number attempt (1-based): retryBase doubled
+// per earlier attempt, capped at retryMax, then spread by +/- retryJitter.
+func (rm *replicationManager) backoff(attempt int) time.Duration {
+	d := rm.retryBase
+	for i := 1; i < attempt && d < rm.retryMax; i++ {
+		d *= 2
+	}
+	d = min(d, rm.retryMax)
+	if rm.retryJitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * rm.retryJitter * float64(d))
+	}
+	return d
+}
 
-		attempt++
-		time.Sleep(2 * time.Second)
+// setRetryBackoff configures retry delays; zero values keep the defaults. jitter is
+// a fraction of the delay (0.2 = +/-20%), clamped to [0, 1].
+func (rm *replicationManager) setRetryBackoff(base, maxDelay time.Duration, jitter float64) {
+	if base > 0 {
+		rm.retryBase = base
 	}
+	if maxDelay > 0 {
+		rm.retryMax = maxDelay
+	}
+	rm.retryMax = max(rm.retryMax, rm.retryBase)
+	rm.retryJitter = min(max(jitter, 0), 1)
+}
+
+// setRetryBudget caps outstanding retries across all workers (0 = default).
+func (rm *replicationManager) setRetryBudget(n int) {
+	if n > 0 {
+		rm.retryBudget = int64(n)
+	}
+}
+
+// setTLS sends replication over https with the given client config.
+func (rm *replicationManager) setTLS(cfg *tls.Config) {
+	rm.client.Transport.(*http.Transport).TLSClientConfig = cfg
+	rm.scheme = "https"
+}
+
+// setRateLimits configures outbound throttling; zero disables a limit.
+// Bursts of up to one second's worth of sends are allowed.
+func (rm *replicationManager) setRateLimits(opsPerSec, bytesPerSec float64) {
+	rm.opsLimit = newTokenBucket(opsPerSec, opsPerSec)
+	rm.bytesLimit = newTokenBucket(bytesPerSec, bytesPerSec)
+}
+
+// throttle waits for send capacity. It returns false if Stop gave up waiting; the
+// limits still apply while the queue is drained on a graceful stop.
+func (rm *replicationManager) throttle(size int) bool {
+	return rm.opsLimit.wait(1, rm.abortCh) && rm.bytesLimit.wait(float64(size), rm.abortCh)
+}
+
+// retarget re-resolves the task's destination against the current ring. It returns
+// false when the task's replica slot no longer exists (e.g. the cluster shrank).
+func (rm *replicationManager) retarget(t *replicationTask) bool {
+	if rm.resolve == nil {
+		return true
+	}
+
+	targets := rm.resolve(t.UserID, t.Key)
+	if t.Slot >= len(targets) {
+		log.Printf("[replication] %s/%s -> %s is no longer a replica; skipping", t.UserID, t.Key, t.To.Addr)
+		return false
+	}
+
+	if next := targets[t.Slot]; next.ID != t.To.ID {
+		log.Printf("[replication] ring changed; rerouting %s/%s from %s to %s", t.UserID, t.Key, t.To.Addr, next.Addr)
+		t.To = next
+	}
+	return true
 }
 
 type replicatePayload struct {
@@ -128,34 +336,33 @@ type replicatePayload struct {
 	Key       string `json:"key"`
 	Value     []byte `json:"value"`
 	TTLSec    int64  `json:"ttl_secs"`
+	ExpiresAt int64  `json:"expires_at,omitempty"` // UnixNano; preferred over ttl_secs
 	Timestamp int64  `json:"timestamp"`
 }
 
 func (rm *replicationManager) doReplicateOnce(t replicationTask) error {
-	payload := replicatePayload{
-		UserID:    t.UserID,
-		Key:       t.Key,
-		Value:     t.Value,
-		TTLSec:    t.TTLSec,
-		Timestamp: t.Timestamp,
-	}
-
-	jsonPayload, err := json.Marshal(payload)
-	if err != nil {
-		return err
-	}
-
-	url := "http://" + t.To.Addr + "/v1/internal/replicate"
-
 	ctx, cancel := context.WithTimeout(context.Background(), rm.timeout)
 	defer cancel()
+	return rm.send(ctx, t)
+}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonPayload))
+// send delivers one task to its replica, bounded by ctx.
+func (rm *replicationManager) send(ctx context.Context, t replicationTask) error {
+	var (
+		req  *http.Request
+		size int
+		err  error
+	)
+	if rm.binary {
+		req, size, err = newRawReplicateRequest(ctx, rm.scheme, t)
+	} else {
+		req, size, err = newJSONReplicateRequest(ctx, rm.scheme, t)
+	}
 	if err != nil {
 		return err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	setClusterSecret(req, rm.secret)
 
 	resp, err := rm.client.Do(req)
 	if err != nil {
@@ -168,5 +375,116 @@ func (rm *replicationManager) doReplicateOnce(t replicationTask) error {
 		return fmt.Errorf("replication failed with status code %d", resp.StatusCode)
 	}
 
+	rm.sentOps.Add(1)
+	rm.sentBytes.Add(int64(size))
+	rm.opsRate.add(1)
+	rm.bytesRate.add(float64(size))
+	rm.sink.IncrCounter("replication.sent_ops", 1)
+	rm.sink.IncrCounter("replication.sent_bytes", int64(size))
 	return nil
 }
+
+// replicaAck is the outcome of one synchronous replica write.
+type replicaAck struct {
+	Node      string  `json:"node"`
+	Addr      string  `json:"addr"`
+	Acked     bool    `json:"acked"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// replicateSync sends every task concurrently and waits for all of them (each bounded
+// by rm.timeout and ctx), returning one result per task in task order. Tasks that
+// fail are handed to the async queue so the replica still converges.
+func (rm *replicationManager) replicateSync(ctx context.Context, tasks []replicationTask) []replicaAck {
+	acks := make([]replicaAck, len(tasks))
+
+	var wg sync.WaitGroup
+	for i, t := range tasks {
+		wg.Add(1)
+		go func(i int, t replicationTask) {
+			defer wg.Done()
+
+			sendCtx, cancel := context.WithTimeout(ctx, rm.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := rm.send(sendCtx, t)
+			ack := replicaAck{
+				Node:      t.To.ID,
+				Addr:      t.To.Addr,
+				Acked:     err == nil,
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				ack.Error = err.Error()
+				rm.scheduleRetry(t)
+			}
+			acks[i] = ack
+		}(i, t)
+	}
+	wg.Wait()
+	return acks
+}
+
+// countAcked returns how many replicas acknowledged.
+func countAcked(acks []replicaAck) int {
+	n := 0
+	for _, a := range acks {
+		if a.Acked {
+			n++
+		}
+	}
+	return n
+}
+
+// newJSONReplicateRequest builds a /v1/internal/replicate request (value base64 in JSON).
+func newJSONReplicateRequest(ctx context.Context, scheme string, t replicationTask) (*http.Request, int, error) {
+	payload := replicatePayload{
+		UserID:    t.UserID,
+		Key:       t.Key,
+		Value:     t.Value,
+		TTLSec:    t.TTLSec,
+		ExpiresAt: t.ExpiresAt,
+		Timestamp: t.Timestamp,
+	}
+
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	url := scheme + "://" + t.To.Addr + "/v1/internal/replicate"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonPayload))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, len(jsonPayload), nil
+}
+
+// Headers of the raw replication transport. User and key are query-escaped.
+const (
+	hdrReplUser      = "X-Repl-User"
+	hdrReplKey       = "X-Repl-Key"
+	hdrReplTTL       = "X-Repl-Ttl-Secs"
+	hdrReplExpiresAt = "X-Repl-Expires-At"
+	hdrReplTimestamp = "X-Repl-Timestamp"
+)
+
+// newRawReplicateRequest builds a /v1/internal/replicate-raw request: the value is the
+// raw body and the metadata travels in headers, avoiding JSON's base64 inflation.
+func newRawReplicateRequest(ctx context.Context, scheme string, t replicationTask) (*http.Request, int, error) {
+	url := scheme + "://" + t.To.Addr + "/v1/internal/replicate-raw"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(t.Value))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(hdrReplUser, neturl.QueryEscape(t.UserID))
+	req.Header.Set(hdrReplKey, neturl.QueryEscape(t.Key))
+	req.Header.Set(hdrReplTTL, strconv.FormatInt(t.TTLSec, 10))
+	req.Header.Set(hdrReplExpiresAt, strconv.FormatInt(t.ExpiresAt, 10))
+	req.Header.Set(hdrReplTimestamp, strconv.FormatInt(t.Timestamp, 10))
+	return req, len(t.Value), nil
+}
@@ -0,0 +1,664 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+func TestReplicatorRetarget(t *testing.T) {
+	b := cluster.NodeInfo{ID: "b", Addr: "10.0.0.2:8080"}
+	c := cluster.NodeInfo{ID: "c", Addr: "10.0.0.3:8080"}
+	d := cluster.NodeInfo{ID: "d", Addr: "10.0.0.4:8080"}
+	tests := []struct {
+		name    string
+		current []cluster.NodeInfo // replicas when the task is sent; nil = no resolver
+		to      cluster.NodeInfo
+		slot    int
+		wantOK  bool
+		wantTo  string
+	}{
+		{name: "no resolver", to: b, wantOK: true, wantTo: "b"},
+		{name: "ring unchanged", current: []cluster.NodeInfo{b, c}, to: c, slot: 1, wantOK: true, wantTo: "c"},
+		{name: "slot moved to another node", current: []cluster.NodeInfo{b, d}, to: c, slot: 1, wantOK: true, wantTo: "d"},
+		{name: "cluster shrank", current: []cluster.NodeInfo{b}, to: c, slot: 1},
+		{name: "no replicas left", current: []cluster.NodeInfo{}, to: b},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rm := newReplicationManager(1, 10, time.Second, 0, "")
+			if tt.current != nil {
+				rm.resolve = func(userID, key string) []cluster.NodeInfo { return tt.current }
+			}
+			task := replicationTask{To: tt.to, Slot: tt.slot, UserID: "alice", Key: "k"}
+			if ok := rm.retarget(&task); ok != tt.wantOK {
+				t.Fatalf("retarget = %v, want %v", ok, tt.wantOK)
+			}
+			if tt.wantOK && task.To.ID != tt.wantTo {
+				t.Fatalf("task goes to %s, want %s", task.To.ID, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestReplicationTransports(t *testing.T) {
+	values := map[string]string{
+		"plain key":  "plain",
+		"ключ/ü?&=%": "unicode and query characters",
+		"binary":     "\x00\x01\xff\r\n trailing",
+	}
+	for _, binary := range []bool{false, true} {
+		t.Run(map[bool]string{false: "json", true: "raw"}[binary], func(t *testing.T) {
+			nodes := startCluster(t, 2, ServerConfig{ReplicationFactor: 2, ReplicationBinary: binary})
+			for key, value := range values {
+				ts := time.Now().UnixNano()
+				if _, err := nodes[0].c.Set("alice", key, []byte(value), time.Hour, ts); err != nil {
+					t.Fatalf("set: %v", err)
+				}
+				nodes[0].s.enqueueReplication("alice", key, []byte(value), time.Hour, ts)
+			}
+			waitFor(t, 5*time.Second, func() bool {
+				for key, value := range values {
+					if v, err := nodes[1].c.Get("alice", key); err != nil || string(v) != value {
+						return false
+					}
+				}
+				return true
+			})
+			if ttl, err := nodes[1].c.TTL("alice", "plain key"); err != nil || ttl <= 59*time.Minute {
+				t.Fatalf("replica TTL = %s, %v; want the primary's hour", ttl, err)
+			}
+		})
+	}
+}
+
+func TestReplicationFactorIndependentOfVirtualNodes(t *testing.T) {
+	nodes := startCluster(t, 3, ServerConfig{VirtualNodes: 150, ReplicationFactor: 2})
+	for _, share := range nodes[0].s.cluster.Distribution() {
+		if share.VirtualNodes != 150 {
+			t.Fatalf("%s has %d virtual nodes, want 150", share.Node.ID, share.VirtualNodes)
+		}
+	}
+
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+		nodes[0].set(t, "alice", keys[i], "v")
+	}
+	// each key lives on its primary and one successor, never on the third node
+	waitFor(t, 5*time.Second, func() bool {
+		for _, key := range keys {
+			for _, n := range nodes {
+				holder := isMember(nodes[0].s.replicaNodes("alice:|:"+key), n.s.cluster.Self().ID)
+				if n.holds("alice", key) != holder {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	for _, key := range keys {
+		if got := nodes[0].s.replicaNodes("alice:|:" + key); len(got) != 2 {
+			t.Fatalf("%s has %d replica nodes, want 2", key, len(got))
+		}
+	}
+}
+
+func TestReplicateRawHeaders(t *testing.T) {
+	n := startNode(t, ServerConfig{})
+	valid := map[string]string{hdrReplUser: "alice", hdrReplKey: "k", hdrReplTTL: "0", hdrReplExpiresAt: "0", hdrReplTimestamp: "5"}
+	tests := []struct {
+		name     string
+		override map[string]string // "" removes the header
+		wantCode int
+	}{
+		{name: "valid", wantCode: http.StatusOK},
+		{name: "missing user", override: map[string]string{hdrReplUser: ""}, wantCode: http.StatusBadRequest},
+		{name: "bad ttl", override: map[string]string{hdrReplTTL: "soon"}, wantCode: http.StatusBadRequest},
+		{name: "bad expiry", override: map[string]string{hdrReplExpiresAt: "x"}, wantCode: http.StatusBadRequest},
+		{name: "missing timestamp", override: map[string]string{hdrReplTimestamp: ""}, wantCode: http.StatusBadRequest},
+		{name: "zero timestamp", override: map[string]string{hdrReplTimestamp: "0"}, wantCode: http.StatusBadRequest},
+		{name: "bad escaping", override: map[string]string{hdrReplKey: "%zz"}, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, n.url+"/v1/internal/replicate-raw", strings.NewReader("raw value"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range valid {
+				req.Header.Set(k, v)
+			}
+			for k, v := range tt.override {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("replicate-raw = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+		})
+	}
+	if v, err := n.c.Get("alice", "k"); err != nil || string(v) != "raw value" {
+		t.Fatalf("stored = %q, %v", v, err)
+	}
+}
+
+func TestReplicateSyncReport(t *testing.T) {
+	replica := func(id string, delay time.Duration, code int) cluster.NodeInfo {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+			w.WriteHeader(code)
+		}))
+		t.Cleanup(srv.Close)
+		return cluster.NodeInfo{ID: id, Addr: strings.TrimPrefix(srv.URL, "http://")}
+	}
+	tests := []struct {
+		name       string
+		to         cluster.NodeInfo
+		wantAcked  bool
+		minLatency time.Duration
+		maxLatency time.Duration
+	}{
+		{name: "fast", to: replica("fast", 0, http.StatusOK), wantAcked: true, maxLatency: 150 * time.Millisecond},
+		{name: "slow", to: replica("slow", 150*time.Millisecond, http.StatusOK), wantAcked: true, minLatency: 150 * time.Millisecond, maxLatency: 300 * time.Millisecond},
+		{name: "failing", to: replica("failing", 0, http.StatusServiceUnavailable), maxLatency: 150 * time.Millisecond},
+		{name: "timed out", to: replica("hung", 800*time.Millisecond, http.StatusOK), minLatency: 300 * time.Millisecond, maxLatency: time.Second},
+	}
+
+	rm := newReplicationManager(1, 10, 300*time.Millisecond, 5, "")
+	tasks := make([]replicationTask, len(tests))
+	for i, tt := range tests {
+		tasks[i] = replicationTask{To: tt.to, UserID: "alice", Key: "k", Value: []byte("v"), Timestamp: 1}
+	}
+	acks := rm.replicateSync(context.Background(), tasks)
+	if len(acks) != len(tests) {
+		t.Fatalf("%d acks for %d replicas", len(acks), len(tests))
+	}
+	if got := countAcked(acks); got != 2 {
+		t.Fatalf("countAcked = %d, want 2", got)
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := acks[i]
+			if a.Node != tt.to.ID || a.Addr != tt.to.Addr {
+				t.Fatalf("ack %d is for %s (%s), want %s", i, a.Node, a.Addr, tt.to.ID)
+			}
+			if a.Acked != tt.wantAcked || (a.Error == "") != tt.wantAcked {
+				t.Fatalf("ack = %+v, want acked %v", a, tt.wantAcked)
+			}
+			latency := time.Duration(a.LatencyMs * float64(time.Millisecond))
+			if latency < tt.minLatency || latency > tt.maxLatency {
+				t.Fatalf("latency = %s, want %s..%s", latency, tt.minLatency, tt.maxLatency)
+			}
+		})
+	}
+
+	// failed replicas are scheduled for a background retry
+	if got := rm.retriesOutstanding.Load(); got != 2 {
+		t.Fatalf("%d retries scheduled, want 2", got)
+	}
+}
+
+func TestFreshWritesUnderRetryFlood(t *testing.T) {
+	tests := []struct {
+		name        string
+		budget      int64 // retryBudget
+		wantDropped bool  // retries over the budget are dropped
+	}{
+		{name: "small budget", budget: 5, wantDropped: true},
+		{name: "large budget", budget: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var failed atomic.Int64
+			bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				failed.Add(1)
+				time.Sleep(10 * time.Millisecond)
+				http.Error(w, "down", http.StatusServiceUnavailable)
+			}))
+			t.Cleanup(bad.Close)
+			arrived := make(chan time.Time, 1)
+			good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				arrived <- time.Now()
+			}))
+			t.Cleanup(good.Close)
+
+			rm := newReplicationManager(1, 100, time.Second, 100, "")
+			rm.retryBudget = tt.budget
+			rm.setRetryBackoff(5*time.Millisecond, 5*time.Millisecond, 0)
+			rm.start()
+			t.Cleanup(func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				defer cancel()
+				rm.Stop(ctx)
+			})
+
+			down := cluster.NodeInfo{ID: "down", Addr: strings.TrimPrefix(bad.URL, "http://")}
+			for i := 0; i < 40; i++ {
+				rm.enqueue(replicationTask{To: down, UserID: "alice", Key: "k" + strconv.Itoa(i), Value: []byte("v"), Timestamp: 1})
+			}
+			// let every first attempt fail, so only retries are left to run
+			waitFor(t, 2*time.Second, func() bool { return len(rm.queue) == 0 && failed.Load() > 40 })
+			if got := rm.retriesOutstanding.Load(); got > tt.budget {
+				t.Fatalf("%d retries outstanding, budget %d", got, tt.budget)
+			}
+
+			start := time.Now()
+			up := cluster.NodeInfo{ID: "up", Addr: strings.TrimPrefix(good.URL, "http://")}
+			rm.enqueue(replicationTask{To: up, UserID: "alice", Key: "fresh", Value: []byte("v"), Timestamp: 2})
+			select {
+			case at := <-arrived:
+				// at most the send in flight runs ahead of it
+				if d := at.Sub(start); d > 150*time.Millisecond {
+					t.Fatalf("fresh write took %s behind the retry flood", d)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("fresh write never reached its replica")
+			}
+
+			if dropped := rm.retriesDropped.Load() > 0; dropped != tt.wantDropped {
+				t.Fatalf("retries dropped = %d, want some = %v", rm.retriesDropped.Load(), tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestSyncReplicationClientDeadline(t *testing.T) {
+	var delay atomic.Int64 // replica response delay, ns
+	cancelled := make(chan struct{}, 10)
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server only notices a dropped connection once the body is consumed
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-time.After(time.Duration(delay.Load())):
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		}
+	}))
+	t.Cleanup(replica.Close)
+
+	n := startNode(t, ServerConfig{WriteAcks: 1, ReplicationFactor: 2, ReplicationTimeout: 5 * time.Second, CmdTimeout: 5 * time.Second})
+	if err := n.s.cluster.AddNode(cluster.NodeInfo{ID: "replica", Addr: strings.TrimPrefix(replica.URL, "http://")}); err != nil {
+		t.Fatalf("add node: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		timeout    string // X-Timeout-Ms
+		delay      time.Duration
+		wantCode   int
+		wantStatus string
+		wantCancel bool // the in-flight replica write was cancelled
+	}{
+		{name: "replica in time", timeout: "2000", wantCode: http.StatusOK, wantStatus: "ok"},
+		{name: "tight deadline", timeout: "100", delay: 3 * time.Second, wantCode: http.StatusGatewayTimeout, wantStatus: "deadline_exceeded", wantCancel: true},
+		{name: "invalid header", timeout: "soon", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay.Store(int64(tt.delay))
+			key := keyOwnedBy(t, n, "alice", n.s.cluster.Self().ID)
+			h := http.Header{}
+			h.Set(timeoutHeader, tt.timeout)
+
+			start := time.Now()
+			code, body := n.doWith(t, http.MethodPost, "/v1/set", "alice", map[string]any{"key": key, "value": "v"}, h)
+			if code != tt.wantCode {
+				t.Fatalf("set = %d %s, want %d", code, body, tt.wantCode)
+			}
+			if took := time.Since(start); took > time.Second {
+				t.Fatalf("set took %s; the client deadline was not honoured", took)
+			}
+			if tt.wantStatus != "" {
+				var resp setResponse
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatalf("decode: %v", err)
+				}
+				if resp.Status != tt.wantStatus {
+					t.Fatalf("status = %q, want %q", resp.Status, tt.wantStatus)
+				}
+			}
+			if tt.wantCancel {
+				select {
+				case <-cancelled:
+				case <-time.After(time.Second):
+					t.Fatalf("replica write was not cancelled")
+				}
+			}
+		})
+	}
+}
+
+func TestReplicationFailurePolicy(t *testing.T) {
+	tests := []struct {
+		policy      string
+		prev        string // value before the failed write; "" = key missing
+		wantCode    int
+		wantOutcome string
+		wantLocal   string // value held locally afterwards; "" = missing
+	}{
+		{policy: ReplicationFailureDegrade, prev: "old", wantCode: http.StatusGatewayTimeout, wantOutcome: "degraded", wantLocal: "new"},
+		{policy: ReplicationFailureRollback, prev: "old", wantCode: http.StatusGatewayTimeout, wantOutcome: "rolled_back", wantLocal: "old"},
+		{policy: ReplicationFailureRollback, wantCode: http.StatusGatewayTimeout, wantOutcome: "rolled_back"},
+		{policy: ReplicationFailureRepair, prev: "old", wantCode: http.StatusAccepted, wantOutcome: "repair_scheduled", wantLocal: "new"},
+	}
+	for _, tt := range tests {
+		name := tt.policy
+		if tt.prev == "" {
+			name += " new key"
+		}
+		t.Run(name, func(t *testing.T) {
+			var down atomic.Bool
+			var latest atomic.Value // last value the replica accepted
+			replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if down.Load() {
+					http.Error(w, "down", http.StatusServiceUnavailable)
+					return
+				}
+				var p replicatePayload
+				json.NewDecoder(r.Body).Decode(&p)
+				latest.Store(string(p.Value))
+			}))
+			t.Cleanup(replica.Close)
+
+			n := startNode(t, ServerConfig{WriteAcks: 1, ReplicationFactor: 2, ReplicationFailurePolicy: tt.policy,
+				ReplicationTimeout: 200 * time.Millisecond, ReplicationMaxRetries: 1})
+			if err := n.s.cluster.AddNode(cluster.NodeInfo{ID: "replica", Addr: strings.TrimPrefix(replica.URL, "http://")}); err != nil {
+				t.Fatalf("add node: %v", err)
+			}
+			key := keyOwnedBy(t, n, "alice", n.s.cluster.Self().ID)
+			set := func(value string) (int, setResponse) {
+				code, body := n.do(t, http.MethodPost, "/v1/set", "alice", map[string]any{"key": key, "value": value})
+				var resp setResponse
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatalf("decode %s: %v", body, err)
+				}
+				return code, resp
+			}
+			if tt.prev != "" {
+				if code, resp := set(tt.prev); code != http.StatusOK || resp.Outcome != "" {
+					t.Fatalf("write with the replica up = %d %+v, want 200 with no outcome", code, resp)
+				}
+			}
+
+			down.Store(true)
+			code, resp := set("new")
+			if code != tt.wantCode || resp.Status != "insufficient_acks" || resp.Outcome != tt.wantOutcome {
+				t.Fatalf("write with the replica down = %d %+v, want %d insufficient_acks %s", code, resp, tt.wantCode, tt.wantOutcome)
+			}
+			if got, err := n.c.Get("alice", key); string(got) != tt.wantLocal || (tt.wantLocal == "") != (err != nil) {
+				t.Fatalf("local value = %q (%v), want %q", got, err, tt.wantLocal)
+			}
+
+			code, body := n.do(t, http.MethodGet, "/v1/admin/under-replicated", "", nil)
+			var under underReplicatedResponse
+			if code != http.StatusOK || json.Unmarshal(body, &under) != nil {
+				t.Fatalf("under-replicated = %d %s", code, body)
+			}
+			if tt.policy != ReplicationFailureRepair {
+				if len(under.Keys) != 0 {
+					t.Fatalf("under-replicated = %+v, want nothing recorded under %s", under.Keys, tt.policy)
+				}
+				return
+			}
+			if len(under.Keys) != 1 || under.Keys[0].Key != key || under.Keys[0].Acks != 0 || under.Keys[0].Needed != 1 {
+				t.Fatalf("under-replicated = %+v, want %s with 0 of 1 acks", under.Keys, key)
+			}
+
+			// still down: nothing repaired
+			var rep repairResponse
+			code, body = n.do(t, http.MethodPost, "/v1/admin/repair", "", nil)
+			if code != http.StatusOK || json.Unmarshal(body, &rep) != nil || rep.Repaired != 0 || rep.Remaining != 1 {
+				t.Fatalf("repair while down = %d %s, want 0 repaired, 1 remaining", code, body)
+			}
+			down.Store(false)
+			code, body = n.do(t, http.MethodPost, "/v1/admin/repair", "", nil)
+			if code != http.StatusOK || json.Unmarshal(body, &rep) != nil || rep.Repaired != 1 || rep.Remaining != 0 {
+				t.Fatalf("repair = %d %s, want 1 repaired, 0 remaining", code, body)
+			}
+			if v, _ := latest.Load().(string); v != "new" {
+				t.Fatalf("replica holds %q after repair, want the new value", v)
+			}
+		})
+	}
+}
+
+func TestInternalReplicateIgnoresStaleWrites(t *testing.T) {
+	n := startNode(t, ServerConfig{})
+	tests := []struct {
+		name  string
+		value string
+		ts    int64
+		want  string // value held afterwards
+	}{
+		{name: "first write", value: "v10", ts: 10, want: "v10"},
+		{name: "delayed older write", value: "v5", ts: 5, want: "v10"},
+		{name: "newer write", value: "v20", ts: 20, want: "v20"},
+		{name: "retry of an older write", value: "v10", ts: 10, want: "v20"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := internalReplicationRequest{UserID: "alice", Key: "k", Value: []byte(tt.value), Timestamp: tt.ts}
+			if code, body := n.do(t, http.MethodPost, "/v1/internal/replicate", "", req); code != http.StatusOK {
+				t.Fatalf("replicate = %d %s", code, body)
+			}
+			if v, err := n.c.Get("alice", "k"); err != nil || string(v) != tt.want {
+				t.Fatalf("k = %q, %v; want %q", v, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetFallsBackToReplica(t *testing.T) {
+	nodes := startCluster(t, 3, ServerConfig{ReplicationFactor: 3})
+	key := keyOwnedBy(t, nodes[0], "alice", "c")
+	nodes[0].set(t, "alice", key, "v1")
+	missing := key + "-missing"
+	for i := 0; ; i++ {
+		if owner, _ := nodes[0].s.cluster.LookupOwner("alice:|:" + missing); owner.ID == "c" {
+			break
+		}
+		missing = key + "-missing" + strconv.Itoa(i)
+	}
+
+	// wait until some other node holds a replica
+	waitFor(t, 5*time.Second, func() bool { return nodes[0].holds("alice", key) || nodes[1].holds("alice", key) })
+
+	get := func(t *testing.T, k string) (int, string, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, nodes[0].url+"/v1/get?key="+k, nil)
+		req.Header.Set("X-User-Id", "alice")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		defer resp.Body.Close()
+		var v valueResponse
+		_ = json.NewDecoder(resp.Body).Decode(&v)
+		return resp.StatusCode, v.Value, resp.Header.Get(replicaReadHeader)
+	}
+
+	if code, v, from := get(t, key); code != http.StatusOK || v != "v1" || from != "" {
+		t.Fatalf("get with owner up = %d %q from %q", code, v, from)
+	}
+
+	nodes[2].stop()
+	code, v, from := get(t, key)
+	if code != http.StatusOK || v != "v1" || (from != "a" && from != "b") {
+		t.Fatalf("get with owner down = %d %q from %q", code, v, from)
+	}
+	if code, _, from := get(t, missing); code != http.StatusNotFound || from == "" {
+		t.Fatalf("missing key with owner down = %d from %q", code, from)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	t.Run("doubles up to the cap", func(t *testing.T) {
+		rm := newReplicationManager(1, 1, time.Second, 3, "")
+		rm.setRetryBackoff(100*time.Millisecond, time.Second, 0)
+		want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+		for i, w := range want {
+			if got := rm.backoff(i + 1); got != w {
+				t.Fatalf("backoff(%d) = %s, want %s", i+1, got, w)
+			}
+		}
+		if got := rm.backoff(1000); got != time.Second {
+			t.Fatalf("backoff(1000) = %s, want the cap", got)
+		}
+	})
+
+	t.Run("jitter stays in bounds", func(t *testing.T) {
+		rm := newReplicationManager(1, 1, time.Second, 3, "")
+		rm.setRetryBackoff(100*time.Millisecond, time.Second, 0.2)
+		lo, hi := 320*time.Millisecond, 480*time.Millisecond // 400ms +/- 20%
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 1000; i++ {
+			d := rm.backoff(3)
+			if d < lo || d > hi {
+				t.Fatalf("backoff(3) = %s, want within [%s, %s]", d, lo, hi)
+			}
+			seen[d] = true
+		}
+		if len(seen) < 2 {
+			t.Fatalf("jittered backoff never varied")
+		}
+	})
+
+	t.Run("settings are clamped", func(t *testing.T) {
+		rm := newReplicationManager(1, 1, time.Second, 3, "")
+		rm.setRetryBackoff(0, 0, -1)
+		if rm.retryBase != defaultRetryBase || rm.retryMax != defaultRetryMax || rm.retryJitter != 0 {
+			t.Fatalf("zero settings = %s/%s/%g, want the defaults without jitter", rm.retryBase, rm.retryMax, rm.retryJitter)
+		}
+		rm.setRetryBackoff(2*time.Second, time.Second, 5)
+		if rm.retryMax != 2*time.Second || rm.retryJitter != 1 {
+			t.Fatalf("max below base = %s, jitter %g; want max raised to base and jitter 1", rm.retryMax, rm.retryJitter)
+		}
+	})
+
+	t.Run("stop drops a pending retry", func(t *testing.T) {
+		var sends atomic.Int64
+		replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sends.Add(1)
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}))
+		t.Cleanup(replica.Close)
+
+		rm := newReplicationManager(1, 10, time.Second, 3, "")
+		rm.setRetryBackoff(200*time.Millisecond, 200*time.Millisecond, 0)
+		rm.start()
+		rm.enqueue(replicationTask{To: cluster.NodeInfo{ID: "replica", Addr: strings.TrimPrefix(replica.URL, "http://")},
+			UserID: "alice", Key: "k", Value: []byte("v"), Timestamp: 1})
+		waitFor(t, 2*time.Second, func() bool { return rm.retriesOutstanding.Load() == 1 })
+
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if left := rm.Stop(ctx); left != 0 {
+			t.Fatalf("Stop left %d tasks", left)
+		}
+		if took := time.Since(start); took > 100*time.Millisecond {
+			t.Fatalf("Stop took %s; it waited out the backoff", took)
+		}
+
+		// the timer fires after stop: the retry is dropped, not requeued or sent
+		waitFor(t, 2*time.Second, func() bool { return rm.retriesOutstanding.Load() == 0 })
+		if len(rm.retryQueue) != 0 || sends.Load() != 1 {
+			t.Fatalf("retry queue %d, sends %d after stop; want the retry dropped", len(rm.retryQueue), sends.Load())
+		}
+	})
+}
+
+func TestReplicatorStop(t *testing.T) {
+	const tasks = 20
+	var got atomic.Int64
+	hang := make(chan struct{})
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("X-Test") {
+		case "hang":
+			<-hang
+		case "fail":
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+		got.Add(1)
+	}))
+	t.Cleanup(replica.Close)
+	t.Cleanup(func() { close(hang) }) // runs first, so Close doesn't wait on a hung send
+	to := cluster.NodeInfo{ID: "replica", Addr: strings.TrimPrefix(replica.URL, "http://")}
+
+	t.Run("queued tasks are sent", func(t *testing.T) {
+		got.Store(0)
+		rm := newReplicationManager(1, tasks, time.Second, 3, "")
+		rm.start()
+		for i := 0; i < tasks; i++ {
+			rm.enqueue(replicationTask{To: to, UserID: "alice", Key: "k" + strconv.Itoa(i), Value: []byte("v"), Timestamp: 1})
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if left := rm.Stop(ctx); left != 0 {
+			t.Fatalf("Stop left %d tasks", left)
+		}
+		if n := got.Load(); n != tasks {
+			t.Fatalf("replica got %d of %d queued tasks", n, tasks)
+		}
+	})
+
+	t.Run("retries waiting on backoff are not a timeout", func(t *testing.T) {
+		rm := newReplicationManager(1, tasks, time.Second, 3, "")
+		rm.client.Transport = headerTransport{"X-Test", "fail"}
+		rm.setRetryBackoff(30*time.Second, 30*time.Second, 0)
+		rm.start()
+		rm.enqueue(replicationTask{To: to, UserID: "alice", Key: "k", Value: []byte("v"), Timestamp: 1})
+		waitFor(t, 2*time.Second, func() bool { return rm.retriesOutstanding.Load() == 1 })
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if left := rm.Stop(ctx); left != 0 || ctx.Err() != nil {
+			t.Fatalf("Stop left %d tasks (ctx %v), want a clean stop", left, ctx.Err())
+		}
+	})
+
+	t.Run("timeout reports what is left", func(t *testing.T) {
+		rm := newReplicationManager(1, tasks, 10*time.Second, 3, "")
+		rm.client.Transport = headerTransport{"X-Test", "hang"}
+		rm.start()
+		for i := 0; i < 5; i++ {
+			rm.enqueue(replicationTask{To: to, UserID: "alice", Key: "k" + strconv.Itoa(i), Value: []byte("v"), Timestamp: 1})
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		// 4 queued behind the hung send, plus the busy worker
+		if left := rm.Stop(ctx); left != 5 {
+			t.Fatalf("Stop left %d tasks, want 5", left)
+		}
+	})
+}
+
+// headerTransport sets one header on every request.
+type headerTransport struct{ name, value string }
+
+func (h headerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set(h.name, h.value)
+	return http.DefaultTransport.RoundTrip(r)
+}
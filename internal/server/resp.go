@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+)
+
+// The RESP listener (ServerConfig.RESPAddr) speaks enough of the Redis protocol for
+// redis-cli and Redis client libraries: requests are RESP arrays of bulk strings (or
+// inline commands), replies are RESP simple strings, errors, integers, bulk strings
+// and nil. It has its own port because "*" already starts a framed command on the
+// line protocol, whose replies are not RESP.
+//
+// Keys are scoped to a user like everywhere else; AUTH <userID> (redis-cli -a, or
+// AUTH <userID> <password> from clients that send a username) picks it; with
+// RequireAuth the password form is required. Like the line
+// protocol, it serves this node's local cache only.
+
+func (s *Server) respAcceptLoop() {
+	s.serveListener(s.respLn, "resp", s.handleRESPConn)
+}
+
+// respWriter encodes RESP replies.
+type respWriter struct {
+	w *bufio.Writer
+}
+
+func (rw respWriter) simple(msg string) { rw.w.WriteString("+" + msg + "\r\n") }
+func (rw respWriter) err(msg string)    { rw.w.WriteString("-" + msg + "\r\n") }
+func (rw respWriter) integer(n int64)   { rw.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n") }
+func (rw respWriter) null()             { rw.w.WriteString("$-1\r\n") }
+
+func (rw respWriter) bulk(b []byte) {
+	rw.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	rw.w.Write(b)
+	rw.w.WriteString("\r\n")
+}
+
+func (rw respWriter) array(n int) { rw.w.WriteString("*" + strconv.Itoa(n) + "\r\n") }
+
+func (s *Server) handleRESPConn(conn net.Conn) {
+	defer conn.Close()
+
+	client := s.clients.register(conn)
+	defer s.clients.unregister(client.id)
+
+	r := bufio.NewReader(conn)
+	rw := respWriter{w: bufio.NewWriter(conn)}
+	defer rw.w.Flush()
+	var authUser string
+
+	for {
+		select {
+		case <-s.shutdownCh:
+			rw.err("ERR server shutting down")
+			rw.w.Flush()
+			return
+		default:
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Minute))
+		if !pendingCommand(r) {
+			rw.w.Flush()
+		}
+
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[resp] read: %v", err)
+			}
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		var args []string
+		if isFramedHeader(line) {
+			args, err = readFramedArgs(r, line)
+			if err != nil {
+				rw.err("ERR Protocol error: " + err.Error())
+				rw.w.Flush()
+				return
+			}
+		} else if args, err = splitArgs(line); err != nil {
+			rw.err("ERR Protocol error: " + err.Error())
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		client.commands.Add(1)
+		if quit := s.respCommand(rw, client, &authUser, args); quit {
+			return
+		}
+	}
+}
+
+// respCommand executes one command and writes its reply. It reports whether the
+// connection should be closed.
+func (s *Server) respCommand(rw respWriter, client *tcpClient, authUser *string, args []string) bool {
+	cmd := strings.ToUpper(args[0])
+	argc := len(args) - 1
+	wrongArgs := func() { rw.err("ERR wrong number of arguments for '" + strings.ToLower(cmd) + "' command") }
+
+	if s.auth != nil && *authUser == "" && cmd != "AUTH" && cmd != "PING" && cmd != "QUIT" {
+		rw.err("NOAUTH Authentication required.")
+		return false
+	}
+
+	switch cmd {
+	case "PING":
+		switch argc {
+		case 0:
+			rw.simple("PONG")
+		case 1:
+			rw.bulk([]byte(args[1]))
+		default:
+			wrongArgs()
+		}
+		return false
+	case "ECHO":
+		if argc != 1 {
+			wrongArgs()
+			return false
+		}
+		rw.bulk([]byte(args[1]))
+		return false
+	case "QUIT":
+		rw.simple("OK")
+		return true
+	case "AUTH":
+		// AUTH <userID>, or AUTH <userID> <password> from ACL-style clients
+		if argc != 1 && argc != 2 {
+			wrongArgs()
+			return false
+		}
+		uid := s.cache.NormalizeUserID(args[1])
+		if s.auth != nil && (argc != 2 || !s.auth.check(uid, args[2])) {
+			log.Printf("[resp] failed AUTH for user %q from %s", uid, client.remoteAddr)
+			rw.err("WRONGPASS invalid username-password pair")
+			return false
+		}
+		*authUser = uid
+		client.setUser(*authUser)
+		rw.simple("OK")
+		return false
+	case "SELECT":
+		// a single keyspace per user; accept database 0 so clients that select it work
+		if argc != 1 || args[1] != "0" {
+			rw.err("ERR DB index is out of range")
+			return false
+		}
+		rw.simple("OK")
+		return false
+	case "CLIENT":
+		// client libraries announce themselves with CLIENT SETNAME / SETINFO
+		rw.simple("OK")
+		return false
+	case "COMMAND":
+		// redis-cli asks for command docs on startup; none are published
+		rw.array(0)
+		return false
+	}
+
+	if !isRESPDataCommand(cmd) {
+		rw.err("ERR unknown command '" + args[0] + "'")
+		return false
+	}
+	if *authUser == "" {
+		rw.err("NOAUTH Authentication required.")
+		return false
+	}
+	if s.readOnly.Load() && (cmd == "SET" || cmd == "DEL" || cmd == "EXPIRE") {
+		rw.err("READONLY node is read-only")
+		return false
+	}
+	if !s.clusterReady() {
+		rw.err("ERR " + errClusterNotReady.Error())
+		return false
+	}
+	uid := *authUser
+
+	switch cmd {
+	case "GET":
+		if argc != 1 {
+			wrongArgs()
+			return false
+		}
+		start := time.Now()
+		val, err := s.getOwned(uid, args[1])
+		s.finishOp(opGet, "resp GET", uid, args[1], start)
+		switch {
+		case err == cache.ErrUserNotFound || err == cache.ErrKeyNotFound:
+			rw.null()
+		case err != nil:
+			rw.err("ERR internal")
+		case s.cfg.MaxResponseBytes > 0 && len(val) > s.cfg.MaxResponseBytes:
+			rw.err("ERR value too large")
+		default:
+			rw.bulk(val)
+		}
+
+	case "SET":
+		// SET key value [EX seconds | PX milliseconds] [NX]
+		if argc < 2 {
+			wrongArgs()
+			return false
+		}
+		key, value := args[1], []byte(args[2])
+		var ttl time.Duration
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch opt := strings.ToUpper(args[i]); opt {
+			case "NX":
+				nx = true
+			case "EX", "PX":
+				if i+1 == len(args) {
+					rw.err("ERR syntax error")
+					return false
+				}
+				n, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil || n <= 0 {
+					rw.err("ERR invalid expire time in 'set' command")
+					return false
+				}
+				unit := time.Second
+				if opt == "PX" {
+					unit = time.Millisecond
+				}
+				ttl = time.Duration(n) * unit
+				i++
+			default:
+				rw.err("ERR syntax error")
+				return false
+			}
+		}
+
+		start := time.Now()
+		var err error
+		stored := true
+		if nx {
+			stored, err = s.cache.SetNX(uid, key, value, ttl, 0)
+		} else {
+			_, err = s.cache.Set(uid, key, value, ttl, 0)
+		}
+		s.finishOp(opSet, "resp SET", uid, key, start)
+		switch {
+		case err == cache.ErrValueTooLarge:
+			rw.err("ERR " + err.Error())
+		case err != nil:
+			rw.err("ERR internal")
+		case !stored:
+			rw.null()
+		default:
+			rw.simple("OK")
+		}
+
+	case "DEL":
+		if argc < 1 {
+			wrongArgs()
+			return false
+		}
+		var removed int64
+		for _, key := range args[1:] {
+			start := time.Now()
+			if _, err := s.cache.TTL(uid, key); err == nil {
+				removed++
+			}
+			_ = s.cache.Delete(uid, key)
+			s.finishOp(opDelete, "resp DEL", uid, key, start)
+		}
+		rw.integer(removed)
+
+	case "EXPIRE":
+		if argc != 2 {
+			wrongArgs()
+			return false
+		}
+		secs, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			rw.err("ERR value is not an integer or out of range")
+			return false
+		}
+		switch err := s.cache.Expire(uid, args[1], time.Duration(secs)*time.Second); err {
+		case nil:
+			rw.integer(1)
+		case cache.ErrUserNotFound, cache.ErrKeyNotFound:
+			rw.integer(0)
+		default:
+			rw.err("ERR internal")
+		}
+
+	case "TTL":
+		if argc != 1 {
+			wrongArgs()
+			return false
+		}
+		left, err := s.cache.TTL(uid, args[1])
+		switch err {
+		case nil:
+			rw.integer(ttlSeconds(left))
+		case cache.ErrUserNotFound, cache.ErrKeyNotFound:
+			rw.integer(-2)
+		default:
+			rw.err("ERR internal")
+		}
+	}
+	return false
+}
+
+func isRESPDataCommand(cmd string) bool {
+	switch cmd {
+	case "GET", "SET", "DEL", "EXPIRE", "TTL":
+		return true
+	}
+	return false
+}
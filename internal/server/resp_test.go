@@ -0,0 +1,93 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// respCmd encodes args as a RESP array of bulk strings, the way Redis clients send them.
+func respCmd(args ...string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		b.WriteString("$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func TestRESP(t *testing.T) {
+	n := startNode(t, ServerConfig{RESPAddr: freeAddr(t)})
+	c := dialTCP(t, n.s.cfg.RESPAddr)
+
+	tests := []struct {
+		args []string
+		want []string // reply lines
+	}{
+		{args: []string{"PING"}, want: []string{"+PONG"}},
+		{args: []string{"PING", "hi there"}, want: []string{"$8", "hi there"}},
+		{args: []string{"GET", "k"}, want: []string{"-NOAUTH Authentication required."}},
+		{args: []string{"AUTH", "alice"}, want: []string{"+OK"}},
+		{args: []string{"GET", "k"}, want: []string{"$-1"}},
+		{args: []string{"SET", "k", "hello world"}, want: []string{"+OK"}},
+		{args: []string{"GET", "k"}, want: []string{"$11", "hello world"}},
+		{args: []string{"SET", "k", "other", "NX"}, want: []string{"$-1"}},
+		{args: []string{"TTL", "k"}, want: []string{":-1"}},
+		{args: []string{"EXPIRE", "k", "100"}, want: []string{":1"}},
+		{args: []string{"TTL", "k"}, want: []string{":100"}},
+		{args: []string{"EXPIRE", "missing", "100"}, want: []string{":0"}},
+		{args: []string{"TTL", "missing"}, want: []string{":-2"}},
+		{args: []string{"SET", "t", "v", "EX", "50"}, want: []string{"+OK"}},
+		{args: []string{"TTL", "t"}, want: []string{":50"}},
+		{args: []string{"SET", "t", "v", "EX", "zero"}, want: []string{"-ERR invalid expire time in 'set' command"}},
+		{args: []string{"DEL", "k", "t", "missing"}, want: []string{":2"}},
+		{args: []string{"GET", "k"}, want: []string{"$-1"}},
+		{args: []string{"GET"}, want: []string{"-ERR wrong number of arguments for 'get' command"}},
+		{args: []string{"FLUSHALL"}, want: []string{"-ERR unknown command 'FLUSHALL'"}},
+		{args: []string{"COMMAND", "DOCS"}, want: []string{"*0"}},
+	}
+	for _, tt := range tests {
+		if got := c.cmd(t, respCmd(tt.args...)); got != tt.want[0] {
+			t.Fatalf("%q = %q, want %q", tt.args, got, tt.want[0])
+		}
+		for _, want := range tt.want[1:] {
+			if got := c.line(t); got != want {
+				t.Fatalf("%q continued %q, want %q", tt.args, got, want)
+			}
+		}
+	}
+
+	// inline commands, as typed into telnet, work too
+	if got := c.cmd(t, `SET k "inline value"`); got != "+OK" {
+		t.Fatalf("inline SET = %q", got)
+	}
+	if v, err := n.c.Get("alice", "k"); err != nil || string(v) != "inline value" {
+		t.Fatalf("stored %q, %v", v, err)
+	}
+	if got := c.cmd(t, respCmd("QUIT")); got != "+OK" {
+		t.Fatalf("QUIT = %q", got)
+	}
+}
+
+func TestRESPRequireAuth(t *testing.T) {
+	n := startNode(t, ServerConfig{RESPAddr: freeAddr(t), RequireAuth: true, AuthSecret: "pw"})
+	c := dialTCP(t, n.s.cfg.RESPAddr)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"PING"}, want: "+PONG"},
+		{args: []string{"COMMAND", "DOCS"}, want: "-NOAUTH Authentication required."},
+		{args: []string{"AUTH", "alice"}, want: "-WRONGPASS invalid username-password pair"},
+		{args: []string{"AUTH", "alice", "nope"}, want: "-WRONGPASS invalid username-password pair"},
+		{args: []string{"GET", "k"}, want: "-NOAUTH Authentication required."},
+		{args: []string{"AUTH", "alice", "pw"}, want: "+OK"},
+		{args: []string{"GET", "k"}, want: "$-1"},
+	}
+	for _, tt := range tests {
+		if got := c.cmd(t, respCmd(tt.args...)); got != tt.want {
+			t.Fatalf("%q = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+// failedNode describes a node that did not answer during a fan-out.
+type failedNode struct {
+	ID    string `json:"id"`
+	Addr  string `json:"addr"`
+	Error string `json:"error"`
+}
+
+// scatterGather calls fn for every node concurrently, each with its own timeout
+// derived from ctx. It always returns: results holds the values of nodes that
+// answered (keyed by node ID) and failed lists the ones that errored or timed out,
+// so callers can return partial results instead of failing the whole operation.
+func scatterGather[T any](ctx context.Context, nodes []cluster.NodeInfo, timeout time.Duration,
+	fn func(ctx context.Context, node cluster.NodeInfo) (T, error)) (map[string]T, []failedNode) {
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]T, len(nodes))
+		failed  []failedNode
+	)
+
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node cluster.NodeInfo) {
+			defer wg.Done()
+
+			nodeCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			v, err := fn(nodeCtx, node)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed = append(failed, failedNode{ID: node.ID, Addr: node.Addr, Error: err.Error()})
+				return
+			}
+			results[node.ID] = v
+		}(node)
+	}
+	wg.Wait()
+
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].ID < failed[j].ID
+	})
+	return results, failed
+}
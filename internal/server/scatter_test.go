@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+func TestScatterGatherPartialResults(t *testing.T) {
+	// node behaviour by ID: "ok" answers, "err" fails, "slow" outlasts the timeout
+	tests := []struct {
+		name       string
+		nodes      map[string]string
+		wantOK     []string
+		wantFailed []string
+	}{
+		{name: "all answer", nodes: map[string]string{"a": "ok", "b": "ok"}, wantOK: []string{"a", "b"}},
+		{name: "one errors", nodes: map[string]string{"a": "ok", "b": "err", "c": "ok"}, wantOK: []string{"a", "c"}, wantFailed: []string{"b"}},
+		{name: "one times out", nodes: map[string]string{"a": "slow", "b": "ok"}, wantOK: []string{"b"}, wantFailed: []string{"a"}},
+		{name: "all fail", nodes: map[string]string{"c": "err", "a": "slow", "b": "err"}, wantFailed: []string{"a", "b", "c"}},
+		{name: "no nodes", nodes: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var nodes []cluster.NodeInfo
+			for id := range tt.nodes {
+				nodes = append(nodes, cluster.NodeInfo{ID: id, Addr: id + ":8080"})
+			}
+			start := time.Now()
+			results, failed := scatterGather(context.Background(), nodes, 50*time.Millisecond, func(ctx context.Context, node cluster.NodeInfo) (string, error) {
+				switch tt.nodes[node.ID] {
+				case "err":
+					return "", errors.New("boom")
+				case "slow":
+					<-ctx.Done()
+					return "", ctx.Err()
+				}
+				return "value from " + node.ID, nil
+			})
+			if d := time.Since(start); d > time.Second {
+				t.Fatalf("scatterGather took %s, want it bounded by the timeout", d)
+			}
+
+			var gotOK []string
+			for id, v := range results {
+				if v != "value from "+id {
+					t.Fatalf("result for %s = %q", id, v)
+				}
+				gotOK = append(gotOK, id)
+			}
+			slices.Sort(gotOK)
+			var gotFailed []string
+			for _, f := range failed {
+				if f.Error == "" || f.Addr != f.ID+":8080" {
+					t.Fatalf("failed entry %+v lacks detail", f)
+				}
+				gotFailed = append(gotFailed, f.ID)
+			}
+			if !slices.Equal(gotOK, tt.wantOK) || !slices.Equal(gotFailed, tt.wantFailed) {
+				t.Fatalf("answered %v, failed %v; want %v, %v", gotOK, gotFailed, tt.wantOK, tt.wantFailed)
+			}
+		})
+	}
+}
@@ -3,13 +3,16 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sanke08/Distributed-Cache/internal/cache"
@@ -18,7 +21,9 @@ import (
 
 type ServerConfig struct {
 	HTTPAddr        string
+	AdvertiseAddr   string // addr other nodes and clients reach this node at (default HTTPAddr)
 	TCPAddr         string
+	RESPAddr        string        // Redis protocol (RESP) listen addr for Redis clients (empty = off)
 	ReadTimeout     time.Duration // http server read timeout
 	WriteTimeout    time.Duration
 	IdealTimeout    time.Duration
@@ -27,25 +32,148 @@ type ServerConfig struct {
 
 	// ClusterState
 	NodeID          string // optional node id
-	ClusterReplicas int    // number of virtual nodes per actual node
-	JoinAddr        string // leader address to join, e.g., "http://leader:8080"
+	VirtualNodes    int    // virtual nodes per node on the hash ring (default 10)
+	MaxVirtualNodes int    // cap on total virtual nodes; per-node count shrinks to fit (0 = no cap)
+	JoinAddr        string // leader address to join, e.g., "http://leader:8080" (https with TLS)
 	PollInterval    time.Duration
 
+	// ReplicationFactor is how many nodes hold each key, its primary included
+	// (0 or 1 = no replicas). Every node should use the same value.
+	ReplicationFactor int
+
+	// Followers poll the leader, and the leader sends heartbeats, every PollInterval
+	// (default 2s). LeaderLease is how long a leader may go without hearing from a
+	// majority, and a follower without hearing from the leader, before a new leader is
+	// elected (default 5 × PollInterval). See election.go.
+	LeaderLease time.Duration
+
+	// HealthCheckInterval makes the leader ping every member this often and remove one
+	// from the ring after HealthCheckFailures (default 3) consecutive failed pings, each
+	// bounded by HealthCheckTimeout (default HealthCheckInterval). 0 disables checks.
+	HealthCheckInterval time.Duration
+	HealthCheckFailures int
+	HealthCheckTimeout  time.Duration
+
+	// RebalanceKeysPerSec caps how fast keys move to new owners after a membership
+	// change (0 = unlimited). See rebalance.go.
+	RebalanceKeysPerSec float64
+
+	// AdvertiseCapacity sends this node's memory and CPU count with its join so the
+	// leader weights its share of the ring. Zero overrides are auto-detected.
+	AdvertiseCapacity   bool
+	CapacityMemoryBytes int64
+	CapacityCPUs        int
+
 	// replication config
 	ReplicationWorkers    int
 	ReplicationQueueSize  int
 	ReplicationTimeout    time.Duration
 	ReplicationMaxRetries int
+	// ReplicationRetryBudget caps retries outstanding across all workers (default 1000);
+	// beyond it failed tasks are dropped so retries can't crowd out new writes.
+	ReplicationRetryBudget int
+	// Retry backoff: ReplicationRetryBase (default 500ms) doubles per attempt up to
+	// ReplicationRetryMax (default 30s); ReplicationRetryJitter spreads each delay by
+	// that fraction (0.2 = +/-20%) so retries to a recovering node don't arrive together.
+	ReplicationRetryBase   time.Duration
+	ReplicationRetryMax    time.Duration
+	ReplicationRetryJitter float64
+	// Outbound replication throttling shared by all workers; 0 means unlimited.
+	ReplicationOpsPerSec   float64
+	ReplicationBytesPerSec float64
+	// ReplicationBinary sends values as raw bodies (/v1/internal/replicate-raw) instead of base64 JSON.
+	ReplicationBinary bool
+
+	// ClusterSecret, when set, must be sent in the X-Cluster-Secret header on /v1/internal/* calls.
+	ClusterSecret string
+
+	// TLS for the HTTP, TCP and RESP listeners and node-to-node requests (see tls.go);
+	// off unless TLSCertFile is set. TLSClientCAFile turns on mTLS, TLSCAFile verifies
+	// other nodes (default: system roots).
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	TLSCAFile       string
+
+	// RequireAuth makes TCP and RESP clients send AUTH <userID> <password> before any
+	// command but PING/QUIT. A user's password is its AuthUsers entry, else AuthSecret.
+	// Both are hashed by NewServer and cleared from the config.
+	RequireAuth bool
+	AuthSecret  string
+	AuthUsers   map[string]string
+
+	// MaxForwardsPerOwner caps concurrent forwarded requests to a single owner node.
+	MaxForwardsPerOwner int
+
+	// MaxForwardsPerSource caps concurrent forwarded requests from a single user/client IP.
+	MaxForwardsPerSource int
+
+	// ReadOnly starts the node rejecting writes; it can be toggled at runtime via /v1/admin/readonly.
+	ReadOnly bool
+
+	// MaxRequestBodyBytes caps request bodies read or forwarded by KV handlers (default 64 MiB).
+	MaxRequestBodyBytes int64
+
+	// MaxResponseBytes caps the value size a GET returns (0 = unlimited). Larger values
+	// are handled per ResponseCapPolicy.
+	MaxResponseBytes int
+	// ResponseCapPolicy is ResponseCapReject (default: 413 / ERR) or ResponseCapTruncate.
+	ResponseCapPolicy string
+
+	// WriteAcks makes /v1/set wait for this many replica acknowledgements before
+	// responding (capped at the number of replicas); 0 keeps replication fully async.
+	// WriteConsistency, if set, takes precedence.
+	WriteAcks int
+	// WriteConsistency and ReadConsistency are ConsistencyOne (default),
+	// ConsistencyQuorum or ConsistencyAll (any case). See consistency.go.
+	WriteConsistency string
+	ReadConsistency  string
+	// ReplicationFailurePolicy decides what a synchronous write that gets fewer acks
+	// than WriteAcks or WriteConsistency requires does: ReplicationFailureDegrade
+	// (default), ReplicationFailureRollback or ReplicationFailureRepair.
+	ReplicationFailurePolicy string
+
+	// SlowOpThreshold logs get/set/delete/forward/snapshot operations slower than this
+	// and keeps them in /v1/admin/slowlog (0 = disabled).
+	SlowOpThreshold time.Duration
+
+	// SnapshotInterval saves every user changed since the previous cycle to DataDir in
+	// the background, plus a final cycle on Shutdown (0 = only explicit snapshots).
+	SnapshotInterval time.Duration
+
+	// EnableFlushAll allows /v1/admin/flushall (wipes every user on every node). Off by default;
+	// meant for test environments. Each node must enable it to accept the internal flush.
+	EnableFlushAll bool
 }
 
+// Outcomes for synchronous writes that miss WriteAcks.
+const (
+	// keep the local write, answer 504; failed replicas are retried in the background
+	ReplicationFailureDegrade = "degrade"
+	// undo the local write (and on replicas that acked), answer 504
+	ReplicationFailureRollback = "rollback"
+	// keep the local write, record the key for /v1/admin/repair, answer 202
+	ReplicationFailureRepair = "repair"
+)
+
+// Policies for values larger than MaxResponseBytes.
+const (
+	ResponseCapReject   = "reject"   // HTTP 413, TCP "ERR value too large"
+	ResponseCapTruncate = "truncate" // first MaxResponseBytes bytes, flagged as truncated
+)
+
 type Server struct {
 	cache *cache.Cache
 	cfg   ServerConfig
 
 	httpSrv *http.Server
 	tcpLn   net.Listener
+	respLn  net.Listener // nil unless RESPAddr is set
 
-	wg sync.WaitGroup
+	// background loops (accept loops included) and TCP/RESP connection handlers,
+	// waited for in separate shutdown phases
+	background taskGroup
+	conns      taskGroup
 
 	started bool
 	mu      sync.Mutex
@@ -57,9 +185,41 @@ type Server struct {
 
 	shutdownOnce sync.Once
 	shutdownCh   chan struct{}
+
+	// readOnly rejects writes while still serving reads.
+	readOnly atomic.Bool
+
+	// latency samples per operation (get/set/delete)
+	latency map[string]*latencyRecorder
+
+	// recent operations slower than SlowOpThreshold
+	slowlog *slowLog
+
+	// forwarding: shared client and per-owner concurrency slots
+	forwardClient  *http.Client
+	forwardMu      sync.Mutex
+	forwardSlots   map[string]chan struct{} // owner addr -> semaphore
+	sourceInFlight map[string]int           // user/client IP -> in-flight forwards
+
+	// active TCP connections
+	clients *clientRegistry
+
+	// AUTH credentials; nil unless RequireAuth
+	auth *authStore
+
+	// listener TLS config; nil unless TLS is enabled
+	tlsServer *tls.Config
+
+	// running long admin operations (listable and cancellable)
+	ops *operationRegistry
+
+	// writes recorded by ReplicationFailureRepair
+	underReplicated *underReplicatedLog
 }
 
-func NewServer(c *cache.Cache, cfg ServerConfig) *Server {
+// NewServer builds a server from cfg, filling in defaults. It returns an error for
+// an unknown consistency level rather than silently serving at ONE.
+func NewServer(c *cache.Cache, cfg ServerConfig) (*Server, error) {
 	if cfg.CmdTimeout == 0 {
 		cfg.CmdTimeout = 5 * time.Second
 	}
@@ -81,11 +241,61 @@ func NewServer(c *cache.Cache, cfg ServerConfig) *Server {
 		cfg.ReplicationMaxRetries = 3
 	}
 
-	return &Server{
+	if cfg.MaxForwardsPerOwner == 0 {
+		cfg.MaxForwardsPerOwner = 64
+	}
+
+	if cfg.MaxForwardsPerSource == 0 {
+		cfg.MaxForwardsPerSource = 16
+	}
+
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = 2 * time.Second
+	}
+
+	if cfg.LeaderLease == 0 {
+		cfg.LeaderLease = defaultLeaseIntervals * cfg.PollInterval
+	}
+
+	cfg.WriteConsistency = strings.ToLower(cfg.WriteConsistency)
+	cfg.ReadConsistency = strings.ToLower(cfg.ReadConsistency)
+	if !validConsistency(cfg.WriteConsistency) {
+		return nil, fmt.Errorf("server: unknown write consistency %q (want one, quorum or all)", cfg.WriteConsistency)
+	}
+	if !validConsistency(cfg.ReadConsistency) {
+		return nil, fmt.Errorf("server: unknown read consistency %q (want one, quorum or all)", cfg.ReadConsistency)
+	}
+
+	if cfg.HealthCheckFailures == 0 {
+		cfg.HealthCheckFailures = defaultHealthCheckFailures
+	}
+
+	if cfg.MaxRequestBodyBytes == 0 {
+		cfg.MaxRequestBodyBytes = 64 << 20
+	}
+
+	s := &Server{
 		cache:      c,
 		cfg:        cfg,
 		shutdownCh: make(chan struct{}),
+		latency:    newLatencyRecorders(),
+		slowlog:    newSlowLog(),
+		forwardClient: &http.Client{
+			Timeout: cfg.CmdTimeout,
+		},
+		forwardSlots:   make(map[string]chan struct{}),
+		sourceInFlight: make(map[string]int),
+		clients:        newClientRegistry(),
+		ops:            newOperationRegistry(),
+
+		underReplicated: newUnderReplicatedLog(),
 	}
+	if cfg.RequireAuth {
+		s.auth = newAuthStore(cfg.AuthSecret, cfg.AuthUsers, c.NormalizeUserID)
+	}
+	s.cfg.AuthSecret, s.cfg.AuthUsers = "", nil
+	s.readOnly.Store(cfg.ReadOnly)
+	return s, nil
 }
 
 func (s *Server) Start() error {
@@ -96,45 +306,65 @@ func (s *Server) Start() error {
 		return errors.New("server: already started")
 	}
 
+	tlsServer, tlsClient, err := s.loadTLS()
+	if err != nil {
+		return err
+	}
+	s.tlsServer = tlsServer
+	if tlsClient != nil {
+		s.forwardClient.Transport = tlsTransport(tlsClient)
+	}
+
 	// create NodeInfo for current server
+	// the ring holds the advertised addr; HTTPAddr is only the bind address
+	addr := s.advertiseAddr()
 	id := s.cfg.NodeID
 	if id == "" {
 		// derive id from addr (simple);
-		id = s.cfg.HTTPAddr
+		id = addr
 	}
 
-	self := cluster.NodeInfo{ID: id, Addr: s.cfg.HTTPAddr}
+	self := cluster.NodeInfo{ID: id, Addr: addr, Capacity: s.selfCapacity()}
 
 	// initialize cluster state
-	cs := cluster.NewClusterState(self, s.cfg.ClusterReplicas)
+	cs := cluster.NewClusterState(self, s.cfg.VirtualNodes)
+	cs.SetMaxVirtualNodes(s.cfg.MaxVirtualNodes)
+	if tlsClient != nil {
+		cs.SetTransport(tlsTransport(tlsClient))
+	}
 	s.cluster = cs
 
 	// replication manager
-	s.replicator = newReplicationManager(s.cfg.ReplicationWorkers, s.cfg.ReplicationQueueSize, s.cfg.ReplicationTimeout, s.cfg.ReplicationMaxRetries)
+	s.replicator = newReplicationManager(s.cfg.ReplicationWorkers, s.cfg.ReplicationQueueSize, s.cfg.ReplicationTimeout, s.cfg.ReplicationMaxRetries, s.cfg.ClusterSecret)
+	s.replicator.resolve = s.replicaTargets
+	s.replicator.setRateLimits(s.cfg.ReplicationOpsPerSec, s.cfg.ReplicationBytesPerSec)
+	s.replicator.binary = s.cfg.ReplicationBinary
+	s.replicator.setRetryBudget(s.cfg.ReplicationRetryBudget)
+	s.replicator.setRetryBackoff(s.cfg.ReplicationRetryBase, s.cfg.ReplicationRetryMax, s.cfg.ReplicationRetryJitter)
+	s.replicator.sink = s.cache.MetricsSink()
+	if tlsClient != nil {
+		s.replicator.setTLS(tlsClient)
+	}
 	s.replicator.start()
 
-	// If join addr provided, join leader and start polling
+	// If join addr provided, join leader; otherwise (or if the join fails) this node
+	// starts its own cluster and leads its first term.
 	if s.cfg.JoinAddr != "" {
 		if err := s.joinLeader(s.cfg.JoinAddr, self); err != nil {
 			log.Printf("[server] join leader failed: %v", err)
 			// proceed as standalone node (optionally error out)
-		} else {
-			// start poller to keep state updated
-			stop := make(chan struct{})
-			go cs.PollLeader(s.cfg.JoinAddr, s.cfg.PollInterval, stop)
-			// when server shutdown close stop via s.shutdownCh handling later (not shown)
-			// close stop in Shutdown
-
-			go func() {
-				<-s.shutdownCh
-				close(stop)
-			}()
-
+			cs.BecomeLeader(1)
 		}
 	} else {
-		// current node is leader
+		cs.BecomeLeader(1)
 	}
 
+	// every node polls whichever node leads, since leadership can move
+	s.background.Go(func() {
+		cs.PollLeader(s.scheme(), s.cfg.PollInterval, s.shutdownCh)
+	})
+	s.background.Go(s.electionLoop)
+
 	// setup HTTP mux and handlers with cluster-aware routing
 	mux := http.NewServeMux()
 	s.httpSrv = &http.Server{
@@ -143,24 +373,29 @@ func (s *Server) Start() error {
 		ReadTimeout:  s.cfg.ReadTimeout,
 		WriteTimeout: s.cfg.WriteTimeout,
 		IdleTimeout:  s.cfg.IdealTimeout,
+		TLSConfig:    s.tlsServer,
 	}
 
 	// register handlers (http.go uses s.cluster)
 	registerHTTPHandlers(mux, s)
-	s.wg.Add(1)
 
 	// Start HTTP in a goroutine
-	go func() {
-		defer s.wg.Done()
-		log.Printf("[server] HTTP listening on %s", s.cfg.HTTPAddr)
-		err := s.httpSrv.ListenAndServe()
+	s.background.Go(func() {
+		log.Printf("[server] HTTP listening on %s (%s)", s.cfg.HTTPAddr, s.scheme())
+		var err error
+		if s.tlsServer != nil {
+			// certificates come from TLSConfig
+			err = s.httpSrv.ListenAndServeTLS("", "")
+		} else {
+			err = s.httpSrv.ListenAndServe()
+		}
 		if err != nil {
 			log.Printf("[server] HTTP error: %v", err)
 		}
-	}()
+	})
 
 	// start TCP
-	ln, err := net.Listen("tcp", s.cfg.TCPAddr)
+	ln, err := s.listen(s.cfg.TCPAddr)
 	if err != nil {
 		s.httpSrv.Shutdown(context.Background())
 		return err
@@ -168,12 +403,35 @@ func (s *Server) Start() error {
 
 	s.tcpLn = ln
 
-	s.wg.Add(1)
-	go func() {
-		defer s.wg.Done()
+	s.background.Go(func() {
 		log.Printf("[server] TCP listening on %s", s.cfg.TCPAddr)
 		s.acceptLoop()
-	}()
+	})
+
+	if s.cfg.RESPAddr != "" {
+		respLn, err := s.listen(s.cfg.RESPAddr)
+		if err != nil {
+			s.tcpLn.Close()
+			s.httpSrv.Shutdown(context.Background())
+			return err
+		}
+		s.respLn = respLn
+
+		s.background.Go(func() {
+			log.Printf("[server] RESP listening on %s", s.cfg.RESPAddr)
+			s.respAcceptLoop()
+		})
+	}
+
+	s.background.Go(s.rebalanceLoop)
+
+	if s.cfg.HealthCheckInterval > 0 {
+		s.background.Go(s.healthLoop)
+	}
+
+	if s.cfg.SnapshotInterval > 0 {
+		s.background.Go(s.snapshotLoop)
+	}
 
 	s.started = true
 	return nil
@@ -181,8 +439,8 @@ func (s *Server) Start() error {
 
 // joinLeader posts /v1/cluster/join to leader and updates local cluster state from response.
 func (s *Server) joinLeader(leaderAddr string, self cluster.NodeInfo) error {
-	// leaderAddr example: "http://127.0.0.1:8080"
-	client := &http.Client{Timeout: 3 * time.Second}
+	// leaderAddr example: "http://127.0.0.1:8080" ("https://..." with TLS)
+	client := &http.Client{Timeout: 3 * time.Second, Transport: s.forwardClient.Transport}
 	bodyBytes, _ := json.Marshal(self)
 	resp, err := client.Post(leaderAddr+"/v1/cluster/join", "application/json", bytes.NewReader(bodyBytes))
 	if err != nil {
@@ -192,72 +450,257 @@ func (s *Server) joinLeader(leaderAddr string, self cluster.NodeInfo) error {
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("join failed: %s", resp.Status)
 	}
-	// parse payload with same structure as cluster.Snapshot (replicas, nodes, ring)
-	var payload struct {
-		Replicas int                         `json:"replicas"`
-		Nodes    []cluster.NodeInfo          `json:"nodes"`
-		Ring     map[string]cluster.NodeInfo `json:"ring"`
-	}
+	// parse payload with same structure as cluster.Snapshot (replicas, nodes, ring, pins)
+	var payload cluster.StatePayload
 	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
 		return err
 	}
-	// replace local cluster state
-	s.cluster.ReplaceFromPayload(payload.Replicas, payload.Nodes, payload.Ring)
+	// replace local cluster state; the answer came from the leader, so it starts our lease
+	s.cluster.ReplaceFromPayload(payload)
+	s.cluster.ObserveLeader(payload.Leader, payload.Term)
 	return nil
 }
 
-// Shutdown Gracefully stops servers
+// taskGroup is a WaitGroup that also counts the goroutines still running, so a
+// shutdown phase can tell a finished group from a timed-out one.
+type taskGroup struct {
+	wg      sync.WaitGroup
+	running atomic.Int64
+}
+
+// Go runs f in a new goroutine of the group.
+func (g *taskGroup) Go(f func()) {
+	g.wg.Add(1)
+	g.running.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer g.running.Add(-1)
+		f()
+	}()
+}
+
+// Wait waits for the group's goroutines until ctx expires and returns how many are
+// still running (0 = all finished). The count is read after ctx expires, so a group
+// that finished in the meantime is not reported as left behind.
+func (g *taskGroup) Wait(ctx context.Context) int {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+		return int(g.running.Load())
+	}
+}
+
+// ShutdownPhaseTimeout describes a shutdown phase that did not finish before the deadline.
+type ShutdownPhaseTimeout struct {
+	Phase     string // "http", "connections", "background" or "replication"
+	Remaining int    // requests, connections, loops or tasks left behind (-1 if unknown)
+}
+
+// ShutdownError is returned by Shutdown when one or more phases timed out,
+// so orchestrators know a forced kill may be needed.
+type ShutdownError struct {
+	Phases []ShutdownPhaseTimeout
+}
+
+func (e *ShutdownError) Error() string {
+	parts := make([]string, 0, len(e.Phases))
+	for _, p := range e.Phases {
+		parts = append(parts, fmt.Sprintf("%s (remaining %d)", p.Phase, p.Remaining))
+	}
+	return "server: shutdown timed out: " + strings.Join(parts, ", ")
+}
+
+// Shutdown Gracefully stops servers: drains HTTP, closes the TCP and RESP listeners
+// and waits for their connections, then for the background loops, then flushes
+// replication workers. It returns a *ShutdownError listing the phases that did not
+// finish before ctx expired; a phase that finished is never listed, even when an
+// earlier one used up ctx.
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.shutdownOnce.Do(func() {
 		close(s.shutdownCh)
 	})
 
-	// General  HTTP shutdown
-	httpDone := make(chan struct{})
+	var timedOut []ShutdownPhaseTimeout
 
-	go func() {
-		_ = s.httpSrv.Shutdown(ctx)
-		close(httpDone)
-	}()
+	// HTTP drain
+	if s.httpSrv != nil {
+		if err := s.httpSrv.Shutdown(ctx); err != nil && ctx.Err() != nil {
+			timedOut = append(timedOut, ShutdownPhaseTimeout{Phase: "http", Remaining: -1})
+		}
+	}
 
 	// Close TCP listener to stop accept loop
 	if s.tcpLn != nil {
 		_ = s.tcpLn.Close()
 	}
+	if s.respLn != nil {
+		_ = s.respLn.Close()
+	}
 
-	// wait for goroutines
-	done := make(chan struct{})
-	go func() {
-		s.wg.Wait()
-		close(done)
-	}()
+	// TCP and RESP connections finish their current command and close
+	if left := s.conns.Wait(ctx); left > 0 {
+		timedOut = append(timedOut, ShutdownPhaseTimeout{Phase: "connections", Remaining: left})
+	}
 
-	select {
-	case <-done:
-		// all goroutines finished
-	case <-ctx.Done():
-		// times out
+	// accept, poll, election, rebalance, health and snapshot loops
+	if left := s.background.Wait(ctx); left > 0 {
+		timedOut = append(timedOut, ShutdownPhaseTimeout{Phase: "background", Remaining: left})
+	}
+
+	// replication flush
+	if s.replicator != nil {
+		if pending := s.replicator.Stop(ctx); pending > 0 {
+			timedOut = append(timedOut, ShutdownPhaseTimeout{Phase: "replication", Remaining: pending})
+		}
+	}
+
+	if len(timedOut) > 0 {
+		return &ShutdownError{Phases: timedOut}
 	}
-	// allow remaining cleanup
 	return nil
 }
 
 // enqueueReplication enqueues replication tasks for a write (primary already stored locally).
-func (s *Server) enqueueReplication(userID, key string, value []byte, ttlSec int64, timestamp int64) {
-	// get replica nodes (N)
-	replicas := s.cluster.GetReplicaNodes(userID+":|:"+key, s.cluster.Replicas)
-
-	// skip first (primary) since primary already has the write
-	for i := 1; i < len(replicas); i++ {
-		t := replicationTask{
-			To:        replicas[i],
+func (s *Server) enqueueReplication(userID, key string, value []byte, ttl time.Duration, timestamp int64) {
+	for _, t := range s.replicationTasks(userID, key, value, ttl, timestamp) {
+		s.replicator.enqueue(t) // non-blocking; if queue full, task dropped and logged
+	}
+}
+
+// replicateSync writes to every replica before returning and reports each one's result.
+// Replicas that fail are retried asynchronously.
+func (s *Server) replicateSync(ctx context.Context, userID, key string, value []byte, ttl time.Duration, timestamp int64) []replicaAck {
+	return s.replicator.replicateSync(ctx, s.replicationTasks(userID, key, value, ttl, timestamp))
+}
+
+// revertWrite rolls back a write made at ts locally and on every replica, restoring
+// prev (nil = delete). It returns the outcome reported to the client.
+func (s *Server) revertWrite(userID, key string, ts int64, prev *cache.Item) string {
+	// the revert must beat the write on replicas that already applied it
+	revertTS := max(time.Now().UnixNano(), ts+1)
+	reverted, err := s.cache.Revert(userID, key, ts, prev, revertTS)
+	if err != nil || !reverted {
+		// a newer write replaced ours; leave it alone
+		return "rollback_skipped"
+	}
+
+	var value []byte
+	expiresAt := revertTS - 1 // already expired: replicas delete the key
+	if prev != nil {
+		value, expiresAt = prev.Value, 0
+		if !prev.ExpiresAt.IsZero() {
+			expiresAt = prev.ExpiresAt.UnixNano()
+		}
+	}
+	for _, t := range s.replicationTasks(userID, key, value, 0, revertTS) {
+		t.ExpiresAt = expiresAt
+		s.replicator.enqueue(t)
+	}
+	return "rolled_back"
+}
+
+// itemReplicationTasks builds replication tasks carrying item as stored locally:
+// value, write timestamp and absolute expiry. Used when the write didn't come with a
+// TTL of its own (counters keep theirs, repairs resend the current state).
+func (s *Server) itemReplicationTasks(userID, key string, item cache.Item) []replicationTask {
+	tasks := s.replicationTasks(userID, key, item.Value, 0, item.Timestamp)
+	if !item.ExpiresAt.IsZero() {
+		for i := range tasks {
+			tasks[i].ExpiresAt = item.ExpiresAt.UnixNano()
+			tasks[i].TTLSec = int64((time.Until(item.ExpiresAt) + time.Second - 1) / time.Second)
+		}
+	}
+	return tasks
+}
+
+// replicationTasks builds one task per current replica of the key.
+func (s *Server) replicationTasks(userID, key string, value []byte, ttl time.Duration, timestamp int64) []replicationTask {
+	// send an absolute expiry so replication delay doesn't extend the TTL on replicas
+	var expiresAt, ttlSec int64
+	if ttl > 0 {
+		expiresAt = time.Unix(0, timestamp).Add(ttl).UnixNano()
+		// ttl_secs is only a fallback for receivers that ignore expires_at; round up
+		// so sub-second TTLs don't turn into "no expiry"
+		ttlSec = int64((ttl + time.Second - 1) / time.Second)
+	}
+
+	targets := s.replicaTargets(userID, key)
+	tasks := make([]replicationTask, 0, len(targets))
+	for i, node := range targets {
+		tasks = append(tasks, replicationTask{
+			To:        node,
+			Slot:      i,
 			UserID:    userID,
 			Key:       key,
 			Value:     value,
 			TTLSec:    ttlSec,
+			ExpiresAt: expiresAt,
 			Timestamp: timestamp,
 			Attempts:  0,
+		})
+	}
+	return tasks
+}
+
+// replicaNodes returns the ReplicationFactor nodes that hold hashKey: its owner
+// (the pinned node, if any) followed by its ring successors.
+func (s *Server) replicaNodes(hashKey string) []cluster.NodeInfo {
+	return s.cluster.GetReplicaNodes(hashKey, s.cfg.ReplicationFactor)
+}
+
+// replicaTargets returns the current replica nodes for a key, excluding self
+// (the primary already has the write).
+func (s *Server) replicaTargets(userID, key string) []cluster.NodeInfo {
+	replicas := s.replicaNodes(userID + ":|:" + key)
+
+	self := s.cluster.Self()
+	out := make([]cluster.NodeInfo, 0, len(replicas))
+	for _, node := range replicas {
+		if node.ID == self.ID {
+			continue
 		}
-		s.replicator.enqueue(t) // non-blocking; if queue full, task dropped and logged
+		out = append(out, node)
+	}
+	return out
+}
+
+// advertiseAddr returns the address this node registers in the ring.
+func (s *Server) advertiseAddr() string {
+	if s.cfg.AdvertiseAddr != "" {
+		return s.cfg.AdvertiseAddr
+	}
+	return s.cfg.HTTPAddr
+}
+
+// isSelf reports whether node is this server. It compares node IDs, so it holds
+// when the listen address differs from the advertised one.
+func (s *Server) isSelf(node cluster.NodeInfo) bool {
+	return node.ID == s.cluster.Self().ID
+}
+
+// getOwned reads uid/key from the local cache. If the user isn't in memory and this
+// node owns the key (e.g. after a ring change), the user is loaded from its snapshot
+// file first; a read never creates a user.
+func (s *Server) getOwned(uid, key string) ([]byte, error) {
+	val, err := s.cache.GetRef(uid, key)
+	if err != cache.ErrUserNotFound {
+		return val, err
+	}
+	if owner, ok := s.cluster.LookupOwner(uid + ":|:" + key); !ok || !s.isSelf(owner) {
+		return nil, err
+	}
+	loaded, lerr := s.cache.LoadUser(uid)
+	if lerr != nil {
+		return nil, lerr
+	}
+	if !loaded {
+		return nil, err
 	}
+	return s.cache.GetRef(uid, key)
 }
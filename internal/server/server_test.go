@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cluster"
+)
+
+func TestShutdownReportsTimeouts(t *testing.T) {
+	t.Run("slow handler", func(t *testing.T) {
+		arrived := make(chan struct{}, 1)
+		release := make(chan struct{})
+		owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1/set" { // pings and heartbeats: keep the owner in the ring
+				w.Write([]byte(`{"accepted":true}`))
+				return
+			}
+			arrived <- struct{}{}
+			<-release
+		}))
+		defer owner.Close()
+		defer close(release)
+
+		n := startNode(t, ServerConfig{CmdTimeout: 10 * time.Second})
+		if err := n.s.cluster.AddNode(cluster.NodeInfo{ID: "slow", Addr: strings.TrimPrefix(owner.URL, "http://")}); err != nil {
+			t.Fatal(err)
+		}
+		key := keyOwnedBy(t, n, "alice", "slow")
+		go n.do(t, http.MethodPost, "/v1/set", "alice", map[string]any{"key": key, "value": "v"})
+		<-arrived
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err := n.s.Shutdown(ctx)
+		var se *ShutdownError
+		if !errors.As(err, &se) {
+			t.Fatalf("Shutdown = %v, want a *ShutdownError", err)
+		}
+		if len(se.Phases) == 0 || se.Phases[0].Phase != "http" {
+			t.Fatalf("timed out phases = %+v, want http first", se.Phases)
+		}
+	})
+
+	t.Run("pending retries are not a timeout", func(t *testing.T) {
+		n := startNode(t, ServerConfig{ReplicationFactor: 2})
+		// a replica that refuses connections, so the write's replication waits on a retry
+		if err := n.s.cluster.AddNode(cluster.NodeInfo{ID: "down", Addr: freeAddr(t)}); err != nil {
+			t.Fatal(err)
+		}
+		n.set(t, "alice", keyOwnedBy(t, n, "alice", n.s.cluster.Self().ID), "v")
+		waitFor(t, 2*time.Second, func() bool { return n.s.replicator.retriesOutstanding.Load() > 0 })
+		// http.Server.Shutdown waits up to 5s on connections that never sent a
+		// request; drop the clients' spare ones so only the retry is left pending
+		n.client.CloseIdleConnections()
+		n.s.forwardClient.CloseIdleConnections()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := n.s.Shutdown(ctx); err != nil {
+			t.Fatalf("Shutdown = %v, want nil", err)
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// slowLogSize bounds the number of recent slow operations kept in memory.
+const slowLogSize = 128
+
+// additional ops tracked only by the slowlog
+const (
+	opForward  = "forward"
+	opSnapshot = "snapshot"
+)
+
+// slowOp is one operation that exceeded SlowOpThreshold.
+type slowOp struct {
+	At       time.Time     `json:"at"`
+	Op       string        `json:"op"`
+	Path     string        `json:"path"`
+	User     string        `json:"user,omitempty"`
+	Key      string        `json:"key,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// slowLog keeps the most recent slow ops in a ring buffer plus per-op counters.
+type slowLog struct {
+	mu      sync.Mutex
+	entries []slowOp
+	next    int
+
+	counts map[string]*atomic.Uint64 // op -> total slow ops, fixed at construction
+}
+
+func newSlowLog() *slowLog {
+	counts := make(map[string]*atomic.Uint64)
+	for _, op := range []string{opGet, opSet, opDelete, opForward, opSnapshot} {
+		counts[op] = new(atomic.Uint64)
+	}
+	return &slowLog{entries: make([]slowOp, 0, slowLogSize), counts: counts}
+}
+
+func (sl *slowLog) add(e slowOp) {
+	if c, ok := sl.counts[e.Op]; ok {
+		c.Add(1)
+	}
+
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if len(sl.entries) < slowLogSize {
+		sl.entries = append(sl.entries, e)
+	} else {
+		sl.entries[sl.next] = e
+		sl.next = (sl.next + 1) % slowLogSize
+	}
+}
+
+// recent returns the logged slow ops, newest first.
+func (sl *slowLog) recent() []slowOp {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	out := make([]slowOp, 0, len(sl.entries))
+	// oldest entry sits at next once the ring has wrapped
+	for i := len(sl.entries) - 1; i >= 0; i-- {
+		out = append(out, sl.entries[(sl.next+i)%len(sl.entries)])
+	}
+	return out
+}
+
+// opTrace times one operation; user and key can be filled in once parsed.
+type opTrace struct {
+	s     *Server
+	op    string
+	path  string
+	user  string
+	key   string
+	start time.Time
+}
+
+// startOp begins timing op for an HTTP request. Use as:
+//
+//	t := s.startOp(opGet, r)
+//	defer t.finish()
+func (s *Server) startOp(op string, r *http.Request) *opTrace {
+	return &opTrace{s: s, op: op, path: r.URL.Path, start: time.Now()}
+}
+
+func (t *opTrace) finish() {
+	t.s.finishOp(t.op, t.path, t.user, t.key, t.start)
+}
+
+// finishOp records latency for op and logs it to the slowlog when it took longer than
+// SlowOpThreshold.
+func (s *Server) finishOp(op, path, user, key string, start time.Time) {
+	d := time.Since(start)
+	if lr, ok := s.latency[op]; ok {
+		lr.record(d)
+	}
+	sink := s.cache.MetricsSink()
+	sink.ObserveLatency("op."+op, d)
+
+	if s.cfg.SlowOpThreshold <= 0 || d < s.cfg.SlowOpThreshold {
+		return
+	}
+	log.Printf("[slowlog] %s %s user=%s key=%s took %s", op, path, user, key, d)
+	sink.IncrCounter("op.slow."+op, 1)
+	s.slowlog.add(slowOp{At: start, Op: op, Path: path, User: user, Key: key, Duration: d})
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSlowOpThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		took      time.Duration
+		wantSlow  bool
+	}{
+		{name: "disabled", threshold: 0, took: time.Second},
+		{name: "under threshold", threshold: time.Hour, took: time.Millisecond},
+		{name: "over threshold", threshold: 10 * time.Millisecond, took: 50 * time.Millisecond, wantSlow: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := startNode(t, ServerConfig{SlowOpThreshold: tt.threshold})
+			before := n.s.slowlog.counts[opSet].Load()
+
+			// backdating the start makes the op look as slow as tt.took
+			n.s.finishOp(opSet, "/v1/set", "alice", "k", time.Now().Add(-tt.took))
+
+			counted := n.s.slowlog.counts[opSet].Load() - before
+			recent := n.s.slowlog.recent()
+			if !tt.wantSlow {
+				if counted != 0 || len(recent) != 0 {
+					t.Fatalf("fast op logged: count +%d, entries %+v", counted, recent)
+				}
+				return
+			}
+			if counted != 1 || len(recent) != 1 {
+				t.Fatalf("slow op: count +%d, %d entries; want +1 and 1", counted, len(recent))
+			}
+			if e := recent[0]; e.Op != opSet || e.Path != "/v1/set" || e.User != "alice" || e.Key != "k" || e.Duration < tt.took {
+				t.Fatalf("entry = %+v", e)
+			}
+		})
+	}
+}
+
+func TestSlowLogRing(t *testing.T) {
+	tests := []struct {
+		name  string
+		added int
+	}{
+		{name: "partial", added: 3},
+		{name: "full", added: slowLogSize},
+		{name: "wrapped", added: slowLogSize + 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sl := newSlowLog()
+			for i := 0; i < tt.added; i++ {
+				sl.add(slowOp{Op: opGet, Key: strconv.Itoa(i)})
+			}
+			recent := sl.recent()
+			if want := min(tt.added, slowLogSize); len(recent) != want {
+				t.Fatalf("%d entries, want %d", len(recent), want)
+			}
+			// newest first, with no gaps
+			for i, e := range recent {
+				if want := strconv.Itoa(tt.added - 1 - i); e.Key != want {
+					t.Fatalf("entry %d = %s, want %s", i, e.Key, want)
+				}
+			}
+			if got := sl.counts[opGet].Load(); got != uint64(tt.added) {
+				t.Fatalf("count = %d, want %d", got, tt.added)
+			}
+		})
+	}
+}
+
+func TestSlowLogEndpoint(t *testing.T) {
+	n := startNode(t, ServerConfig{SlowOpThreshold: time.Nanosecond})
+	n.set(t, "alice", "k", "v")
+
+	code, body := n.do(t, http.MethodGet, "/v1/admin/slowlog", "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("slowlog = %d %s", code, body)
+	}
+	var resp slowLogResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	var found bool
+	for _, e := range resp.Entries {
+		if e.Op == opSet && e.User == "alice" && e.Key == "k" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("set missing from slowlog: %+v", resp.Entries)
+	}
+	if n.s.slowlog.counts[opSet].Load() == 0 {
+		t.Fatalf("slow set not counted")
+	}
+}
@@ -2,7 +2,9 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -15,42 +17,82 @@ import (
 )
 
 func (s *Server) acceptLoop() {
+	s.serveListener(s.tcpLn, "tcp", s.handleConn)
+}
+
+// Accept backoff after transient errors (e.g. out of file descriptors).
+const (
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+)
+
+// serveListener accepts connections on ln and runs handle for each in its own
+// goroutine. It returns once the server shuts down or ln is closed; other accept
+// errors are retried after a backoff that doubles up to acceptBackoffMax.
+func (s *Server) serveListener(ln net.Listener, proto string, handle func(net.Conn)) {
+	var backoff time.Duration
 	for {
-		conn, err := s.tcpLn.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			select {
 			case <-s.shutdownCh:
-				// expect shuting down
+				return
 			default:
-				log.Printf("[tcp] accept error: %v", err)
-				continue
 			}
+			if errors.Is(err, net.ErrClosed) {
+				log.Printf("[%s] listener closed", proto)
+				return
+			}
+			if backoff == 0 {
+				backoff = acceptBackoffMin
+			} else if backoff *= 2; backoff > acceptBackoffMax {
+				backoff = acceptBackoffMax
+			}
+			log.Printf("[%s] accept error: %v; retrying in %v", proto, err, backoff)
+			select {
+			case <-s.shutdownCh:
+				return
+			case <-time.After(backoff):
+			}
+			continue
 		}
-		s.wg.Add(1)
-		go func() {
-			defer s.wg.Done()
-			s.handleConn(conn)
-		}()
+		backoff = 0
+
+		s.conns.Go(func() { handle(conn) })
 	}
 }
 
 func (s *Server) handleConn(conn net.Conn) {
 	defer conn.Close()
 
+	client := s.clients.register(conn)
+	defer s.clients.unregister(client.id)
+
 	r := bufio.NewReader(conn)
 	w := bufio.NewWriter(conn)
+	defer w.Flush()
 
 	var authUser string
 
+	// replies are buffered and flushed once no further command is waiting (see
+	// pendingCommand), so a pipelined batch costs one write instead of one per reply
 	write := func(format string, a ...interface{}) {
 		fmt.Fprintf(w, format+"\n", a...)
-		w.Flush()
 	}
 
 	writeErr := func(msg string) {
 		write("ERR %s", msg)
 	}
 
+	// with RequireAuth a connection only acts as the user it authenticated as
+	denied := func(uid string) bool {
+		if s.auth == nil || s.cache.NormalizeUserID(uid) == authUser {
+			return false
+		}
+		writeErr("permission denied")
+		return true
+	}
+
 	// set a generous deadline to read first command (we'll set per-command deadlines below)
 	_ = conn.SetDeadline(time.Now().Add(5 * time.Minute))
 
@@ -62,6 +104,10 @@ func (s *Server) handleConn(conn net.Conn) {
 		default:
 		}
 
+		if !pendingCommand(r) {
+			w.Flush()
+		}
+
 		// read line
 		line, err := r.ReadString('\n')
 
@@ -79,29 +125,81 @@ func (s *Server) handleConn(conn net.Conn) {
 			continue
 		}
 
-		// splits a string on any whitespace (spaces, tabs, etc.), and collapses multiple spaces.
-		toks := strings.Fields(line)
+		var toks []string
+		framed := isFramedHeader(line)
+		if framed {
+			// length-prefixed arguments: binary-safe keys and values
+			toks, err = readFramedArgs(r, line)
+			if err != nil {
+				writeErr("bad frame")
+				return
+			}
+		} else {
+			// whitespace-separated, with double-quoted arguments kept whole
+			toks, err = splitArgs(line)
+			if err != nil {
+				writeErr(err.Error())
+				continue
+			}
+		}
 		if len(toks) == 0 {
 			writeErr("empty command")
 			continue
 		}
 
 		cmd := strings.ToUpper(toks[0])
+		client.commands.Add(1)
+
+		if s.auth != nil && authUser == "" && cmd != "AUTH" && cmd != "PING" && cmd != "QUIT" {
+			writeErr("authentication required")
+			continue
+		}
+
+		if s.readOnly.Load() && isTCPWriteCommand(cmd) {
+			writeErr("read-only")
+			continue
+		}
+
+		if isTCPDataCommand(cmd) && !s.clusterReady() {
+			writeErr(errClusterNotReady.Error())
+			continue
+		}
 
 		// Per-command context with timeout
-		_, cancel := context.WithTimeout(context.Background(), s.cfg.CmdTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.CmdTimeout)
 		// ensure we cancel
 		defer cancel()
 
 		switch cmd {
 		case "AUTH":
-			if len(toks) != 2 {
-				writeErr("usage: Auth <userID>")
+			// AUTH <userID> [password]; the password is required (and checked) with RequireAuth
+			if len(toks) != 2 && len(toks) != 3 {
+				writeErr("usage: AUTH <userID> <password>")
 				continue
 			}
-			authUser = toks[1]
+			uid := s.cache.NormalizeUserID(toks[1])
+			if s.auth != nil && (len(toks) != 3 || !s.auth.check(uid, toks[2])) {
+				log.Printf("[tcp] failed AUTH for user %q from %s", uid, conn.RemoteAddr())
+				writeErr("invalid credentials")
+				continue
+			}
+			authUser = uid
+			client.setUser(authUser)
 			write("ok")
 
+		case "CLIENT":
+			// CLIENT LIST: one line per connection, preceded by the count
+			if len(toks) != 2 || strings.ToUpper(toks[1]) != "LIST" {
+				writeErr("usage: CLIENT LIST")
+				continue
+			}
+			clients := s.clients.list()
+			write("CLIENTS %d", len(clients))
+			for _, c := range clients {
+				write("id=%d addr=%s user=%s age=%s cmds=%d", c.ID, c.RemoteAddr, c.User,
+					time.Since(c.ConnectedAt).Round(time.Second), c.Commands)
+			}
+
 		case "PING":
 			write("PONG")
 
@@ -115,6 +213,9 @@ func (s *Server) handleConn(conn net.Conn) {
 				continue
 			}
 			uid := toks[1]
+			if denied(uid) {
+				continue
+			}
 			if err := s.cache.CreateUser(uid); err != nil {
 				if err == cache.ErrUserExists {
 					writeErr("user exists")
@@ -131,6 +232,9 @@ func (s *Server) handleConn(conn net.Conn) {
 				continue
 			}
 			uid := toks[1]
+			if denied(uid) {
+				continue
+			}
 			if err := s.cache.DeleteUser(uid); err != nil {
 				if err == cache.ErrUserNotFound {
 					writeErr("user not found")
@@ -179,15 +283,206 @@ func (s *Server) handleConn(conn net.Conn) {
 				ttl = time.Duration(ttlSec) * time.Second
 			}
 
-			if err := s.cache.Set(uid, key, []byte(value), ttl, 0); err != nil {
+			start := time.Now()
+			created, err := s.cache.Set(uid, key, []byte(value), ttl, 0)
+			s.finishOp(opSet, "tcp SET", uid, key, start)
+			if err != nil {
 				if err == cache.ErrUserNotFound {
 					writeErr("user not found")
+				} else if err == cache.ErrValueTooLarge {
+					writeErr(err.Error())
 				} else {
 					writeErr("internal")
 				}
+			} else if created {
+				write("OK CREATED")
 			} else {
+				write("OK UPDATED")
+			}
+
+		case "SETNX":
+			// SETNX <key> <value> [ttl] (auth) or SETNX <user> <key> <value> [ttl]
+			var uid string
+			args := toks[1:]
+			if authUser != "" {
+				uid = authUser
+			} else if len(args) >= 3 {
+				uid, args = args[0], args[1:]
+			}
+			if uid == "" || len(args) < 2 || len(args) > 3 {
+				writeErr("usage: SETNX <key> <value> [ttl] or SETNX <user> <key> <value> [ttl]")
+				continue
+			}
+			var ttl time.Duration
+			if len(args) == 3 {
+				if ttlSec, _ := strconv.ParseInt(args[2], 10, 64); ttlSec > 0 {
+					ttl = time.Duration(ttlSec) * time.Second
+				}
+			}
+
+			// the owner picks the single winner, like POST /v1/setnx
+			start := time.Now()
+			var resp setNXResponse
+			in := setRequest{Key: args[0], Value: args[1], TTLMs: ttl.Milliseconds()}
+			err := s.writeOwned(ctx, uid, args[0], "/v1/setnx", in, &resp, func() (err error) {
+				resp.Set, err = s.setNXLocal(uid, args[0], []byte(args[1]), ttl)
+				return err
+			})
+			s.finishOp(opSet, "tcp SETNX", uid, args[0], start)
+			if err == cache.ErrValueTooLarge || err == errClusterNotReady {
+				writeErr(err.Error())
+			} else if err != nil {
+				writeErr("internal")
+			} else if resp.Set {
 				write("OK")
+			} else {
+				write("EXISTS")
+			}
+
+		case "MSET":
+			// MSET <key> <value> [<key> <value> ...] (auth) or MSET <user> <key> <value> ...
+			// no TTL; keys are grouped by owner like POST /v1/mset
+			var uid string
+			args := toks[1:]
+			if authUser != "" {
+				uid = authUser
+			} else if len(args)%2 == 1 {
+				uid, args = args[0], args[1:]
+			}
+			if uid == "" || len(args) == 0 || len(args)%2 != 0 {
+				writeErr("usage: MSET <key> <value> ... or MSET <user> <key> <value> ...")
+				continue
+			}
+			// a repeated key keeps its last value
+			items := make(map[string]string, len(args)/2)
+			for i := 0; i < len(args); i += 2 {
+				items[args[i]] = args[i+1]
+			}
+
+			start := time.Now()
+			resp, err := s.mset(ctx, uid, msetRequest{Items: items}, 0, s.cfg.CmdTimeout)
+			s.finishOp(opSet, "tcp MSET", uid, "", start)
+			if err != nil {
+				writeErr(err.Error())
+			} else if len(resp.Failed) > 0 {
+				writeErr("mset failed on " + failedNodeIDs(resp.Failed))
+			} else {
+				write("OK %d", len(args)/2)
+			}
+
+		case "MGET":
+			// MGET <key> ... (auth) or MGET <user> <key> ...
+			// replies VALUES <n>, then one VALUE (or NIL) line per key, in order
+			var uid string
+			args := toks[1:]
+			if authUser != "" {
+				uid = authUser
+			} else if len(args) >= 2 {
+				uid, args = args[0], args[1:]
+			}
+			if uid == "" || len(args) == 0 {
+				writeErr("usage: MGET <key> ... or MGET <user> <key> ...")
+				continue
+			}
 
+			start := time.Now()
+			values, err := s.cache.MGet(uid, args)
+			s.finishOp(opGet, "tcp MGET", uid, "", start)
+			if err != nil && err != cache.ErrUserNotFound {
+				writeErr("internal")
+				continue
+			}
+			write("VALUES %d", len(args))
+			for _, k := range args {
+				val, ok := values[k]
+				switch {
+				case !ok:
+					write("NIL")
+				case framed:
+					writeFramedValue(w, val)
+				default:
+					write("VALUE %s", string(val))
+				}
+			}
+
+		case "GETSET":
+			// GETSET <key> <value> (auth) or GETSET <user> <key> <value>
+			var uid string
+			args := toks[1:]
+			if authUser != "" {
+				uid = authUser
+			} else if len(args) == 3 {
+				uid, args = args[0], args[1:]
+			}
+			if uid == "" || len(args) != 2 {
+				writeErr("usage: GETSET <key> <value> or GETSET <user> <key> <value>")
+				continue
+			}
+
+			// on the key's owner, like POST /v1/getset, so the new value is replicated
+			start := time.Now()
+			var resp getSetResponse
+			err := s.writeOwned(ctx, uid, args[0], "/v1/getset", setRequest{Key: args[0], Value: args[1]}, &resp, func() error {
+				old, err := s.getSetLocal(uid, args[0], []byte(args[1]), 0)
+				resp.Old, resp.Existed = string(old), err == nil
+				if err == cache.ErrKeyNotFound {
+					return nil
+				}
+				return err
+			})
+			s.finishOp(opSet, "tcp GETSET", uid, args[0], start)
+			if err == cache.ErrValueTooLarge || err == errClusterNotReady {
+				writeErr(err.Error())
+			} else if err != nil {
+				writeErr("internal")
+			} else if !resp.Existed {
+				write("NIL")
+			} else if framed {
+				writeFramedValue(w, []byte(resp.Old))
+			} else {
+				write("VALUE %s", resp.Old)
+			}
+
+		case "INCR", "DECR":
+			// INCR <key> [delta] (auth) or INCR <user> <key> [delta]
+			var uid, key string
+			args := toks[1:]
+			if authUser != "" {
+				uid = authUser
+			} else if len(args) >= 2 {
+				uid, args = args[0], args[1:]
+			}
+			if uid == "" || len(args) < 1 || len(args) > 2 {
+				writeErr("usage: " + cmd + " <key> [delta] or " + cmd + " <user> <key> [delta]")
+				continue
+			}
+			key = args[0]
+			delta := int64(1)
+			if len(args) == 2 {
+				d, err := strconv.ParseInt(args[1], 10, 64)
+				if err != nil {
+					writeErr("delta must be an integer")
+					continue
+				}
+				delta = d
+			}
+
+			// on the key's owner, like POST /v1/incr, so the result is replicated
+			start := time.Now()
+			var resp incrResponse
+			err := s.writeOwned(ctx, uid, key, "/v1/"+strings.ToLower(cmd), incrRequest{Key: key, Delta: &delta}, &resp, func() (err error) {
+				resp.Value, err = s.incrLocal(uid, key, delta, cmd == "DECR")
+				return err
+			})
+			s.finishOp(opSet, "tcp "+cmd, uid, key, start)
+			if err != nil {
+				if err == cache.ErrNotInteger || err == cache.ErrIntegerOverflow || err == cache.ErrUserNotFound || err == errClusterNotReady {
+					writeErr(err.Error())
+				} else {
+					writeErr("internal")
+				}
+			} else {
+				write("VALUE %d", resp.Value)
 			}
 
 		case "GET":
@@ -208,13 +503,34 @@ func (s *Server) handleConn(conn net.Conn) {
 				key = toks[2]
 			}
 
-			val, err := s.cache.Get(uid, key)
+			start := time.Now()
+			val, err := s.getOwned(uid, key)
+			s.finishOp(opGet, "tcp GET", uid, key, start)
+			fullLen := len(val)
+			truncated := false
+			if max := s.cfg.MaxResponseBytes; err == nil && max > 0 && fullLen > max {
+				if s.cfg.ResponseCapPolicy != ResponseCapTruncate {
+					writeErr("value too large")
+					continue
+				}
+				val, truncated = val[:max], true
+			}
 			if err != nil {
 				if err == cache.ErrUserNotFound || err == cache.ErrKeyNotFound {
 					writeErr(err.Error())
 				} else {
 					writeErr("internal")
 				}
+			} else if truncated {
+				// announce the full size, then the usual reply with the first MaxResponseBytes
+				write("TRUNCATED %d", fullLen)
+				if framed {
+					writeFramedValue(w, val)
+				} else {
+					write("VALUE %s", string(val))
+				}
+			} else if framed {
+				writeFramedValue(w, val)
 			} else {
 				write("VALUE %s", string(val))
 			}
@@ -238,7 +554,10 @@ func (s *Server) handleConn(conn net.Conn) {
 				key = toks[2]
 			}
 
-			if err := s.cache.Delete(uid, key); err != nil {
+			start := time.Now()
+			err := s.cache.Delete(uid, key)
+			s.finishOp(opDelete, "tcp DELETE", uid, key, start)
+			if err != nil {
 				if err == cache.ErrUserNotFound {
 					writeErr("user not found")
 				} else {
@@ -249,58 +568,199 @@ func (s *Server) handleConn(conn net.Conn) {
 			}
 
 		case "KEYS":
-			// KEYS (auth) or KEYS <user>
-			var uid string
+			// KEYS [pattern] (auth) or KEYS <user> [pattern]
+			var uid, pattern string
 			if authUser != "" {
+				if len(toks) > 2 {
+					writeErr("usage: KEYS [pattern]")
+					continue
+				}
 				uid = authUser
+				if len(toks) == 2 {
+					pattern = toks[1]
+				}
 			} else {
-				if len(toks) != 2 {
-					writeErr("usage: KEYS <user>")
+				if len(toks) < 2 || len(toks) > 3 {
+					writeErr("usage: KEYS <user> [pattern]")
 					continue
 				}
 				uid = toks[1]
+				if len(toks) == 3 {
+					pattern = toks[2]
+				}
+			}
+			// every node's share; nodes that don't answer are named on a PARTIAL line first
+			keys, found, failed := s.keysCluster(ctx, s.cfg.CmdTimeout, uid, pattern)
+			if !found && len(failed) == 0 {
+				writeErr("user not found")
+				continue
+			}
+			if len(failed) > 0 {
+				write("PARTIAL %s", failedNodeIDs(failed))
+			}
+			write("KEYS %s", strings.Join(keys, ","))
+
+		case "TTL":
+			// TTL <key> (auth) or TTL <user> <key>; seconds left, -1 = no expiry
+			var uid, key string
+			if authUser != "" && len(toks) == 2 {
+				uid, key = authUser, toks[1]
+			} else if len(toks) == 3 {
+				uid, key = toks[1], toks[2]
+			} else {
+				writeErr("usage: TTL <key> or TTL <user> <key>")
+				continue
 			}
-			keys, err := s.cache.ListKeys(uid)
+			if denied(uid) {
+				continue
+			}
+			left, err := s.cache.TTL(uid, key)
 			if err != nil {
-				if err == cache.ErrUserNotFound {
-					writeErr("user not found")
+				if err == cache.ErrUserNotFound || err == cache.ErrKeyNotFound {
+					writeErr(err.Error())
 				} else {
 					writeErr("internal")
 				}
 			} else {
-				write("KEYS %s", strings.Join(keys, ","))
+				write("TTL %d", ttlSeconds(left))
 			}
 
-		case "SNAPSHOT":
-			// SNAPSHOT <userID>  or SNAPSHOT (with AUTH)
+		case "EXPIRE":
+			// EXPIRE <key> <seconds> (auth) or EXPIRE <user> <key> <seconds>; <= 0 deletes
 			var uid string
+			args := toks[1:]
 			if authUser != "" {
 				uid = authUser
+			} else if len(args) == 3 {
+				uid, args = args[0], args[1:]
+			}
+			if uid == "" || len(args) != 2 {
+				writeErr("usage: EXPIRE <key> <seconds> or EXPIRE <user> <key> <seconds>")
+				continue
+			}
+			secs, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				writeErr("seconds must be an integer")
+				continue
+			}
+
+			// on the key's owner, like POST /v1/expire, so replicas get the new expiry
+			start := time.Now()
+			ms := secs * 1000
+			ttl := time.Duration(secs) * time.Second
+			err = s.writeOwned(ctx, uid, args[0], "/v1/expire", expireRequest{Key: args[0], TTLMs: &ms}, nil, func() error {
+				return s.expireLocal(uid, args[0], ttl, false)
+			})
+			s.finishOp(opSet, "tcp EXPIRE", uid, args[0], start)
+			if err != nil {
+				if err == cache.ErrUserNotFound || err == cache.ErrKeyNotFound || err == errClusterNotReady {
+					writeErr(err.Error())
+				} else {
+					writeErr("internal")
+				}
+			} else {
+				write("OK")
+			}
+
+		case "PERSIST":
+			// PERSIST <key> (auth) or PERSIST <user> <key>
+			var uid, key string
+			if authUser != "" && len(toks) == 2 {
+				uid, key = authUser, toks[1]
+			} else if len(toks) == 3 {
+				uid, key = toks[1], toks[2]
+			} else {
+				writeErr("usage: PERSIST <key> or PERSIST <user> <key>")
+				continue
+			}
+			if denied(uid) {
+				continue
+			}
+
+			start := time.Now()
+			err := s.writeOwned(ctx, uid, key, "/v1/persist", expireRequest{Key: key}, nil, func() error {
+				return s.expireLocal(uid, key, 0, true)
+			})
+			s.finishOp(opSet, "tcp PERSIST", uid, key, start)
+			if err != nil {
+				if err == cache.ErrUserNotFound || err == cache.ErrKeyNotFound || err == errClusterNotReady {
+					writeErr(err.Error())
+				} else {
+					writeErr("internal")
+				}
+			} else {
+				write("OK")
+			}
+
+		case "STATS":
+			// STATS (auth) or STATS <user>; counters on this node only
+			var uid string
+			if authUser != "" && len(toks) == 1 {
+				uid = authUser
 			} else if len(toks) == 2 {
 				uid = toks[1]
 			} else {
-				writeErr("usage: SNAPSHOT <user>")
+				writeErr("usage: STATS <user> or AUTH + STATS")
 				continue
 			}
-			snap, err := s.cache.SnapshotUser(uid)
-
+			if denied(uid) {
+				continue
+			}
+			st, err := s.cache.UserStats(uid)
 			if err != nil {
 				if err == cache.ErrUserNotFound {
 					writeErr("user not found")
 				} else {
 					writeErr("internal")
 				}
-				cancel()
+			} else {
+				write("STATS entries=%d bytes=%d hits=%d misses=%d evictions=%d",
+					st.Entries, st.Bytes, st.Hits, st.Misses, st.Evictions)
+			}
+
+		case "FLUSH":
+			// FLUSH (requires AUTH): remove all of the user's keys on every node
+			if authUser == "" {
+				writeErr("FLUSH requires AUTH")
 				continue
 			}
-			if _, err := s.cache.SaveUserToFile(snap); err != nil {
-				writeErr("save failed")
+			if len(toks) != 1 {
+				writeErr("usage: FLUSH")
+				continue
+			}
+
+			_, failed := s.flushCluster(ctx, authUser)
+			if len(failed) > 0 {
+				writeErr("flush failed on " + failedNodeIDs(failed))
 			} else {
 				write("OK")
 			}
 
+		case "SNAPSHOT":
+			// SNAPSHOT <userID>  or SNAPSHOT (with AUTH)
+			// a user's keys are spread over the ring, so every node saves its share
+			var uid string
+			if authUser != "" {
+				uid = authUser
+			} else if len(toks) == 2 {
+				uid = toks[1]
+			} else {
+				writeErr("usage: SNAPSHOT <user>")
+				continue
+			}
+
+			start := time.Now()
+			results, failed := s.snapshotCluster(ctx, uid, false)
+			s.finishOp(opSnapshot, "tcp SNAPSHOT", uid, "", start)
+			if len(failed) > 0 {
+				writeErr("snapshot failed on " + failedNodeIDs(failed))
+			} else {
+				write("OK nodes=%d", len(results))
+			}
+
 		case "RESTORE":
 			// RESTORE <userID>
+			// every node restores its own share from its own snapshot
 			var uid string
 			if authUser != "" && len(toks) == 1 {
 				uid = authUser
@@ -308,19 +768,25 @@ func (s *Server) handleConn(conn net.Conn) {
 				uid = toks[1]
 			} else {
 				writeErr("usage: RESTORE <userID> or AUTH + RESTORE")
-				cancel()
 				continue
 			}
-			snap, err := s.cache.LoadUserFromFile(uid)
-			if err != nil {
-				writeErr("snapshot not found")
-				cancel()
+			if denied(uid) {
 				continue
 			}
-			if err := s.cache.RestoreUserFromSnapshot(snap); err != nil {
-				writeErr("restore failed")
+
+			results, failed := s.snapshotCluster(ctx, uid, true)
+			if len(failed) > 0 {
+				writeErr("restore failed on " + failedNodeIDs(failed))
+				continue
+			}
+			keys := 0
+			for _, r := range results {
+				keys += r.Keys
+			}
+			if keys == 0 {
+				writeErr("snapshot not found")
 			} else {
-				write("OK")
+				write("OK nodes=%d", len(results))
 			}
 
 		default:
@@ -330,3 +796,28 @@ func (s *Server) handleConn(conn net.Conn) {
 		cancel()
 	}
 }
+
+// pendingCommand reports whether r already holds a complete command line, i.e. the
+// client pipelined another command and the next read won't block.
+func pendingCommand(r *bufio.Reader) bool {
+	buf, _ := r.Peek(r.Buffered())
+	return bytes.IndexByte(buf, '\n') >= 0
+}
+
+// isTCPWriteCommand reports whether cmd mutates the cache (rejected in read-only mode).
+func isTCPWriteCommand(cmd string) bool {
+	switch cmd {
+	case "CREATEUSER", "DELETEUSER", "SET", "DELETE", "RESTORE", "INCR", "DECR", "SETNX", "GETSET", "EXPIRE", "PERSIST", "MSET", "FLUSH":
+		return true
+	}
+	return false
+}
+
+// isTCPDataCommand reports whether cmd reads or writes keys (which need a routable ring).
+func isTCPDataCommand(cmd string) bool {
+	switch cmd {
+	case "SET", "GET", "DELETE", "INCR", "DECR", "SETNX", "GETSET", "TTL", "EXPIRE", "PERSIST", "MSET", "MGET":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+// Plain-line commands are split on whitespace, except inside double quotes, so a
+// value with spaces can be sent without framing:
+//
+//	SET k "hello world"
+//	SET k "say \"hi\"\n"
+//
+// Inside quotes a backslash escapes the next character: \n, \r and \t are control
+// characters, anything else (\" and \\ included) stands for itself. Outside quotes
+// backslashes and quotes in the middle of a word are literal, so existing unquoted
+// commands parse as before. "" is an empty argument.
+
+var (
+	errUnbalancedQuotes = errors.New("unbalanced quotes")
+	errQuoteNotSpaced   = errors.New("closing quote must be followed by a space")
+)
+
+// splitArgs tokenizes a plain-line command.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isArgSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		if line[i] != '"' {
+			start := i
+			for i < len(line) && !isArgSpace(line[i]) {
+				i++
+			}
+			args = append(args, line[start:i])
+			continue
+		}
+
+		// quoted argument
+		var b strings.Builder
+		i++
+		for {
+			if i == len(line) {
+				return nil, errUnbalancedQuotes
+			}
+			c := line[i]
+			if c == '"' {
+				i++
+				break
+			}
+			if c == '\\' && i+1 < len(line) {
+				i++
+				switch c = line[i]; c {
+				case 'n':
+					c = '\n'
+				case 'r':
+					c = '\r'
+				case 't':
+					c = '\t'
+				}
+			}
+			b.WriteByte(c)
+			i++
+		}
+		if i < len(line) && !isArgSpace(line[i]) {
+			return nil, errQuoteNotSpaced
+		}
+		args = append(args, b.String())
+	}
+}
+
+func isArgSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\v' || c == '\f'
+}
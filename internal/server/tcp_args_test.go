@@ -0,0 +1,67 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    []string
+		wantErr error
+	}{
+		{line: "SET k v", want: []string{"SET", "k", "v"}},
+		{line: "  SET\tk   v  ", want: []string{"SET", "k", "v"}},
+		{line: "", want: nil},
+		{line: `SET k "hello world"`, want: []string{"SET", "k", "hello world"}},
+		{line: `SET "my key" "a  b" 60`, want: []string{"SET", "my key", "a  b", "60"}},
+		{line: `SET k "say \"hi\""`, want: []string{"SET", "k", `say "hi"`}},
+		{line: `SET k "a\\b"`, want: []string{"SET", "k", `a\b`}},
+		{line: `SET k "one\ntwo\tx\r"`, want: []string{"SET", "k", "one\ntwo\tx\r"}},
+		{line: `SET k "\q"`, want: []string{"SET", "k", "q"}},
+		{line: `SET k ""`, want: []string{"SET", "k", ""}},
+		// outside quotes nothing is special, as before
+		{line: `SET k C:\dir\file`, want: []string{"SET", "k", `C:\dir\file`}},
+		{line: `SET k it"s`, want: []string{"SET", "k", `it"s`}},
+		{line: `SET k "open`, wantErr: errUnbalancedQuotes},
+		{line: `SET k "ends in backslash\`, wantErr: errUnbalancedQuotes},
+		{line: `SET k "a"b`, wantErr: errQuoteNotSpaced},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := splitArgs(tt.line)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("args = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotedArgsOverTCP(t *testing.T) {
+	n := startNode(t, ServerConfig{})
+	c := dialTCP(t, n.tcp)
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{cmd: `SET alice k "hello world"`, want: "OK CREATED"},
+		{cmd: `GET alice k`, want: "VALUE hello world"},
+		{cmd: `SET alice "my key" "say \"hi\""`, want: "OK CREATED"},
+		{cmd: `GET alice "my key"`, want: `VALUE say "hi"`},
+		{cmd: `DELETE alice "my key"`, want: "OK"},
+		{cmd: `GET alice "my key"`, want: "ERR key not found"},
+		{cmd: `SET alice plain value`, want: "OK CREATED"},
+		{cmd: `GET alice plain`, want: "VALUE value"},
+		{cmd: `SET alice k "unterminated`, want: "ERR unbalanced quotes"},
+	}
+	for _, tt := range tests {
+		if got := c.cmd(t, tt.cmd); got != tt.want {
+			t.Fatalf("%s = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
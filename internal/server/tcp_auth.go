@@ -0,0 +1,52 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// With ServerConfig.RequireAuth, line-protocol and RESP connections must send
+// AUTH <userID> <password> before anything but PING and QUIT, and then act only as
+// that user. A user's password is its entry in AuthUsers, or AuthSecret for users
+// without one. Passwords are kept only as salted SHA-256 digests and are never logged.
+
+// authStore checks AUTH credentials.
+type authStore struct {
+	salt   [16]byte
+	shared []byte            // digest of AuthSecret; nil if unset
+	users  map[string][]byte // normalized user ID -> digest
+}
+
+// newAuthStore hashes the configured passwords; normalize maps user IDs the way the
+// cache does.
+func newAuthStore(shared string, users map[string]string, normalize func(string) string) *authStore {
+	a := &authStore{users: make(map[string][]byte, len(users))}
+	_, _ = rand.Read(a.salt[:])
+	if shared != "" {
+		a.shared = a.digest(shared)
+	}
+	for uid, pw := range users {
+		a.users[normalize(uid)] = a.digest(pw)
+	}
+	return a
+}
+
+func (a *authStore) digest(password string) []byte {
+	h := sha256.New()
+	h.Write(a.salt[:])
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+// check reports whether password is valid for the (normalized) user ID.
+func (a *authStore) check(userID, password string) bool {
+	want, ok := a.users[userID]
+	if !ok {
+		want = a.shared
+	}
+	if want == nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(a.digest(password), want) == 1
+}
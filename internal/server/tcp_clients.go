@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tcpClient is the live state of one TCP connection.
+type tcpClient struct {
+	id          int64
+	remoteAddr  string
+	connectedAt time.Time
+	commands    atomic.Int64
+
+	mu   sync.Mutex
+	user string
+}
+
+func (c *tcpClient) setUser(user string) {
+	c.mu.Lock()
+	c.user = user
+	c.mu.Unlock()
+}
+
+// clientInfo is the introspection view of a TCP connection.
+type clientInfo struct {
+	ID          int64     `json:"id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	User        string    `json:"user,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Commands    int64     `json:"commands"`
+}
+
+func (c *tcpClient) info() clientInfo {
+	c.mu.Lock()
+	user := c.user
+	c.mu.Unlock()
+	return clientInfo{
+		ID:          c.id,
+		RemoteAddr:  c.remoteAddr,
+		User:        user,
+		ConnectedAt: c.connectedAt,
+		Commands:    c.commands.Load(),
+	}
+}
+
+// clientRegistry tracks active TCP connections. Safe for concurrent use.
+type clientRegistry struct {
+	mu      sync.Mutex
+	nextID  int64
+	clients map[int64]*tcpClient
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{clients: make(map[int64]*tcpClient)}
+}
+
+func (cr *clientRegistry) register(conn net.Conn) *tcpClient {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.nextID++
+	c := &tcpClient{
+		id:          cr.nextID,
+		remoteAddr:  conn.RemoteAddr().String(),
+		connectedAt: time.Now(),
+	}
+	cr.clients[c.id] = c
+	return c
+}
+
+func (cr *clientRegistry) unregister(id int64) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	delete(cr.clients, id)
+}
+
+// list returns active connections ordered by id.
+func (cr *clientRegistry) list() []clientInfo {
+	cr.mu.Lock()
+	clients := make([]*tcpClient, 0, len(cr.clients))
+	for _, c := range cr.clients {
+		clients = append(clients, c)
+	}
+	cr.mu.Unlock()
+
+	out := make([]clientInfo, 0, len(clients))
+	for _, c := range clients {
+		out = append(out, c.info())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Framed commands let clients send arguments containing whitespace or binary data.
+// A framed command starts with "*<argc>" on its own line, followed by each argument
+// as "$<len>" on its own line and exactly <len> raw bytes plus a line terminator:
+//
+//	*3
+//	$3
+//	SET
+//	$5
+//	my key
+//	...
+//
+// Simple commands (PING, QUIT, ...) can keep using the plain line protocol.
+const (
+	maxFramedArgs  = 1024
+	maxFramedBytes = 64 << 20 // all arguments of one command together, 64 MiB
+
+	framedReadChunk = 64 << 10 // initial buffer for an argument
+)
+
+var errBadFrame = errors.New("malformed framed command")
+
+// isFramedHeader reports whether line starts a framed command.
+func isFramedHeader(line string) bool {
+	return strings.HasPrefix(line, "*")
+}
+
+// readFramedArgs reads the arguments announced by header ("*<argc>") from r. The
+// arguments may total at most maxFramedBytes.
+func readFramedArgs(r *bufio.Reader, header string) ([]string, error) {
+	argc, err := strconv.Atoi(strings.TrimPrefix(header, "*"))
+	if err != nil || argc <= 0 || argc > maxFramedArgs {
+		return nil, errBadFrame
+	}
+
+	args := make([]string, 0, argc)
+	remaining := maxFramedBytes
+	for i := 0; i < argc; i++ {
+		lenLine, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		lenLine = strings.TrimSpace(lenLine)
+		if !strings.HasPrefix(lenLine, "$") {
+			return nil, errBadFrame
+		}
+		n, err := strconv.Atoi(lenLine[1:])
+		// checked before reading, so a client can't reserve argc×64 MiB up front
+		if err != nil || n < 0 || n > remaining {
+			return nil, errBadFrame
+		}
+		remaining -= n
+
+		// grow with the bytes that actually arrive rather than allocating n at once
+		var arg strings.Builder
+		arg.Grow(min(n, framedReadChunk))
+		if _, err := io.CopyN(&arg, r, int64(n)); err != nil {
+			return nil, err
+		}
+		if err := readLineEnd(r); err != nil {
+			return nil, err
+		}
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// readLineEnd consumes a "\n" or "\r\n" terminator after a framed argument.
+func readLineEnd(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == '\r' {
+		if b, err = r.ReadByte(); err != nil {
+			return err
+		}
+	}
+	if b != '\n' {
+		return errBadFrame
+	}
+	return nil
+}
+
+// writeFramedValue writes a binary-safe value reply: "$<len>\n<bytes>\n". Like other
+// replies it is flushed by the connection loop.
+func writeFramedValue(w *bufio.Writer, val []byte) {
+	fmt.Fprintf(w, "$%d\n", len(val))
+	w.Write(val)
+	w.WriteByte('\n')
+}
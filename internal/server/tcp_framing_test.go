@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReadFramedArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "plain", header: "*2", body: "$3\nGET\n$1\nk\n", want: []string{"GET", "k"}},
+		{name: "crlf", header: "*2", body: "$3\r\nGET\r\n$1\r\nk\r\n", want: []string{"GET", "k"}},
+		{name: "spaces and newlines", header: "*3", body: "$3\nSET\n$6\nmy key\n$4\na\nb\n\n", want: []string{"SET", "my key", "a\nb\n"}},
+		{name: "empty argument", header: "*2", body: "$3\nGET\n$0\n\n", want: []string{"GET", ""}},
+		{name: "zero args", header: "*0", wantErr: true},
+		{name: "bad count", header: "*x", wantErr: true},
+		{name: "too many args", header: "*1025", wantErr: true},
+		{name: "missing length line", header: "*1", body: "GET\n", wantErr: true},
+		{name: "negative length", header: "*1", body: "$-1\n\n", wantErr: true},
+		{name: "argument over the cap", header: "*1", body: "$67108865\n", wantErr: true},
+		{name: "short argument", header: "*1", body: "$5\nGET", wantErr: true},
+		{name: "no terminator", header: "*1", body: "$3\nGETX", wantErr: true},
+	}
+	t.Run("frame over the total cap", func(t *testing.T) {
+		// the second length alone fits, but not on top of the first: it is rejected
+		// before anything is allocated or read for it
+		half := maxFramedBytes/2 + 1
+		body := io.MultiReader(
+			strings.NewReader("$"+strconv.Itoa(half)+"\n"),
+			io.LimitReader(zeros{}, int64(half)),
+			strings.NewReader("\n$"+strconv.Itoa(half)+"\n"),
+		)
+		if _, err := readFramedArgs(bufio.NewReader(body), "*2"); err != errBadFrame {
+			t.Fatalf("err = %v, want errBadFrame", err)
+		}
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readFramedArgs(bufio.NewReader(strings.NewReader(tt.body)), tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("args = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFramedSetAndGet(t *testing.T) {
+	n := startNode(t, ServerConfig{})
+	c := dialTCP(t, n.tcp)
+	tests := []struct {
+		name  string
+		key   string
+		value string
+	}{
+		{name: "spaces", key: "my key", value: "hello world"},
+		{name: "newlines", key: "k2", value: "line one\nline two\n"},
+		{name: "binary", key: "k3", value: "\x00\xff\r\n\x01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := func(args ...string) string {
+				out := "*" + strconv.Itoa(len(args)) + "\n"
+				for _, a := range args {
+					out += "$" + strconv.Itoa(len(a)) + "\n" + a + "\n"
+				}
+				return strings.TrimSuffix(out, "\n")
+			}
+			if got := c.cmd(t, frame("SET", "alice", tt.key, tt.value)); got != "OK CREATED" {
+				t.Fatalf("framed SET = %q", got)
+			}
+			if got := c.cmd(t, frame("GET", "alice", tt.key)); got != "$"+strconv.Itoa(len(tt.value)) {
+				t.Fatalf("framed GET header = %q", got)
+			}
+			buf := make([]byte, len(tt.value)+1)
+			if _, err := io.ReadFull(c.r, buf); err != nil {
+				t.Fatalf("read value: %v", err)
+			}
+			if got := string(buf[:len(tt.value)]); got != tt.value {
+				t.Fatalf("framed GET = %q, want %q", got, tt.value)
+			}
+		})
+	}
+}
+
+// zeros is an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+)
+
+func TestClientList(t *testing.T) {
+	n := startNode(t, ServerConfig{})
+	c1 := dialTCP(t, n.tcp)
+	if got := c1.cmd(t, "AUTH alice"); got != "ok" {
+		t.Fatalf("AUTH = %q", got)
+	}
+	c1.cmd(t, "GET k")
+	c2 := dialTCP(t, n.tcp)
+	c2.cmd(t, "PING")
+
+	tests := []struct {
+		name string
+		list func(t *testing.T) []clientInfo
+	}{
+		{name: "CLIENT LIST", list: func(t *testing.T) []clientInfo {
+			header := c2.cmd(t, "CLIENT LIST")
+			count, err := strconv.Atoi(strings.TrimPrefix(header, "CLIENTS "))
+			if err != nil {
+				t.Fatalf("CLIENT LIST = %q", header)
+			}
+			var out []clientInfo
+			for i := 0; i < count; i++ {
+				fields := make(map[string]string)
+				for _, f := range strings.Fields(c2.line(t)) {
+					k, v, _ := strings.Cut(f, "=")
+					fields[k] = v
+				}
+				id, _ := strconv.ParseInt(fields["id"], 10, 64)
+				cmds, _ := strconv.ParseInt(fields["cmds"], 10, 64)
+				out = append(out, clientInfo{ID: id, RemoteAddr: fields["addr"], User: fields["user"], Commands: cmds})
+			}
+			return out
+		}},
+		{name: "admin connections", list: func(t *testing.T) []clientInfo {
+			code, body := n.do(t, http.MethodGet, "/v1/admin/connections", "", nil)
+			var resp connectionsResponse
+			if err := json.Unmarshal(body, &resp); code != http.StatusOK || err != nil {
+				t.Fatalf("connections = %d %s", code, body)
+			}
+			return resp.Connections
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.list(t)
+			if len(got) != 2 {
+				t.Fatalf("listed %d connections, want 2: %+v", len(got), got)
+			}
+			if got[0].User != "alice" || got[0].Commands < 2 || got[0].ID >= got[1].ID {
+				t.Fatalf("first connection = %+v, want alice's with 2+ commands, ordered by id", got[0])
+			}
+			if got[1].User != "" || got[1].Commands < 1 {
+				t.Fatalf("second connection = %+v, want an anonymous one with 1+ commands", got[1])
+			}
+		})
+	}
+
+	c2.conn.Close()
+	waitFor(t, 2*time.Second, func() bool { return len(n.s.clients.list()) == 1 })
+}
+
+func TestNormalizedUserIDsAcrossProtocols(t *testing.T) {
+	cc := testCacheConfig(t)
+	cc.NormalizeUserID = strings.ToLower
+	n := startNodeWithCache(t, ServerConfig{}, cache.NewCache(cc))
+	n.set(t, "Alice", "k", "v")
+
+	tests := []struct {
+		name string
+		user string
+	}{
+		{name: "as written", user: "Alice"},
+		{name: "lowercase", user: "alice"},
+		{name: "uppercase", user: "ALICE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, v := n.get(t, tt.user, "k"); code != http.StatusOK || v != "v" {
+				t.Fatalf("http get as %s = %d %q", tt.user, code, v)
+			}
+			c := dialTCP(t, n.tcp)
+			if got := c.cmd(t, "AUTH "+tt.user); got != "ok" {
+				t.Fatalf("auth: %q", got)
+			}
+			if got := c.cmd(t, "GET k"); got != "VALUE v" {
+				t.Fatalf("tcp GET as %s = %q", tt.user, got)
+			}
+		})
+	}
+	if users, _ := n.c.ListUsersMatch("*"); len(users) != 1 || users[0] != "alice" {
+		t.Fatalf("users = %v, want [alice]", users)
+	}
+}
+
+func TestFlushClearsEveryNode(t *testing.T) {
+	tests := []struct {
+		name  string
+		flush func(t *testing.T, n *testNode) // flushes alice through n
+	}{
+		{name: "http", flush: func(t *testing.T, n *testNode) {
+			if code, body := n.do(t, http.MethodPost, "/v1/flush", "alice", nil); code != http.StatusOK {
+				t.Fatalf("flush = %d %s", code, body)
+			}
+		}},
+		{name: "tcp", flush: func(t *testing.T, n *testNode) {
+			c := dialTCP(t, n.tcp)
+			if got := c.cmd(t, "FLUSH"); got != "ERR FLUSH requires AUTH" {
+				t.Fatalf("FLUSH without AUTH = %q", got)
+			}
+			if got := c.cmd(t, "AUTH alice"); got != "ok" {
+				t.Fatalf("auth: %q", got)
+			}
+			if got := c.cmd(t, "FLUSH"); got != "OK" {
+				t.Fatalf("FLUSH = %q", got)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes := startCluster(t, 2, ServerConfig{})
+			var keys []string
+			for _, n := range nodes {
+				key := keyOwnedBy(t, nodes[0], "alice", n.s.cluster.Self().ID)
+				keys = append(keys, key)
+				nodes[0].set(t, "alice", key, "v")
+			}
+			nodes[0].set(t, "bob", "k", "v")
+			for i, n := range nodes {
+				waitFor(t, 2*time.Second, func() bool { return n.holds("alice", keys[i]) })
+			}
+
+			tt.flush(t, nodes[1])
+
+			for _, n := range nodes {
+				for _, k := range keys {
+					if n.holds("alice", k) {
+						t.Fatalf("node %s still holds %s", n.s.cluster.Self().ID, k)
+					}
+				}
+				if _, err := n.c.UserStats("alice"); err != nil {
+					t.Fatalf("node %s dropped the user", n.s.cluster.Self().ID)
+				}
+			}
+			if code, v := nodes[0].get(t, "bob", "k"); code != http.StatusOK || v != "v" {
+				t.Fatalf("bob/k = %d %q after flushing alice", code, v)
+			}
+		})
+	}
+}
+
+// BenchmarkTCPPipeline sends 10k SETs in one write, then reads the 10k replies.
+func TestTCPRequireAuth(t *testing.T) {
+	n := startNode(t, ServerConfig{
+		RequireAuth: true,
+		AuthSecret:  "shared",
+		AuthUsers:   map[string]string{"alice": "s3cret"},
+	})
+	if n.s.cfg.AuthSecret != "" || n.s.cfg.AuthUsers != nil {
+		t.Fatalf("plaintext secrets kept in config")
+	}
+	c := dialTCP(t, n.tcp)
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{cmd: "PING", want: "PONG"},
+		{cmd: "SET alice k v", want: "ERR authentication required"},
+		{cmd: "GET alice k", want: "ERR authentication required"},
+		{cmd: "AUTH alice", want: "ERR invalid credentials"},
+		{cmd: "AUTH alice wrong", want: "ERR invalid credentials"},
+		{cmd: "AUTH alice shared", want: "ERR invalid credentials"}, // alice has her own password
+		{cmd: "GET k", want: "ERR authentication required"},
+		{cmd: "AUTH alice s3cret", want: "ok"},
+		{cmd: "SET k v", want: "OK CREATED"},
+		{cmd: "GET k", want: "VALUE v"},
+		{cmd: "AUTH alice wrong", want: "ERR invalid credentials"},
+		{cmd: "GET k", want: "VALUE v"}, // a failed AUTH keeps the previous user
+		{cmd: "TTL bob k", want: "ERR permission denied"},
+		{cmd: "DELETEUSER bob", want: "ERR permission denied"},
+		{cmd: "AUTH bob shared", want: "ok"},
+		{cmd: "GET k", want: "ERR user not found"},
+		{cmd: "QUIT", want: "BYE"},
+	}
+	for _, tt := range tests {
+		if got := c.cmd(t, tt.cmd); got != tt.want {
+			t.Fatalf("%s = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+// scriptedListener returns the queued Accept results in order, then net.ErrClosed.
+type scriptedListener struct {
+	net.Listener
+	results []error // nil accepts a connection
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	if len(l.results) == 0 {
+		return nil, net.ErrClosed
+	}
+	err := l.results[0]
+	l.results = l.results[1:]
+	if err != nil {
+		return nil, err
+	}
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func TestServeListener(t *testing.T) {
+	s, err := NewServer(cache.NewCache(testCacheConfig(t)), ServerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(ln net.Listener) (handled []net.Conn, elapsed time.Duration) {
+		t.Helper()
+		done := make(chan struct{})
+		var mu sync.Mutex
+		start := time.Now()
+		go func() {
+			defer close(done)
+			s.serveListener(ln, "test", func(c net.Conn) {
+				mu.Lock()
+				handled = append(handled, c)
+				mu.Unlock()
+				c.Close()
+			})
+		}()
+		if ln, ok := ln.(*net.TCPListener); ok {
+			time.Sleep(20 * time.Millisecond)
+			ln.Close()
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("accept loop did not exit")
+		}
+		s.conns.wg.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		return handled, time.Since(start)
+	}
+
+	t.Run("closed listener", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if handled, _ := serve(ln); len(handled) != 0 {
+			t.Fatalf("handled %d connections", len(handled))
+		}
+	})
+
+	t.Run("transient errors back off", func(t *testing.T) {
+		transient := errors.New("too many open files")
+		ln := &scriptedListener{results: []error{transient, transient, nil, transient}}
+		handled, elapsed := serve(ln)
+		if len(handled) != 1 || handled[0] == nil {
+			t.Fatalf("handled %v, want one connection", handled)
+		}
+		// 5ms + 10ms, then reset by the accepted connection, then 5ms
+		if elapsed < 3*acceptBackoffMin {
+			t.Fatalf("loop returned after %v, expected backoff", elapsed)
+		}
+	})
+}
+
+func BenchmarkTCPPipeline(b *testing.B) {
+	const batch = 10_000
+	n := startNode(b, ServerConfig{})
+	c := dialTCP(b, n.tcp)
+	if got := c.cmd(b, "AUTH alice"); got != "ok" {
+		b.Fatalf("AUTH = %q", got)
+	}
+	var req strings.Builder
+	for i := 0; i < batch; i++ {
+		req.WriteString("SET k" + strconv.Itoa(i) + " value\n")
+	}
+	payload := []byte(req.String())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = c.conn.SetDeadline(time.Now().Add(time.Minute))
+		go c.conn.Write(payload)
+		for j := 0; j < batch; j++ {
+			if reply := c.line(b); !strings.HasPrefix(reply, "OK") {
+				b.Fatalf("reply %d = %q", j, reply)
+			}
+		}
+	}
+	b.ReportMetric(float64(b.N*batch)/b.Elapsed().Seconds(), "cmds/s")
+}
+
+// TestTCPWritesReachOwnerAndReplicas sends each write to a node that doesn't own the
+// key and checks that every replica ends up with the owner's result.
+func TestTCPWritesReachOwnerAndReplicas(t *testing.T) {
+	nodes := startCluster(t, 3, ServerConfig{ReplicationFactor: 3})
+	tests := []struct {
+		name     string
+		setup    string // value written through HTTP first; "" = none
+		setupTTL int64  // seconds
+		cmd      string // %s is replaced by "<user> <key>"
+		reply    string
+		value    string
+		expiring bool
+	}{
+		{name: "incr", setup: "41", cmd: "INCR %s", reply: "VALUE 42", value: "42"},
+		{name: "decr", cmd: "DECR %s 5", reply: "VALUE -5", value: "-5"},
+		{name: "setnx", cmd: "SETNX %s v", reply: "OK", value: "v"},
+		{name: "setnx existing", setup: "old", cmd: "SETNX %s v", reply: "EXISTS", value: "old"},
+		{name: "getset", setup: "old", cmd: "GETSET %s new", reply: "VALUE old", value: "new"},
+		{name: "getset missing", cmd: "GETSET %s new", reply: "NIL", value: "new"},
+		{name: "expire", setup: "v", cmd: "EXPIRE %s 100", reply: "OK", value: "v", expiring: true},
+		{name: "persist", setup: "v", setupTTL: 100, cmd: "PERSIST %s", reply: "OK", value: "v"},
+		{name: "mset", cmd: "MSET %s v", reply: "OK 1", value: "v"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := "tcp-" + strings.ReplaceAll(tt.name, " ", "-")
+			key := keyOwnedBy(t, nodes[0], user, "b")
+			if tt.setup != "" {
+				body := map[string]any{"key": key, "value": tt.setup, "ttl_second": tt.setupTTL}
+				if code, resp := nodes[1].do(t, http.MethodPost, "/v1/set", user, body); code != http.StatusOK {
+					t.Fatalf("set = %d %s", code, resp)
+				}
+			}
+
+			c := dialTCP(t, nodes[0].tcp)
+			if got := c.cmd(t, strings.Replace(tt.cmd, "%s", user+" "+key, 1)); got != tt.reply {
+				t.Fatalf("reply = %q, want %q", got, tt.reply)
+			}
+			waitFor(t, 2*time.Second, func() bool {
+				for _, n := range nodes {
+					item, err := n.c.Peek(user, key)
+					if err != nil || string(item.Value) != tt.value || item.ExpiresAt.IsZero() == tt.expiring {
+						return false
+					}
+				}
+				return true
+			})
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// TLS is optional: with TLSCertFile and TLSKeyFile set, the HTTP, TCP and RESP
+// listeners serve TLS and node-to-node requests (forwarding, replication, joins and
+// leader polls) use https. TLSClientCAFile additionally requires clients to present
+// a certificate signed by that CA (mTLS); nodes present their own certificate, so
+// one CA can sign both. TLSCAFile verifies other nodes' certificates (default: the
+// system roots).
+
+func (s *Server) tlsEnabled() bool {
+	return s.cfg.TLSCertFile != ""
+}
+
+// scheme is the URL scheme other nodes are reached with.
+func (s *Server) scheme() string {
+	if s.tlsEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// nodeURL returns the base URL of the node at addr.
+func (s *Server) nodeURL(addr string) string {
+	return s.scheme() + "://" + addr
+}
+
+// loadTLS builds the listener and outbound TLS configs. It returns nils when TLS is off.
+func (s *Server) loadTLS() (srv, client *tls.Config, err error) {
+	if !s.tlsEnabled() {
+		return nil, nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.cfg.TLSCertFile, s.cfg.TLSKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load tls certificate: %w", err)
+	}
+
+	srv = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if s.cfg.TLSClientCAFile != "" {
+		pool, err := loadCertPool(s.cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		srv.ClientCAs = pool
+		srv.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	client = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if s.cfg.TLSCAFile != "" {
+		pool, err := loadCertPool(s.cfg.TLSCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		client.RootCAs = pool
+	}
+	return srv, client, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read ca file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// listen opens a TCP listener on addr, wrapped in TLS when configured.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil || s.tlsServer == nil {
+		return ln, err
+	}
+	return tls.NewListener(ln, s.tlsServer), nil
+}
+
+// tlsTransport returns an HTTP transport for node-to-node requests that uses the
+// outbound TLS config.
+func tlsTransport(client *tls.Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = client
+	return t
+}
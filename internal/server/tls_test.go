@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1, usable as server,
+// client and CA certificate, and returns the cert and key file paths.
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cache-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	nodes := startCluster(t, 2, ServerConfig{
+		TLSCertFile:     certFile,
+		TLSKeyFile:      keyFile,
+		TLSClientCAFile: certFile, // mTLS: nodes present the same certificate
+		TLSCAFile:       certFile,
+	})
+	if !strings.HasPrefix(nodes[0].url, "https://") {
+		t.Fatalf("url = %s", nodes[0].url)
+	}
+
+	// a write through either node reaches the owner over https
+	key := keyOwnedBy(t, nodes[0], "alice", "b")
+	nodes[0].set(t, "alice", key, "secret")
+	if code, v := nodes[0].get(t, "alice", key); code != http.StatusOK || v != "secret" {
+		t.Fatalf("get = %d %q", code, v)
+	}
+	if !nodes[1].holds("alice", key) {
+		t.Fatalf("owner b does not hold %s", key)
+	}
+
+	// plaintext and certificate-less clients are refused
+	if resp, err := http.Get("http://" + nodes[0].s.cfg.HTTPAddr + "/v1/ping"); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Fatalf("plaintext HTTP accepted")
+		}
+	}
+	roots := nodes[0].client.Transport.(*http.Transport).TLSClientConfig.RootCAs
+	noCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if resp, err := noCert.Get(nodes[0].url + "/v1/ping"); err == nil {
+		resp.Body.Close()
+		t.Fatalf("client without certificate accepted")
+	}
+
+	// the line protocol is served over TLS too
+	cfg := nodes[0].client.Transport.(*http.Transport).TLSClientConfig
+	conn, err := tls.Dial("tcp", nodes[0].tcp, cfg)
+	if err != nil {
+		t.Fatalf("tls dial: %v", err)
+	}
+	c := &lineClient{conn: conn, r: bufio.NewReader(conn)}
+	t.Cleanup(func() { conn.Close() })
+	if got := c.cmd(t, "PING"); got != "PONG" {
+		t.Fatalf("PING = %q", got)
+	}
+}
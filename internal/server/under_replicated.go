@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sanke08/Distributed-Cache/internal/cache"
+)
+
+// maxUnderReplicated bounds the repair log; writes beyond it are logged but not recorded.
+const maxUnderReplicated = 10000
+
+// underReplicatedKey is a write that got fewer replica acks than WriteAcks.
+type underReplicatedKey struct {
+	UserID     string    `json:"user_id"`
+	Key        string    `json:"key"`
+	Timestamp  int64     `json:"timestamp"`
+	Acks       int       `json:"acks"`
+	Needed     int       `json:"needed"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// underReplicatedLog records under-replicated writes for later repair
+// (ReplicationFailureRepair). Safe for concurrent use.
+type underReplicatedLog struct {
+	mu      sync.Mutex
+	entries map[string]underReplicatedKey // uid + ":|:" + key -> latest entry
+}
+
+func newUnderReplicatedLog() *underReplicatedLog {
+	return &underReplicatedLog{entries: make(map[string]underReplicatedKey)}
+}
+
+// record adds or replaces the entry for the key. It reports false when the log is full.
+func (ul *underReplicatedLog) record(e underReplicatedKey) bool {
+	id := e.UserID + ":|:" + e.Key
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	if _, ok := ul.entries[id]; !ok && len(ul.entries) >= maxUnderReplicated {
+		return false
+	}
+	ul.entries[id] = e
+	return true
+}
+
+// remove drops the entry if it still refers to the write at ts.
+func (ul *underReplicatedLog) remove(e underReplicatedKey) {
+	id := e.UserID + ":|:" + e.Key
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	if cur, ok := ul.entries[id]; ok && cur.Timestamp == e.Timestamp {
+		delete(ul.entries, id)
+	}
+}
+
+// list returns the recorded writes, oldest first.
+func (ul *underReplicatedLog) list() []underReplicatedKey {
+	ul.mu.Lock()
+	out := make([]underReplicatedKey, 0, len(ul.entries))
+	for _, e := range ul.entries {
+		out = append(out, e)
+	}
+	ul.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].RecordedAt.Before(out[j].RecordedAt)
+	})
+	return out
+}
+
+// repairUnderReplicated re-replicates every recorded write synchronously with its
+// current local value. Entries that now reach their ack target, or whose key is gone,
+// are dropped. It returns how many were repaired and how many remain.
+func (s *Server) repairUnderReplicated(ctx context.Context) (repaired, remaining int) {
+	for _, e := range s.underReplicated.list() {
+		if ctx.Err() != nil {
+			break
+		}
+
+		item, err := s.cache.Peek(e.UserID, e.Key)
+		if err == cache.ErrUserNotFound || err == cache.ErrKeyNotFound {
+			s.underReplicated.remove(e)
+			continue
+		}
+		if err != nil {
+			log.Printf("[repair] peek %s/%s err: %v", e.UserID, e.Key, err)
+			continue
+		}
+
+		acks := s.replicator.replicateSync(ctx, s.itemReplicationTasks(e.UserID, e.Key, item))
+		if countAcked(acks) >= min(e.Needed, len(acks)) {
+			s.underReplicated.remove(e)
+			repaired++
+		}
+	}
+	return repaired, len(s.underReplicated.list())
+}